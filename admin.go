@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// StatusResponse is returned by GET /api/v1/status.
+type StatusResponse struct {
+	Cluster string   `json:"cluster,omitempty"`
+	Backend *Backend `json:"backend,omitempty"`
+	ControlStatus
+	Distribution map[string]int    `json:"distribution"`
+	NodeNames    map[string]string `json:"node_names"`
+	Imbalance    int               `json:"imbalance"`
+	Threshold    int               `json:"threshold"`
+	Relocating   []ShardRouting    `json:"relocating"`
+	// Progress is how far the moves of the running cycle are, if it
+	// issued some.
+	Progress *RelocationProgress `json:"progress,omitempty"`
+
+	InMaintenanceWindow bool                  `json:"in_maintenance_window"`
+	AllocationDisabled  AllocationWindowStats `json:"allocation_disabled"`
+}
+
+// PlanResponse is returned by GET /api/v1/plan. The plan is computed from the
+// current cluster state and not executed.
+type PlanResponse struct {
+	Moves           []PlannedMove `json:"moves"`
+	BytesToRelocate int64         `json:"bytes_to_relocate"`
+	EstimatedMillis int64         `json:"estimated_ms"`
+	// Oversized are the copies left for manual handling, see MaxShardSize.
+	Oversized []OversizedShard `json:"oversized,omitempty"`
+}
+
+type PlannedMove struct {
+	MoveSummary
+	EstimatedMillis int64 `json:"estimated_ms"`
+}
+
+// serveAdmin serves the admin API on cfg.AdminListen, under /api/v1:
+//
+//	POST /rebalance    start a cycle now
+//	GET  /status       distribution, imbalance and in-flight moves
+//	GET  /plan         the moves a cycle would make now
+//	GET  /pending-plan the plan waiting for approval
+//	POST /approve      approve the pending plan
+//	POST /pause        stop issuing moves until resumed
+//	POST /resume       resume issuing moves
+//	POST /acknowledge  leave safe mode after an unclean shutdown
+//	GET  /history      the recorded moves
+//	GET  /trend        health and imbalance at the end of the last cycles
+//	GET  /metrics      metrics in the Prometheus text format
+//
+// A dashboard using the API is served at /, and the OpenAPI spec of the API
+// at /api/openapi.json. The endpoints
+// are also served without the prefix, for the clients predating it. With
+// cfg.AdminTokens, the requests need a bearer token of the role of the
+// endpoint, see authorize. The liveness and readiness probes of Kubernetes
+// go to /healthz and /readyz, which need no token, and cfg.DebugEndpoints
+// adds the profiles and state dump under /debug/.
+func serveAdmin(ctx context.Context) error {
+	mux := http.NewServeMux()
+	for _, e := range apiEndpoints {
+		h := method(e.method, authorize(e.role, e.handler))
+		mux.HandleFunc(apiPrefix+e.path, h)
+		mux.HandleFunc(e.path, h)
+	}
+	mux.HandleFunc("/api/openapi.json", method("GET", handleOpenAPI))
+	mux.HandleFunc("/healthz", method("GET", handleHealthz))
+	mux.HandleFunc("/readyz", method("GET", handleReadyz))
+	if cfg.DebugEndpoints {
+		debugEndpoints(mux)
+	}
+	mux.HandleFunc("/", method("GET", handleDashboard))
+
+	server := &http.Server{Addr: cfg.AdminListen, Handler: mux}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdown)
+	}()
+
+	fmt.Println("Admin API listening on", cfg.AdminListen)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func method(m string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != m {
+			w.Header().Set("Allow", m)
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("use %s", m))
+			return
+		}
+		h(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, ErrorResponse{Error: err.Error()})
+}
+
+// adminSource is the audit source of the cycles triggered by the request,
+// naming its token if any.
+func adminSource(r *http.Request) string {
+	if token, ok := lookupToken(r); ok {
+		return "admin API, token " + token.Name
+	}
+	return "admin API from " + r.RemoteAddr
+}
+
+func handleRebalance(w http.ResponseWriter, r *http.Request) {
+	if ctl.isPaused() {
+		writeError(w, http.StatusConflict, fmt.Errorf("balancer is paused"))
+		return
+	}
+	ctl.triggerNow(adminSource(r))
+	writeJSON(w, http.StatusAccepted, TriggerResponse{Result: "triggered"})
+}
+
+func handlePause(w http.ResponseWriter, r *http.Request) {
+	ctl.setPaused(true)
+	fmt.Println("Balancer paused through the admin API.")
+	writeJSON(w, http.StatusOK, ctl.status())
+}
+
+func handleResume(w http.ResponseWriter, r *http.Request) {
+	ctl.setPaused(false)
+	fmt.Println("Balancer resumed through the admin API.")
+	writeJSON(w, http.StatusOK, ctl.status())
+}
+
+func handleAcknowledge(w http.ResponseWriter, r *http.Request) {
+	if !ctl.acknowledge() {
+		writeError(w, http.StatusConflict, fmt.Errorf("balancer is not in safe mode"))
+		return
+	}
+	clearExecution()
+	fmt.Println("Safe mode acknowledged through the admin API, resuming normal operation.")
+	writeJSON(w, http.StatusOK, ctl.status())
+}
+
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	obs, err := observeCluster()
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	resp := StatusResponse{
+		Cluster:       cfg.ClusterAlias,
+		ControlStatus: ctl.status(),
+		Distribution:  obs.Distribution,
+		NodeNames:     make(map[string]string, len(obs.Distribution)),
+		Imbalance:     planImbalance(obs),
+		Threshold:     cfg.RebalanceThreshold,
+		Relocating:    []ShardRouting{},
+		Progress:      inFlightProgress(obs.State),
+
+		InMaintenanceWindow: inMaintenanceWindow(time.Now()),
+		AllocationDisabled:  disabledWindow.stats(),
+	}
+	if b, err := getBackend(); err == nil {
+		resp.Backend = b
+	}
+	for id := range obs.Distribution {
+		resp.NodeNames[id] = nodeName(obs, id)
+	}
+	for _, shards := range obs.State.RoutingNodes.Nodes {
+		for _, shard := range shards {
+			if shard.State == "RELOCATING" {
+				resp.Relocating = append(resp.Relocating, shard)
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func handlePlan(w http.ResponseWriter, r *http.Request) {
+	obs, err := observeCluster()
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, planResponse(obs, estimatePlan(obs, planMoves(obs))))
+}
+
+func planResponse(obs *Observation, estimates []MoveEstimate) PlanResponse {
+	resp := PlanResponse{Moves: []PlannedMove{}, Oversized: findOversizedShards(obs)}
+	for _, e := range estimates {
+		resp.Moves = append(resp.Moves, PlannedMove{MoveSummary: summarizeMove(e.Move), EstimatedMillis: e.Duration.Milliseconds()})
+		resp.BytesToRelocate += e.Bytes
+		resp.EstimatedMillis += e.Duration.Milliseconds()
+	}
+	return resp
+}
+
+// pauseCommand and resumeCommand pause and resume a running balancer
+// through its admin API at cfg.AdminListen.
+func pauseCommand(args []string) error {
+	return postAdmin(apiPrefix + "/pause")
+}
+
+func resumeCommand(args []string) error {
+	return postAdmin(apiPrefix + "/resume")
+}
+
+func postAdmin(path string) error {
+	body, err := callAdmin(path)
+	if err != nil {
+		return err
+	}
+	if jsonOutput() {
+		var status ControlStatus
+		if err := json.Unmarshal(body, &status); err != nil {
+			return fmt.Errorf("POST %s: %w", path, err)
+		}
+		emit("control", status)
+		return nil
+	}
+	fmt.Print(string(body))
+	return nil
+}
+
+// callAdmin posts to the admin API of the running balancer and returns the
+// body of its response.
+func callAdmin(path string) ([]byte, error) {
+	if cfg.AdminListen == "" {
+		return nil, fmt.Errorf("the admin API address is needed, set -admin-listen")
+	}
+	addr := cfg.AdminListen
+	if strings.HasPrefix(addr, ":") {
+		addr = "localhost" + addr
+	}
+	req, err := http.NewRequest("POST", "http://"+addr+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if cfg.AdminToken != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.AdminToken)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("POST %s: %s: %s", path, resp.Status, body)
+	}
+	return body, nil
+}
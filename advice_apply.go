@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/tjandrayana/elasticsearch-rebalance-shard/observer"
+)
+
+// applicableSetting is the advised setting that can be changed on an
+// existing index. The shard count is fixed at index creation and can only be
+// changed in the index template.
+const applicableSetting = "index.routing.allocation.total_shards_per_node"
+
+// AdviceChange records an index setting applied from advice, with the value
+// it replaced so it can be undone.
+type AdviceChange struct {
+	ID        string      `json:"id"`
+	Index     string      `json:"index"`
+	Setting   string      `json:"setting"`
+	Previous  *string     `json:"previous"`
+	Applied   interface{} `json:"applied"`
+	AppliedAt time.Time   `json:"applied_at"`
+	UndoneAt  *time.Time  `json:"undone_at,omitempty"`
+}
+
+func adviceChangesPath() string {
+	return filepath.Join(cfg.StateDir, "advice_changes.json")
+}
+
+func loadAdviceChanges() ([]AdviceChange, error) {
+	data, err := ioutil.ReadFile(adviceChangesPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var changes []AdviceChange
+	if err := json.Unmarshal(data, &changes); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", adviceChangesPath(), err)
+	}
+	return changes, nil
+}
+
+func saveAdviceChanges(changes []AdviceChange) error {
+	data, err := json.MarshalIndent(changes, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(adviceChangesPath(), data)
+}
+
+// applyAdviceCommand computes the advice for the given indices and, once
+// the operator confirmed, applies the advised total_shards_per_node to them.
+//
+//	apply-advice [-yes] <index>...
+func applyAdviceCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: apply-advice [-yes] <index>...")
+	}
+	if cfg.StateDir == "" {
+		return errors.New("apply-advice needs -state-dir to record how to undo the change")
+	}
+
+	nodes, err := getNodesInfo()
+	if err != nil {
+		return fmt.Errorf("getting nodes info: %w", err)
+	}
+	dataNodes := 0
+	for _, node := range nodes.Nodes {
+		if observer.IsDataNode(node) {
+			dataNodes++
+		}
+	}
+
+	changes, err := loadAdviceChanges()
+	if err != nil {
+		return err
+	}
+	for _, index := range args {
+		var infos []IndexInfo
+		if err := esGet("/_cat/indices/"+url.PathEscape(index)+"?format=json&h=index,pri,rep", &infos); err != nil {
+			return fmt.Errorf("getting index %s: %w", index, err)
+		}
+		for _, info := range infos {
+			change, err := applyAdvice(adviseIndex(info, dataNodes))
+			if err != nil {
+				return err
+			}
+			if change != nil {
+				changes = append(changes, *change)
+				if err := saveAdviceChanges(changes); err != nil {
+					return fmt.Errorf("recording change: %w", err)
+				}
+				emit("advice_change", change)
+				fmt.Printf("Applied. Undo with: undo-advice %s\n", change.ID)
+			}
+		}
+	}
+	return nil
+}
+
+func applyAdvice(advice IndexAdvice) (*AdviceChange, error) {
+	value := advice.Settings["routing.allocation.total_shards_per_node"]
+	previous, err := getIndexSetting(advice.Index, applicableSetting)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("Index %s: %s\n", advice.Index, advice.Reason)
+	if shards, ok := advice.Settings["number_of_shards"]; ok {
+		fmt.Printf("  number_of_shards %v has to be set in the index template matching %q.\n", shards, advice.Pattern)
+	}
+	current := "unset"
+	if previous != nil {
+		current = *previous
+	}
+	if !confirm(fmt.Sprintf("  Change %s from %s to %v?", applicableSetting, current, value)) {
+		fmt.Println("  Skipped.")
+		return nil, nil
+	}
+
+	if err := putIndexSetting(advice.Index, applicableSetting, value); err != nil {
+		return nil, err
+	}
+	change := &AdviceChange{
+		ID:        fmt.Sprintf("%s-%d", advice.Index, time.Now().Unix()),
+		Index:     advice.Index,
+		Setting:   applicableSetting,
+		Previous:  previous,
+		Applied:   value,
+		AppliedAt: time.Now().UTC(),
+	}
+	audit("index_settings_applied", map[string]interface{}{
+		"change_id": change.ID,
+		"index":     change.Index,
+		"setting":   change.Setting,
+		"previous":  change.Previous,
+		"applied":   change.Applied,
+	})
+	return change, nil
+}
+
+// undoAdviceCommand restores the setting value an applied advice replaced.
+//
+//	undo-advice [-yes] <change-id>
+func undoAdviceCommand(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: undo-advice [-yes] <change-id>")
+	}
+	if cfg.StateDir == "" {
+		return errors.New("undo-advice needs -state-dir")
+	}
+	changes, err := loadAdviceChanges()
+	if err != nil {
+		return err
+	}
+	for i := range changes {
+		change := &changes[i]
+		if change.ID != args[0] {
+			continue
+		}
+		if change.UndoneAt != nil {
+			return fmt.Errorf("change %s was already undone at %s", change.ID, change.UndoneAt.Format(time.RFC3339))
+		}
+
+		var previous interface{} = nil
+		shown := "unset"
+		if change.Previous != nil {
+			previous, shown = *change.Previous, *change.Previous
+		}
+		if !confirm(fmt.Sprintf("Restore %s of index %s to %s?", change.Setting, change.Index, shown)) {
+			return nil
+		}
+		if err := putIndexSetting(change.Index, change.Setting, previous); err != nil {
+			return err
+		}
+		now := time.Now().UTC()
+		change.UndoneAt = &now
+		audit("index_settings_undone", map[string]interface{}{
+			"change_id": change.ID,
+			"index":     change.Index,
+			"setting":   change.Setting,
+			"restored":  previous,
+		})
+		if err := saveAdviceChanges(changes); err != nil {
+			return err
+		}
+		emit("advice_change", change)
+		return nil
+	}
+	return fmt.Errorf("no applied advice with ID %s", args[0])
+}
+
+// getIndexSetting returns the explicitly set value of a setting of the
+// index, or nil when it is not set.
+func getIndexSetting(index, setting string) (*string, error) {
+	var resp map[string]struct {
+		Settings map[string]string `json:"settings"`
+	}
+	if err := esGet("/"+url.PathEscape(index)+"/_settings/"+setting+"?flat_settings=true", &resp); err != nil {
+		return nil, fmt.Errorf("getting settings of %s: %w", index, err)
+	}
+	if value, ok := resp[index].Settings[setting]; ok {
+		return &value, nil
+	}
+	return nil, nil
+}
+
+// putIndexSetting updates a single setting of the index; a nil value
+// resets it to its default.
+func putIndexSetting(index, setting string, value interface{}) error {
+	body, err := sendJSON("PUT", "/"+url.PathEscape(index)+"/_settings", map[string]interface{}{setting: value})
+	if err != nil {
+		return fmt.Errorf("updating settings of %s: %w", index, err)
+	}
+	fmt.Println("Response:", string(body))
+	return nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// advisorDominantShare is the share of a cycle's moves above which an index
+// is considered to dominate that cycle.
+const advisorDominantShare = 0.25
+
+// AdvisorCycle lists the indices that dominated one rebalance cycle.
+type AdvisorCycle struct {
+	At       time.Time `json:"at"`
+	Dominant []string  `json:"dominant"`
+}
+
+// AdvisorHistory keeps the most recent cycles, oldest first.
+type AdvisorHistory struct {
+	Cycles []AdvisorCycle `json:"cycles"`
+}
+
+type IndexInfo struct {
+	Index    string `json:"index"`
+	Primary  string `json:"pri"`
+	Replicas string `json:"rep"`
+}
+
+var advisorHistory *AdvisorHistory
+
+func advisorPath() string {
+	return filepath.Join(cfg.StateDir, "advisor.json")
+}
+
+func loadAdvisorHistory() *AdvisorHistory {
+	history := &AdvisorHistory{}
+	if cfg.StateDir == "" {
+		return history
+	}
+	data, err := ioutil.ReadFile(advisorPath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Println("Error reading advisor history:", err)
+		}
+		return history
+	}
+	if err := json.Unmarshal(data, history); err != nil {
+		fmt.Println("Error parsing advisor history:", err)
+	}
+	return history
+}
+
+func (h *AdvisorHistory) save() {
+	if cfg.StateDir == "" {
+		return
+	}
+	data, err := json.MarshalIndent(h, "", "  ")
+	if err != nil {
+		fmt.Println("Error marshaling advisor history:", err)
+		return
+	}
+	if err := writeFileAtomic(advisorPath(), data); err != nil {
+		fmt.Println("Error writing advisor history:", err)
+	}
+}
+
+// adviseOnPlan records which indices dominate the planned moves and, for
+// the indices that did so in at least cfg.AdvisorMinCycles of the last
+// cfg.AdvisorWindow cycles, prints index settings that would keep them
+// balanced without the tool's help.
+func adviseOnPlan(obs *Observation, moves []Move) {
+	if cfg.AdvisorMinCycles <= 0 || len(moves) == 0 {
+		return
+	}
+	if advisorHistory == nil {
+		advisorHistory = loadAdvisorHistory()
+	}
+
+	perIndex := make(map[string]int)
+	for _, move := range moves {
+		perIndex[move.Shard.Index]++
+	}
+	cycle := AdvisorCycle{At: time.Now().UTC()}
+	for index, n := range perIndex {
+		if float64(n) >= advisorDominantShare*float64(len(moves)) {
+			cycle.Dominant = append(cycle.Dominant, index)
+		}
+	}
+	sort.Strings(cycle.Dominant)
+
+	advisorHistory.Cycles = append(advisorHistory.Cycles, cycle)
+	if len(advisorHistory.Cycles) > cfg.AdvisorWindow {
+		advisorHistory.Cycles = advisorHistory.Cycles[len(advisorHistory.Cycles)-cfg.AdvisorWindow:]
+	}
+	advisorHistory.save()
+
+	counts := make(map[string]int)
+	for _, c := range advisorHistory.Cycles {
+		for _, index := range c.Dominant {
+			counts[index]++
+		}
+	}
+	var chronic []string
+	for index, n := range counts {
+		if n >= cfg.AdvisorMinCycles {
+			chronic = append(chronic, index)
+		}
+	}
+	if len(chronic) == 0 {
+		return
+	}
+	sort.Strings(chronic)
+
+	var infos []IndexInfo
+	if err := esGet("/_cat/indices?format=json&h=index,pri,rep", &infos); err != nil {
+		fmt.Println("Error getting index settings for advice:", err)
+		return
+	}
+	byName := make(map[string]IndexInfo, len(infos))
+	for _, info := range infos {
+		byName[info.Index] = info
+	}
+	for _, index := range chronic {
+		info, ok := byName[index]
+		if !ok {
+			continue
+		}
+		advice := adviseIndex(info, len(obs.Distribution))
+		fmt.Printf("Advice: index %s dominated %d of the last %d cycles.\n", index, counts[index], len(advisorHistory.Cycles))
+		fmt.Printf("  %s\n", advice.Reason)
+		fmt.Printf("  Settings for the index template matching %q:\n  %s\n", advice.Pattern, advice.SettingsJSON())
+	}
+}
+
+// IndexAdvice holds the settings suggested for an index template.
+type IndexAdvice struct {
+	Index    string
+	Pattern  string
+	Reason   string
+	Settings map[string]interface{}
+}
+
+func (a IndexAdvice) SettingsJSON() string {
+	data, _ := json.Marshal(map[string]interface{}{"index": a.Settings})
+	return string(data)
+}
+
+// adviseIndex suggests a shard count whose copies divide evenly over the
+// data nodes and a total_shards_per_node limit that keeps Elasticsearch from
+// stacking copies of the index on a few nodes, with room for one node to
+// fail.
+func adviseIndex(info IndexInfo, dataNodes int) IndexAdvice {
+	var primaries, replicas int
+	fmt.Sscan(info.Primary, &primaries)
+	fmt.Sscan(info.Replicas, &replicas)
+	if dataNodes < 1 {
+		dataNodes = 1
+	}
+	copies := primaries * (replicas + 1)
+
+	advice := IndexAdvice{Index: info.Index, Pattern: templatePattern(info.Index), Settings: map[string]interface{}{}}
+	perNode := (copies + dataNodes - 1) / dataNodes
+	if copies%dataNodes == 0 {
+		perNode++
+	}
+	advice.Settings["routing.allocation.total_shards_per_node"] = perNode
+	advice.Reason = fmt.Sprintf("%d primaries with %d replicas make %d copies over %d data nodes.", primaries, replicas, copies, dataNodes)
+
+	if copies%dataNodes != 0 {
+		for p := primaries + 1; p <= primaries+dataNodes; p++ {
+			if p*(replicas+1)%dataNodes == 0 {
+				advice.Settings["number_of_shards"] = p
+				advice.Settings["routing.allocation.total_shards_per_node"] = p*(replicas+1)/dataNodes + 1
+				advice.Reason += fmt.Sprintf(" %d primaries would spread evenly.", p)
+				break
+			}
+		}
+	}
+	return advice
+}
+
+var indexSuffix = regexp.MustCompile(`^(.*?)\d[\d.\-_]*$`)
+
+// templatePattern guesses the template pattern of a time-based or rolled
+// over index by replacing its date or counter suffix with a wildcard.
+func templatePattern(index string) string {
+	if m := indexSuffix.FindStringSubmatch(index); m != nil && m[1] != "" {
+		return m[1] + "*"
+	}
+	return index
+}
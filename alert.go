@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	eventImbalanceBreach   = "imbalance_breach"
+	eventImbalanceResolved = "imbalance_resolved"
+)
+
+// ImbalanceAlert escalates while the imbalance stays above MaxImbalance:
+// every level is notified once the breach lasted its After, and the levels
+// that were notified get an all-clear when the imbalance is back within
+// bounds.
+type ImbalanceAlert struct {
+	MaxImbalance int          `json:"max_imbalance"`
+	Levels       []AlertLevel `json:"levels"`
+}
+
+type AlertLevel struct {
+	After    Duration             `json:"after"`
+	Severity string               `json:"severity"`
+	Targets  []NotificationTarget `json:"targets"`
+}
+
+// AlertEvent is the payload posted to generic webhooks for imbalance
+// alerts.
+type AlertEvent struct {
+	Event        string    `json:"event"`
+	Cluster      string    `json:"cluster,omitempty"`
+	Severity     string    `json:"severity"`
+	Imbalance    int       `json:"imbalance"`
+	MaxImbalance int       `json:"max_imbalance"`
+	Since        time.Time `json:"since"`
+}
+
+func (a *ImbalanceAlert) validate() error {
+	if len(a.Levels) == 0 {
+		return fmt.Errorf("imbalance_alert has no levels")
+	}
+	for i, level := range a.Levels {
+		if i > 0 && level.After.Duration <= a.Levels[i-1].After.Duration {
+			return fmt.Errorf("imbalance_alert levels must be in increasing order of after")
+		}
+		if level.Severity == "" {
+			return fmt.Errorf("imbalance_alert level %d has no severity", i+1)
+		}
+		for _, target := range level.Targets {
+			if err := target.validate(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// alerter keeps track of an ongoing breach.
+type alerter struct {
+	since   time.Time // start of the breach, zero if none
+	reached int       // number of levels notified
+}
+
+// watchImbalance observes the cluster every cfg.SleepInterval, whether or
+// not cycles run, and escalates imbalance alerts.
+func watchImbalance(ctx context.Context) error {
+	var a alerter
+	for {
+		obs, err := observeCluster()
+		if err != nil {
+			fmt.Println("Error observing cluster for imbalance alerts:", err)
+		} else {
+			a.update(planImbalance(obs), time.Now())
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(cfg.SleepInterval.Duration):
+		}
+	}
+}
+
+func (a *alerter) update(imbalance int, now time.Time) {
+	alert := cfg.ImbalanceAlert
+	if imbalance <= alert.MaxImbalance {
+		if !a.since.IsZero() && a.reached > 0 {
+			fmt.Printf("Imbalance %d is back within %d.\n", imbalance, alert.MaxImbalance)
+			for _, level := range alert.Levels[:a.reached] {
+				level.send(a.event(eventImbalanceResolved, level, imbalance))
+			}
+		}
+		*a = alerter{}
+		return
+	}
+
+	if a.since.IsZero() {
+		a.since = now
+	}
+	for a.reached < len(alert.Levels) && now.Sub(a.since) >= alert.Levels[a.reached].After.Duration {
+		level := alert.Levels[a.reached]
+		fmt.Printf("Imbalance %d above %d since %s, alerting %s.\n", imbalance, alert.MaxImbalance, a.since.Format(time.RFC3339), level.Severity)
+		level.send(a.event(eventImbalanceBreach, level, imbalance))
+		a.reached++
+	}
+}
+
+func (a *alerter) event(name string, level AlertLevel, imbalance int) AlertEvent {
+	return AlertEvent{
+		Event:        name,
+		Cluster:      cfg.ClusterAlias,
+		Severity:     level.Severity,
+		Imbalance:    imbalance,
+		MaxImbalance: cfg.ImbalanceAlert.MaxImbalance,
+		Since:        a.since.UTC(),
+	}
+}
+
+func (l AlertLevel) send(event AlertEvent) {
+	for _, target := range l.Targets {
+		if !target.wants(event.Event) {
+			continue
+		}
+		var payload interface{} = event
+		if chatTarget(target.Type) {
+			payload = chatPayload(target.Type, alertSlackText(event))
+		}
+		if err := postJSON(target.URL, payload); err != nil {
+			fmt.Printf("Error sending %s alert: %v\n", target.Type, err)
+		}
+	}
+}
+
+func alertSlackText(event AlertEvent) string {
+	var b strings.Builder
+	if event.Cluster != "" {
+		fmt.Fprintf(&b, "[%s] ", event.Cluster)
+	}
+	switch event.Event {
+	case eventImbalanceBreach:
+		fmt.Fprintf(&b, ":warning: [%s] Imbalance %d above %d for %s",
+			event.Severity, event.Imbalance, event.MaxImbalance, time.Since(event.Since).Round(time.Minute))
+	case eventImbalanceResolved:
+		fmt.Fprintf(&b, ":white_check_mark: [%s] All clear: imbalance %d is back within %d", event.Severity, event.Imbalance, event.MaxImbalance)
+	}
+	return b.String()
+}
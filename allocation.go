@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	settingAllocationEnable = "cluster.routing.allocation.enable"
+	settingRebalanceEnable  = "cluster.routing.rebalance.enable"
+)
+
+// The values cycles may scope allocation to, see cfg.AllocationEnable.
+const (
+	allocationEnableNone         = "none"
+	allocationEnablePrimaries    = "primaries"
+	allocationEnableNewPrimaries = "new_primaries"
+)
+
+// allocationPrior holds the value of allocationSetting in the settings scope
+// before the last cycle changed it, empty when it was not set there, for
+// enableAllocation to restore. It is kept in the execution marker so
+// that a crashed run restores it at the next start.
+var (
+	allocationPriorMu sync.Mutex
+	allocationPrior   string
+)
+
+// allocationSetting is the setting cycles change in the mode: rebalancing
+// in reroute-only mode, allocation otherwise.
+func allocationSetting(rerouteOnly bool) string {
+	if rerouteOnly {
+		return settingRebalanceEnable
+	}
+	return settingAllocationEnable
+}
+
+// rememberAllocation records the value of allocationSetting a cycle is about
+// to replace. The values cycles set are taken to be left over by a run that
+// could not restore them, and are not recorded.
+func rememberAllocation() {
+	prior := ""
+	setting := allocationSetting(cfg.RerouteOnly)
+	settings, err := getClusterSettings()
+	if err != nil {
+		fmt.Printf("Error getting cluster settings, %s will be unset afterwards: %v\n", setting, err)
+	} else if v, ok := settings.scope(settingsScope())[setting].(string); ok && v != allocationEnableNone && (cfg.RerouteOnly || v != cfg.AllocationEnable) {
+		prior = v
+	}
+	allocationPriorMu.Lock()
+	defer allocationPriorMu.Unlock()
+	allocationPrior = prior
+}
+
+// allocationWindow measures how long cycles keep shard allocation disabled.
+// Failed shards are not recovered anywhere in the cluster meanwhile, so
+// windows longer than cfg.MaxAllocationDisabled are notified while still
+// open.
+type allocationWindow struct {
+	mu    sync.Mutex
+	since time.Time // zero while allocation is enabled
+	last  time.Duration
+	total time.Duration
+	count int
+	alarm *time.Timer
+}
+
+var disabledWindow = &allocationWindow{}
+
+func (w *allocationWindow) start() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.since.IsZero() {
+		return
+	}
+	since := time.Now()
+	w.since = since
+	if max := cfg.MaxAllocationDisabled.Duration; max > 0 {
+		w.alarm = time.AfterFunc(max, func() { allocationDisabledTooLong(since) })
+	}
+}
+
+// end closes the window opened by start, if any.
+func (w *allocationWindow) end() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.since.IsZero() {
+		return
+	}
+	if w.alarm != nil {
+		w.alarm.Stop()
+		w.alarm = nil
+	}
+	w.last = time.Since(w.since)
+	w.total += w.last
+	w.count++
+	w.since = time.Time{}
+	fmt.Printf("Shard allocation was disabled for %s.\n", w.last.Round(time.Millisecond))
+}
+
+// AllocationWindowStats describes the allocation-disable windows in the
+// admin API.
+type AllocationWindowStats struct {
+	DisabledSince *time.Time `json:"disabled_since,omitempty"`
+	CurrentMillis int64      `json:"current_ms"`
+	LastMillis    int64      `json:"last_ms"`
+	TotalMillis   int64      `json:"total_ms"`
+	Windows       int        `json:"windows"`
+}
+
+func (w *allocationWindow) stats() AllocationWindowStats {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	stats := AllocationWindowStats{
+		LastMillis:  w.last.Milliseconds(),
+		TotalMillis: w.total.Milliseconds(),
+		Windows:     w.count,
+	}
+	if !w.since.IsZero() {
+		since := w.since.UTC()
+		stats.DisabledSince = &since
+		stats.CurrentMillis = time.Since(w.since).Milliseconds()
+	}
+	return stats
+}
+
+func allocationDisabledTooLong(since time.Time) {
+	elapsed := time.Since(since)
+	fmt.Printf("Warning: shard allocation has been disabled for %s, more than %s.\n", elapsed.Round(time.Second), cfg.MaxAllocationDisabled.Duration)
+	bus.publish(topicCycle, CycleEvent{
+		Event:          eventAllocationDisabledTooLong,
+		Cluster:        cfg.ClusterAlias,
+		StartedAt:      since.UTC(),
+		DurationMillis: elapsed.Milliseconds(),
+	})
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+)
+
+// rebalanceEnable returns cluster.routing.rebalance.enable in the scope,
+// nil when it is not set there.
+func rebalanceEnable(t *testing.T, scope string) interface{} {
+	t.Helper()
+	settings, err := getClusterSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return settings.scope(scope)[settingRebalanceEnable]
+}
+
+func TestRerouteOnlyRestoresRebalancing(t *testing.T) {
+	tests := []struct {
+		name  string
+		prior interface{} // nil when the operator did not set it
+		crash bool        // restored at the next start, from the marker
+	}{
+		{name: "unset"},
+		{name: "set", prior: "primaries"},
+		{name: "set, after a crash", prior: "primaries", crash: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testCluster(t, "a", "b")
+			cfg.RerouteOnly = true
+			cfg.StateDir = t.TempDir()
+			cfg.AcknowledgeCrash = true
+			if tt.prior != nil {
+				if err := putScopedSettings(scopePersistent, clusterSettings{settingRebalanceEnable: tt.prior}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			disableAllocation()
+			if got := rebalanceEnable(t, scopePersistent); got != allocationEnableNone {
+				t.Fatalf("rebalancing is %v during the cycle, want %s", got, allocationEnableNone)
+			}
+			if tt.crash {
+				// A new process, which only has the marker.
+				allocationPriorMu.Lock()
+				allocationPrior = ""
+				allocationPriorMu.Unlock()
+				if err := checkUncleanShutdown(); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				enableAllocation()
+			}
+			if got := rebalanceEnable(t, scopePersistent); got != tt.prior {
+				t.Errorf("rebalancing is %v after the cycle, want %v", got, tt.prior)
+			}
+			if marker, err := loadExecutionMarker(); err != nil || marker != nil {
+				t.Errorf("the execution marker is %+v (%v) after the cycle", marker, err)
+			}
+		})
+	}
+}
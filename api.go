@@ -0,0 +1,173 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiPrefix is the prefix of the versioned admin API. Breaking changes to
+// the requests and responses go to a new version.
+const apiPrefix = "/api/v1"
+
+// ErrorResponse is returned by every endpoint on errors.
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// TriggerResponse is returned by POST /api/v1/rebalance.
+type TriggerResponse struct {
+	Result string `json:"result"`
+}
+
+// apiEndpoint is an endpoint of the admin API. The response is a value of
+// the type of the JSON body returned on success, nil for a text body, and
+// is what the OpenAPI spec is generated from.
+type apiEndpoint struct {
+	method   string
+	path     string
+	role     string
+	summary  string
+	status   int
+	response interface{}
+	handler  http.HandlerFunc
+}
+
+var apiEndpoints = []apiEndpoint{
+	{"POST", "/rebalance", roleOperator, "Start a cycle now", http.StatusAccepted, TriggerResponse{}, handleRebalance},
+	{"GET", "/status", roleRead, "Distribution, imbalance and in-flight moves", http.StatusOK, StatusResponse{}, handleStatus},
+	{"GET", "/plan", roleRead, "The moves a cycle would make now", http.StatusOK, PlanResponse{}, handlePlan},
+	{"GET", "/pending-plan", roleRead, "The plan waiting for approval", http.StatusOK, PendingPlan{}, handlePendingPlan},
+	{"POST", "/approve", roleOperator, "Approve the pending plan of the id query parameter", http.StatusOK, PendingPlan{}, handleApprove},
+	{"POST", "/pause", roleOperator, "Stop issuing moves until resumed", http.StatusOK, ControlStatus{}, handlePause},
+	{"POST", "/resume", roleOperator, "Resume issuing moves", http.StatusOK, ControlStatus{}, handleResume},
+	{"POST", "/acknowledge", roleOperator, "Leave safe mode after an unclean shutdown", http.StatusOK, ControlStatus{}, handleAcknowledge},
+	{"GET", "/history", roleRead, "The recorded moves, by the since, limit, index and result query parameters", http.StatusOK, HistoryResponse{}, handleHistory},
+	{"GET", "/trend", roleRead, "Health and imbalance at the end of the last cycles", http.StatusOK, TrendResponse{}, handleTrend},
+	{"GET", "/metrics", roleRead, "Metrics in the Prometheus text format", http.StatusOK, nil, handleMetrics},
+}
+
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, openAPISpec())
+}
+
+// openAPISpec generates the OpenAPI 3 document of the versioned admin API
+// from apiEndpoints.
+func openAPISpec() map[string]interface{} {
+	g := &schemaGenerator{schemas: make(map[string]interface{})}
+	errorSchema := g.schema(reflect.TypeOf(ErrorResponse{}))
+	paths := make(map[string]interface{}, len(apiEndpoints))
+	for _, e := range apiEndpoints {
+		content := map[string]interface{}{"text/plain": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}}}
+		if e.response != nil {
+			content = map[string]interface{}{"application/json": map[string]interface{}{"schema": g.schema(reflect.TypeOf(e.response))}}
+		}
+		paths[apiPrefix+e.path] = map[string]interface{}{
+			strings.ToLower(e.method): map[string]interface{}{
+				"summary":     e.summary,
+				"description": "Needs a token of the " + e.role + " role when the API has tokens.",
+				"security":    []map[string][]string{{"bearer": {}}},
+				"responses": map[string]interface{}{
+					strconv.Itoa(e.status): map[string]interface{}{
+						"description": http.StatusText(e.status),
+						"content":     content,
+					},
+					"default": map[string]interface{}{
+						"description": "Error",
+						"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": errorSchema}},
+					},
+				},
+			},
+		}
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info":    map[string]interface{}{"title": "Shard rebalancer admin API", "version": strings.TrimPrefix(apiPrefix, "/api/")},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas":         g.schemas,
+			"securitySchemes": map[string]interface{}{"bearer": map[string]interface{}{"type": "http", "scheme": "bearer"}},
+		},
+	}
+}
+
+// schemaGenerator derives JSON schemas from Go types the way encoding/json
+// marshals them. Named structs go to the components, and are referenced.
+type schemaGenerator struct {
+	schemas map[string]interface{}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func (g *schemaGenerator) schema(t reflect.Type) map[string]interface{} {
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return g.schema(t.Elem())
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.object(t)
+		}
+		if _, ok := g.schemas[t.Name()]; !ok {
+			// Set before generating, for recursive types.
+			g.schemas[t.Name()] = nil
+			g.schemas[t.Name()] = g.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return map[string]interface{}{}
+}
+
+// object generates the schema of a struct. The fields of embedded structs
+// are inlined. The fields without omitempty are required, unless they are
+// pointers, which may be null.
+func (g *schemaGenerator) object(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	var required []string
+	var addFields func(t reflect.Type)
+	addFields = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag := f.Tag.Get("json")
+			if tag == "-" || f.PkgPath != "" && !f.Anonymous {
+				continue
+			}
+			name, opts, _ := strings.Cut(tag, ",")
+			if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+				addFields(f.Type)
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			properties[name] = g.schema(f.Type)
+			if !strings.Contains(","+opts+",", ",omitempty,") && f.Type.Kind() != reflect.Ptr {
+				required = append(required, name)
+			}
+		}
+	}
+	addFields(t)
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
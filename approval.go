@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	eventPlanPending = "plan_pending_approval"
+	eventPlanExpired = "plan_expired"
+)
+
+// PendingPlan is a plan published for approval by a cycle, see
+// cfg.RequireApproval. It is returned by GET /api/v1/pending-plan and
+// POST /api/v1/approve.
+type PendingPlan struct {
+	ID        string    `json:"id"`
+	Cluster   string    `json:"cluster,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// ApprovedAt is when an operator approved the plan, for the next cycle
+	// to execute it.
+	ApprovedAt *time.Time `json:"approved_at,omitempty"`
+	PlanResponse
+
+	moves []Move
+}
+
+// approvals holds the plan waiting for approval. Cycles publish no other
+// plan until it is executed or expired.
+var approvals struct {
+	sync.Mutex
+	plan *PendingPlan
+}
+
+// approvedMoves gates the moves a cycle planned with cfg.RequireApproval.
+// Once the pending plan is approved, it returns its moves that are still
+// valid on obs, and true for the cycle to execute them. Otherwise the
+// planned moves are published for approval, unless a plan is pending
+// already, and it returns false. With nothing planned and no plan pending,
+// it returns the empty plan.
+func approvedMoves(c *cycle, obs *Observation, estimates []MoveEstimate) ([]Move, bool) {
+	approvals.Lock()
+	plan := approvals.plan
+	switch {
+	case plan == nil:
+	case plan.ApprovedAt != nil:
+		approvals.plan = nil
+	case time.Now().Before(plan.ExpiresAt):
+		approvals.Unlock()
+		fmt.Printf("Plan %s is waiting for approval until %s.\n", plan.ID, plan.ExpiresAt.Local().Format(time.RFC3339))
+		return nil, false
+	default:
+		approvals.plan = nil
+	}
+	approvals.Unlock()
+
+	if plan != nil && plan.ApprovedAt != nil {
+		var moves []Move
+		for _, move := range plan.moves {
+			if reason := validateMove(obs, move); reason != "" {
+				fmt.Printf("Approved move of [%s][%d] from %s to %s is no longer valid: %s.\n", move.Shard.Index, move.Shard.Shard, move.From, move.To, reason)
+				continue
+			}
+			moves = append(moves, move)
+		}
+		fmt.Printf("Executing plan %s, approved at %s: %d of its %d moves.\n", plan.ID, plan.ApprovedAt.Local().Format(time.RFC3339), len(moves), len(plan.moves))
+		return moves, true
+	}
+	if plan != nil {
+		fmt.Printf("Plan %s expired without approval.\n", plan.ID)
+		c.publishPlan(eventPlanExpired, plan)
+	}
+	if len(estimates) == 0 {
+		return nil, true
+	}
+
+	plan, err := newPendingPlan(obs, estimates)
+	if err != nil {
+		fmt.Println("Error publishing plan:", err)
+		return nil, false
+	}
+	approvals.Lock()
+	approvals.plan = plan
+	approvals.Unlock()
+	fmt.Printf("Plan %s waits for approval until %s: approve it with the approve command or POST %s/approve?id=%s.\n",
+		plan.ID, plan.ExpiresAt.Local().Format(time.RFC3339), apiPrefix, plan.ID)
+	c.publishPlan(eventPlanPending, plan)
+	return nil, false
+}
+
+func newPendingPlan(obs *Observation, estimates []MoveEstimate) (*PendingPlan, error) {
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	plan := &PendingPlan{
+		ID:           hex.EncodeToString(id),
+		Cluster:      cfg.ClusterAlias,
+		CreatedAt:    now,
+		ExpiresAt:    now.Add(cfg.ApprovalTTL.Duration),
+		PlanResponse: planResponse(obs, estimates),
+	}
+	for _, e := range estimates {
+		plan.moves = append(plan.moves, e.Move)
+	}
+	return plan, nil
+}
+
+// publishPlan announces a pending or expired plan like the cycle events,
+// to the notification targets among others.
+func (c *cycle) publishPlan(name string, plan *PendingPlan) {
+	event := c.event(name, plan.moves)
+	event.PlanID = plan.ID
+	event.ExpiresAt = &plan.ExpiresAt
+	bus.publish(topicCycle, event)
+}
+
+func handlePendingPlan(w http.ResponseWriter, r *http.Request) {
+	approvals.Lock()
+	plan := approvals.plan
+	approvals.Unlock()
+	if plan == nil {
+		writeError(w, http.StatusNotFound, errors.New("no plan is waiting for approval"))
+		return
+	}
+	writeJSON(w, http.StatusOK, plan)
+}
+
+// handleApprove approves the pending plan of the id query parameter and
+// starts a cycle to execute it, unless the balancer is paused.
+func handleApprove(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	approvals.Lock()
+	plan := approvals.plan
+	var err error
+	switch {
+	case plan == nil || plan.ID != id:
+		err = fmt.Errorf("no plan %q is waiting for approval", id)
+	case !time.Now().Before(plan.ExpiresAt):
+		err = fmt.Errorf("plan %s expired at %s", id, plan.ExpiresAt.Format(time.RFC3339))
+	case plan.ApprovedAt == nil:
+		now := time.Now().UTC()
+		plan.ApprovedAt = &now
+	}
+	approvals.Unlock()
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	audit("plan_approved", map[string]interface{}{"plan": plan.ID, "moves": len(plan.Moves), "bytes": plan.BytesToRelocate})
+	fmt.Printf("Plan %s approved through the admin API.\n", plan.ID)
+	if !ctl.isPaused() {
+		ctl.triggerNow(adminSource(r) + ", plan " + plan.ID + " approved")
+	}
+	writeJSON(w, http.StatusOK, plan)
+}
+
+// approveCommand approves a plan published by the balancer at
+// cfg.AdminListen.
+//
+//	approve <plan-id>
+func approveCommand(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: approve <plan-id>")
+	}
+	body, err := callAdmin(apiPrefix + "/approve?id=" + url.QueryEscape(args[0]))
+	if err != nil {
+		return err
+	}
+	var plan PendingPlan
+	if err := json.Unmarshal(body, &plan); err != nil {
+		return fmt.Errorf("approving plan %s: %w", args[0], err)
+	}
+	if jsonOutput() {
+		emit("approval", plan)
+		return nil
+	}
+	fmt.Printf("Approved plan %s: %d moves, %s to relocate.\n", plan.ID, len(plan.Moves), formatBytes(plan.BytesToRelocate))
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// audit publishes an event the operator may need to review later, such as
+// a move whose result does not match expectations, on the safety topic.
+func audit(event string, fields map[string]interface{}) {
+	bus.publish(topicSafety, SafetyEvent{Time: time.Now().UTC(), Name: event, Fields: fields})
+}
+
+// auditBodies are the fields of audit events only written to cfg.AuditLog,
+// too long for the AUDIT lines.
+var auditBodies = []string{"request_body", "response_body"}
+
+// logAudit prints the safety event as an AUDIT line of JSON, and appends it
+// to cfg.AuditLog if set.
+func logAudit(event SafetyEvent) {
+	entry := map[string]interface{}{
+		"@timestamp": event.Time.Format(time.RFC3339),
+		"event":      event.Name,
+		"source":     currentAuditSource(),
+	}
+	if cfg.ClusterAlias != "" {
+		entry["cluster"] = cfg.ClusterAlias
+	}
+	for k, v := range event.Fields {
+		entry[k] = v
+	}
+	if cfg.AuditLog != "" {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			fmt.Println("Error marshaling audit entry:", err)
+			return
+		}
+		if err := auditLog.write(append(line, '\n')); err != nil {
+			fmt.Println("Error writing audit log:", err)
+		}
+	}
+	for _, field := range auditBodies {
+		delete(entry, field)
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		fmt.Println("Error marshaling audit entry:", err)
+		return
+	}
+	fmt.Println("AUDIT", string(line))
+}
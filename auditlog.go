@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// sourceScheduler is the audit source of the cycles started on schedule.
+const sourceScheduler = "scheduler"
+
+// auditSource is who or what the actions being audited are taken for: the
+// command and user running it, or the trigger of the running cycle.
+var auditSource = struct {
+	sync.Mutex
+	source string
+}{source: sourceScheduler}
+
+func setAuditSource(source string) {
+	auditSource.Lock()
+	auditSource.source = source
+	auditSource.Unlock()
+}
+
+func currentAuditSource() string {
+	auditSource.Lock()
+	defer auditSource.Unlock()
+	return auditSource.source
+}
+
+// auditRequest audits the requests changing settings or moving shards,
+// with their bodies, when cfg.AuditLog is set. Reroute dry runs only
+// validate moves and are left out.
+func auditRequest(method, path string, status int, reqBody, respBody []byte, err error) {
+	if cfg.AuditLog == "" || !auditedRequest(method, path) {
+		return
+	}
+	fields := map[string]interface{}{
+		"method":        method,
+		"path":          path,
+		"status":        status,
+		"request_body":  auditBody(reqBody),
+		"response_body": auditBody(respBody),
+	}
+	if err != nil {
+		fields["error"] = err.Error()
+	}
+	audit("cluster_request", fields)
+}
+
+func auditedRequest(method, path string) bool {
+	endpoint, query := path, ""
+	if i := strings.Index(path, "?"); i >= 0 {
+		endpoint, query = path[:i], path[i+1:]
+	}
+	switch {
+	case method == "PUT" && endpoint == "/_cluster/settings":
+		return true
+	case method == "POST" && endpoint == "/_cluster/reroute":
+		values, _ := url.ParseQuery(query)
+		return values.Get("dry_run") != "true"
+	case method == "PUT" && strings.HasSuffix(endpoint, "/_settings"):
+		return true
+	}
+	return false
+}
+
+// auditBody keeps a JSON body as JSON in the audit log, anything else as a
+// string.
+func auditBody(body []byte) interface{} {
+	if len(body) == 0 {
+		return nil
+	}
+	if json.Valid(body) {
+		return json.RawMessage(body)
+	}
+	return string(body)
+}
+
+// commandSource is the audit source of a command run by hand.
+func commandSource(name string) string {
+	user := os.Getenv("USER")
+	if user == "" {
+		user = "unknown"
+	}
+	return name + " command, user " + user
+}
+
+// auditFile appends the lines of the audit log to cfg.AuditLog, rotating
+// it by size. Every line is synced, so that a crash loses none of the
+// actions taken before it.
+type auditFile struct {
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+var auditLog = &auditFile{}
+
+func (a *auditFile) write(line []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.f == nil {
+		if err := a.open(); err != nil {
+			return err
+		}
+	}
+	max, _ := parseByteSize(cfg.AuditLogMaxSize)
+	if a.size > 0 && a.size+int64(len(line)) > max {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+		if err := a.open(); err != nil {
+			return err
+		}
+	}
+	n, err := a.f.Write(line)
+	a.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return a.f.Sync()
+}
+
+func (a *auditFile) open() error {
+	f, err := os.OpenFile(cfg.AuditLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.f, a.size = f, info.Size()
+	return nil
+}
+
+// rotate closes the log and shifts it and the rotated ones by one, dropping
+// the oldest beyond cfg.AuditLogMaxFiles.
+func (a *auditFile) rotate() error {
+	a.f.Close()
+	a.f, a.size = nil, 0
+	rotated := func(i int) string { return cfg.AuditLog + "." + strconv.Itoa(i) }
+	if cfg.AuditLogMaxFiles == 0 {
+		return os.Remove(cfg.AuditLog)
+	}
+	os.Remove(rotated(cfg.AuditLogMaxFiles))
+	for i := cfg.AuditLogMaxFiles - 1; i >= 1; i-- {
+		if err := os.Rename(rotated(i), rotated(i+1)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("rotating audit log: %w", err)
+		}
+	}
+	if err := os.Rename(cfg.AuditLog, rotated(1)); err != nil {
+		return fmt.Errorf("rotating audit log: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// The roles of the admin API: readers may only get the state of the
+// balancer, operators may also act on it.
+const (
+	roleRead     = "read"
+	roleOperator = "operator"
+)
+
+// AdminToken lets the clients sending it as a bearer token use the admin
+// API with the role. Name identifies the client in the audit log.
+type AdminToken struct {
+	Name  string `json:"name"`
+	Token string `json:"token"`
+	Role  string `json:"role"`
+}
+
+func (t AdminToken) validate() error {
+	if t.Token == "" {
+		return fmt.Errorf("admin token %q has no token", t.Name)
+	}
+	if t.Role != roleRead && t.Role != roleOperator {
+		return fmt.Errorf("invalid role %q of admin token %q, want %s or %s", t.Role, t.Name, roleRead, roleOperator)
+	}
+	return nil
+}
+
+// allows tells whether the role of the token includes role.
+func (t AdminToken) allows(role string) bool {
+	return t.Role == roleOperator || role == roleRead
+}
+
+// lookupToken returns the admin token of the request's bearer token.
+func lookupToken(r *http.Request) (AdminToken, bool) {
+	bearer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if bearer == "" || bearer == r.Header.Get("Authorization") {
+		return AdminToken{}, false
+	}
+	for _, t := range cfg.AdminTokens {
+		if subtle.ConstantTimeCompare([]byte(t.Token), []byte(bearer)) == 1 {
+			return t, true
+		}
+	}
+	return AdminToken{}, false
+}
+
+// authorize only lets through the requests with a token of the role. Without
+// cfg.AdminTokens the API is open to anyone reaching it. The requests of
+// operators are audited.
+func authorize(role string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(cfg.AdminTokens) == 0 {
+			h(w, r)
+			return
+		}
+		token, ok := lookupToken(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			writeError(w, http.StatusUnauthorized, fmt.Errorf("a valid bearer token is needed"))
+			return
+		}
+		if !token.allows(role) {
+			writeError(w, http.StatusForbidden, fmt.Errorf("token %s has the %s role, %s needs %s", token.Name, token.Role, r.URL.Path, role))
+			return
+		}
+		if role == roleOperator {
+			audit("admin_request", map[string]interface{}{"method": r.Method, "path": r.URL.Path, "token": token.Name})
+		}
+		h(w, r)
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// awsChain finds AWS credentials the way the AWS SDKs do, trying in turn:
+//
+//   - the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN
+//     environment variables;
+//   - the profile of AWS_PROFILE, or default, in the shared credentials
+//     file, ~/.aws/credentials unless AWS_SHARED_CREDENTIALS_FILE is set;
+//   - the web identity token of AWS_WEB_IDENTITY_TOKEN_FILE, exchanged for
+//     the role of AWS_ROLE_ARN, as with IAM roles for EKS service accounts;
+//   - the container credentials endpoint of ECS and EKS Pod Identity;
+//   - the instance profile of EC2, through IMDSv2.
+//
+// Temporary credentials are cached until five minutes before they expire.
+type awsChain struct {
+	mu      sync.Mutex
+	creds   awsCredentials
+	expires time.Time // zero for the credentials that do not expire
+}
+
+var awsDefaultCredentials = &awsChain{}
+
+// awsMetadataClient talks to the metadata and credentials endpoints, which
+// answer quickly or not at all.
+var awsMetadataClient = &http.Client{Timeout: 5 * time.Second}
+
+func (c *awsChain) get() (awsCredentials, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.creds.AccessKeyID != "" && (c.expires.IsZero() || time.Until(c.expires) > 5*time.Minute) {
+		return c.creds, nil
+	}
+	creds, expires, err := findAWSCredentials()
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	c.creds, c.expires = creds, expires
+	return creds, nil
+}
+
+func findAWSCredentials() (awsCredentials, time.Time, error) {
+	if creds := awsEnvCredentials(); creds.AccessKeyID != "" {
+		return creds, time.Time{}, nil
+	}
+	if creds, err := awsSharedCredentials(); err != nil {
+		return awsCredentials{}, time.Time{}, err
+	} else if creds.AccessKeyID != "" {
+		return creds, time.Time{}, nil
+	}
+	if os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE") != "" {
+		return awsWebIdentityCredentials()
+	}
+	if os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI") != "" || os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI") != "" {
+		return awsContainerCredentials()
+	}
+	creds, expires, err := awsInstanceCredentials()
+	if err != nil {
+		return awsCredentials{}, time.Time{}, fmt.Errorf("no AWS credentials found, the instance profile failed: %w", err)
+	}
+	return creds, expires, nil
+}
+
+// awsSharedCredentials reads the profile from the shared credentials file,
+// if there is one.
+func awsSharedCredentials() (awsCredentials, error) {
+	path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return awsCredentials{}, nil
+		}
+		path = filepath.Join(home, ".aws", "credentials")
+	}
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return awsCredentials{}, nil
+	}
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	defer f.Close()
+
+	var creds awsCredentials
+	var section string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok || section != profile {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "aws_access_key_id":
+			creds.AccessKeyID = strings.TrimSpace(value)
+		case "aws_secret_access_key":
+			creds.SecretAccessKey = strings.TrimSpace(value)
+		case "aws_session_token":
+			creds.SessionToken = strings.TrimSpace(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return awsCredentials{}, fmt.Errorf("reading %s: %w", path, err)
+	}
+	return creds, nil
+}
+
+// awsWebIdentityCredentials calls AssumeRoleWithWebIdentity of STS, which
+// needs no signature.
+func awsWebIdentityCredentials() (awsCredentials, time.Time, error) {
+	token, err := ioutil.ReadFile(os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"))
+	if err != nil {
+		return awsCredentials{}, time.Time{}, fmt.Errorf("reading web identity token: %w", err)
+	}
+	session := os.Getenv("AWS_ROLE_SESSION_NAME")
+	if session == "" {
+		session = "elasticsearch-rebalance-shard"
+	}
+	endpoint := "https://sts.amazonaws.com"
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		endpoint = "https://sts." + region + ".amazonaws.com"
+	}
+	query := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {os.Getenv("AWS_ROLE_ARN")},
+		"RoleSessionName":  {session},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}
+	req, err := http.NewRequest("GET", endpoint+"/?"+query.Encode(), nil)
+	if err != nil {
+		return awsCredentials{}, time.Time{}, err
+	}
+	body, err := doAWSMetadata(req)
+	if err != nil {
+		return awsCredentials{}, time.Time{}, fmt.Errorf("assuming role with web identity: %w", err)
+	}
+	var resp struct {
+		Credentials struct {
+			AccessKeyID     string    `xml:"AccessKeyId"`
+			SecretAccessKey string    `xml:"SecretAccessKey"`
+			SessionToken    string    `xml:"SessionToken"`
+			Expiration      time.Time `xml:"Expiration"`
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	if err := xml.Unmarshal(body, &resp); err != nil {
+		return awsCredentials{}, time.Time{}, fmt.Errorf("parsing STS response: %w", err)
+	}
+	c := resp.Credentials
+	return awsCredentials{AccessKeyID: c.AccessKeyID, SecretAccessKey: c.SecretAccessKey, SessionToken: c.SessionToken}, c.Expiration, nil
+}
+
+// awsTemporaryCredentials is how the container and instance endpoints
+// return credentials.
+type awsTemporaryCredentials struct {
+	AccessKeyID     string    `json:"AccessKeyId"`
+	SecretAccessKey string    `json:"SecretAccessKey"`
+	Token           string    `json:"Token"`
+	Expiration      time.Time `json:"Expiration"`
+}
+
+func (c awsTemporaryCredentials) credentials() (awsCredentials, time.Time, error) {
+	if c.AccessKeyID == "" {
+		return awsCredentials{}, time.Time{}, fmt.Errorf("no access key in the credentials returned")
+	}
+	return awsCredentials{AccessKeyID: c.AccessKeyID, SecretAccessKey: c.SecretAccessKey, SessionToken: c.Token}, c.Expiration, nil
+}
+
+func awsContainerCredentials() (awsCredentials, time.Time, error) {
+	u := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if relative := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); relative != "" {
+		u = "http://169.254.170.2" + relative
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return awsCredentials{}, time.Time{}, err
+	}
+	token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+	if file := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"); file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return awsCredentials{}, time.Time{}, fmt.Errorf("reading container authorization token: %w", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	body, err := doAWSMetadata(req)
+	if err != nil {
+		return awsCredentials{}, time.Time{}, fmt.Errorf("getting container credentials: %w", err)
+	}
+	var creds awsTemporaryCredentials
+	if err := json.Unmarshal(body, &creds); err != nil {
+		return awsCredentials{}, time.Time{}, fmt.Errorf("parsing container credentials: %w", err)
+	}
+	return creds.credentials()
+}
+
+func awsInstanceCredentials() (awsCredentials, time.Time, error) {
+	const imds = "http://169.254.169.254"
+	req, err := http.NewRequest("PUT", imds+"/latest/api/token", nil)
+	if err != nil {
+		return awsCredentials{}, time.Time{}, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "21600")
+	token, err := doAWSMetadata(req)
+	if err != nil {
+		return awsCredentials{}, time.Time{}, err
+	}
+	get := func(path string) ([]byte, error) {
+		req, err := http.NewRequest("GET", imds+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("X-aws-ec2-metadata-token", string(token))
+		return doAWSMetadata(req)
+	}
+	role, err := get("/latest/meta-data/iam/security-credentials/")
+	if err != nil {
+		return awsCredentials{}, time.Time{}, err
+	}
+	name := strings.TrimSpace(strings.SplitN(string(role), "\n", 2)[0])
+	body, err := get("/latest/meta-data/iam/security-credentials/" + url.PathEscape(name))
+	if err != nil {
+		return awsCredentials{}, time.Time{}, err
+	}
+	var creds awsTemporaryCredentials
+	if err := json.Unmarshal(body, &creds); err != nil {
+		return awsCredentials{}, time.Time{}, fmt.Errorf("parsing instance credentials: %w", err)
+	}
+	return creds.credentials()
+}
+
+func doAWSMetadata(req *http.Request) ([]byte, error) {
+	resp, err := awsMetadataClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		// The query may hold a token.
+		return nil, fmt.Errorf("%s %s://%s%s: %s", req.Method, req.URL.Scheme, req.URL.Host, req.URL.Path, resp.Status)
+	}
+	return body, nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	distributionElasticsearch = "elasticsearch"
+	distributionOpenSearch    = "opensearch"
+)
+
+// RootInfo is the response of the root endpoint.
+type RootInfo struct {
+	ClusterName string `json:"cluster_name"`
+	ClusterUUID string `json:"cluster_uuid"`
+	Version     struct {
+		Number       string `json:"number"`
+		Distribution string `json:"distribution"`
+	} `json:"version"`
+}
+
+// Backend is the search engine behind cfg.ESHost. OpenSearch forked from
+// Elasticsearch 7.10.2 and kept its APIs, so it answers the requests that
+// version does: ESMajor and ESMinor are the Elasticsearch version whose
+// APIs the backend offers, which is what version gates should look at.
+type Backend struct {
+	Distribution string `json:"distribution"`
+	Version      string `json:"version"`
+	ESMajor      int    `json:"-"`
+	ESMinor      int    `json:"-"`
+}
+
+func (b *Backend) String() string {
+	name := "Elasticsearch"
+	if b.OpenSearch() {
+		name = "OpenSearch"
+	}
+	return name + " " + b.Version
+}
+
+func (b *Backend) OpenSearch() bool {
+	return b.Distribution == distributionOpenSearch
+}
+
+// atLeast reports whether the backend offers the APIs of the given
+// Elasticsearch version.
+func (b *Backend) atLeast(major, minor int) bool {
+	return b.ESMajor > major || b.ESMajor == major && b.ESMinor >= minor
+}
+
+// The Elasticsearch majors the balancer works with. OpenSearch counts as
+// 7.10.
+const (
+	minSupportedMajor = 7
+	maxSupportedMajor = 9
+)
+
+// unsupportedError is returned by getBackend for versions the balancer
+// refuses to work with.
+type unsupportedError struct {
+	backend *Backend
+}
+
+func (e unsupportedError) Error() string {
+	return fmt.Sprintf("%s is not supported, only Elasticsearch %d.x to %d.x and OpenSearch are", e.backend, minSupportedMajor, maxSupportedMajor)
+}
+
+// supportsDataTiers tells whether nodes can have data tier roles such as
+// data_hot, introduced in Elasticsearch 7.10.
+func (b *Backend) supportsDataTiers() bool {
+	return !b.OpenSearch() && b.atLeast(7, 10)
+}
+
+// defaultSettingsScope is where the balancer puts the cluster settings it
+// only needs for a while. Transient settings are deprecated since
+// Elasticsearch 8.0, so persistent ones are used there; safe mode restores
+// them if the balancer dies before it does.
+func (b *Backend) defaultSettingsScope() string {
+	if b.atLeast(8, 0) {
+		return scopePersistent
+	}
+	return scopeTransient
+}
+
+var (
+	backendMu sync.Mutex
+	backend   *Backend
+)
+
+// getBackend detects the backend through the root endpoint the first time
+// it is called successfully.
+func getBackend() (*Backend, error) {
+	backendMu.Lock()
+	defer backendMu.Unlock()
+	if backend != nil {
+		return backend, nil
+	}
+	var root RootInfo
+	if err := esGet("/", &root); err != nil {
+		return nil, fmt.Errorf("detecting backend: %w", err)
+	}
+	b, err := parseBackend(root)
+	if err != nil {
+		return nil, err
+	}
+	if b.ESMajor < minSupportedMajor || b.ESMajor > maxSupportedMajor {
+		return nil, unsupportedError{b}
+	}
+	backend = b
+	return b, nil
+}
+
+func parseBackend(root RootInfo) (*Backend, error) {
+	b := &Backend{Distribution: distributionElasticsearch, Version: root.Version.Number}
+	if root.Version.Distribution == distributionOpenSearch {
+		b.Distribution = distributionOpenSearch
+	}
+	parts := strings.SplitN(root.Version.Number, ".", 3)
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("unexpected version %q", root.Version.Number)
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("unexpected version %q", root.Version.Number)
+	}
+	minor, _ := strconv.Atoi(parts[1])
+	b.ESMajor, b.ESMinor = major, minor
+	if b.OpenSearch() {
+		b.ESMajor, b.ESMinor = 7, 10
+	}
+	return b, nil
+}
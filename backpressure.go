@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// backpressurePoll is how often the load is checked again while the cluster
+// is overloaded.
+const backpressurePoll = 15 * time.Second
+
+type NodeLoad struct {
+	Name string `json:"name"`
+	OS   struct {
+		CPU struct {
+			Percent int `json:"percent"`
+		} `json:"cpu"`
+	} `json:"os"`
+	JVM struct {
+		Mem struct {
+			HeapUsedPercent int `json:"heap_used_percent"`
+		} `json:"mem"`
+	} `json:"jvm"`
+	FS struct {
+		IOStats struct {
+			Total struct {
+				IOTimeMillis int64 `json:"io_time_in_millis"`
+			} `json:"total"`
+		} `json:"io_stats"`
+	} `json:"fs"`
+}
+
+type NodesStats struct {
+	Nodes map[string]NodeLoad `json:"nodes"`
+}
+
+type PendingTasks struct {
+	Tasks []struct {
+		Source string `json:"source"`
+	} `json:"tasks"`
+}
+
+// ioSample is the cumulative disk IO time of every node at one point in
+// time. Disk utilization is the IO time spent between two samples.
+type ioSample struct {
+	at     time.Time
+	ioTime map[string]int64
+}
+
+var lastIO ioSample
+
+const maxIOSampleAge = 5 * time.Minute
+
+// clusterOverloaded returns why the cluster is too loaded to accept another
+// relocation, or "" if it is not. Thresholds that are 0 are not checked.
+func clusterOverloaded() (string, error) {
+	var reasons []string
+	if cfg.MaxPendingTasks > 0 {
+		var pending PendingTasks
+		if err := esGet("/_cluster/pending_tasks", &pending); err != nil {
+			return "", err
+		}
+		if len(pending.Tasks) >= cfg.MaxPendingTasks {
+			reasons = append(reasons, fmt.Sprintf("%d pending cluster tasks (limit %d)", len(pending.Tasks), cfg.MaxPendingTasks))
+		}
+	}
+	if cfg.MaxNodeCPU == 0 && cfg.MaxNodeHeap == 0 && cfg.MaxNodeDiskIO == 0 {
+		return strings.Join(reasons, ", "), nil
+	}
+
+	var stats NodesStats
+	if err := esGet("/_nodes/stats/os,jvm,fs?filter_path=nodes.*.name,nodes.*.os.cpu.percent,nodes.*.jvm.mem.heap_used_percent,nodes.*.fs.io_stats.total.io_time_in_millis", &stats); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	sample := ioSample{at: now, ioTime: make(map[string]int64, len(stats.Nodes))}
+	var nodes []string
+	for id, node := range stats.Nodes {
+		sample.ioTime[id] = node.FS.IOStats.Total.IOTimeMillis
+		var over []string
+		if cfg.MaxNodeCPU > 0 && node.OS.CPU.Percent >= cfg.MaxNodeCPU {
+			over = append(over, fmt.Sprintf("CPU %d%%", node.OS.CPU.Percent))
+		}
+		if cfg.MaxNodeHeap > 0 && node.JVM.Mem.HeapUsedPercent >= cfg.MaxNodeHeap {
+			over = append(over, fmt.Sprintf("heap %d%%", node.JVM.Mem.HeapUsedPercent))
+		}
+		if prev, ok := lastIO.ioTime[id]; ok && cfg.MaxNodeDiskIO > 0 {
+			// An old sample would average the IO over too long a time.
+			elapsed := now.Sub(lastIO.at).Milliseconds()
+			if used := sample.ioTime[id] - prev; elapsed > 0 && elapsed < maxIOSampleAge.Milliseconds() && used >= 0 {
+				if util := int(used * 100 / elapsed); util >= cfg.MaxNodeDiskIO {
+					over = append(over, fmt.Sprintf("disk IO %d%%", util))
+				}
+			}
+		}
+		if len(over) > 0 {
+			nodes = append(nodes, fmt.Sprintf("%s (%s)", node.Name, strings.Join(over, ", ")))
+		}
+	}
+	lastIO = sample
+	sort.Strings(nodes)
+	if len(nodes) > 0 {
+		reasons = append(reasons, "busy nodes "+strings.Join(nodes, ", "))
+	}
+	return strings.Join(reasons, ", "), nil
+}
+
+// waitForCalm holds off the next move while the cluster is overloaded. It
+// returns false if the cycle should stop instead: the balancer was paused
+// or lost the leadership meanwhile, or the cluster stayed overloaded for
+// cfg.MoveTimeout. Errors getting the load do not hold moves off.
+func waitForCalm() bool {
+	deadline := time.Now().Add(cfg.MoveTimeout.Duration)
+	for {
+		reason, err := clusterOverloaded()
+		if err != nil {
+			fmt.Println("Error getting cluster load:", err)
+			return true
+		}
+		if reason == "" {
+			return true
+		}
+		if time.Now().After(deadline) {
+			fmt.Printf("Cluster still overloaded after %s, not issuing further moves: %s.\n", cfg.MoveTimeout.Duration, reason)
+			return false
+		}
+		fmt.Printf("Cluster overloaded, holding off moves: %s.\n", reason)
+		ctl.beat(cfg.MoveTimeout.Duration)
+		time.Sleep(backpressurePoll)
+		if ctl.isPaused() || !ctl.isLeader() {
+			fmt.Println("Paused or lost the leadership while holding off moves, not issuing further moves.")
+			return false
+		}
+	}
+}
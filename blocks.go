@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type ClusterBlock struct {
+	Description string   `json:"description"`
+	Retryable   bool     `json:"retryable"`
+	Levels      []string `json:"levels"`
+}
+
+type ClusterBlocks struct {
+	Blocks struct {
+		Global map[string]ClusterBlock `json:"global"`
+	} `json:"blocks"`
+}
+
+// blockingLevels are the block levels that keep the balancer from working:
+// it changes cluster settings and the routing table.
+var blockingLevels = map[string]bool{"write": true, "metadata_write": true}
+
+// clusterBlocked returns a description of the cluster-wide blocks that
+// forbid changing the cluster, such as cluster.blocks.read_only or a lost
+// master, or "" if there are none.
+func clusterBlocked() (string, error) {
+	var blocks ClusterBlocks
+	if err := esGet("/_cluster/state/blocks", &blocks); err != nil {
+		return "", err
+	}
+	var found []string
+	for id, block := range blocks.Blocks.Global {
+		for _, level := range block.Levels {
+			if blockingLevels[level] {
+				found = append(found, fmt.Sprintf("block %s (%s)", id, block.Description))
+				break
+			}
+		}
+	}
+	sort.Strings(found)
+	return strings.Join(found, ", "), nil
+}
+
+// lastBlock is the block reported by the previous cycle, to only notify
+// when blocks appear or change.
+var lastBlock string
+
+// checkClusterBlocks reports whether the cycle may go on. A new block
+// fails the cycle, which notifies about it; while it stays, cycles are
+// skipped quietly.
+func checkClusterBlocks() bool {
+	block, err := clusterBlocked()
+	if err != nil {
+		fmt.Println("Error getting cluster blocks:", err)
+		return true
+	}
+	if block == "" {
+		if lastBlock != "" {
+			fmt.Println("Cluster blocks lifted.")
+		}
+		lastBlock = ""
+		return true
+	}
+	fmt.Println("Cluster is blocked, not acting:", block)
+	if block != lastBlock {
+		newCycle().failed(fmt.Errorf("cluster is blocked: %s", block))
+	}
+	lastBlock = block
+	return false
+}
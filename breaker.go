@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errBreakerOpen is returned by the waits of a cycle once the circuit
+// breaker opened, and by the requests it holds back.
+var errBreakerOpen = errors.New("circuit breaker open")
+
+// circuitBreaker trips after cfg.BreakerFailures consecutive failed
+// requests to Elasticsearch, errors or 5xx responses, so that a struggling
+// master is left alone: the running cycle stops issuing and waiting for
+// moves and restores allocation right away, and for cfg.BreakerCooldown no
+// cycle starts and no request is sent but the ones restoring cluster
+// settings, see allowsRequest. The first cycle after the cool-down probes
+// the cluster with a health request, which closes the breaker if it
+// succeeds and opens it for another cool-down if it fails. Nothing else
+// closes it, the requests of the admin API, the probes and the metrics
+// included.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time // zero when closed
+	restored  bool      // the cycle stopped and restored allocation
+}
+
+var breaker = &circuitBreaker{}
+
+// record counts the outcome of a request to Elasticsearch while the breaker
+// is closed.
+func (b *circuitBreaker) record(failed bool) {
+	if cfg.BreakerFailures == 0 {
+		return
+	}
+	b.mu.Lock()
+	if !b.openUntil.IsZero() {
+		b.mu.Unlock()
+		return
+	}
+	if !failed {
+		b.failures = 0
+		b.mu.Unlock()
+		return
+	}
+	b.failures++
+	failures := b.failures
+	if failures < cfg.BreakerFailures {
+		b.mu.Unlock()
+		return
+	}
+	b.openUntil, b.restored = time.Now().Add(cfg.BreakerCooldown.Duration), false
+	until := b.openUntil
+	b.mu.Unlock()
+	fmt.Printf("Circuit breaker open: %d consecutive requests to Elasticsearch failed, no cycle starts until %s.\n", failures, until.Format(time.RFC3339))
+	audit("circuit_breaker_open", map[string]interface{}{
+		"consecutive_failures": failures,
+		"until":                until.UTC().Format(time.RFC3339),
+	})
+}
+
+// isOpen tells whether the breaker is open, the cool-down over or not.
+func (b *circuitBreaker) isOpen() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.openUntil.IsZero()
+}
+
+// allowsRequest reports whether the request may be sent. During the
+// cool-down only the updates of the cluster settings are, which restore
+// allocation and recovery settings: leaving them changed would hurt more
+// than a request.
+func (b *circuitBreaker) allowsRequest(method, path string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.openUntil.IsZero() || !time.Now().Before(b.openUntil) {
+		return true
+	}
+	return method == "PUT" && strings.HasPrefix(path, "/_cluster/settings")
+}
+
+// allowsCycle reports whether a cycle may start. Once the cool-down is over
+// it probes the cluster first.
+func (b *circuitBreaker) allowsCycle() bool {
+	b.mu.Lock()
+	until := b.openUntil
+	b.mu.Unlock()
+	switch {
+	case until.IsZero():
+		return true
+	case time.Now().Before(until):
+		fmt.Printf("Circuit breaker open until %s, skipping cycle.\n", until.Format(time.RFC3339))
+		return false
+	}
+	fmt.Println("Circuit breaker cool-down over, probing Elasticsearch.")
+	resp, err := es.Do("GET", "/_cluster/health", nil)
+	if err == nil {
+		resp.Body.Close()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err != nil || resp.StatusCode >= 500 {
+		b.openUntil, b.restored = time.Now().Add(cfg.BreakerCooldown.Duration), false
+		if err == nil {
+			err = fmt.Errorf("health request: %s", resp.Status)
+		}
+		fmt.Printf("Circuit breaker probe failed, skipping cycles until %s: %v\n", b.openUntil.Format(time.RFC3339), err)
+		audit("circuit_breaker_open", map[string]interface{}{
+			"probe_error": err.Error(),
+			"until":       b.openUntil.UTC().Format(time.RFC3339),
+		})
+		return false
+	}
+	b.failures, b.openUntil, b.restored = 0, time.Time{}, false
+	fmt.Println("Circuit breaker closed: Elasticsearch answers again.")
+	audit("circuit_breaker_closed", nil)
+	return true
+}
+
+// allowsMove reports whether the cycle may issue another move. The first
+// time it does not, it restores allocation.
+func (b *circuitBreaker) allowsMove() bool {
+	b.mu.Lock()
+	open, restored := !b.openUntil.IsZero(), b.restored
+	if open {
+		b.restored = true
+	}
+	b.mu.Unlock()
+	if !open {
+		return true
+	}
+	fmt.Println("Circuit breaker open, not issuing further moves.")
+	if !restored {
+		// The cycle restores them again once it stops.
+		enableAllocation()
+	}
+	return false
+}
+
+// sample is the metric of the state of the breaker.
+func (b *circuitBreaker) sample() sample {
+	var open float64
+	if b.isOpen() {
+		open = 1
+	}
+	return sample{"rebalancer_circuit_breaker_open", "gauge",
+		"1 while the circuit breaker around Elasticsearch is open, 0 otherwise.", open}
+}
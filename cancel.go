@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+)
+
+// CancelResult is the document of the cancel command.
+type CancelResult struct {
+	Index    string          `json:"index"`
+	Shard    int             `json:"shard"`
+	Primary  bool            `json:"primary"`
+	Node     string          `json:"node"`
+	State    string          `json:"state"`
+	Response json.RawMessage `json:"response"`
+}
+
+var cancelOptions struct {
+	allowPrimary bool
+}
+
+func cancelFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&cancelOptions.allowPrimary, "allow-primary", false, "also cancel the recovery of a primary, which may lose data if no other copy is started")
+}
+
+// cancelAllocationCommand cancels the recovery or relocation of one shard
+// copy, whoever started it. node is the node the copy is initializing on or
+// relocating from, by name or ID. Cancelling a relocation from its source
+// cancels it as a whole.
+//
+//	cancel [-yes] [-allow-primary] <index> <shard> <node>
+func cancelAllocationCommand(args []string) error {
+	if len(args) != 3 {
+		return errors.New("usage: cancel [-yes] [-allow-primary] <index> <shard> <node>")
+	}
+	index, node := args[0], args[2]
+	shardNum, err := strconv.Atoi(args[1])
+	if err != nil {
+		return fmt.Errorf("invalid shard number %q", args[1])
+	}
+
+	obs, err := observeCluster()
+	if err != nil {
+		return fmt.Errorf("observing cluster: %w", err)
+	}
+	nodeID, err := resolveNode(obs, node)
+	if err != nil {
+		return err
+	}
+	var shard ShardRouting
+	found := false
+	for _, s := range obs.State.RoutingNodes.Nodes[nodeID] {
+		if s.Index == index && s.Shard == shardNum {
+			shard, found = s, true
+		}
+	}
+	if !found {
+		return fmt.Errorf("node %s holds no copy of [%s][%d]", node, index, shardNum)
+	}
+	if shard.State != "INITIALIZING" && shard.State != "RELOCATING" {
+		return fmt.Errorf("the copy of [%s][%d] on %s is %s, there is nothing to cancel", index, shardNum, node, shard.State)
+	}
+	if shard.Primary && !cancelOptions.allowPrimary {
+		return fmt.Errorf("[%s][%d] on %s is a primary, cancelling it needs -allow-primary", index, shardNum, node)
+	}
+
+	what := "recovery"
+	if shard.State == "RELOCATING" {
+		what = "relocation to " + nodeName(obs, shard.RelocatingNode)
+	}
+	if !confirm(fmt.Sprintf("Cancel the %s of [%s][%d] on %s?", what, index, shardNum, nodeName(obs, nodeID))) {
+		return errors.New("aborted")
+	}
+	audit("cancel_allocation", map[string]interface{}{
+		"index":           index,
+		"shard":           shardNum,
+		"primary":         shard.Primary,
+		"node":            nodeID,
+		"state":           shard.State,
+		"relocating_node": shard.RelocatingNode,
+	})
+
+	body, err := sendJSON("POST", "/_cluster/reroute?metric=none", cancelCommand(shard, nodeID, cancelOptions.allowPrimary))
+	if err != nil {
+		return fmt.Errorf("cancelling [%s][%d]: %w", index, shardNum, err)
+	}
+	if jsonOutput() {
+		emit("cancel", CancelResult{Index: index, Shard: shardNum, Primary: shard.Primary, Node: nodeID, State: shard.State, Response: body})
+		return nil
+	}
+	fmt.Println("Response:", string(body))
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The texts of notifications are written for Slack: a first line with an
+// emoji shortcode, such as :x:, telling how it went, and lines of
+// details in Slack markdown. chatPayload turns them into the message of
+// the chat tool of a target: the text for Slack, a message card for
+// Microsoft Teams and an embed for Discord, their title the first line and
+// their color the one of its emoji.
+
+// chatEmoji are the shortcodes of the texts, by the emoji they stand for
+// in Teams and Discord, and the color of the messages starting with them.
+var chatEmoji = []struct {
+	shortcode, emoji string
+	color            int
+}{
+	{":white_check_mark:", "✅", 0x2eb67d},
+	{":x:", "❌", 0xe01e5a},
+	{":rotating_light:", "🚨", 0xe01e5a},
+	{":warning:", "⚠️", 0xecb22e},
+	{":hourglass:", "⏳", 0xecb22e},
+	{":raised_hand:", "✋", 0xecb22e},
+	{":arrows_counterclockwise:", "🔄", 0x36c5f0},
+}
+
+// defaultChatColor is the color of the messages without a known emoji.
+const defaultChatColor = 0x36c5f0
+
+// Discord cuts off neither the titles nor the descriptions of embeds: it
+// rejects longer ones.
+const (
+	discordTitleMax       = 256
+	discordDescriptionMax = 4096
+)
+
+// chatTarget tells whether notifications to targets of the type are chat
+// messages made by chatPayload, rather than the JSON of the event.
+func chatTarget(kind string) bool {
+	return kind == notifierSlack || kind == notifierTeams || kind == notifierDiscord
+}
+
+func chatPayload(kind, text string) interface{} {
+	if kind == notifierSlack {
+		return map[string]string{"text": text}
+	}
+	title, body := text, ""
+	if i := strings.Index(text, "\n"); i >= 0 {
+		title, body = text[:i], text[i+1:]
+	}
+	color := defaultChatColor
+	for _, e := range chatEmoji {
+		if strings.Contains(title, e.shortcode) {
+			color = e.color
+			break
+		}
+	}
+	for _, e := range chatEmoji {
+		title = strings.ReplaceAll(title, e.shortcode, e.emoji)
+		body = strings.ReplaceAll(body, e.shortcode, e.emoji)
+	}
+
+	if kind == notifierTeams {
+		card := map[string]interface{}{
+			"@type":      "MessageCard",
+			"@context":   "https://schema.org/extensions",
+			"summary":    title,
+			"themeColor": fmt.Sprintf("%06X", color),
+			"title":      title,
+		}
+		if body != "" {
+			// Single newlines do not break lines in cards.
+			card["text"] = strings.ReplaceAll(body, "\n", "\n\n")
+		}
+		return card
+	}
+	embed := map[string]interface{}{
+		"title": truncate(title, discordTitleMax),
+		"color": color,
+	}
+	if body != "" {
+		embed["description"] = truncate(body, discordDescriptionMax)
+	}
+	return map[string]interface{}{"embeds": []interface{}{embed}}
+}
+
+// truncate shortens s to at most max characters, ending it with an
+// ellipsis if cut.
+func truncate(s string, max int) string {
+	r := []rune(s)
+	if len(r) <= max {
+		return s
+	}
+	return string(r[:max-1]) + "…"
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+var churnOptions struct {
+	since    time.Duration
+	minMoves int
+	minDays  int
+	top      int
+}
+
+func churnFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&churnOptions.since, "since", 30*24*time.Hour, "analyze the moves recorded within this period")
+	fs.IntVar(&churnOptions.minMoves, "min-moves", 3, "report shards moved at least this many times")
+	fs.IntVar(&churnOptions.minDays, "min-days", 3, "report nodes overloaded on at least this many days")
+	fs.IntVar(&churnOptions.top, "top", 10, "number of indices to report, by moves")
+}
+
+// ChurnReport is the document of the churn command. Only executed moves
+// count. Shards and Nodes are the chronic offenders, Indices the indices
+// moved most.
+type ChurnReport struct {
+	Since   time.Time    `json:"since"`
+	Moves   int          `json:"moves"`
+	Bytes   int64        `json:"bytes"`
+	Shards  []ShardChurn `json:"shards"`
+	Nodes   []NodeChurn  `json:"nodes"`
+	Indices []IndexChurn `json:"indices"`
+}
+
+// ShardChurn is a shard moved repeatedly. Returns counts the moves of its
+// copies back to a node one of them had left.
+type ShardChurn struct {
+	Index   string    `json:"index"`
+	Shard   int       `json:"shard"`
+	Moves   int       `json:"moves"`
+	Returns int       `json:"returns"`
+	Bytes   int64     `json:"bytes"`
+	Last    time.Time `json:"last"`
+}
+
+// NodeChurn is a node repeatedly overloaded: OverloadedDays counts the days
+// more copies were moved off it than onto it.
+type NodeChurn struct {
+	Node           string `json:"node"`
+	MovedOff       int    `json:"moved_off"`
+	MovedOnto      int    `json:"moved_onto"`
+	OverloadedDays int    `json:"overloaded_days"`
+}
+
+// IndexChurn sums the moves of an index. DominatedCycles is how many of the
+// cycles the advisor remembers it dominated, see advisorDominantShare.
+type IndexChurn struct {
+	Index           string `json:"index"`
+	Moves           int    `json:"moves"`
+	Shards          int    `json:"shards"`
+	Bytes           int64  `json:"bytes"`
+	DominatedCycles int    `json:"dominated_cycles"`
+}
+
+// churnCommand analyzes the move history for what rebalancing keeps
+// undoing: the shards moved over and over, the nodes that keep needing
+// shards moved off, and the indices behind most moves. These call for a
+// structural fix, such as different shard counts, total_shards_per_node or
+// node weights, rather than more cycles.
+//
+//	churn [-since 720h] [-min-moves 3] [-min-days 3] [-top 10]
+func churnCommand(args []string) error {
+	records, err := readHistory(churnOptions.since, "", moveResultExecuted, 0)
+	if err != nil {
+		return err
+	}
+	report := analyzeChurn(records, loadAdvisorHistory())
+	report.Since = time.Now().Add(-churnOptions.since).UTC()
+	if jsonOutput() {
+		emit("churn", report)
+		return nil
+	}
+
+	fmt.Printf("%d moves, %s relocated since %s\n", report.Moves, formatBytes(report.Bytes), report.Since.Local().Format("2006-01-02 15:04"))
+	fmt.Printf("\nShards moved at least %d times\n", churnOptions.minMoves)
+	if len(report.Shards) == 0 {
+		fmt.Println("  none")
+	}
+	for _, s := range report.Shards {
+		fmt.Printf("  [%s][%d]  %d moves, %d back to a node it left, %s, last %s\n", s.Index, s.Shard, s.Moves, s.Returns, formatBytes(s.Bytes), s.Last.Local().Format("2006-01-02 15:04"))
+	}
+	fmt.Printf("\nNodes overloaded on at least %d days\n", churnOptions.minDays)
+	if len(report.Nodes) == 0 {
+		fmt.Println("  none")
+	}
+	for _, n := range report.Nodes {
+		fmt.Printf("  %-17s %d days, %d copies moved off, %d onto\n", n.Node, n.OverloadedDays, n.MovedOff, n.MovedOnto)
+	}
+	fmt.Println("\nIndices moved most")
+	if len(report.Indices) == 0 {
+		fmt.Println("  none")
+	}
+	for _, i := range report.Indices {
+		fmt.Printf("  %-30s %d moves of %d shards, %s", i.Index, i.Moves, i.Shards, formatBytes(i.Bytes))
+		if i.DominatedCycles > 0 {
+			fmt.Printf(", dominated %d cycles", i.DominatedCycles)
+		}
+		fmt.Println()
+	}
+	if len(report.Shards) > 0 || len(report.Nodes) > 0 {
+		fmt.Println("\nShards moving back and forth usually belong to an index with too few shards to spread evenly, see apply-advice.")
+		fmt.Println("Nodes overloaded day after day may need a different weight or allocation filter.")
+	}
+	return nil
+}
+
+// analyzeChurn computes the report of the executed moves, oldest first.
+func analyzeChurn(records []MoveRecord, advisor *AdvisorHistory) ChurnReport {
+	report := ChurnReport{Shards: []ShardChurn{}, Nodes: []NodeChurn{}, Indices: []IndexChurn{}}
+	shards := make(map[string]*ShardChurn)
+	left := make(map[string]map[string]bool) // the nodes the copies of a shard left
+	nodes := make(map[string]*NodeChurn)
+	balance := make(map[string]map[string]int) // moves off minus onto, by node and day
+	indices := make(map[string]*IndexChurn)
+	indexShards := make(map[string]map[int]bool)
+
+	node := func(id string) *NodeChurn {
+		if nodes[id] == nil {
+			nodes[id] = &NodeChurn{Node: id}
+			balance[id] = make(map[string]int)
+		}
+		return nodes[id]
+	}
+	for _, r := range records {
+		report.Moves++
+		report.Bytes += r.Bytes
+
+		key := r.Index + "/" + strconv.Itoa(r.Shard)
+		s := shards[key]
+		if s == nil {
+			s = &ShardChurn{Index: r.Index, Shard: r.Shard}
+			shards[key], left[key] = s, make(map[string]bool)
+		}
+		s.Moves++
+		s.Bytes += r.Bytes
+		s.Last = r.Time
+		if left[key][r.Target] {
+			s.Returns++
+		}
+		left[key][r.Source] = true
+
+		day := r.Time.Local().Format("2006-01-02")
+		node(r.Source).MovedOff++
+		balance[r.Source][day]++
+		node(r.Target).MovedOnto++
+		balance[r.Target][day]--
+
+		i := indices[r.Index]
+		if i == nil {
+			i = &IndexChurn{Index: r.Index}
+			indices[r.Index], indexShards[r.Index] = i, make(map[int]bool)
+		}
+		i.Moves++
+		i.Bytes += r.Bytes
+		indexShards[r.Index][r.Shard] = true
+	}
+
+	for _, s := range shards {
+		if s.Moves >= churnOptions.minMoves {
+			report.Shards = append(report.Shards, *s)
+		}
+	}
+	sort.Slice(report.Shards, func(i, j int) bool {
+		a, b := report.Shards[i], report.Shards[j]
+		if a.Moves != b.Moves {
+			return a.Moves > b.Moves
+		}
+		return a.Index < b.Index || a.Index == b.Index && a.Shard < b.Shard
+	})
+
+	for id, n := range nodes {
+		for _, net := range balance[id] {
+			if net > 0 {
+				n.OverloadedDays++
+			}
+		}
+		if n.OverloadedDays >= churnOptions.minDays {
+			report.Nodes = append(report.Nodes, *n)
+		}
+	}
+	sort.Slice(report.Nodes, func(i, j int) bool {
+		a, b := report.Nodes[i], report.Nodes[j]
+		return a.OverloadedDays > b.OverloadedDays || a.OverloadedDays == b.OverloadedDays && a.Node < b.Node
+	})
+
+	for _, c := range advisor.Cycles {
+		for _, index := range c.Dominant {
+			if i := indices[index]; i != nil {
+				i.DominatedCycles++
+			}
+		}
+	}
+	for index, i := range indices {
+		i.Shards = len(indexShards[index])
+		report.Indices = append(report.Indices, *i)
+	}
+	sort.Slice(report.Indices, func(i, j int) bool {
+		a, b := report.Indices[i], report.Indices[j]
+		return a.Moves > b.Moves || a.Moves == b.Moves && a.Index < b.Index
+	})
+	if churnOptions.top >= 0 && len(report.Indices) > churnOptions.top {
+		report.Indices = report.Indices[:churnOptions.top]
+	}
+	return report
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// parseCloudID returns the Elasticsearch endpoint of an Elastic Cloud ID,
+// name:base64(host[:port]$es-uuid[:port]$kibana-uuid), as the official
+// clients do: the port of the Elasticsearch part wins over the one of the
+// host, 443 if neither has one.
+func parseCloudID(id string) (string, error) {
+	i := strings.LastIndex(id, ":")
+	if i < 0 {
+		return "", fmt.Errorf("invalid cloud ID %q, want name:base64", id)
+	}
+	data, err := base64.StdEncoding.DecodeString(id[i+1:])
+	if err != nil {
+		if data, err = base64.RawStdEncoding.DecodeString(id[i+1:]); err != nil {
+			return "", fmt.Errorf("invalid cloud ID %q: %w", id, err)
+		}
+	}
+	parts := strings.Split(string(data), "$")
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return "", fmt.Errorf("invalid cloud ID %q, it has no Elasticsearch endpoint", id)
+	}
+	host, port := parts[0], "443"
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		host, port = h, p
+	}
+	uuid := parts[1]
+	if u, p, err := net.SplitHostPort(uuid); err == nil {
+		uuid, port = u, p
+	}
+	return "https://" + uuid + "." + host + ":" + port, nil
+}
+
+// resolveCloudEndpoint points cfg.ESHost at the Elastic Cloud deployment of
+// cfg.ESCloudID or cfg.ElasticCloudDeployment, if set.
+func resolveCloudEndpoint() error {
+	switch {
+	case cfg.ESCloudID != "":
+		host, err := parseCloudID(cfg.ESCloudID)
+		if err != nil {
+			return err
+		}
+		cfg.ESHost = host
+	case cfg.ElasticCloudDeployment != "":
+		host, err := lookupDeployment(cfg.ElasticCloudDeployment)
+		if err != nil {
+			return fmt.Errorf("resolving Elastic Cloud deployment %s: %w", cfg.ElasticCloudDeployment, err)
+		}
+		fmt.Printf("Elastic Cloud deployment %s is at %s.\n", cfg.ElasticCloudDeployment, host)
+		cfg.ESHost = host
+	}
+	return nil
+}
+
+// lookupDeployment gets the endpoint of the Elasticsearch resource of the
+// deployment from the Elastic Cloud API.
+func lookupDeployment(id string) (string, error) {
+	req, err := http.NewRequest("GET", strings.TrimRight(cfg.ElasticCloudAPI, "/")+"/api/v1/deployments/"+url.PathEscape(id), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "ApiKey "+cfg.ElasticCloudAPIKey)
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return "", fmt.Errorf("GET %s: %s", req.URL.Redacted(), resp.Status)
+	}
+	var deployment struct {
+		Resources struct {
+			Elasticsearch []struct {
+				Info struct {
+					Metadata struct {
+						ServiceURL string `json:"service_url"`
+						CloudID    string `json:"cloud_id"`
+					} `json:"metadata"`
+				} `json:"info"`
+			} `json:"elasticsearch"`
+		} `json:"resources"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&deployment); err != nil {
+		return "", fmt.Errorf("parsing deployment: %w", err)
+	}
+	if len(deployment.Resources.Elasticsearch) == 0 {
+		return "", fmt.Errorf("the deployment has no Elasticsearch resource")
+	}
+	metadata := deployment.Resources.Elasticsearch[0].Info.Metadata
+	if metadata.ServiceURL != "" {
+		return strings.TrimRight(metadata.ServiceURL, "/"), nil
+	}
+	if metadata.CloudID != "" {
+		return parseCloudID(metadata.CloudID)
+	}
+	return "", fmt.Errorf("the deployment has no Elasticsearch endpoint yet")
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// clusterSection is an entry of the clusters list of the config file: a
+// name plus any setting of the top level, which it overrides for that
+// cluster only.
+type clusterSection struct {
+	Name string `json:"name"`
+	*Config
+}
+
+// clusterNames returns the names of the clusters of the config file, in
+// order.
+func (c *Config) clusterNames() ([]string, error) {
+	var names []string
+	seen := make(map[string]bool)
+	for _, raw := range c.Clusters {
+		var section struct {
+			Name string `json:"name"`
+		}
+		if err := json.Unmarshal(raw, &section); err != nil {
+			return nil, fmt.Errorf("parsing clusters: %w", err)
+		}
+		if section.Name == "" {
+			return nil, errors.New("every entry of clusters needs a name")
+		}
+		if seen[section.Name] {
+			return nil, fmt.Errorf("cluster %q is defined twice", section.Name)
+		}
+		seen[section.Name] = true
+		names = append(names, section.Name)
+	}
+	return names, nil
+}
+
+// useCluster applies the settings of the named cluster over the top level
+// ones. The cluster name becomes the default alias, see separate for what
+// it does not inherit as is.
+func (c *Config) useCluster(name string) error {
+	for _, raw := range c.Clusters {
+		var id struct {
+			Name string `json:"name"`
+		}
+		if err := json.Unmarshal(raw, &id); err != nil || id.Name != name {
+			continue
+		}
+
+		stateDir, adminListen, auditLog := c.StateDir, c.AdminListen, c.AuditLog
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&clusterSection{Config: c}); err != nil {
+			return fmt.Errorf("parsing cluster %s: %w", name, err)
+		}
+		if c.ClusterAlias == "" {
+			c.ClusterAlias = name
+		}
+		c.separate(name, stateDir, adminListen, auditLog)
+		c.Clusters = nil
+		return nil
+	}
+	return fmt.Errorf("no cluster %q in the config file", name)
+}
+
+// separate keeps the named cluster from sharing with the others what only
+// one process can hold, given the top level stateDir, adminListen and
+// auditLog: where it inherits them, it gets a subdirectory of the state
+// directory, an audit log suffixed with its name, and no admin API. The
+// StatsD agent is shared, the metrics being tagged with the cluster.
+func (c *Config) separate(name, stateDir, adminListen, auditLog string) {
+	if c.StateDir != "" && c.StateDir == stateDir {
+		c.StateDir = filepath.Join(stateDir, name)
+	}
+	if c.AdminListen == adminListen {
+		c.AdminListen = ""
+	}
+	if c.AuditLog != "" && c.AuditLog == auditLog {
+		ext := filepath.Ext(auditLog)
+		c.AuditLog = strings.TrimSuffix(auditLog, ext) + "-" + name + ext
+	}
+}
+
+// checkClusterOutputs fails when two clusters would serve the admin API on
+// the same address or append to the same audit log.
+func (c *Config) checkClusterOutputs() error {
+	admin := make(map[string]string)
+	audit := make(map[string]string)
+	for _, raw := range c.Clusters {
+		section := clusterSection{Config: &Config{StateDir: c.StateDir, AdminListen: c.AdminListen, AuditLog: c.AuditLog}}
+		if err := json.Unmarshal(raw, &section); err != nil {
+			return fmt.Errorf("parsing clusters: %w", err)
+		}
+		section.separate(section.Name, c.StateDir, c.AdminListen, c.AuditLog)
+		if addr := section.AdminListen; addr != "" {
+			if other, ok := admin[addr]; ok {
+				return fmt.Errorf("clusters %s and %s both set admin_listen %s", other, section.Name, addr)
+			}
+			admin[addr] = section.Name
+		}
+		if file := section.AuditLog; file != "" {
+			if other, ok := audit[filepath.Clean(file)]; ok {
+				return fmt.Errorf("clusters %s and %s both write the audit log %s", other, section.Name, file)
+			}
+			audit[filepath.Clean(file)] = section.Name
+		}
+	}
+	return nil
+}
+
+// runClusters balances every cluster of the config file. Each cluster runs
+// in its own child process, since the balancer keeps its settings and
+// runtime state globally, and is restarted by the supervisor if it exits.
+// args are the command-line arguments of this process, passed on to the
+// children.
+func runClusters(ctx context.Context, args []string) error {
+	names, err := cfg.clusterNames()
+	if err != nil {
+		return err
+	}
+	var components []component
+	for _, name := range names {
+		name := name
+		components = append(components, component{
+			name: "cluster " + name,
+			run: func(ctx context.Context) error {
+				return runClusterProcess(ctx, name, args)
+			},
+		})
+	}
+	return supervise(ctx, components...)
+}
+
+func runClusterProcess(ctx context.Context, name string, args []string) error {
+	var stdout io.Writer = os.Stdout
+	if jsonOutput() {
+		// The documents of the clusters, the text went to stderr already.
+		stdout = documents.w
+	}
+	return runChild(ctx, append([]string{"run", "-cluster", name}, args...), stdout, os.Stderr)
+}
+
+// runChild runs this executable with args until it exits or ctx is done,
+// which stops it like a signal would. An exit for an invalid configuration
+// is fatal.
+func runChild(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	self, err := os.Executable()
+	if err != nil {
+		return fatal(err)
+	}
+	cmd := exec.Command(self, args...)
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	select {
+	case err := <-exited:
+		var exit *exec.ExitError
+		if errors.As(err, &exit) && exit.ExitCode() == 2 {
+			return fatal(fmt.Errorf("invalid configuration"))
+		}
+		if err == nil {
+			err = errors.New("exited")
+		}
+		return err
+	case <-ctx.Done():
+		// Let the cycle wind down like on a signal to this process.
+		cmd.Process.Signal(syscall.SIGTERM)
+		select {
+		case <-exited:
+		case <-time.After(cfg.MoveTimeout.Duration):
+			cmd.Process.Kill()
+			<-exited
+		}
+		return nil
+	}
+}
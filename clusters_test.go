@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestClusterOutputs(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		args    []string
+		cluster string // loaded as the process of this cluster
+		wantErr string
+		// want are the admin API address and audit log of the cluster.
+		wantAdmin, wantAudit string
+	}{
+		{
+			name:      "derives the audit log and drops the admin API",
+			config:    `{"admin_listen": ":9300", "audit_log": "/var/log/audit.log", "clusters": [{"name": "a"}, {"name": "b"}]}`,
+			cluster:   "b",
+			wantAudit: "/var/log/audit-b.log",
+		},
+		{
+			name:      "keeps the settings of the entry",
+			config:    `{"audit_log": "/var/log/audit.log", "clusters": [{"name": "a", "admin_listen": ":9301", "audit_log": "/var/log/a.log"}, {"name": "b"}]}`,
+			cluster:   "a",
+			wantAdmin: ":9301",
+			wantAudit: "/var/log/a.log",
+		},
+		{
+			name:    "rejects a shared admin API",
+			config:  `{"clusters": [{"name": "a", "admin_listen": ":9300"}, {"name": "b", "admin_listen": ":9300"}]}`,
+			wantErr: "clusters a and b both set admin_listen :9300",
+		},
+		{
+			name:    "rejects a shared audit log",
+			config:  `{"audit_log": "/var/log/audit.log", "clusters": [{"name": "a", "audit_log": "/var/log/audit-b.log"}, {"name": "b"}]}`,
+			wantErr: "clusters a and b both write the audit log /var/log/audit-b.log",
+		},
+		{
+			name:    "rejects an admin API flag",
+			config:  `{"clusters": [{"name": "a"}, {"name": "b"}]}`,
+			args:    []string{"-admin-listen", ":9300"},
+			wantErr: "-admin-listen would be shared by every cluster",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "config.json")
+			if err := ioutil.WriteFile(file, []byte(tt.config), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			args := append([]string{"-config", file}, tt.args...)
+			if tt.cluster != "" {
+				args = append(args, "-cluster", tt.cluster)
+			}
+			c, _, err := loadConfig(args, nil)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loading the config returned %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.AdminListen != tt.wantAdmin || c.AuditLog != tt.wantAudit {
+				t.Errorf("admin_listen %q and audit_log %q, want %q and %q", c.AdminListen, c.AuditLog, tt.wantAdmin, tt.wantAudit)
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// command is a subcommand. run receives the arguments left after the flags;
+// flags, if set, registers the flags specific to the command next to the
+// common ones. Commands changing the cluster are locked: they run holding
+// the cluster lock.
+type command struct {
+	run    func(args []string) error
+	flags  func(fs *flag.FlagSet)
+	locked bool
+}
+
+// commandArgs are the arguments of the command, flags included.
+var commandArgs []string
+
+var commands = map[string]command{
+	"run":          {run: runCommand},
+	"operator":     {run: operatorCommand, flags: operatorFlags},
+	"apply-advice": {run: applyAdviceCommand, locked: true},
+	"undo-advice":  {run: undoAdviceCommand, locked: true},
+	"history":      {run: historyCommand, flags: historyFlags},
+	"churn":        {run: churnCommand, flags: churnFlags},
+	"report":       {run: reportCommand},
+	"status":       {run: statusCommand, flags: statusFlags},
+	"plan":         {run: planCommand},
+	"import-plan":  {run: importPlanCommand, locked: true},
+	"tui":          {run: tuiCommand, flags: tuiFlags},
+	"move":         {run: manualMoveCommand, locked: true},
+	"cancel":       {run: cancelAllocationCommand, flags: cancelFlags, locked: true},
+	"snapshot":     {run: snapshotCommand, flags: snapshotFlags},
+	"replay":       {run: replayCommand, flags: snapshotFlags},
+	"simulate":     {run: simulateCommand, flags: simulateFlags},
+	"pause":        {run: pauseCommand},
+	"resume":       {run: resumeCommand},
+	"approve":      {run: approveCommand},
+}
+
+// runCommand is the default command: rebalance until interrupted. The
+// scheduler, the balancer running the cycles, the admin API and the leader
+// election are supervised separately, so that a failing admin API does not
+// stop the balancing and vice versa. On SIGINT or SIGTERM no further moves are
+// issued and the running cycle winds down; a second signal exits at once.
+func runCommand(args []string) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if len(cfg.Clusters) > 0 {
+		return runClusters(ctx, commandArgs)
+	}
+	go func() {
+		<-ctx.Done()
+		stop()
+		ctl.setPaused(true)
+		fmt.Println("Shutting down, waiting for the running cycle to stop...")
+	}()
+
+	if err := checkBackend(); err != nil {
+		return err
+	}
+	if err := checkClusterUUIDs(identifyEndpoints()); err != nil {
+		return err
+	}
+	if err := checkUncleanShutdown(); err != nil {
+		return err
+	}
+
+	due := make(chan chan struct{})
+	components := []component{
+		{name: "scheduler", run: func(ctx context.Context) error { return (&scheduler{}).run(ctx, due) }},
+		{name: "balancer", run: func(ctx context.Context) error { return balance(ctx, due) }},
+	}
+	if cfg.AdminListen != "" {
+		components = append(components, component{name: "admin", run: serveAdmin})
+	}
+	if cfg.ESCredentials != nil && cfg.ESCredentials.Refresh.Duration > 0 {
+		components = append(components, component{name: "credentials", run: refreshCredentials})
+	}
+	if cfg.StatsDAddress != "" {
+		components = append(components, component{name: "statsd", run: emitStatsD})
+	}
+	if cfg.ImbalanceAlert != nil {
+		components = append(components, component{name: "imbalance-alert", run: watchImbalance})
+	}
+	if cfg.LeaderElection != "" || cfg.ClusterLock {
+		ctl.setLeader(false)
+		components = append(components, component{name: "leader-election", run: electLeader})
+	}
+	return supervise(ctx, components...)
+}
+
+// checkBackend refuses the versions the balancer does not support, before
+// running or changing anything. It runs for the run command and for every
+// locked one. A cluster that cannot be reached is only reported, as it may
+// just be unreachable for now.
+func checkBackend() error {
+	b, err := getBackend()
+	var unsupported unsupportedError
+	switch {
+	case errors.As(err, &unsupported):
+		return err
+	case err != nil:
+		fmt.Println("Error:", err)
+	default:
+		fmt.Printf("Connected to %s.\n", b)
+	}
+	return nil
+}
+
+// balance runs a cycle every time one is due.
+func balance(ctx context.Context, due <-chan chan struct{}) error {
+	for {
+		var done chan struct{}
+		select {
+		case done = <-due:
+		case <-ctx.Done():
+			return nil
+		}
+		ctl.beat(cfg.MoveTimeout.Duration)
+		func() {
+			defer close(done)
+			runCycle()
+		}()
+	}
+}
+
+func runCycle() {
+	if !ctl.isLeader() {
+		fmt.Println("Not the leader, standing by.")
+		return
+	}
+	defer func() {
+		// The cycle may have disabled allocation before panicking.
+		if r := recover(); r != nil {
+			ctl.enterSafeMode(fmt.Sprintf("cycle panicked: %v", r))
+			enableAllocation()
+			panic(r)
+		}
+	}()
+	if !breaker.allowsCycle() || !checkClusterIdentity() || !checkClusterBlocks() {
+		return
+	}
+	// Runs while allocation is still enabled. Remediation changes the
+	// cluster, so it is left out in safe mode.
+	if !ctl.inSafeMode() {
+		remediateUnassigned()
+	}
+	rebalanceShards()
+}
+
+var stdin = bufio.NewReader(os.Stdin)
+
+// confirm asks the operator a yes/no question on the terminal, unless -yes
+// was given.
+func confirm(question string) bool {
+	if cfg.AssumeYes {
+		return true
+	}
+	fmt.Printf("%s [y/N] ", question)
+	answer, _ := stdin.ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
@@ -0,0 +1,1024 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Config holds the settings of the balancer. The defaults match the values
+// the tool used to have hard-coded. Settings can be given in a JSON config
+// file and overridden by command-line flags.
+type Config struct {
+	ESHost             string   `json:"es_host"`
+	RebalanceThreshold int      `json:"rebalance_threshold"` // Maximum allowed difference in shard count between nodes
+	SleepInterval      Duration `json:"interval"`
+
+	// RebalanceStopThreshold adds hysteresis in count mode: once the spread
+	// exceeds RebalanceThreshold, cycles keep balancing until it is down to
+	// RebalanceStopThreshold, so that a cluster hovering at the threshold
+	// does not flap. 0 disables it.
+	RebalanceStopThreshold int `json:"rebalance_stop_threshold"`
+
+	// MaxShardsPerNode, in count mode, is an absolute cap on the shards of
+	// a node, unlike RebalanceThreshold which bounds the difference between
+	// nodes: shards are moved off the nodes above it even when the spread
+	// is within the threshold, and never onto a node at it. 0 disables it.
+	MaxShardsPerNode int `json:"max_shards_per_node"`
+
+	// MinMoveImprovement, in count mode, ends the plan at the first move
+	// that improves the standard deviation of the shard counts by less than
+	// this. 0 disables it.
+	MinMoveImprovement float64 `json:"min_move_improvement"`
+
+	// BreakerFailures consecutive failed requests to Elasticsearch open the
+	// circuit breaker, which stops the running cycle and starts none for
+	// BreakerCooldown, see circuitBreaker. 0 disables it.
+	BreakerFailures int      `json:"breaker_failures"`
+	BreakerCooldown Duration `json:"breaker_cooldown"`
+
+	// CycleCooldown is the time after a cycle that moved shards during which
+	// no other cycle starts. 0 disables it.
+	CycleCooldown Duration `json:"cycle_cooldown"`
+
+	// Schedule is a cron expression starting the cycles, such as
+	// "0 2 * * *", instead of waiting SleepInterval between them. It is
+	// evaluated in MaintenanceTimezone.
+	Schedule string `json:"schedule"`
+
+	// AdaptiveInterval waits less than SleepInterval, down to MinInterval,
+	// when the cluster is badly imbalanced, and backs off up to MaxInterval
+	// while it is balanced.
+	AdaptiveInterval bool     `json:"adaptive_interval"`
+	MinInterval      Duration `json:"min_interval"`
+	MaxInterval      Duration `json:"max_interval"`
+
+	// ESCloudID targets the Elastic Cloud deployment of the Cloud ID shown
+	// in its console instead of ESHost. ElasticCloudDeployment does by the
+	// ID of the deployment, looking its endpoint up at startup with the
+	// Elastic Cloud API at ElasticCloudAPI and an API key of the
+	// organization, ElasticCloudAPIKey. The requests to Elasticsearch still
+	// authenticate with ESAPIKey or ESUsername.
+	ESCloudID              string `json:"es_cloud_id"`
+	ElasticCloudDeployment string `json:"elastic_cloud_deployment"`
+	ElasticCloudAPIKey     string `json:"elastic_cloud_api_key"`
+	ElasticCloudAPI        string `json:"elastic_cloud_api"`
+
+	// ESHosts are further endpoints of the cluster to fail over to when
+	// ESHost is unreachable. Sniff also adds the HTTP addresses of all
+	// nodes, refreshed every SniffInterval.
+	ESHosts       []string `json:"es_hosts"`
+	Sniff         bool     `json:"sniff"`
+	SniffInterval Duration `json:"sniff_interval"`
+
+	// The requests to Elasticsearch share a client keeping up to
+	// ESMaxIdleConns idle connections to every endpoint for
+	// ESIdleConnTimeout, so that polling reuses its connections; 0 closes
+	// every connection after its request. ESTimeout
+	// bounds a request, reading the response included; 0 disables it.
+	// Proxies are taken from HTTP_PROXY, HTTPS_PROXY and NO_PROXY, unless
+	// Proxy, an http, https or socks5 URL such as socks5://bastion:1080,
+	// sends all of them through the one proxy.
+	ESTimeout         Duration `json:"es_timeout"`
+	ESMaxIdleConns    int      `json:"es_max_idle_conns"`
+	ESIdleConnTimeout Duration `json:"es_idle_conn_timeout"`
+	Proxy             string   `json:"proxy"`
+
+	// ESUsername and ESPassword authenticate the requests to Elasticsearch
+	// with basic auth, or ESAPIKey, the base64 encoding of id:api_key, with
+	// an API key. ESCredentials fetches them from Vault or AWS Secrets
+	// Manager instead, see CredentialSource; it can only be set in the
+	// config file.
+	ESUsername    string            `json:"es_username"`
+	ESPassword    string            `json:"es_password"`
+	ESAPIKey      string            `json:"es_api_key"`
+	ESCredentials *CredentialSource `json:"es_credentials"`
+
+	// ESSigV4Region signs the requests with AWS Signature Version 4 for
+	// ESSigV4Service in the region instead, as the domains of Amazon
+	// OpenSearch Service with IAM access control need, with the default
+	// credentials of AWS, see awsChain.
+	ESSigV4Region  string `json:"es_sigv4_region"`
+	ESSigV4Service string `json:"es_sigv4_service"`
+
+	// Simulate runs against an in-memory cluster generated with most of the
+	// shards on half of its nodes, see esapi.Fake, instead of ESHost: for
+	// demos and trying settings out. Nothing is sent to Elasticsearch, and
+	// the state goes to the simulate directory of StateDir.
+	Simulate bool `json:"simulate"`
+
+	// ClusterAlias is a human-friendly name of the cluster. When set it
+	// prefixes every line of output and is included in notifications, audit
+	// entries and the admin API, to tell clusters apart.
+	ClusterAlias string `json:"cluster_alias"`
+
+	// Output is the format of what the commands print: "text" for people,
+	// or "json" for newline-delimited JSON documents on stdout, the text
+	// going to stderr, see Document.
+	Output string `json:"output"`
+
+	// BalanceMode selects what is balanced: "count" equalizes the total
+	// shard count per node, "index" spreads the shards of each index, and
+	// "heat" spreads the shards of the indices with the most indexing and
+	// search operations, until no node is hotter than the mean by more than
+	// HeatTolerance (a fraction, 0.2 when 0).
+	BalanceMode   string  `json:"balance_mode"`
+	HeatTolerance float64 `json:"heat_tolerance"`
+
+	// SampleIndices, in count mode, first estimates the imbalance from the
+	// shards of that many random indices, and only observes the whole
+	// cluster when the estimate is above the threshold, or when
+	// MaxShardsPerNode, NodeWeights, BalancePrimaries or draining need it.
+	// 0 disables it.
+	SampleIndices int `json:"sample_indices"`
+
+	// SmoothingAlpha smooths the shard count of every node over the
+	// cycles in count mode: each cycle weighs the observed count with
+	// SmoothingAlpha and the previous average with 1-SmoothingAlpha. 0
+	// disables smoothing.
+	SmoothingAlpha float64 `json:"smoothing_alpha"`
+
+	// RemediateUnassigned retries failed allocations and explicitly
+	// allocates replicas of unassigned shards when the cause is retryable.
+	// Without it unassigned shards are only explained in the logs.
+	RemediateUnassigned bool `json:"remediate_unassigned"`
+
+	// BalancePrimaries additionally evens out the number of primaries per
+	// node until no two nodes differ by more than PrimaryThreshold.
+	BalancePrimaries bool `json:"balance_primaries"`
+	PrimaryThreshold int  `json:"primary_threshold"`
+
+	// MaxClusterRecoveries is the ceiling of concurrent recoveries in the
+	// whole cluster, including the ones the tool did not start. No new
+	// relocation is issued while it is reached. 0 disables the check.
+	MaxClusterRecoveries int `json:"max_cluster_recoveries"`
+
+	// MaxConcurrentRelocations lets a cycle run up to this many of its
+	// relocations at once, each node taking part in no more of them than
+	// its node_concurrent_recoveries. Then each move is tracked until it
+	// completes. 0 issues the moves one after the other.
+	MaxConcurrentRelocations int `json:"max_concurrent_relocations"`
+
+	// The load above which moves are held off until the cluster calms
+	// down: the CPU, heap and disk IO utilization of any node in percent,
+	// and the number of pending cluster tasks. 0 disables a check.
+	MaxNodeCPU      int `json:"max_node_cpu"`
+	MaxNodeHeap     int `json:"max_node_heap"`
+	MaxNodeDiskIO   int `json:"max_node_disk_io"`
+	MaxPendingTasks int `json:"max_pending_tasks"`
+
+	// BoostMaxBytesPerSec and BoostNodeConcurrentRecoveries raise
+	// indices.recovery.max_bytes_per_sec (a byte size such as "250mb") and
+	// cluster.routing.allocation.node_concurrent_recoveries while a cycle
+	// moves shards, when they are lower. The prior values are restored at
+	// the end of the cycle. Empty and 0 leave them alone.
+	BoostMaxBytesPerSec           string `json:"boost_max_bytes_per_sec"`
+	BoostNodeConcurrentRecoveries int    `json:"boost_node_concurrent_recoveries"`
+
+	// IncludeIndices and ExcludeIndices are glob patterns restricting which
+	// indices may have their shards relocated.
+	IncludeIndices []string `json:"include_indices"`
+	ExcludeIndices []string `json:"exclude_indices"`
+
+	// ExcludeNodes are the nodes shards are neither moved to nor from, by
+	// name, glob or /regular expression/.
+	ExcludeNodes []string `json:"exclude_nodes"`
+
+	// MaintenanceAttribute is the node attribute, "name:value", of the nodes
+	// under maintenance, such as the nodes started with
+	// node.attr.maintenance: true by default. No shards are moved to them,
+	// and none off them either unless DrainMaintenanceNodes is set, which
+	// moves all their shards to the other nodes before balancing. Empty
+	// disables it.
+	MaintenanceAttribute  string `json:"maintenance_attribute"`
+	DrainMaintenanceNodes bool   `json:"drain_maintenance_nodes"`
+
+	// MinShardSize, a byte size such as "50mb", leaves the smaller shard
+	// copies in place as long as a larger copy can be moved instead, since
+	// they barely weigh on the real imbalance. Empty disables it.
+	MinShardSize string `json:"min_shard_size"`
+
+	// Copies larger than MaxShardSize, a byte size such as "100gb", are
+	// never moved by the balancer since relocating them takes hours. They
+	// are listed in the report and the plans for manual handling instead.
+	// Empty disables it. The -max-shard-move-bytes flag sets it too.
+	MaxShardSize string `json:"max_shard_size"`
+
+	// NodeWeights let bigger nodes hold proportionally more shards in count
+	// mode, see NodeWeight. Nodes matching none weigh 1. They can only be
+	// set in the config file.
+	NodeWeights []NodeWeight `json:"node_weights"`
+
+	// ILMAware leaves alone the indices in the middle of an ILM action
+	// moving or rewriting their shards, such as shrink or forcemerge.
+	ILMAware bool `json:"ilm_aware"`
+
+	// DiskWatermarkAware only moves a copy to a node that stays below the
+	// high disk watermark of the cluster once it received the copy.
+	DiskWatermarkAware bool `json:"disk_watermark_aware"`
+
+	// DryRunMoves validates every move with a reroute dry run before
+	// issuing it and skips the ones the allocation deciders would reject.
+	DryRunMoves bool `json:"dry_run_moves"`
+
+	// DuringSnapshots is what to do when a cycle is due while snapshots
+	// are running: "skip" the cycle, "wait" for them to finish for up to
+	// MoveTimeout, or "ignore" them.
+	DuringSnapshots string `json:"during_snapshots"`
+
+	// OnMoveFailure is what a cycle does once one of its moves failed:
+	// "continue" with the remaining moves, "abort" them, or "rollback",
+	// which also moves the executed ones back.
+	OnMoveFailure string `json:"on_move_failure"`
+
+	// RerouteOnly leaves shard allocation enabled during cycles, so that
+	// failed shards keep recovering, and only disables the rebalancing of
+	// Elasticsearch so that it does not undo the explicit moves.
+	RerouteOnly bool `json:"reroute_only"`
+
+	// AllocationEnable is what cycles set cluster.routing.allocation.enable
+	// to while they move shards: "none", or "primaries" or "new_primaries"
+	// to keep allocating primaries, or only the primaries of new indices,
+	// meanwhile. Explicit moves are not affected by it. The value the
+	// setting had before is restored at the end of the cycle. Like any
+	// setting it can differ per entry of Clusters.
+	AllocationEnable string `json:"allocation_enable"`
+
+	// VerifyMoves waits for every move to complete and compares the doc
+	// count and store size of the relocated copy with the source copy.
+	// Store sizes may differ by VerifyStoreTolerance (a fraction, 0.1 is
+	// 10%) since segments merge independently on each copy.
+	VerifyMoves          bool     `json:"verify_moves"`
+	VerifyStoreTolerance float64  `json:"verify_store_tolerance"`
+	MoveTimeout          Duration `json:"move_timeout"`
+
+	// StallTimeout cancels the relocation of a move whose recovery made no
+	// progress for this long, with a reroute cancel command. OnStall then
+	// "retry"s the move once to the least loaded node the planner would
+	// move the copy to, or "flag"s it for the operator in the audit log.
+	// Every move is waited for while it is set. 0 disables it.
+	StallTimeout Duration `json:"stall_timeout"`
+	OnStall      string   `json:"on_stall"`
+
+	// ProgressInterval is how often the progress of the moves of a cycle is
+	// printed while they run. 0 disables it.
+	ProgressInterval Duration `json:"progress_interval"`
+
+	// LatencyTolerance, when above 0, measures the search and indexing
+	// latency for LatencyWindow before executing a plan and again once the
+	// relocations settled, and flags the cycle when either got slower by
+	// more than this fraction (0.5 is 50%). LatencyRollback then moves the
+	// shards back.
+	LatencyTolerance float64  `json:"latency_tolerance"`
+	LatencyWindow    Duration `json:"latency_window"`
+	LatencyRollback  bool     `json:"latency_rollback"`
+
+	// NodeCooldown is the minimum time between two moves involving the same
+	// node, as source or target. 0 disables it.
+	NodeCooldown Duration `json:"node_cooldown"`
+
+	// MaxAllocationDisabled is how long a cycle may keep allocation disabled
+	// before a notification is sent, since recoveries of failed shards wait
+	// meanwhile. 0 disables the alert.
+	MaxAllocationDisabled Duration `json:"max_allocation_disabled"`
+
+	// SettingsScope is where cluster settings are written: transient or
+	// persistent. Empty means persistent on Elasticsearch 8 and later, where
+	// transient settings are deprecated, and transient before.
+	SettingsScope string `json:"settings_scope"`
+
+	// Notifications are sent when a cycle with moves starts and completes,
+	// when a cycle fails, and when allocation stays disabled longer than
+	// MaxAllocationDisabled.
+	Notifications []NotificationTarget `json:"notifications"`
+
+	// ImbalanceAlert, if set, alerts with escalating severity while the
+	// imbalance stays above a maximum. It can only be set in the config
+	// file.
+	ImbalanceAlert *ImbalanceAlert `json:"imbalance_alert"`
+
+	// HealthGuard, if set, stops the moves of a cycle as soon as the
+	// cluster health degrades or too many of them failed, and alerts. It
+	// can only be set in the config file.
+	HealthGuard *HealthGuard `json:"health_guard"`
+
+	// EmailReport, if set, mails a report of the cycles that moved shards
+	// or failed, see EmailReport. It can only be set in the config file.
+	EmailReport *EmailReport `json:"email_report"`
+
+	// Incidents, if set, open PagerDuty or Opsgenie incidents for the
+	// errors needing someone, see Incidents. They can only be set in the
+	// config file.
+	Incidents *Incidents `json:"incidents"`
+
+	// ReportSinks archive the plans and results of the cycles with moves,
+	// see ReportSink. They can only be set in the config file.
+	ReportSinks []ReportSink `json:"report_sinks"`
+
+	// Policies are rules the moves must follow, see Policy. They can only
+	// be set in the config file.
+	Policies []Policy `json:"policies"`
+
+	// AdminListen is the address of the admin HTTP API, e.g. ":9300".
+	// Empty disables it. The entries of Clusters do not inherit it, each
+	// sets its own.
+	AdminListen string `json:"admin_listen"`
+
+	// DebugEndpoints serves the profiles of net/http/pprof under
+	// /debug/pprof/ on the admin API, and a dump of the state of the
+	// balancer at /debug/state, see DebugState. Both need the operator role.
+	DebugEndpoints bool `json:"debug_endpoints"`
+
+	// StatsDAddress is the host:port of a StatsD or DogStatsD agent the
+	// metrics are sent to over UDP, see statsdClient; empty sends none.
+	// StatsDFormat is dogstatsd, tagging them with the cluster and the nodes
+	// of the moves, or statsd, which has no tags and appends their values to
+	// the names.
+	StatsDAddress  string   `json:"statsd_address"`
+	StatsDFormat   string   `json:"statsd_format"`
+	StatsDInterval Duration `json:"statsd_interval"`
+
+	// OTLPEndpoint is the URL of an OTLP/HTTP collector, such as
+	// http://localhost:4318, the cycles are traced to, see tracer. Empty
+	// disables tracing. OTLPHeaders are sent along, such as for
+	// authentication; they can only be set in the config file.
+	OTLPEndpoint string            `json:"otlp_endpoint"`
+	OTLPHeaders  map[string]string `json:"otlp_headers"`
+
+	// RequireApproval makes cycles publish their plan, on the admin API and
+	// to the notification targets, instead of executing it. The plan is
+	// executed by the first cycle after an operator approved it, with the
+	// approve command or POST /api/v1/approve, unless ApprovalTTL passed
+	// first. Pending plans are not kept across restarts.
+	RequireApproval bool     `json:"require_approval"`
+	ApprovalTTL     Duration `json:"approval_ttl"`
+
+	// AdminTokens are the bearer tokens accepted by the admin API, see
+	// AdminToken. Without any, the API needs no token. They can only be set
+	// in the config file.
+	AdminTokens []AdminToken `json:"admin_tokens"`
+
+	// AdminToken is the bearer token the pause, resume and approve commands
+	// send to the admin API.
+	AdminToken string `json:"admin_token"`
+
+	// AuditLog is a file the audit events are appended to as lines of JSON,
+	// with the full bodies of the settings changes and reroutes sent to the
+	// cluster. Once it would grow past AuditLogMaxSize it is rotated to
+	// AuditLog.1, AuditLog.2 and so on, keeping AuditLogMaxFiles of them.
+	// The entries of Clusters inheriting it write to a file suffixed with
+	// their name, such as audit-prod.log.
+	AuditLog         string `json:"audit_log"`
+	AuditLogMaxSize  string `json:"audit_log_max_size"`
+	AuditLogMaxFiles int    `json:"audit_log_max_files"`
+
+	// StateDir is where the balancer keeps what it learns across runs, such
+	// as the observed relocation throughput. Empty disables persistence.
+	StateDir string `json:"state_dir"`
+
+	// HistoryRetention is how long the move history in StateDir is kept.
+	HistoryRetention Duration `json:"history_retention"`
+
+	// The advisor suggests index template settings for indices dominating
+	// the planned moves in at least AdvisorMinCycles of the last
+	// AdvisorWindow cycles. AdvisorMinCycles 0 disables the advisor.
+	AdvisorMinCycles int `json:"advisor_min_cycles"`
+	AdvisorWindow    int `json:"advisor_window"`
+
+	// AssumeYes answers yes to every confirmation prompt.
+	AssumeYes bool `json:"-"`
+
+	// AcknowledgeCrash skips safe mode after an unclean shutdown.
+	AcknowledgeCrash bool `json:"-"`
+
+	// DefaultRecoveryThroughput, in bytes per second, is used to estimate
+	// move durations when no completed recovery has been observed yet.
+	DefaultRecoveryThroughput int64 `json:"default_recovery_throughput"`
+
+	// StageSize splits a plan into stages of that many moves with a
+	// checkpoint in between. 0 runs the whole plan as a single stage.
+	StageSize int `json:"stage_size"`
+
+	// ReplanEvery refreshes the cluster state and plans the remaining moves
+	// again after that many moves. 0 keeps the initial plan.
+	ReplanEvery int `json:"replan_every"`
+
+	// MaintenanceWindows restricts when shards are moved, see
+	// maintenanceWindow for the syntax. Outside of all windows no cycle
+	// starts and a running cycle stops issuing moves. Empty allows moves at
+	// any time. Windows are evaluated in MaintenanceTimezone, an IANA name
+	// such as "Europe/Berlin", or local time if empty.
+	MaintenanceWindows  []string `json:"maintenance_windows"`
+	MaintenanceTimezone string   `json:"maintenance_timezone"`
+
+	// LeaderElection lets several instances run against the same cluster
+	// with only one of them rebalancing: "kubernetes" uses the Lease
+	// LeaseName in LeaseNamespace (the namespace of the pod if empty).
+	// Empty disables leader election. LeaderIdentity tells the instances
+	// apart and defaults to the host name, which is the pod name.
+	LeaderElection string   `json:"leader_election"`
+	LeaseName      string   `json:"lease_name"`
+	LeaseNamespace string   `json:"lease_namespace"`
+	LeaseDuration  Duration `json:"lease_duration"`
+	LeaderIdentity string   `json:"leader_identity"`
+
+	// Clusters lets a single process balance several clusters. Every entry
+	// has a name and overrides any of the settings above for that cluster,
+	// see clusterSection. Cluster selects one of them, which is how the
+	// process balancing each cluster is started.
+	Clusters []json.RawMessage `json:"clusters"`
+	Cluster  string            `json:"-"`
+
+	// ClusterLock requires holding a lock document in the .rebalancer-lock
+	// index to change the cluster, so that two instances or operators never
+	// do at the same time. It expires LeaseDuration after its last renewal.
+	ClusterLock bool `json:"cluster_lock"`
+}
+
+var cfg = defaultConfig()
+
+func defaultConfig() *Config {
+	hostname, _ := os.Hostname()
+	return &Config{
+		ESHost:               "http://localhost:9200",
+		RebalanceThreshold:   10,
+		SleepInterval:        Duration{60 * time.Second},
+		SniffInterval:        Duration{5 * time.Minute},
+		ESTimeout:            Duration{5 * time.Minute},
+		ESMaxIdleConns:       10,
+		ESIdleConnTimeout:    Duration{90 * time.Second},
+		ESSigV4Service:       "es",
+		ElasticCloudAPI:      "https://api.elastic-cloud.com",
+		MinInterval:          Duration{10 * time.Second},
+		MaxInterval:          Duration{30 * time.Minute},
+		Output:               outputText,
+		BalanceMode:          balanceModeCount,
+		MaintenanceAttribute: "maintenance:true",
+		PrimaryThreshold:     2,
+		MaxClusterRecoveries: 20,
+		DryRunMoves:          true,
+		ILMAware:             true,
+		DiskWatermarkAware:   true,
+		DuringSnapshots:      snapshotsSkip,
+		OnMoveFailure:        onMoveFailureContinue,
+		AllocationEnable:     allocationEnableNone,
+		VerifyStoreTolerance: 0.1,
+		MoveTimeout:          Duration{time.Hour},
+		OnStall:              onStallFlag,
+		BreakerFailures:      5,
+		BreakerCooldown:      Duration{10 * time.Minute},
+		ProgressInterval:     Duration{30 * time.Second},
+		StatsDFormat:         statsdFormatDogStatsD,
+		StatsDInterval:       Duration{10 * time.Second},
+		ApprovalTTL:          Duration{time.Hour},
+
+		// Elasticsearch's default indices.recovery.max_bytes_per_sec.
+		DefaultRecoveryThroughput: 40 << 20,
+
+		HistoryRetention: Duration{30 * 24 * time.Hour},
+		AuditLogMaxSize:  "100mb",
+		AuditLogMaxFiles: 5,
+
+		AdvisorMinCycles: 3,
+		AdvisorWindow:    10,
+
+		LeaseName:      "elasticsearch-rebalance-shard",
+		LeaseDuration:  Duration{15 * time.Second},
+		LeaderIdentity: hostname,
+		ClusterLock:    true,
+	}
+}
+
+func (c *Config) bindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.ESHost, "es-host", c.ESHost, "Elasticsearch URL")
+	fs.StringVar(&c.ESCloudID, "es-cloud-id", c.ESCloudID, "Cloud ID of the Elastic Cloud deployment to use instead of -es-host")
+	fs.StringVar(&c.ElasticCloudDeployment, "elastic-cloud-deployment", c.ElasticCloudDeployment, "ID of the Elastic Cloud deployment to use instead of -es-host, looked up with -elastic-cloud-api-key")
+	fs.StringVar(&c.ElasticCloudAPIKey, "elastic-cloud-api-key", c.ElasticCloudAPIKey, "Elastic Cloud API key to look -elastic-cloud-deployment up with")
+	fs.StringVar(&c.ElasticCloudAPI, "elastic-cloud-api", c.ElasticCloudAPI, "URL of the Elastic Cloud API")
+	fs.Var((*stringList)(&c.ESHosts), "es-hosts", "comma-separated further Elasticsearch URLs to fail over to")
+	fs.BoolVar(&c.Sniff, "sniff", c.Sniff, "also fail over to the HTTP addresses of all nodes of the cluster")
+	fs.DurationVar(&c.SniffInterval.Duration, "sniff-interval", c.SniffInterval.Duration, "how often to refresh the node addresses when sniffing")
+	fs.DurationVar(&c.ESTimeout.Duration, "es-timeout", c.ESTimeout.Duration, "how long a request to Elasticsearch may take, reading the response included (0 disables it)")
+	fs.IntVar(&c.ESMaxIdleConns, "es-max-idle-conns", c.ESMaxIdleConns, "idle connections to keep open to every Elasticsearch endpoint (0 disables keep-alives)")
+	fs.StringVar(&c.Proxy, "proxy", c.Proxy, "http, https or socks5 proxy URL to reach Elasticsearch through, instead of HTTP_PROXY and HTTPS_PROXY")
+	fs.StringVar(&c.ESUsername, "es-username", c.ESUsername, "user to authenticate to Elasticsearch as, with -es-password")
+	fs.StringVar(&c.ESPassword, "es-password", c.ESPassword, "password of -es-username")
+	fs.StringVar(&c.ESAPIKey, "es-api-key", c.ESAPIKey, "Elasticsearch API key, base64 of id:api_key, instead of a user")
+	fs.StringVar(&c.ESSigV4Region, "es-sigv4-region", c.ESSigV4Region, "sign the requests with AWS SigV4 for this region, for Amazon OpenSearch Service")
+	fs.StringVar(&c.ESSigV4Service, "es-sigv4-service", c.ESSigV4Service, "AWS service the requests are signed for, es, or aoss for OpenSearch Serverless")
+	fs.BoolVar(&c.Simulate, "simulate", c.Simulate, "run against a generated in-memory cluster instead of Elasticsearch")
+	fs.DurationVar(&c.ESIdleConnTimeout.Duration, "es-idle-conn-timeout", c.ESIdleConnTimeout.Duration, "how long idle connections to Elasticsearch are kept open")
+	fs.StringVar(&c.Cluster, "cluster", c.Cluster, "name of the cluster of the config file to use, when it defines several")
+	fs.StringVar(&c.ClusterAlias, "cluster-alias", c.ClusterAlias, "human-friendly cluster name shown in all output and notifications")
+	fs.StringVar(&c.Output, "output", c.Output, "output format: text, or json for newline-delimited JSON documents on stdout")
+	fs.IntVar(&c.RebalanceThreshold, "rebalance-threshold", c.RebalanceThreshold, "maximum allowed difference in shard count between nodes")
+	fs.IntVar(&c.RebalanceStopThreshold, "rebalance-stop-threshold", c.RebalanceStopThreshold, "once rebalancing, keep going until the difference is down to this (0 disables it)")
+	fs.IntVar(&c.MaxShardsPerNode, "max-shards-per-node", c.MaxShardsPerNode, "move shards off the nodes holding more than this many shards, in count mode (0 disables)")
+	fs.Float64Var(&c.MinMoveImprovement, "min-move-improvement", c.MinMoveImprovement, "end the plan at the first move improving the stddev of the shard counts by less than this (0 disables it)")
+	fs.IntVar(&c.BreakerFailures, "breaker-failures", c.BreakerFailures, "consecutive failed requests to Elasticsearch that stop the cycle and open the circuit breaker (0 disables it)")
+	fs.DurationVar(&c.BreakerCooldown.Duration, "breaker-cooldown", c.BreakerCooldown.Duration, "how long the open circuit breaker keeps cycles from starting")
+	fs.DurationVar(&c.CycleCooldown.Duration, "cycle-cooldown", c.CycleCooldown.Duration, "no cycle starts for this long after one that moved shards (0 disables it)")
+	fs.DurationVar(&c.SleepInterval.Duration, "interval", c.SleepInterval.Duration, "time to wait between rebalance cycles")
+	fs.StringVar(&c.Schedule, "schedule", c.Schedule, "cron expression starting the cycles, e.g. \"0 2 * * *\", instead of -interval")
+	fs.BoolVar(&c.AdaptiveInterval, "adaptive-interval", c.AdaptiveInterval, "run more often while badly imbalanced and back off while balanced")
+	fs.DurationVar(&c.MinInterval.Duration, "min-interval", c.MinInterval.Duration, "shortest interval with -adaptive-interval")
+	fs.DurationVar(&c.MaxInterval.Duration, "max-interval", c.MaxInterval.Duration, "longest interval with -adaptive-interval")
+	fs.StringVar(&c.BalanceMode, "balance-mode", c.BalanceMode, "what to balance: count (total shards per node), index (shards of each index per node) or heat (busiest shards)")
+	fs.Float64Var(&c.HeatTolerance, "heat-tolerance", c.HeatTolerance, "in heat mode, how much hotter than the mean a node may be, as a fraction (default 0.2)")
+	fs.IntVar(&c.SampleIndices, "sample-indices", c.SampleIndices, "estimate the imbalance from this many random indices before observing the whole cluster (0 disables it)")
+	fs.Float64Var(&c.SmoothingAlpha, "smoothing-alpha", c.SmoothingAlpha, "weight of the latest shard counts in their moving average, between 0 and 1 (0 disables smoothing)")
+	fs.BoolVar(&c.RemediateUnassigned, "remediate-unassigned", c.RemediateUnassigned, "retry failed allocations and allocate held back replicas")
+	fs.BoolVar(&c.BalancePrimaries, "balance-primaries", c.BalancePrimaries, "also balance the number of primaries per node")
+	fs.IntVar(&c.PrimaryThreshold, "primary-threshold", c.PrimaryThreshold, "maximum allowed difference in primary count between nodes")
+	fs.IntVar(&c.MaxClusterRecoveries, "max-cluster-recoveries", c.MaxClusterRecoveries, "do not start relocations while the cluster has this many active recoveries (0 disables)")
+	fs.IntVar(&c.MaxConcurrentRelocations, "max-concurrent-relocations", c.MaxConcurrentRelocations, "run up to this many of the cycle's relocations at once (0 runs them one after the other)")
+	fs.IntVar(&c.MaxNodeCPU, "max-node-cpu", c.MaxNodeCPU, "hold off moves while a node uses this much CPU, in percent (0 disables)")
+	fs.IntVar(&c.MaxNodeHeap, "max-node-heap", c.MaxNodeHeap, "hold off moves while a node uses this much heap, in percent (0 disables)")
+	fs.IntVar(&c.MaxNodeDiskIO, "max-node-disk-io", c.MaxNodeDiskIO, "hold off moves while a node has this disk IO utilization, in percent (0 disables)")
+	fs.IntVar(&c.MaxPendingTasks, "max-pending-tasks", c.MaxPendingTasks, "hold off moves while this many cluster tasks are pending (0 disables)")
+	fs.StringVar(&c.BoostMaxBytesPerSec, "boost-max-bytes-per-sec", c.BoostMaxBytesPerSec, "raise indices.recovery.max_bytes_per_sec to this during cycles, e.g. 250mb")
+	fs.IntVar(&c.BoostNodeConcurrentRecoveries, "boost-node-concurrent-recoveries", c.BoostNodeConcurrentRecoveries, "raise node_concurrent_recoveries to this during cycles (0 leaves it alone)")
+	fs.Var((*stringList)(&c.IncludeIndices), "include-indices", "comma-separated glob patterns of indices that may be relocated")
+	fs.Var((*stringList)(&c.ExcludeIndices), "exclude-indices", "comma-separated glob patterns of indices that are never relocated")
+	fs.Var((*stringList)(&c.ExcludeNodes), "exclude-nodes", "comma-separated names, globs or /regular expressions/ of nodes shards are neither moved to nor from")
+	fs.StringVar(&c.MaintenanceAttribute, "maintenance-attribute", c.MaintenanceAttribute, "node attribute, name:value, of the nodes under maintenance, which receive no shards (empty disables it)")
+	fs.BoolVar(&c.DrainMaintenanceNodes, "drain-maintenance-nodes", c.DrainMaintenanceNodes, "move all shards off the nodes under maintenance before balancing")
+	fs.StringVar(&c.MinShardSize, "min-shard-size", c.MinShardSize, "only move shards smaller than this, e.g. 50mb, when no larger one can be moved")
+	fs.StringVar(&c.MaxShardSize, "max-shard-size", c.MaxShardSize, "never move shards larger than this, e.g. 100gb, and list them for manual handling")
+	fs.StringVar(&c.MaxShardSize, "max-shard-move-bytes", c.MaxShardSize, "same as -max-shard-size, in bytes or with a unit")
+	fs.BoolVar(&c.DryRunMoves, "dry-run-moves", c.DryRunMoves, "validate every move with a reroute dry run before issuing it")
+	fs.BoolVar(&c.ILMAware, "ilm-aware", c.ILMAware, "leave alone the indices undergoing ILM actions such as shrink or forcemerge")
+	fs.BoolVar(&c.DiskWatermarkAware, "disk-watermark-aware", c.DiskWatermarkAware, "only move shards to nodes staying below the high disk watermark")
+	fs.StringVar(&c.DuringSnapshots, "during-snapshots", c.DuringSnapshots, "what to do while snapshots are running: skip the cycle, wait for them, or ignore them")
+	fs.StringVar(&c.OnMoveFailure, "on-move-failure", c.OnMoveFailure, "what to do once a move of the cycle failed: continue, abort the remaining moves, or rollback the executed ones too")
+	fs.BoolVar(&c.RerouteOnly, "reroute-only", c.RerouteOnly, "keep shard allocation enabled during cycles and only disable rebalancing")
+	fs.StringVar(&c.AllocationEnable, "allocation-enable", c.AllocationEnable, "what cycles scope shard allocation to while they move shards: none, primaries or new_primaries")
+	fs.BoolVar(&c.VerifyMoves, "verify-moves", c.VerifyMoves, "wait for each move and compare doc count and store size of the relocated copy")
+	fs.Float64Var(&c.VerifyStoreTolerance, "verify-store-tolerance", c.VerifyStoreTolerance, "allowed relative store size difference when verifying moves")
+	fs.Var(notificationFlag{c, notifierSlack}, "slack-webhook", "Slack incoming webhook URL to notify about cycles (repeatable)")
+	fs.Var(notificationFlag{c, notifierTeams}, "teams-webhook", "Microsoft Teams incoming webhook URL to notify about cycles (repeatable)")
+	fs.Var(notificationFlag{c, notifierDiscord}, "discord-webhook", "Discord webhook URL to notify about cycles (repeatable)")
+	fs.Var(notificationFlag{c, notifierWebhook}, "webhook", "URL to post cycle events to as JSON (repeatable)")
+	fs.StringVar(&c.AdminListen, "admin-listen", c.AdminListen, "address of the admin HTTP API, e.g. :9300 (empty disables it)")
+	fs.BoolVar(&c.DebugEndpoints, "debug-endpoints", c.DebugEndpoints, "serve pprof profiles and a dump of the balancer state on the admin API")
+	fs.StringVar(&c.StatsDAddress, "statsd-address", c.StatsDAddress, "host:port of a StatsD or DogStatsD agent to send the metrics to over UDP (empty disables it)")
+	fs.StringVar(&c.StatsDFormat, "statsd-format", c.StatsDFormat, "dogstatsd, with tags, or statsd, with the tag values in the metric names")
+	fs.DurationVar(&c.StatsDInterval.Duration, "statsd-interval", c.StatsDInterval.Duration, "how often to send the gauges to StatsD")
+	fs.StringVar(&c.OTLPEndpoint, "otlp-endpoint", c.OTLPEndpoint, "URL of the OTLP/HTTP collector to export traces of the cycles and moves to (empty disables tracing)")
+	fs.BoolVar(&c.RequireApproval, "require-approval", c.RequireApproval, "publish the plans of cycles and only execute them once approved")
+	fs.DurationVar(&c.ApprovalTTL.Duration, "approval-ttl", c.ApprovalTTL.Duration, "how long a published plan can be approved")
+	fs.StringVar(&c.AdminToken, "admin-token", c.AdminToken, "bearer token the pause, resume and approve commands send to the admin API")
+	fs.StringVar(&c.AuditLog, "audit-log", c.AuditLog, "file to append the audit events to as NDJSON, with the bodies of settings changes and reroutes")
+	fs.StringVar(&c.AuditLogMaxSize, "audit-log-max-size", c.AuditLogMaxSize, "size at which the audit log is rotated, e.g. 100mb")
+	fs.IntVar(&c.AuditLogMaxFiles, "audit-log-max-files", c.AuditLogMaxFiles, "number of rotated audit logs to keep")
+	fs.StringVar(&c.StateDir, "state-dir", c.StateDir, "directory for state kept across runs (empty disables persistence)")
+	fs.DurationVar(&c.HistoryRetention.Duration, "history-retention", c.HistoryRetention.Duration, "how long to keep the move history (0 keeps it forever)")
+	fs.IntVar(&c.AdvisorMinCycles, "advisor-min-cycles", c.AdvisorMinCycles, "suggest index settings for indices dominating this many recent cycles (0 disables)")
+	fs.IntVar(&c.AdvisorWindow, "advisor-window", c.AdvisorWindow, "number of recent cycles the advisor looks at")
+	fs.BoolVar(&c.AssumeYes, "yes", c.AssumeYes, "do not ask for confirmation")
+	fs.BoolVar(&c.AcknowledgeCrash, "acknowledge-crash", c.AcknowledgeCrash, "resume moving shards right away after an unclean shutdown instead of starting in safe mode")
+	fs.Int64Var(&c.DefaultRecoveryThroughput, "default-recovery-throughput", c.DefaultRecoveryThroughput, "bytes per second assumed for ETAs until recoveries have been observed")
+	fs.IntVar(&c.StageSize, "stage-size", c.StageSize, "number of moves per stage, with a checkpoint between stages (0 for a single stage)")
+	fs.IntVar(&c.ReplanEvery, "replan-every", c.ReplanEvery, "re-plan the remaining moves after this many moves (0 disables)")
+	fs.Var(windowFlag{c}, "maintenance-window", "time range (22:00-06:00) or cron expression during which shards may be moved (repeatable)")
+	fs.StringVar(&c.MaintenanceTimezone, "maintenance-timezone", c.MaintenanceTimezone, "time zone of the maintenance windows (default local time)")
+	fs.StringVar(&c.LeaderElection, "leader-election", c.LeaderElection, "elect a single active instance: kubernetes (empty disables it)")
+	fs.StringVar(&c.LeaseName, "lease-name", c.LeaseName, "name of the Kubernetes Lease used for leader election")
+	fs.StringVar(&c.LeaseNamespace, "lease-namespace", c.LeaseNamespace, "namespace of the Lease (default the namespace of the pod)")
+	fs.DurationVar(&c.LeaseDuration.Duration, "lease-duration", c.LeaseDuration.Duration, "how long the leadership and the cluster lock last without being renewed")
+	fs.BoolVar(&c.ClusterLock, "cluster-lock", c.ClusterLock, "hold a lock document in the .rebalancer-lock index while changing the cluster")
+	fs.StringVar(&c.LeaderIdentity, "leader-identity", c.LeaderIdentity, "identity of this instance in leader election (default the host name)")
+	fs.DurationVar(&c.MoveTimeout.Duration, "move-timeout", c.MoveTimeout.Duration, "how long to wait for a move to complete")
+	fs.DurationVar(&c.StallTimeout.Duration, "stall-timeout", c.StallTimeout.Duration, "cancel relocations that made no progress for this long (0 disables it)")
+	fs.StringVar(&c.OnStall, "on-stall", c.OnStall, "what to do with a cancelled stalled relocation: retry it to another node once, or flag it for the operator")
+	fs.DurationVar(&c.ProgressInterval.Duration, "progress-interval", c.ProgressInterval.Duration, "how often to print the progress of the moves while they run (0 disables it)")
+	fs.Float64Var(&c.LatencyTolerance, "latency-tolerance", c.LatencyTolerance, "flag cycles after which search or indexing latency grew by more than this fraction (0 disables the check)")
+	fs.DurationVar(&c.LatencyWindow.Duration, "latency-window", c.LatencyWindow.Duration, "how long latency is measured before and after a cycle (default 1m)")
+	fs.BoolVar(&c.LatencyRollback, "latency-rollback", c.LatencyRollback, "move the shards back when latency regressed")
+	fs.DurationVar(&c.NodeCooldown.Duration, "node-cooldown", c.NodeCooldown.Duration, "minimum time between two moves involving the same node (0 disables it)")
+	fs.DurationVar(&c.MaxAllocationDisabled.Duration, "max-allocation-disabled", c.MaxAllocationDisabled.Duration, "notify when a cycle keeps allocation disabled longer than this (0 disables it)")
+	fs.StringVar(&c.SettingsScope, "settings-scope", c.SettingsScope, "scope of the cluster settings written: transient or persistent (default persistent on 8.x)")
+}
+
+// loadConfig builds the configuration from defaults, the optional config
+// file and the command-line flags, in increasing order of precedence. It
+// also returns the arguments left after the flags. extraFlags registers
+// the flags of the subcommand, if any.
+func loadConfig(args []string, extraFlags func(fs *flag.FlagSet)) (*Config, []string, error) {
+	c := defaultConfig()
+	var configFile string
+	fs := flag.NewFlagSet("elasticsearch-rebalance-shard", flag.ContinueOnError)
+	fs.StringVar(&configFile, "config", "", "path to a JSON config file")
+	c.bindFlags(fs)
+	if extraFlags != nil {
+		extraFlags(fs)
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	if c.Cluster != "" && configFile == "" {
+		return nil, nil, fmt.Errorf("-cluster needs a config file defining clusters")
+	}
+	if configFile != "" {
+		if err := c.readFile(configFile); err != nil {
+			return nil, nil, err
+		}
+		if c.Cluster != "" {
+			if err := c.useCluster(c.Cluster); err != nil {
+				return nil, nil, err
+			}
+		}
+		// Parse again so flags win over the file.
+		if err := fs.Parse(args); err != nil {
+			return nil, nil, err
+		}
+	}
+	if c.Cluster == "" && len(c.Clusters) > 1 {
+		// The flags are passed on to the process of every cluster.
+		var shared error
+		fs.Visit(func(f *flag.Flag) {
+			if f.Name == "admin-listen" || f.Name == "audit-log" {
+				shared = fmt.Errorf("-%s would be shared by every cluster, set it per cluster in the config file", f.Name)
+			}
+		})
+		if shared != nil {
+			return nil, nil, shared
+		}
+	}
+
+	if err := c.validate(); err != nil {
+		return nil, nil, err
+	}
+	return c, fs.Args(), nil
+}
+
+func (c *Config) readFile(name string) error {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return fmt.Errorf("parsing %s: %w", name, err)
+	}
+	return nil
+}
+
+func (c *Config) validate() error {
+	if _, err := c.clusterNames(); err != nil {
+		return err
+	}
+	if err := c.checkClusterOutputs(); err != nil {
+		return err
+	}
+	if c.ESTimeout.Duration < 0 || c.ESMaxIdleConns < 0 || c.ESIdleConnTimeout.Duration < 0 {
+		return fmt.Errorf("es_timeout, es_max_idle_conns and es_idle_conn_timeout cannot be negative")
+	}
+	if c.Proxy != "" {
+		u, err := url.Parse(c.Proxy)
+		if err != nil {
+			return fmt.Errorf("invalid proxy: %w", err)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return fmt.Errorf("invalid proxy %q, want an http, https or socks5 URL", c.Proxy)
+		}
+	}
+	if c.ESCloudID != "" {
+		if c.ElasticCloudDeployment != "" {
+			return fmt.Errorf("es_cloud_id and elastic_cloud_deployment cannot both be set")
+		}
+		if _, err := parseCloudID(c.ESCloudID); err != nil {
+			return err
+		}
+	}
+	if c.ElasticCloudDeployment != "" && c.ElasticCloudAPIKey == "" {
+		return fmt.Errorf("elastic_cloud_deployment needs elastic_cloud_api_key")
+	}
+	if c.ESAPIKey != "" && c.ESUsername != "" {
+		return fmt.Errorf("es_api_key and es_username cannot both be set")
+	}
+	if c.ESSigV4Region != "" && (c.ESUsername != "" || c.ESAPIKey != "" || c.ESCredentials != nil) {
+		return fmt.Errorf("es_sigv4_region cannot be combined with other Elasticsearch credentials")
+	}
+	if c.ESCredentials != nil {
+		if err := c.ESCredentials.validate(); err != nil {
+			return err
+		}
+	}
+	if c.BreakerFailures < 0 || (c.BreakerFailures > 0 && c.BreakerCooldown.Duration <= 0) {
+		return fmt.Errorf("breaker_failures cannot be negative, and breaker_cooldown must be positive")
+	}
+	if c.MinMoveImprovement < 0 {
+		return fmt.Errorf("min_move_improvement cannot be negative")
+	}
+	if c.RebalanceStopThreshold < 0 || c.RebalanceStopThreshold > c.RebalanceThreshold {
+		return fmt.Errorf("rebalance_stop_threshold must be between 0 and rebalance_threshold")
+	}
+	if c.LatencyTolerance < 0 || c.LatencyWindow.Duration < 0 {
+		return fmt.Errorf("latency_tolerance and latency_window cannot be negative")
+	}
+	if c.MaxShardsPerNode < 0 {
+		return fmt.Errorf("max_shards_per_node cannot be negative")
+	}
+	if c.MaxConcurrentRelocations < 0 {
+		return fmt.Errorf("max_concurrent_relocations cannot be negative")
+	}
+	if c.ProgressInterval.Duration < 0 {
+		return fmt.Errorf("progress_interval cannot be negative")
+	}
+	if c.DebugEndpoints && c.AdminListen == "" {
+		return fmt.Errorf("debug_endpoints needs admin_listen")
+	}
+	if c.StatsDAddress != "" {
+		if _, _, err := net.SplitHostPort(c.StatsDAddress); err != nil {
+			return fmt.Errorf("statsd_address must be host:port: %w", err)
+		}
+		if c.StatsDFormat != statsdFormatDogStatsD && c.StatsDFormat != statsdFormatStatsD {
+			return fmt.Errorf("statsd_format must be %s or %s", statsdFormatDogStatsD, statsdFormatStatsD)
+		}
+		if c.StatsDInterval.Duration <= 0 {
+			return fmt.Errorf("statsd_interval must be positive")
+		}
+	}
+	if c.OTLPEndpoint != "" {
+		if u, err := url.Parse(c.OTLPEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("otlp_endpoint must be an http or https URL")
+		}
+	}
+	if c.RequireApproval && c.AdminListen == "" {
+		return fmt.Errorf("require_approval needs admin_listen, plans are approved through the admin API")
+	}
+	if c.RequireApproval && c.ApprovalTTL.Duration <= 0 {
+		return fmt.Errorf("approval_ttl must be positive")
+	}
+	if c.MaintenanceAttribute != "" && !strings.Contains(c.MaintenanceAttribute, ":") {
+		return fmt.Errorf("invalid maintenance_attribute %q, want name:value", c.MaintenanceAttribute)
+	}
+	switch c.AllocationEnable {
+	case allocationEnableNone, allocationEnablePrimaries, allocationEnableNewPrimaries:
+	default:
+		return fmt.Errorf("invalid allocation_enable %q, want %s, %s or %s", c.AllocationEnable, allocationEnableNone, allocationEnablePrimaries, allocationEnableNewPrimaries)
+	}
+	switch c.Output {
+	case outputText, outputJSON:
+	default:
+		return fmt.Errorf("invalid output %q, want %s or %s", c.Output, outputText, outputJSON)
+	}
+	switch c.BalanceMode {
+	case balanceModeCount, balanceModeIndex, balanceModeHeat:
+	default:
+		return fmt.Errorf("invalid balance mode %q", c.BalanceMode)
+	}
+	if c.StallTimeout.Duration < 0 {
+		return fmt.Errorf("stall_timeout cannot be negative")
+	}
+	if c.OnStall != onStallRetry && c.OnStall != onStallFlag {
+		return fmt.Errorf("invalid on_stall %q, want %s or %s", c.OnStall, onStallRetry, onStallFlag)
+	}
+	if c.HeatTolerance < 0 {
+		return fmt.Errorf("heat_tolerance cannot be negative")
+	}
+	for _, max := range []int{c.MaxNodeCPU, c.MaxNodeHeap, c.MaxNodeDiskIO} {
+		if max < 0 || max > 100 {
+			return fmt.Errorf("max_node_cpu, max_node_heap and max_node_disk_io must be between 0 and 100")
+		}
+	}
+	if c.BoostMaxBytesPerSec != "" {
+		n, err := parseByteSize(c.BoostMaxBytesPerSec)
+		if err != nil {
+			return err
+		}
+		if n > maxBoostBytesPerSec {
+			return fmt.Errorf("boost_max_bytes_per_sec may be at most %s", formatBytes(maxBoostBytesPerSec))
+		}
+	}
+	var minShard int64
+	if c.MinShardSize != "" {
+		n, err := parseByteSize(c.MinShardSize)
+		if err != nil {
+			return err
+		}
+		minShard = n
+	}
+	if c.MaxShardSize != "" {
+		n, err := parseByteSize(c.MaxShardSize)
+		if err != nil {
+			return err
+		}
+		if n <= minShard {
+			return fmt.Errorf("max_shard_size must be larger than min_shard_size")
+		}
+	}
+	if c.AuditLog != "" {
+		n, err := parseByteSize(c.AuditLogMaxSize)
+		if err != nil {
+			return err
+		}
+		if n <= 0 {
+			return fmt.Errorf("audit_log_max_size must be positive")
+		}
+	}
+	if c.AuditLogMaxFiles < 0 {
+		return fmt.Errorf("audit_log_max_files cannot be negative")
+	}
+	if c.BoostNodeConcurrentRecoveries < 0 || c.BoostNodeConcurrentRecoveries > maxBoostConcurrentRecoveries {
+		return fmt.Errorf("boost_node_concurrent_recoveries must be between 0 and %d", maxBoostConcurrentRecoveries)
+	}
+	if c.SampleIndices < 0 || (c.SampleIndices > 0 && c.BalanceMode != balanceModeCount) {
+		return fmt.Errorf("sample_indices must be positive and only works in count mode")
+	}
+	if c.SmoothingAlpha < 0 || c.SmoothingAlpha > 1 {
+		return fmt.Errorf("smoothing_alpha must be between 0 and 1")
+	}
+	if c.AdvisorMinCycles > c.AdvisorWindow {
+		return fmt.Errorf("advisor_min_cycles cannot exceed advisor_window")
+	}
+	if c.Schedule != "" {
+		if c.AdaptiveInterval {
+			return fmt.Errorf("schedule and adaptive_interval cannot be combined")
+		}
+		expr, err := parseCron(c.Schedule)
+		if err != nil {
+			return fmt.Errorf("invalid schedule: %w", err)
+		}
+		if expr.next(time.Now()).IsZero() {
+			return fmt.Errorf("schedule %q never matches", c.Schedule)
+		}
+	}
+	if c.MinInterval.Duration > c.MaxInterval.Duration {
+		return fmt.Errorf("min_interval cannot exceed max_interval")
+	}
+	switch c.DuringSnapshots {
+	case snapshotsSkip, snapshotsWait, snapshotsIgnore:
+	default:
+		return fmt.Errorf("invalid during_snapshots %q", c.DuringSnapshots)
+	}
+	switch c.OnMoveFailure {
+	case onMoveFailureContinue, onMoveFailureAbort, onMoveFailureRollback:
+	default:
+		return fmt.Errorf("invalid on_move_failure %q", c.OnMoveFailure)
+	}
+	switch c.SettingsScope {
+	case "", scopeTransient, scopePersistent:
+	default:
+		return fmt.Errorf("invalid settings scope %q", c.SettingsScope)
+	}
+	switch c.LeaderElection {
+	case "", leaderElectionKubernetes:
+	default:
+		return fmt.Errorf("invalid leader election %q", c.LeaderElection)
+	}
+	if (c.LeaderElection != "" || c.ClusterLock) && (c.LeaderIdentity == "" || c.LeaseDuration.Duration < 3*time.Second) {
+		return fmt.Errorf("leader election and the cluster lock need a leader_identity and a lease_duration of at least 3s")
+	}
+	if c.StageSize > 0 && c.ReplanEvery > 0 {
+		return fmt.Errorf("stage_size and replan_every cannot be combined")
+	}
+	for _, target := range c.Notifications {
+		if err := target.validate(); err != nil {
+			return err
+		}
+	}
+	for _, sink := range c.ReportSinks {
+		if err := sink.validate(); err != nil {
+			return err
+		}
+	}
+	for _, p := range c.Policies {
+		if err := p.validate(); err != nil {
+			return err
+		}
+		if (p.MaxPerSource > 0 || p.MaxPerTarget > 0) && c.MaxConcurrentRelocations == 0 {
+			return fmt.Errorf("policy %s: concurrency limits need max_concurrent_relocations", p.Name)
+		}
+	}
+	for _, w := range c.NodeWeights {
+		if err := w.validate(); err != nil {
+			return err
+		}
+	}
+	for _, t := range c.AdminTokens {
+		if err := t.validate(); err != nil {
+			return err
+		}
+	}
+	if c.EmailReport != nil {
+		if err := c.EmailReport.validate(); err != nil {
+			return err
+		}
+	}
+	if c.Incidents != nil {
+		if err := c.Incidents.validate(); err != nil {
+			return err
+		}
+	}
+	if c.HealthGuard != nil {
+		if err := c.HealthGuard.validate(); err != nil {
+			return err
+		}
+	}
+	if c.ImbalanceAlert != nil {
+		if err := c.ImbalanceAlert.validate(); err != nil {
+			return err
+		}
+	}
+	for _, pattern := range append(append([]string{}, c.IncludeIndices...), c.ExcludeIndices...) {
+		resolved, err := resolveDateMath(pattern, time.Now())
+		if err != nil {
+			return err
+		}
+		if _, err := path.Match(resolved, ""); err != nil {
+			return fmt.Errorf("invalid index pattern %q: %w", pattern, err)
+		}
+	}
+	for _, pattern := range c.ExcludeNodes {
+		if err := nodePatternError(pattern); err != nil {
+			return err
+		}
+	}
+	for _, w := range c.MaintenanceWindows {
+		if _, err := parseMaintenanceWindow(w); err != nil {
+			return fmt.Errorf("invalid maintenance window: %w", err)
+		}
+	}
+	if _, err := time.LoadLocation(c.MaintenanceTimezone); err != nil {
+		return fmt.Errorf("invalid maintenance timezone: %w", err)
+	}
+	return nil
+}
+
+// Duration is a time.Duration written as a string ("90s", "5m") in the
+// config file.
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+// stringList is a flag holding a comma-separated list of values. Setting it
+// replaces the previous value rather than appending to it.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// notificationFlag adds a notification target of a given type for every
+// occurrence of the flag. Flags are parsed again after reading the config
+// file, so targets already present are not added twice.
+type notificationFlag struct {
+	c    *Config
+	kind string
+}
+
+func (f notificationFlag) String() string {
+	return ""
+}
+
+func (f notificationFlag) Set(url string) error {
+	target := NotificationTarget{Type: f.kind, URL: url}
+	for _, t := range f.c.Notifications {
+		if t.Type == target.Type && t.URL == target.URL && len(t.Events) == 0 {
+			return nil
+		}
+	}
+	f.c.Notifications = append(f.c.Notifications, target)
+	return nil
+}
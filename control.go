@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// controller holds the runtime state shared between the rebalance loop and
+// the admin API.
+type controller struct {
+	mu        sync.Mutex
+	leader    bool
+	paused    bool
+	safeMode  string // why, empty when not in safe mode
+	running   bool
+	inFlight  []Move
+	lastCycle *CycleEvent
+	trigger   chan struct{}
+	// triggeredBy is the audit source of the pending trigger.
+	triggeredBy string
+
+	// The imbalance and number of planned moves of the last cycle, for the
+	// adaptive interval.
+	hasPlan       bool
+	lastImbalance int
+	lastMoves     int
+
+	// balancing is set while cycles keep moving shards until the spread is
+	// down to the stop threshold, see balanceThreshold.
+	balancing bool
+	// movedAt is when the last cycle that moved shards ended, for the
+	// cycle cooldown.
+	movedAt time.Time
+	// beatDue is when the loop is expected to show it is alive next, see
+	// beat.
+	beatDue time.Time
+}
+
+// Without leader election every instance is the leader.
+var ctl = &controller{leader: true, trigger: make(chan struct{}, 1)}
+
+// wait sleeps until the next cycle is due or a rebalance is triggered, and
+// sets the audit source of the cycle accordingly. It returns false if ctx
+// is done first.
+func (c *controller) wait(ctx context.Context, d time.Duration) bool {
+	c.beat(d)
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		setAuditSource(sourceScheduler)
+	case <-c.trigger:
+		c.mu.Lock()
+		setAuditSource(c.triggeredBy)
+		c.mu.Unlock()
+	case <-ctx.Done():
+		return false
+	}
+	return true
+}
+
+// triggerNow asks for a cycle to start right away, on behalf of source for
+// the audit log. Triggers arriving while one is already pending are merged,
+// the last source winning.
+func (c *controller) triggerNow(source string) {
+	c.mu.Lock()
+	c.triggeredBy = source
+	c.mu.Unlock()
+	select {
+	case c.trigger <- struct{}{}:
+	default:
+	}
+}
+
+func (c *controller) setPaused(paused bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.paused = paused
+}
+
+func (c *controller) isPaused() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.paused
+}
+
+func (c *controller) enterSafeMode(reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.safeMode = reason
+	fmt.Printf("Entering safe mode: %s. Moves resume once acknowledged with POST /api/v1/acknowledge or -acknowledge-crash.\n", reason)
+}
+
+func (c *controller) inSafeMode() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.safeMode != ""
+}
+
+// acknowledge leaves safe mode. It reports whether the balancer was in safe
+// mode.
+func (c *controller) acknowledge() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	was := c.safeMode != ""
+	c.safeMode = ""
+	return was
+}
+
+func (c *controller) setLeader(leader bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.leader = leader
+}
+
+func (c *controller) isLeader() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.leader
+}
+
+func (c *controller) cycleStarted() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.running = true
+	c.inFlight = nil
+	c.beatDue = time.Now().Add(cfg.MoveTimeout.Duration)
+}
+
+func (c *controller) cycleEnded(event CycleEvent) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.running = false
+	c.inFlight = nil
+	c.lastCycle = &event
+	if event.Event == eventCycleCompleted && len(event.Moves) > 0 {
+		c.movedAt = time.Now()
+	}
+}
+
+// coolingDown returns until when cycles wait after the last one that moved
+// shards, and whether that is still ahead.
+func (c *controller) coolingDown() (time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cfg.CycleCooldown.Duration <= 0 || c.movedAt.IsZero() {
+		return time.Time{}, false
+	}
+	until := c.movedAt.Add(cfg.CycleCooldown.Duration)
+	return until, time.Now().Before(until)
+}
+
+func (c *controller) setBalancing(balancing bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.balancing = balancing
+}
+
+func (c *controller) isBalancing() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.balancing
+}
+
+func (c *controller) planned(imbalance, moves int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.hasPlan = true
+	c.lastImbalance = imbalance
+	c.lastMoves = moves
+}
+
+func (c *controller) lastPlan() (imbalance, moves int, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastImbalance, c.lastMoves, c.hasPlan
+}
+
+func (c *controller) moveIssued(move Move) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.inFlight = append(c.inFlight, move)
+	c.beatDue = time.Now().Add(cfg.MoveTimeout.Duration)
+}
+
+// livenessGrace is how late the loop may be to beat before it is
+// considered stuck.
+const livenessGrace = time.Minute
+
+// beat tells that the loop is alive and will be again within d: the
+// scheduler beats before waiting for the next cycle, a cycle as it starts,
+// issues moves and polls for them, none of which takes longer than
+// cfg.MoveTimeout.
+func (c *controller) beat(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.beatDue = time.Now().Add(d)
+}
+
+// alive returns an error if the loop is stuck: it did not beat in time.
+func (c *controller) alive() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if late := time.Since(c.beatDue); !c.beatDue.IsZero() && late > livenessGrace {
+		return fmt.Errorf("the balancing loop is %s late, stuck since %s", late.Round(time.Second), c.beatDue.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// inFlightMoves returns the moves issued by the running cycle.
+func (c *controller) inFlightMoves() []Move {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Move(nil), c.inFlight...)
+}
+
+// ControlStatus is the runtime part of the admin API status.
+type ControlStatus struct {
+	Leader    bool          `json:"leader"`
+	Paused    bool          `json:"paused"`
+	SafeMode  string        `json:"safe_mode,omitempty"`
+	Running   bool          `json:"running"`
+	InFlight  []MoveSummary `json:"in_flight"`
+	LastCycle *CycleEvent   `json:"last_cycle"`
+}
+
+func (c *controller) status() ControlStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	status := ControlStatus{
+		Leader:    c.leader,
+		Paused:    c.paused,
+		SafeMode:  c.safeMode,
+		Running:   c.running,
+		InFlight:  []MoveSummary{},
+		LastCycle: c.lastCycle,
+	}
+	for _, move := range c.inFlight {
+		status.InFlight = append(status.InFlight, summarizeMove(move))
+	}
+	return status
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// nodeTouches remembers when each node last took part in a move issued by
+// the balancer, as source or target, to give nodes cfg.NodeCooldown of rest
+// between moves.
+type nodeTouches struct {
+	mu     sync.Mutex
+	loaded bool
+	last   map[string]time.Time
+}
+
+var touches = &nodeTouches{last: map[string]time.Time{}}
+
+func (t *nodeTouches) touch(nodes ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	for _, node := range nodes {
+		t.last[node] = now
+	}
+}
+
+// coolingDown returns until when the node rests, if it does.
+func (t *nodeTouches) coolingDown(node string) (time.Time, bool) {
+	if cfg.NodeCooldown.Duration <= 0 {
+		return time.Time{}, false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.loaded {
+		t.load()
+		t.loaded = true
+	}
+	until := t.last[node].Add(cfg.NodeCooldown.Duration)
+	return until, time.Now().Before(until)
+}
+
+// load picks up the moves of previous runs from the move history, so that a
+// restart does not lift the cooldown.
+func (t *nodeTouches) load() {
+	if cfg.StateDir == "" {
+		return
+	}
+	if _, err := os.Stat(historyPath()); os.IsNotExist(err) {
+		return
+	}
+	err := withHistory(true, func(db *bolt.DB) error {
+		return db.View(func(tx *bolt.Tx) error {
+			b := tx.Bucket(historyBucket)
+			if b == nil {
+				return nil
+			}
+			c := b.Cursor()
+			for k, v := c.Seek(historyKey(time.Now().Add(-cfg.NodeCooldown.Duration), 0)); k != nil; k, v = c.Next() {
+				var record MoveRecord
+				if err := json.Unmarshal(v, &record); err != nil || record.Result != moveResultExecuted {
+					continue
+				}
+				for _, node := range []string{record.Source, record.Target} {
+					if record.Time.After(t.last[node]) {
+						t.last[node] = record.Time
+					}
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		fmt.Println("Error reading node cooldowns from the move history:", err)
+	}
+}
+
+// moveCoolingDown returns the node of the move that is cooling down, if any.
+func moveCoolingDown(move Move) (string, time.Time, bool) {
+	for _, node := range []string{move.To, move.From} {
+		if until, ok := touches.coolingDown(node); ok {
+			return node, until, true
+		}
+	}
+	return "", time.Time{}, false
+}
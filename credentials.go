@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	credentialsVault          = "vault"
+	credentialsSecretsManager = "aws_secrets_manager"
+)
+
+// CredentialSource is a secret holding the credentials of Elasticsearch: a
+// username and password, or an api_key. It is fetched at startup, again
+// every Refresh if set, and whenever Elasticsearch rejects the credentials,
+// so that rotated secrets are picked up without a restart.
+//
+// With Vault, Path is the path of the secret under the API, such as
+// secret/data/elasticsearch for a KV version 2 engine mounted at secret.
+// Address and Token default to the VAULT_ADDR and VAULT_TOKEN environment
+// variables.
+//
+// With AWS Secrets Manager, SecretID is the name or ARN of a secret whose
+// string is a JSON object, in Region, which defaults to the AWS_REGION
+// environment variable. Requests are signed with the default credentials,
+// see awsChain. Address overrides the endpoint of the region.
+type CredentialSource struct {
+	Type     string   `json:"type"`
+	Address  string   `json:"address"`
+	Token    string   `json:"token"`
+	Path     string   `json:"path"`
+	SecretID string   `json:"secret_id"`
+	Region   string   `json:"region"`
+	Refresh  Duration `json:"refresh"`
+}
+
+func (s *CredentialSource) validate() error {
+	switch s.Type {
+	case credentialsVault:
+		if s.Path == "" {
+			return fmt.Errorf("vault es_credentials need a path")
+		}
+	case credentialsSecretsManager:
+		if s.SecretID == "" {
+			return fmt.Errorf("aws_secrets_manager es_credentials need a secret_id")
+		}
+	default:
+		return fmt.Errorf("invalid es_credentials type %q, want %s or %s", s.Type, credentialsVault, credentialsSecretsManager)
+	}
+	if s.Refresh.Duration < 0 {
+		return fmt.Errorf("es_credentials refresh cannot be negative")
+	}
+	return nil
+}
+
+// esSecret is what a secret holds, and how requests authenticate.
+type esSecret struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	APIKey   string `json:"api_key"`
+}
+
+func (s esSecret) authorize(req *http.Request) {
+	switch {
+	case s.APIKey != "":
+		req.Header.Set("Authorization", "ApiKey "+s.APIKey)
+	case s.Username != "":
+		req.SetBasicAuth(s.Username, s.Password)
+	}
+}
+
+// credentialStore holds the credentials requests authenticate with.
+type credentialStore struct {
+	mu      sync.Mutex
+	secret  esSecret
+	fetched time.Time
+}
+
+var esCredentials = &credentialStore{}
+
+// minCredentialRefresh bounds how often rejected requests refetch the
+// secret.
+const minCredentialRefresh = 30 * time.Second
+
+func (c *credentialStore) get() esSecret {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.secret
+}
+
+func (c *credentialStore) set(secret esSecret) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.secret = secret
+	c.fetched = time.Now()
+}
+
+// setupCredentials takes the credentials of the config, fetching them from
+// cfg.ESCredentials if set.
+func setupCredentials() error {
+	if cfg.ESCredentials == nil {
+		esCredentials.set(esSecret{Username: cfg.ESUsername, Password: cfg.ESPassword, APIKey: cfg.ESAPIKey})
+		return nil
+	}
+	secret, err := cfg.ESCredentials.fetch()
+	if err != nil {
+		return fmt.Errorf("fetching Elasticsearch credentials from %s: %w", cfg.ESCredentials.Type, err)
+	}
+	esCredentials.set(secret)
+	return nil
+}
+
+// rejected refetches the secret after Elasticsearch rejected the
+// credentials, unless it was fetched less than minCredentialRefresh ago. It
+// reports whether the credentials changed.
+func (c *credentialStore) rejected() (esSecret, bool) {
+	c.mu.Lock()
+	old, recent := c.secret, time.Since(c.fetched) < minCredentialRefresh
+	c.mu.Unlock()
+	if cfg.ESCredentials == nil || recent {
+		return old, false
+	}
+	secret, err := cfg.ESCredentials.fetch()
+	if err != nil {
+		fmt.Println("Error refetching Elasticsearch credentials:", err)
+		return old, false
+	}
+	c.set(secret)
+	if secret == old {
+		return old, false
+	}
+	fmt.Printf("Fetched rotated Elasticsearch credentials from %s.\n", cfg.ESCredentials.Type)
+	return secret, true
+}
+
+// refreshCredentials refetches the secret every cfg.ESCredentials.Refresh.
+// Failures keep the credentials fetched last.
+func refreshCredentials(ctx context.Context) error {
+	ticker := time.NewTicker(cfg.ESCredentials.Refresh.Duration)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+		secret, err := cfg.ESCredentials.fetch()
+		if err != nil {
+			fmt.Println("Error refreshing Elasticsearch credentials:", err)
+			continue
+		}
+		if secret != esCredentials.get() {
+			fmt.Printf("Fetched rotated Elasticsearch credentials from %s.\n", cfg.ESCredentials.Type)
+		}
+		esCredentials.set(secret)
+	}
+}
+
+// authTransport authenticates the requests to Elasticsearch, or signs them
+// with cfg.ESSigV4Region. A request rejected with 401 is sent again once, if
+// refetching the secret got other credentials.
+type authTransport struct {
+	base http.RoundTripper
+}
+
+func (t authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	authorized, err := authenticate(req, esCredentials.get())
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.base.RoundTrip(authorized)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || (req.Body != nil && req.GetBody == nil) {
+		return resp, err
+	}
+	secret, changed := esCredentials.rejected()
+	if !changed {
+		return resp, nil
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	if retry, err = authenticate(retry, secret); err != nil {
+		return nil, err
+	}
+	return t.base.RoundTrip(retry)
+}
+
+// authenticate returns a copy of req with the credentials of secret, or its
+// SigV4 signature.
+func authenticate(req *http.Request, secret esSecret) (*http.Request, error) {
+	authorized := req.Clone(req.Context())
+	if cfg.ESSigV4Region == "" {
+		secret.authorize(authorized)
+		return authorized, nil
+	}
+	creds, err := awsDefaultCredentials.get()
+	if err != nil {
+		return nil, err
+	}
+	var payload []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		body := req.Body
+		if req.GetBody != nil {
+			if body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		if payload, err = ioutil.ReadAll(body); err != nil {
+			return nil, err
+		}
+		authorized.Body = ioutil.NopCloser(bytes.NewReader(payload))
+	}
+	signV4(authorized, payload, creds, cfg.ESSigV4Region, cfg.ESSigV4Service, time.Now())
+	return authorized, nil
+}
+
+func (s *CredentialSource) fetch() (esSecret, error) {
+	var data []byte
+	var err error
+	if s.Type == credentialsVault {
+		data, err = s.fetchVault()
+	} else {
+		data, err = s.fetchSecretsManager()
+	}
+	if err != nil {
+		return esSecret{}, err
+	}
+	var secret esSecret
+	if err := json.Unmarshal(data, &secret); err != nil {
+		return esSecret{}, fmt.Errorf("parsing secret: %w", err)
+	}
+	if secret.APIKey == "" && (secret.Username == "" || secret.Password == "") {
+		return esSecret{}, fmt.Errorf("secret has neither username and password nor api_key")
+	}
+	return secret, nil
+}
+
+// fetchVault reads the secret from the KV engine of Vault, version 1 or 2.
+func (s *CredentialSource) fetchVault() ([]byte, error) {
+	address, token := s.Address, s.Token
+	if address == "" {
+		address = os.Getenv("VAULT_ADDR")
+	}
+	if token == "" {
+		token = os.Getenv("VAULT_TOKEN")
+	}
+	if address == "" {
+		return nil, fmt.Errorf("no Vault address, set address or VAULT_ADDR")
+	}
+	req, err := http.NewRequest("GET", strings.TrimRight(address, "/")+"/v1/"+strings.TrimLeft(s.Path, "/"), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	body, err := doSecretRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, fmt.Errorf("parsing Vault response: %w", err)
+	}
+	// Version 2 nests the secret in data, next to its metadata.
+	if inner, ok := resp.Data["data"]; ok && resp.Data["metadata"] != nil {
+		return inner, nil
+	}
+	return json.Marshal(resp.Data)
+}
+
+// fetchSecretsManager calls GetSecretValue.
+func (s *CredentialSource) fetchSecretsManager() ([]byte, error) {
+	region := s.Region
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		return nil, fmt.Errorf("no AWS region, set region or AWS_REGION")
+	}
+	endpoint := s.Address
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://secretsmanager.%s.amazonaws.com", region)
+	}
+	payload, err := json.Marshal(map[string]string{"SecretId": s.SecretID})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", strings.TrimRight(endpoint, "/")+"/", bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	creds, err := awsDefaultCredentials.get()
+	if err != nil {
+		return nil, err
+	}
+	signV4(req, payload, creds, region, "secretsmanager", time.Now())
+	body, err := doSecretRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		SecretString string `json:"SecretString"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, fmt.Errorf("parsing Secrets Manager response: %w", err)
+	}
+	if resp.SecretString == "" {
+		return nil, fmt.Errorf("secret %s has no string", s.SecretID)
+	}
+	return []byte(resp.SecretString), nil
+}
+
+func doSecretRequest(req *http.Request) ([]byte, error) {
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Redacted(), resp.Status, bytes.TrimSpace(body))
+	}
+	return body, nil
+}
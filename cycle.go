@@ -0,0 +1,85 @@
+package main
+
+import (
+	"time"
+
+	"github.com/tjandrayana/elasticsearch-rebalance-shard/observer"
+)
+
+// cycle tracks one rebalance cycle for notifications and the admin API.
+type cycle struct {
+	startedAt time.Time
+	// The imbalance score when the cycle observed the cluster, and the one
+	// expected once its moves are done.
+	scoreBefore, scoreAfter *observer.Score
+	// The latency before executing and once the relocations settled, see
+	// checkLatency.
+	latencyBefore, latencyAfter *Latency
+	latencyRegressed            bool
+	rolledBack                  []Move
+	// distribution is the shard count of every node, by name, expected
+	// once the moves are done.
+	distribution map[string]int
+}
+
+func newCycle() *cycle {
+	ctl.cycleStarted()
+	return &cycle{startedAt: time.Now()}
+}
+
+func summarizeMove(move Move) MoveSummary {
+	return MoveSummary{
+		Index:   move.Shard.Index,
+		Shard:   move.Shard.Shard,
+		Primary: move.Shard.Primary,
+		From:    move.From,
+		To:      move.To,
+		Bytes:   move.Bytes,
+	}
+}
+
+func (c *cycle) event(name string, moves []Move) CycleEvent {
+	event := CycleEvent{
+		Event:          name,
+		Cluster:        cfg.ClusterAlias,
+		StartedAt:      c.startedAt.UTC(),
+		DurationMillis: time.Since(c.startedAt).Milliseconds(),
+		Moves:          []MoveSummary{},
+		ScoreBefore:    c.scoreBefore,
+		ScoreAfter:     c.scoreAfter,
+
+		LatencyBefore:    c.latencyBefore,
+		LatencyAfter:     c.latencyAfter,
+		LatencyRegressed: c.latencyRegressed,
+		Distribution:     c.distribution,
+	}
+	for _, move := range moves {
+		summary := summarizeMove(move)
+		event.Moves = append(event.Moves, summary)
+		event.BytesRelocated += summary.Bytes
+	}
+	for _, move := range c.rolledBack {
+		event.RolledBack = append(event.RolledBack, summarizeMove(move))
+	}
+	return event
+}
+
+// The cycle events are published on the event bus, see subscribeConsumers.
+func (c *cycle) started(moves []Move) {
+	bus.publish(topicCycle, c.event(eventCycleStarted, moves))
+}
+
+func (c *cycle) completed(moves []Move) {
+	bus.publish(topicCycle, c.event(eventCycleCompleted, moves))
+}
+
+// idle ends a cycle that had nothing to do.
+func (c *cycle) idle() {
+	bus.publish(topicCycle, c.event(eventCycleCompleted, nil))
+}
+
+func (c *cycle) failed(err error) {
+	event := c.event(eventCycleFailed, nil)
+	event.Error = err.Error()
+	bus.publish(topicCycle, event)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// dashboardHTML is the page served at / by the admin API. It only uses the
+// API, with the token entered on the page when the API has tokens.
+//
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+// trendPoints is how many cycles the trend keeps, a day of cycles five
+// minutes apart.
+const trendPoints = 288
+
+// TrendPoint is the state of the cluster at the end of a cycle. Spread is
+// the spread of the shard counts the cycle started from.
+type TrendPoint struct {
+	Time   time.Time `json:"time"`
+	Health string    `json:"health,omitempty"`
+	Spread float64   `json:"spread"`
+	Moves  int       `json:"moves"`
+	Failed bool      `json:"failed,omitempty"`
+}
+
+// HistoryResponse is returned by GET /api/v1/history.
+type HistoryResponse struct {
+	Moves []MoveRecord `json:"moves"`
+}
+
+// TrendResponse is returned by GET /api/v1/trend, oldest point first.
+type TrendResponse struct {
+	Points []TrendPoint `json:"points"`
+}
+
+var trend struct {
+	sync.Mutex
+	points []TrendPoint
+}
+
+// recordTrend adds the end of a cycle to the trend, with the health of the
+// cluster then.
+func recordTrend(event CycleEvent) {
+	point := TrendPoint{Time: time.Now().UTC(), Moves: len(event.Moves), Failed: event.Event == eventCycleFailed}
+	if event.ScoreBefore != nil {
+		point.Spread = event.ScoreBefore.Spread
+	}
+	if health, err := getClusterHealth(); err == nil {
+		point.Health = health.Status
+	}
+	trend.Lock()
+	defer trend.Unlock()
+	trend.points = append(trend.points, point)
+	if len(trend.points) > trendPoints {
+		trend.points = trend.points[len(trend.points)-trendPoints:]
+	}
+}
+
+func handleDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no endpoint %s", r.URL.Path))
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(dashboardHTML)
+}
+
+// handleHistory serves the recorded moves, like the history command. The
+// query parameters since (24h by default), limit (100), index and result
+// select them.
+func handleHistory(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	since, limit := 24*time.Hour, 100
+	if v := q.Get("since"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid since %q: %w", v, err))
+			return
+		}
+		since = d
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit %q", v))
+			return
+		}
+		limit = n
+	}
+	records, err := readHistory(since, q.Get("index"), q.Get("result"), limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	resp := HistoryResponse{Moves: records}
+	if resp.Moves == nil {
+		resp.Moves = []MoveRecord{}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func handleTrend(w http.ResponseWriter, r *http.Request) {
+	trend.Lock()
+	resp := TrendResponse{Points: append([]TrendPoint{}, trend.points...)}
+	trend.Unlock()
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultDateMathFormat is the format Elasticsearch uses for date math in
+// index names when none is given.
+const defaultDateMathFormat = "yyyy.MM.dd"
+
+// rolloverSuffix is the counter rollover appends to index names.
+var rolloverSuffix = regexp.MustCompile(`-\d+$`)
+
+// isDateMath tells whether the index pattern uses date math, like
+// <logs-{now/d}>.
+func isDateMath(pattern string) bool {
+	return strings.HasPrefix(pattern, "<") && strings.HasSuffix(pattern, ">")
+}
+
+// resolveDateMath resolves an index name with date math the way
+// Elasticsearch does, e.g. <logs-{now/d}> to logs-2024.03.01 and
+// <logs-{now/M-1M{yyyy.MM|Europe/Paris}}> to the previous month in Paris.
+// Other patterns are returned as is.
+func resolveDateMath(pattern string, now time.Time) (string, error) {
+	if !isDateMath(pattern) {
+		return pattern, nil
+	}
+	s := pattern[1 : len(pattern)-1]
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\\':
+			if i+1 < len(s) {
+				i++
+				b.WriteByte(s[i])
+			}
+		case '{':
+			end, depth := -1, 0
+			for j := i; j < len(s) && end < 0; j++ {
+				switch s[j] {
+				case '{':
+					depth++
+				case '}':
+					if depth--; depth == 0 {
+						end = j
+					}
+				}
+			}
+			if end < 0 {
+				return "", fmt.Errorf("unbalanced braces in %q", pattern)
+			}
+			resolved, err := evalDateMath(s[i+1:end], now)
+			if err != nil {
+				return "", fmt.Errorf("invalid date math in %q: %w", pattern, err)
+			}
+			b.WriteString(resolved)
+			i = end
+		case '}':
+			return "", fmt.Errorf("unbalanced braces in %q", pattern)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), nil
+}
+
+// evalDateMath evaluates an expression such as now-1d/d{yyyy.MM.dd|UTC}.
+func evalDateMath(expr string, now time.Time) (string, error) {
+	format, loc := defaultDateMathFormat, time.UTC
+	if i := strings.IndexByte(expr, '{'); i >= 0 {
+		if !strings.HasSuffix(expr, "}") {
+			return "", fmt.Errorf("unterminated format in %q", expr)
+		}
+		spec := expr[i+1 : len(expr)-1]
+		expr = expr[:i]
+		if j := strings.IndexByte(spec, '|'); j >= 0 {
+			var err error
+			if loc, err = time.LoadLocation(spec[j+1:]); err != nil {
+				return "", err
+			}
+			spec = spec[:j]
+		}
+		if spec != "" {
+			format = spec
+		}
+	}
+	if !strings.HasPrefix(expr, "now") {
+		return "", fmt.Errorf("%q does not start with now", expr)
+	}
+	t := now.In(loc)
+	for rest := expr[len("now"):]; rest != ""; {
+		op := rest[0]
+		rest = rest[1:]
+		switch op {
+		case '+', '-':
+			n := 0
+			for n < len(rest) && rest[n] >= '0' && rest[n] <= '9' {
+				n++
+			}
+			if n == 0 || n == len(rest) {
+				return "", fmt.Errorf("invalid offset in %q", expr)
+			}
+			amount, _ := strconv.Atoi(rest[:n])
+			if op == '-' {
+				amount = -amount
+			}
+			var err error
+			if t, err = addDateUnit(t, amount, rest[n]); err != nil {
+				return "", err
+			}
+			rest = rest[n+1:]
+		case '/':
+			if rest == "" {
+				return "", fmt.Errorf("missing rounding unit in %q", expr)
+			}
+			var err error
+			if t, err = roundDateUnit(t, rest[0]); err != nil {
+				return "", err
+			}
+			rest = rest[1:]
+		default:
+			return "", fmt.Errorf("unexpected %q in %q", op, expr)
+		}
+	}
+	layout, err := javaDateLayout(format)
+	if err != nil {
+		return "", err
+	}
+	return t.Format(layout), nil
+}
+
+func addDateUnit(t time.Time, n int, unit byte) (time.Time, error) {
+	switch unit {
+	case 'y':
+		return t.AddDate(n, 0, 0), nil
+	case 'M':
+		return t.AddDate(0, n, 0), nil
+	case 'w':
+		return t.AddDate(0, 0, 7*n), nil
+	case 'd':
+		return t.AddDate(0, 0, n), nil
+	case 'h', 'H':
+		return t.Add(time.Duration(n) * time.Hour), nil
+	case 'm':
+		return t.Add(time.Duration(n) * time.Minute), nil
+	case 's':
+		return t.Add(time.Duration(n) * time.Second), nil
+	}
+	return t, fmt.Errorf("unknown date math unit %q", unit)
+}
+
+func roundDateUnit(t time.Time, unit byte) (time.Time, error) {
+	y, mo, d := t.Date()
+	loc := t.Location()
+	switch unit {
+	case 'y':
+		return time.Date(y, 1, 1, 0, 0, 0, 0, loc), nil
+	case 'M':
+		return time.Date(y, mo, 1, 0, 0, 0, 0, loc), nil
+	case 'w':
+		// Weeks start on Monday.
+		return time.Date(y, mo, d-(int(t.Weekday())+6)%7, 0, 0, 0, 0, loc), nil
+	case 'd':
+		return time.Date(y, mo, d, 0, 0, 0, 0, loc), nil
+	case 'h', 'H':
+		return time.Date(y, mo, d, t.Hour(), 0, 0, 0, loc), nil
+	case 'm':
+		return time.Date(y, mo, d, t.Hour(), t.Minute(), 0, 0, loc), nil
+	case 's':
+		return time.Date(y, mo, d, t.Hour(), t.Minute(), t.Second(), 0, loc), nil
+	}
+	return t, fmt.Errorf("unknown date math unit %q", unit)
+}
+
+// javaDateLayout converts the common subset of Java date formats used in
+// index names to a Go layout.
+func javaDateLayout(format string) (string, error) {
+	tokens := []struct{ java, goLayout string }{
+		{"yyyy", "2006"}, {"yy", "06"}, {"MM", "01"}, {"dd", "02"},
+		{"HH", "15"}, {"mm", "04"}, {"ss", "05"},
+	}
+	var b strings.Builder
+next:
+	for format != "" {
+		for _, t := range tokens {
+			if strings.HasPrefix(format, t.java) {
+				b.WriteString(t.goLayout)
+				format = format[len(t.java):]
+				continue next
+			}
+		}
+		c := format[0]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' {
+			return "", fmt.Errorf("unsupported date format %q", format)
+		}
+		b.WriteByte(c)
+		format = format[1:]
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// DebugState is returned by GET /debug/state: the state the balancer keeps
+// between cycles, to tell what it holds on to, and the memory of the
+// process.
+type DebugState struct {
+	Control            ControlStatus         `json:"control"`
+	LastObservation    *ObservationStats     `json:"last_observation"`
+	Smoothed           map[string]float64    `json:"smoothed_counts"`
+	NodeTouches        map[string]time.Time  `json:"node_touches"`
+	PendingPlan        *PendingPlan          `json:"pending_plan"`
+	AllocationDisabled AllocationWindowStats `json:"allocation_disabled"`
+	AllocationPrior    string                `json:"allocation_prior,omitempty"`
+	Hosts              []string              `json:"hosts"`
+	Runtime            RuntimeStats          `json:"runtime"`
+}
+
+// ObservationStats sizes an observation of the cluster, the bulk of the
+// memory of a cycle.
+type ObservationStats struct {
+	At             time.Time `json:"at"`
+	DurationMillis int64     `json:"duration_ms"`
+	Nodes          int       `json:"nodes"`
+	DataNodes      int       `json:"data_nodes"`
+	Indices        int       `json:"indices"`
+	ShardCopies    int       `json:"shard_copies"`
+	Unassigned     int       `json:"unassigned"`
+}
+
+type RuntimeStats struct {
+	Goroutines  int    `json:"goroutines"`
+	HeapAlloc   uint64 `json:"heap_alloc_bytes"`
+	HeapInuse   uint64 `json:"heap_inuse_bytes"`
+	HeapObjects uint64 `json:"heap_objects"`
+	Sys         uint64 `json:"sys_bytes"`
+	NumGC       uint32 `json:"gc_runs"`
+	PauseTotal  int64  `json:"gc_pause_total_ms"`
+}
+
+var lastObservation struct {
+	sync.Mutex
+	stats *ObservationStats
+}
+
+// recordObservation keeps the sizes of an observation that took d.
+func recordObservation(obs *Observation, d time.Duration) {
+	stats := &ObservationStats{
+		At:             time.Now().UTC(),
+		DurationMillis: d.Milliseconds(),
+		Nodes:          len(obs.Nodes.Nodes),
+		DataNodes:      len(obs.Distribution),
+		Unassigned:     len(obs.State.RoutingNodes.Unassigned),
+	}
+	indices := make(map[string]bool)
+	for _, shards := range obs.State.RoutingNodes.Nodes {
+		stats.ShardCopies += len(shards)
+		for _, shard := range shards {
+			indices[shard.Index] = true
+		}
+	}
+	stats.Indices = len(indices)
+	lastObservation.Lock()
+	lastObservation.stats = stats
+	lastObservation.Unlock()
+}
+
+// debugEndpoints adds the endpoints of cfg.DebugEndpoints to mux.
+func debugEndpoints(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", authorize(roleOperator, pprof.Index))
+	mux.HandleFunc("/debug/pprof/cmdline", authorize(roleOperator, pprof.Cmdline))
+	mux.HandleFunc("/debug/pprof/profile", authorize(roleOperator, pprof.Profile))
+	mux.HandleFunc("/debug/pprof/symbol", authorize(roleOperator, pprof.Symbol))
+	mux.HandleFunc("/debug/pprof/trace", authorize(roleOperator, pprof.Trace))
+	mux.HandleFunc("/debug/state", method("GET", authorize(roleOperator, handleDebugState)))
+}
+
+func handleDebugState(w http.ResponseWriter, r *http.Request) {
+	state := DebugState{
+		Control:            ctl.status(),
+		AllocationDisabled: disabledWindow.stats(),
+	}
+
+	lastObservation.Lock()
+	state.LastObservation = lastObservation.stats
+	lastObservation.Unlock()
+
+	smoothed.mu.Lock()
+	state.Smoothed = make(map[string]float64, len(smoothed.counts))
+	for node, n := range smoothed.counts {
+		state.Smoothed[node] = n
+	}
+	smoothed.mu.Unlock()
+
+	touches.mu.Lock()
+	state.NodeTouches = make(map[string]time.Time, len(touches.last))
+	for node, t := range touches.last {
+		state.NodeTouches[node] = t.UTC()
+	}
+	touches.mu.Unlock()
+
+	approvals.Lock()
+	state.PendingPlan = approvals.plan
+	approvals.Unlock()
+
+	allocationPriorMu.Lock()
+	state.AllocationPrior = allocationPrior
+	allocationPriorMu.Unlock()
+
+	esHosts.mu.Lock()
+	state.Hosts = append([]string{}, esHosts.hosts...)
+	esHosts.mu.Unlock()
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	state.Runtime = RuntimeStats{
+		Goroutines:  runtime.NumGoroutine(),
+		HeapAlloc:   mem.HeapAlloc,
+		HeapInuse:   mem.HeapInuse,
+		HeapObjects: mem.HeapObjects,
+		Sys:         mem.Sys,
+		NumGC:       mem.NumGC,
+		PauseTotal:  time.Duration(mem.PauseTotalNs).Milliseconds(),
+	}
+	writeJSON(w, http.StatusOK, state)
+}
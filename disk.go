@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/tjandrayana/elasticsearch-rebalance-shard/observer"
+)
+
+const (
+	settingDiskThresholdEnabled = "cluster.routing.allocation.disk.threshold_enabled"
+	settingDiskWatermarkHigh    = "cluster.routing.allocation.disk.watermark.high"
+
+	// defaultDiskWatermarkHigh is the default of Elasticsearch.
+	defaultDiskWatermarkHigh = "90%"
+)
+
+type NodesFS struct {
+	Nodes map[string]struct {
+		FS struct {
+			Total struct {
+				TotalInBytes     int64 `json:"total_in_bytes"`
+				AvailableInBytes int64 `json:"available_in_bytes"`
+			} `json:"total"`
+		} `json:"fs"`
+	} `json:"nodes"`
+}
+
+// diskWatermark is the high disk watermark, either a ratio of the disk used
+// or the bytes that must stay free.
+type diskWatermark struct {
+	usedRatio float64
+	freeBytes int64
+}
+
+// parseDiskWatermark parses a watermark setting such as "90%", "0.9" or
+// "100gb".
+func parseDiskWatermark(s string) (diskWatermark, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasSuffix(s, "%") {
+		p, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+		if err != nil || p < 0 || p > 100 {
+			return diskWatermark{}, fmt.Errorf("invalid disk watermark %q", s)
+		}
+		return diskWatermark{usedRatio: p / 100}, nil
+	}
+	if r, err := strconv.ParseFloat(s, 64); err == nil && r >= 0 && r <= 1 {
+		return diskWatermark{usedRatio: r}, nil
+	}
+	free, err := parseByteSize(s)
+	if err != nil {
+		return diskWatermark{}, fmt.Errorf("invalid disk watermark %q", s)
+	}
+	return diskWatermark{freeBytes: free}, nil
+}
+
+// exceeded tells whether a disk with total and available bytes is above the
+// watermark.
+func (w diskWatermark) exceeded(total, available int64) bool {
+	if w.freeBytes > 0 {
+		return available < w.freeBytes
+	}
+	return total > 0 && float64(total-available) > w.usedRatio*float64(total)
+}
+
+// diskUsage holds the total and available disk bytes of the data nodes, the
+// high watermark and the size of the shard copies, as of the last
+// readDiskUsage. It is nil when the targets are not checked.
+var (
+	diskMu    sync.Mutex
+	diskUsage *diskState
+)
+
+type diskState struct {
+	total, available map[string]int64
+	watermark        diskWatermark
+	shardBytes       map[string]int64
+}
+
+// readDiskUsage records the disk usage of the nodes and the high watermark
+// before planning. On errors the targets are not checked for this plan,
+// leaving it to the dry runs of the moves.
+func readDiskUsage(obs *Observation) {
+	state, err := getDiskState(obs)
+	if err != nil {
+		fmt.Println("Error getting disk usage, not checking the watermark:", err)
+	}
+	diskMu.Lock()
+	diskUsage = state
+	diskMu.Unlock()
+}
+
+func getDiskState(obs *Observation) (*diskState, error) {
+	if !cfg.DiskWatermarkAware {
+		return nil, nil
+	}
+	settings, err := getClusterSettings()
+	if err != nil {
+		return nil, err
+	}
+	if settings.effective(settingDiskThresholdEnabled) == "false" {
+		return nil, nil
+	}
+	high := settings.effective(settingDiskWatermarkHigh)
+	if high == "" {
+		high = defaultDiskWatermarkHigh
+	}
+	watermark, err := parseDiskWatermark(high)
+	if err != nil {
+		return nil, err
+	}
+	var fs NodesFS
+	if err := esGet("/_nodes/stats/fs?filter_path=nodes.*.fs.total.total_in_bytes,nodes.*.fs.total.available_in_bytes", &fs); err != nil {
+		return nil, err
+	}
+	state := &diskState{
+		total:      make(map[string]int64, len(fs.Nodes)),
+		available:  make(map[string]int64, len(fs.Nodes)),
+		watermark:  watermark,
+		shardBytes: obs.ShardBytes,
+	}
+	for nodeID, node := range fs.Nodes {
+		state.total[nodeID] = node.FS.Total.TotalInBytes
+		state.available[nodeID] = node.FS.Total.AvailableInBytes
+	}
+	return state, nil
+}
+
+// belowHighWatermark tells whether the node stays below the high disk
+// watermark once it received the copy on top of the copies already planned
+// to move to it, the copies of onNode observed on another node. Nodes
+// without disk stats are not checked.
+func belowHighWatermark(shard ShardRouting, nodeID string, onNode []ShardRouting) bool {
+	diskMu.Lock()
+	defer diskMu.Unlock()
+	if diskUsage == nil {
+		return true
+	}
+	total, ok := diskUsage.total[nodeID]
+	if !ok {
+		return true
+	}
+	incoming := diskUsage.shardBytes[observer.CopyKey(shard, shard.Node)]
+	for _, s := range onNode {
+		if s.Node != nodeID {
+			incoming += diskUsage.shardBytes[observer.CopyKey(s, s.Node)]
+		}
+	}
+	return !diskUsage.watermark.exceeded(total, diskUsage.available[nodeID]-incoming)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// maintenanceNodes holds the IDs of the data nodes under maintenance, see
+// cfg.MaintenanceAttribute, as of the last observation.
+var (
+	maintenanceNodesMu sync.Mutex
+	maintenanceNodes   []string
+)
+
+// setAsideMaintenanceNodes leaves the nodes under maintenance out of the
+// distribution, like excludeNodes, and records them for planDrainMoves.
+func setAsideMaintenanceNodes(obs *Observation) {
+	var nodes []string
+	if name, value, ok := strings.Cut(cfg.MaintenanceAttribute, ":"); ok {
+		for id := range obs.Distribution {
+			if v, ok := obs.Nodes.Nodes[id].Attributes[name]; ok && v == value {
+				nodes = append(nodes, id)
+				delete(obs.Distribution, id)
+			}
+		}
+	}
+	sort.Strings(nodes)
+	maintenanceNodesMu.Lock()
+	defer maintenanceNodesMu.Unlock()
+	maintenanceNodes = nodes
+}
+
+func underMaintenance() []string {
+	maintenanceNodesMu.Lock()
+	defer maintenanceNodesMu.Unlock()
+	return maintenanceNodes
+}
+
+// planDrainMoves, with cfg.DrainMaintenanceNodes, moves the copies off the
+// nodes under maintenance, each to the node with the fewest shards per
+// weight that can take it. The copies that no node can take are left.
+func planDrainMoves(obs *Observation, verdicts *verdictCache) []Move {
+	drained := underMaintenance()
+	if !cfg.DrainMaintenanceNodes || len(drained) == 0 {
+		return nil
+	}
+
+	nodeIDs := make([]string, 0, len(obs.Distribution))
+	load := make(map[string]int, len(obs.Distribution))
+	placement := make(map[string][]ShardRouting, len(obs.Distribution)+len(drained))
+	for nodeID, n := range obs.Distribution {
+		nodeIDs = append(nodeIDs, nodeID)
+		load[nodeID] = n
+		placement[nodeID] = append([]ShardRouting(nil), obs.State.RoutingNodes.Nodes[nodeID]...)
+	}
+	for _, nodeID := range drained {
+		placement[nodeID] = append([]ShardRouting(nil), obs.State.RoutingNodes.Nodes[nodeID]...)
+	}
+
+	var moves []Move
+	for _, from := range drained {
+		for {
+			sort.Slice(nodeIDs, func(i, j int) bool {
+				a, b := float64(load[nodeIDs[i]])/nodeWeight(nodeIDs[i]), float64(load[nodeIDs[j]])/nodeWeight(nodeIDs[j])
+				return a < b || a == b && nodeIDs[i] < nodeIDs[j]
+			})
+			picked := false
+			for _, to := range nodeIDs {
+				i, ok := movableCopy(placement[from], placement[to], to, verdicts)
+				if !ok {
+					continue
+				}
+				relocated := placement[from][i]
+				moves = append(moves, Move{Shard: relocated, From: from, To: to})
+				relocated.State = "INITIALIZING"
+				placement[from] = append(placement[from][:i:i], placement[from][i+1:]...)
+				placement[to] = append(placement[to], relocated)
+				load[to]++
+				picked = true
+				break
+			}
+			if !picked {
+				break
+			}
+		}
+		left := 0
+		for _, shard := range placement[from] {
+			if shard.State == "STARTED" {
+				left++
+			}
+		}
+		if left > 0 {
+			fmt.Printf("%d copies cannot be moved off %s, under maintenance.\n", left, nodeName(obs, from))
+		}
+	}
+	if len(moves) > 0 {
+		fmt.Printf("Draining %d nodes under maintenance before balancing.\n", len(drained))
+	}
+	return moves
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// EmailReport mails a report at the end of every cycle that moved shards or
+// failed: its moves, the bytes relocated, how long it took and the expected
+// distribution. Host is the host:port of the SMTP server, which is talked
+// to with STARTTLS when it offers it, or over TLS from the start with TLS,
+// usually on port 465. Username and Password, if set, authenticate with
+// PLAIN.
+type EmailReport struct {
+	Host     string   `json:"host"`
+	TLS      bool     `json:"tls"`
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+}
+
+func (r *EmailReport) validate() error {
+	if _, _, err := net.SplitHostPort(r.Host); err != nil {
+		return fmt.Errorf("email_report host must be host:port: %w", err)
+	}
+	if r.From == "" || len(r.To) == 0 {
+		return fmt.Errorf("email_report needs from and to")
+	}
+	return nil
+}
+
+// mailReport sends the report of the cycle event. Failures are only
+// logged.
+func mailReport(event CycleEvent) {
+	subject, body := emailText(event)
+	if err := cfg.EmailReport.send(subject, body); err != nil {
+		fmt.Println("Error sending email report:", err)
+	}
+}
+
+func emailText(event CycleEvent) (subject, body string) {
+	var prefix string
+	if event.Cluster != "" {
+		prefix = "[" + event.Cluster + "] "
+	}
+	duration := (time.Duration(event.DurationMillis) * time.Millisecond).Round(time.Second)
+	var b strings.Builder
+	if event.Event == eventCycleFailed {
+		subject = fmt.Sprintf("%sRebalance failed after %s", prefix, duration)
+		fmt.Fprintf(&b, "The rebalance cycle started at %s failed after %s:\n\n  %s\n", event.StartedAt.Format(time.RFC1123), duration, event.Error)
+	} else {
+		subject = fmt.Sprintf("%sRebalance completed: %d moves, %s relocated", prefix, len(event.Moves), formatBytes(event.BytesRelocated))
+		fmt.Fprintf(&b, "The rebalance cycle started at %s completed in %s.\n\n", event.StartedAt.Format(time.RFC1123), duration)
+		fmt.Fprintf(&b, "Moves executed:   %d\n", len(event.Moves))
+		fmt.Fprintf(&b, "Bytes relocated:  %s\n", formatBytes(event.BytesRelocated))
+		if event.ScoreBefore != nil && event.ScoreAfter != nil {
+			fmt.Fprintf(&b, "Imbalance:        %s -> %s\n", event.ScoreBefore, event.ScoreAfter)
+		}
+		if event.LatencyRegressed {
+			fmt.Fprintf(&b, "Latency regressed: %s -> %s, %d moves rolled back\n", event.LatencyBefore, event.LatencyAfter, len(event.RolledBack))
+		}
+	}
+
+	if len(event.Distribution) > 0 {
+		names := make([]string, 0, len(event.Distribution))
+		width := len("NODE")
+		for name := range event.Distribution {
+			names = append(names, name)
+			if len(name) > width {
+				width = len(name)
+			}
+		}
+		sort.Strings(names)
+		fmt.Fprintf(&b, "\nExpected distribution:\n\n  %-*s  SHARDS\n", width, "NODE")
+		for _, name := range names {
+			fmt.Fprintf(&b, "  %-*s  %d\n", width, name, event.Distribution[name])
+		}
+	}
+	if len(event.Moves) > 0 {
+		b.WriteString("\nMoves:\n\n")
+		for _, move := range event.Moves {
+			fmt.Fprintf(&b, "  [%s][%d] %s -> %s  %s\n", move.Index, move.Shard, move.From, move.To, formatBytes(move.Bytes))
+		}
+	}
+	return subject, b.String()
+}
+
+// emailTimeout bounds the whole conversation with the SMTP server.
+const emailTimeout = 30 * time.Second
+
+func (r *EmailReport) send(subject, body string) error {
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", r.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(r.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+
+	host, _, _ := net.SplitHostPort(r.Host)
+	var auth smtp.Auth
+	if r.Username != "" {
+		auth = smtp.PlainAuth("", r.Username, r.Password, host)
+	}
+
+	dialer := &net.Dialer{Timeout: notifyClient.Timeout}
+	var conn net.Conn
+	var err error
+	if r.TLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", r.Host, &tls.Config{ServerName: host})
+	} else {
+		conn, err = dialer.Dial("tcp", r.Host)
+	}
+	if err != nil {
+		return err
+	}
+	// A server that accepts the connection and stalls must not hold up
+	// the queue of the reports.
+	conn.SetDeadline(time.Now().Add(emailTimeout))
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if !r.TLS {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+				return err
+			}
+		}
+	}
+	if auth != nil {
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(r.From); err != nil {
+		return err
+	}
+	for _, to := range r.To {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte(msg.String())); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,67 @@
+// Package esapi is the boundary between the balancer and Elasticsearch. The
+// balancer sends every request through an API: its HTTP client talking to
+// the cluster, or Fake, an in-memory cluster simulating nodes, shards and
+// relocations, for tests of the planner and executor and for demos.
+package esapi
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+)
+
+// API sends a request to the cluster. path includes the query string and
+// body, unless nil, is JSON. Responses with an error status are returned as
+// they are; errors are for requests that could not be sent.
+//
+// These are the operations of the balancer, by the endpoints they use:
+//
+//	observing      GET /_cluster/state/routing_nodes, /_nodes, /_cat/shards,
+//	               /_all/_settings/index.routing.allocation.*
+//	moving         POST /_cluster/reroute, with dry_run for the deciders
+//	throttling     GET and PUT /_cluster/settings
+//	waiting        GET /_cluster/health, /_recovery, /<index>/_recovery,
+//	               /_cat/recovery
+//	backpressure   GET /_nodes/stats, /_cluster/pending_tasks
+//	safety checks  GET /, /_cluster/state/blocks, /_snapshot/_status,
+//	               /<index>/_ilm/explain
+//	cluster lock   GET, PUT and DELETE /<lock index>/_doc/<id>
+type API interface {
+	Do(method, path string, body []byte) (*http.Response, error)
+}
+
+// Transport makes an http.Client send its requests to api, whatever their
+// host, such as to point the balancer at a Fake.
+type Transport struct {
+	API API
+}
+
+func (t Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+	}
+	resp, err := t.API.Do(req.Method, req.URL.RequestURI(), body)
+	if err != nil {
+		return nil, err
+	}
+	resp.Request = req
+	return resp, nil
+}
+
+// serve runs h on the request in process, for the APIs implemented as
+// handlers.
+func serve(h http.Handler, method, path string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec.Result(), nil
+}
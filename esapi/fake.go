@@ -0,0 +1,289 @@
+package esapi
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fake is an in-memory Elasticsearch cluster. It answers the requests of
+// the balancer, see API, from its nodes and shard copies: moves relocate
+// copies at BytesPerSec, dry runs are decided by the same-shard, data-role
+// and disk rules, and cluster settings and documents are kept. Requests it
+// does not simulate get a 404, which the balancer takes like an old or
+// restricted cluster.
+type Fake struct {
+	Name    string
+	UUID    string
+	Version string
+	// BytesPerSec is the speed of the relocations.
+	BytesPerSec int64
+	// Now is the clock of the relocations, time.Now if nil.
+	Now func() time.Time
+
+	mu            sync.Mutex
+	nodes         []*FakeNode
+	shards        []*FakeShard
+	recoveries    []fakeRecovery // completed
+	settings      map[string]map[string]interface{}
+	indexSettings map[string]map[string]string // flat
+	docs          map[string]fakeDoc
+	seqNo         int64
+}
+
+// FakeNode is a node of a Fake. DiskBytes is the size of its disk, 0 for
+// one that never fills up. The relocations to a Stalled node make no
+// progress until they are cancelled.
+type FakeNode struct {
+	ID         string
+	Name       string
+	Roles      []string
+	Attributes map[string]string
+	DiskBytes  int64
+	Stalled    bool
+}
+
+// FakeShard is a shard copy of a Fake. Target is the node it relocates to,
+// since Started.
+type FakeShard struct {
+	Index   string
+	Shard   int
+	Primary bool
+	Node    string
+	Docs    int64
+	Bytes   int64
+	Target  string
+	Started time.Time
+}
+
+type fakeRecovery struct {
+	shard          FakeShard
+	from, to       string
+	start, stopped time.Time
+}
+
+type fakeDoc struct {
+	seqNo  int64
+	source []byte
+}
+
+// NewFake returns an empty cluster.
+func NewFake() *Fake {
+	return &Fake{
+		Name:          "simulated",
+		UUID:          "simulated-cluster-uuid",
+		Version:       "8.11.0",
+		BytesPerSec:   200 << 20,
+		settings:      map[string]map[string]interface{}{"persistent": {}, "transient": {}},
+		docs:          make(map[string]fakeDoc),
+		indexSettings: make(map[string]map[string]string),
+	}
+}
+
+// AddNode adds a node, replacing the one of the same ID.
+func (f *Fake) AddNode(node FakeNode) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, n := range f.nodes {
+		if n.ID == node.ID {
+			f.nodes[i] = &node
+			return
+		}
+	}
+	f.nodes = append(f.nodes, &node)
+}
+
+// AddShard adds a shard copy, unassigned if its node is empty.
+func (f *Fake) AddShard(shard FakeShard) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.shards = append(f.shards, &shard)
+}
+
+// SetIndexSettings sets the settings of the index, flat such as
+// index.routing.allocation.require.box, replacing the ones set before.
+func (f *Fake) SetIndexSettings(index string, settings map[string]string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.indexSettings[index] = settings
+}
+
+// GenerateFake returns a cluster of nodes data nodes and indices indices of
+// shards primaries with replicas replicas each, of random sizes up to
+// maxBytes. Most of the copies are on the first nodes, as after adding
+// nodes to a cluster, for the balancer to have something to do.
+func GenerateFake(nodes, indices, shards, replicas int, maxBytes int64, rnd *rand.Rand) *Fake {
+	f := NewFake()
+	for i := 0; i < nodes; i++ {
+		f.AddNode(FakeNode{
+			ID:        fmt.Sprintf("node-%d-id", i+1),
+			Name:      fmt.Sprintf("data-%d", i+1),
+			Roles:     []string{"data", "master", "ingest"},
+			DiskBytes: 1 << 40,
+		})
+	}
+	// The older nodes, holding the copies, are the first half.
+	crowded := (nodes + 1) / 2
+	for i := 0; i < indices; i++ {
+		index := fmt.Sprintf("logs-%03d", i+1)
+		for s := 0; s < shards; s++ {
+			bytes := rnd.Int63n(maxBytes) + 1
+			docs := bytes / 512
+			used := make(map[int]bool)
+			for c := 0; c <= replicas && c < nodes; c++ {
+				node := rnd.Intn(nodes)
+				if rnd.Intn(5) > 0 {
+					node = rnd.Intn(crowded)
+				}
+				for used[node] {
+					node = (node + 1) % nodes
+				}
+				used[node] = true
+				f.AddShard(FakeShard{Index: index, Shard: s, Primary: c == 0, Node: f.nodes[node].ID, Docs: docs, Bytes: bytes})
+			}
+		}
+	}
+	return f
+}
+
+func (f *Fake) now() time.Time {
+	if f.Now != nil {
+		return f.Now()
+	}
+	return time.Now()
+}
+
+// Do implements API.
+func (f *Fake) Do(method, path string, body []byte) (*http.Response, error) {
+	return serve(f, method, path, body)
+}
+
+// advance completes the relocations that had enough time.
+func (f *Fake) advance() {
+	now := f.now()
+	for _, s := range f.shards {
+		if s.Target == "" || f.stalled(s) || now.Before(s.Started.Add(f.relocationTime(s))) {
+			continue
+		}
+		f.recoveries = append(f.recoveries, fakeRecovery{shard: *s, from: s.Node, to: s.Target, start: s.Started, stopped: now})
+		s.Node, s.Target, s.Started = s.Target, "", time.Time{}
+	}
+}
+
+// stalled tells whether the copy relocates to a Stalled node.
+func (f *Fake) stalled(s *FakeShard) bool {
+	n := f.node(s.Target)
+	return n != nil && n.Stalled
+}
+
+func (f *Fake) relocationTime(s *FakeShard) time.Duration {
+	if f.BytesPerSec <= 0 {
+		return 0
+	}
+	return time.Duration(float64(s.Bytes) / float64(f.BytesPerSec) * float64(time.Second))
+}
+
+func (f *Fake) node(id string) *FakeNode {
+	for _, n := range f.nodes {
+		if n.ID == id {
+			return n
+		}
+	}
+	return nil
+}
+
+// nodeByIDOrName resolves the node of a reroute command, which accepts both.
+func (f *Fake) nodeByIDOrName(name string) *FakeNode {
+	for _, n := range f.nodes {
+		if n.ID == name || n.Name == name {
+			return n
+		}
+	}
+	return nil
+}
+
+func isDataNode(n *FakeNode) bool {
+	for _, role := range n.Roles {
+		if role == "data" || strings.HasPrefix(role, "data_") {
+			return true
+		}
+	}
+	return false
+}
+
+// usedBytes is the size of the copies on the node, relocating ones
+// counting on both nodes.
+func (f *Fake) usedBytes(id string) int64 {
+	var used int64
+	for _, s := range f.shards {
+		if s.Node == id || s.Target == id {
+			used += s.Bytes
+		}
+	}
+	return used
+}
+
+// indices returns the names of the indices, sorted.
+func (f *Fake) indices() []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, s := range f.shards {
+		if !seen[s.Index] {
+			seen[s.Index] = true
+			names = append(names, s.Index)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// copyOn returns the copy of the shard on the node, relocating away from it
+// or not.
+func (f *Fake) copyOn(index string, shard int, node string) *FakeShard {
+	for _, s := range f.shards {
+		if s.Index == index && s.Shard == shard && (s.Node == node || s.Target == node) {
+			return s
+		}
+	}
+	return nil
+}
+
+// decide returns why the move of the copy to the node would be rejected,
+// by the decider rejecting it, or "" if it would not.
+func (f *Fake) decide(s *FakeShard, to *FakeNode) (decider, explanation string) {
+	switch {
+	case !isDataNode(to):
+		return "data_tier", fmt.Sprintf("node [%s] has no data role", to.Name)
+	case f.copyOn(s.Index, s.Shard, to.ID) != nil:
+		return "same_shard", fmt.Sprintf("a copy of this shard is already allocated to this node [%s]", to.ID)
+	case to.DiskBytes > 0 && f.usedBytes(to.ID)+s.Bytes > to.DiskBytes*90/100:
+		return "disk_threshold", fmt.Sprintf("the node [%s] is above the high watermark once the shard is allocated", to.ID)
+	}
+	return "", ""
+}
+
+// Relocate moves the copy of the shard on from to to at once, unless the
+// move would be rejected, for simulations planning cycle after cycle
+// without waiting for relocations.
+func (f *Fake) Relocate(index string, shard int, from, to string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.advance()
+	target := f.nodeByIDOrName(to)
+	if target == nil {
+		return fmt.Errorf("no node %s", to)
+	}
+	s := f.copyOn(index, shard, from)
+	if s == nil || s.Node != from || s.Target != "" {
+		return fmt.Errorf("no copy of [%s][%d] on %s to move", index, shard, from)
+	}
+	if decider, explanation := f.decide(s, target); decider != "" {
+		return fmt.Errorf("rejected by %s: %s", decider, explanation)
+	}
+	s.Node = target.ID
+	return nil
+}
@@ -0,0 +1,577 @@
+package esapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ServeHTTP answers the requests of the balancer, making Fake an
+// http.Handler that can also be served over the network.
+func (f *Fake) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.advance()
+
+	path, query := r.URL.Path, r.URL.Query()
+	switch {
+	case strings.Contains(path, "/_doc/"):
+		f.serveDoc(w, r.Method, path, query.Get("op_type"), query.Get("if_seq_no"), body)
+	case r.Method == "HEAD":
+		code := http.StatusNotFound
+		for _, index := range f.indices() {
+			if "/"+index == path {
+				code = http.StatusOK
+			}
+		}
+		w.WriteHeader(code)
+	case r.Method == "GET" && path == "/":
+		reply(w, http.StatusOK, map[string]interface{}{
+			"name":         f.masterNode().Name,
+			"cluster_name": f.Name,
+			"cluster_uuid": f.UUID,
+			"version":      map[string]interface{}{"number": f.Version},
+			"tagline":      "You Know, for Search",
+		})
+	case r.Method == "GET" && path == "/_cluster/health":
+		reply(w, http.StatusOK, f.health())
+	case r.Method == "GET" && path == "/_cluster/state/routing_nodes":
+		reply(w, http.StatusOK, f.routingNodes())
+	case r.Method == "GET" && path == "/_cluster/state/blocks":
+		reply(w, http.StatusOK, map[string]interface{}{"blocks": map[string]interface{}{}})
+	case r.Method == "GET" && path == "/_nodes":
+		reply(w, http.StatusOK, f.nodesInfo())
+	case r.Method == "GET" && strings.HasPrefix(path, "/_nodes/stats"):
+		reply(w, http.StatusOK, f.nodesStats())
+	case r.Method == "GET" && path == "/_nodes/http":
+		reply(w, http.StatusOK, map[string]interface{}{"nodes": map[string]interface{}{}})
+	case r.Method == "GET" && (path == "/_cat/shards" || strings.HasPrefix(path, "/_cat/shards/")):
+		reply(w, http.StatusOK, f.catShards(strings.TrimPrefix(strings.TrimPrefix(path, "/_cat/shards"), "/")))
+	case r.Method == "GET" && (path == "/_cat/indices" || strings.HasPrefix(path, "/_cat/indices/")):
+		reply(w, http.StatusOK, f.catIndices(strings.TrimPrefix(strings.TrimPrefix(path, "/_cat/indices"), "/")))
+	case r.Method == "GET" && path == "/_cat/recovery":
+		reply(w, http.StatusOK, f.catRecovery(query.Get("active_only") == "true"))
+	case r.Method == "GET" && strings.HasSuffix(path, "/_recovery"):
+		reply(w, http.StatusOK, f.recovery(strings.Trim(strings.TrimSuffix(path, "_recovery"), "/")))
+	case r.Method == "GET" && path == "/_cat/master":
+		master := f.masterNode()
+		reply(w, http.StatusOK, []map[string]string{{"id": master.ID, "node": master.Name}})
+	case r.Method == "GET" && path == "/_cluster/settings":
+		reply(w, http.StatusOK, f.clusterSettings(query.Get("include_defaults") == "true"))
+	case r.Method == "PUT" && path == "/_cluster/settings":
+		f.putClusterSettings(w, body)
+	case r.Method == "POST" && path == "/_cluster/reroute":
+		f.reroute(w, body, query.Get("dry_run") == "true")
+	case r.Method == "GET" && path == "/_cluster/pending_tasks":
+		reply(w, http.StatusOK, map[string]interface{}{"tasks": []interface{}{}})
+	case r.Method == "GET" && path == "/_snapshot/_status":
+		reply(w, http.StatusOK, map[string]interface{}{"snapshots": []interface{}{}})
+	case r.Method == "GET" && strings.HasPrefix(path, "/_stats"):
+		reply(w, http.StatusOK, f.indexStats())
+	case r.Method == "GET" && path == "/_cluster/stats":
+		reply(w, http.StatusOK, f.clusterStats())
+	case r.Method == "GET" && strings.HasSuffix(path, "/_ilm/explain"):
+		reply(w, http.StatusOK, map[string]interface{}{"indices": map[string]interface{}{}})
+	case r.Method == "GET" && strings.HasPrefix(path, "/_all/_settings"):
+		reply(w, http.StatusOK, f.allIndexSettings())
+	case r.Method == "GET" && strings.Contains(path, "/_settings"):
+		index := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)[0]
+		reply(w, http.StatusOK, map[string]interface{}{index: map[string]interface{}{"settings": f.indexSettings[index]}})
+	case r.Method == "PUT" && strings.HasSuffix(path, "/_settings"):
+		reply(w, http.StatusOK, map[string]interface{}{"acknowledged": true})
+	default:
+		replyError(w, http.StatusNotFound, "no handler found for uri ["+path+"] and method ["+r.Method+"]")
+	}
+}
+
+func reply(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func replyError(w http.ResponseWriter, code int, reason string) {
+	reply(w, code, map[string]interface{}{
+		"error":  map[string]interface{}{"type": "illegal_argument_exception", "reason": reason},
+		"status": code,
+	})
+}
+
+// masterNode is the first master-eligible node, the first node if none is.
+func (f *Fake) masterNode() *FakeNode {
+	for _, n := range f.nodes {
+		for _, role := range n.Roles {
+			if role == "master" {
+				return n
+			}
+		}
+	}
+	if len(f.nodes) > 0 {
+		return f.nodes[0]
+	}
+	return &FakeNode{}
+}
+
+func (f *Fake) health() map[string]interface{} {
+	var relocating, unassigned, unassignedPrimaries, active int
+	for _, s := range f.shards {
+		switch {
+		case s.Node == "":
+			unassigned++
+			if s.Primary {
+				unassignedPrimaries++
+			}
+		case s.Target != "":
+			relocating++
+			active++
+		default:
+			active++
+		}
+	}
+	status := "green"
+	if unassignedPrimaries > 0 {
+		status = "red"
+	} else if unassigned > 0 {
+		status = "yellow"
+	}
+	data := 0
+	for _, n := range f.nodes {
+		if isDataNode(n) {
+			data++
+		}
+	}
+	return map[string]interface{}{
+		"cluster_name":         f.Name,
+		"status":               status,
+		"number_of_nodes":      len(f.nodes),
+		"number_of_data_nodes": data,
+		"active_shards":        active,
+		"relocating_shards":    relocating,
+		"initializing_shards":  relocating,
+		"unassigned_shards":    unassigned,
+	}
+}
+
+// routingNodes lists the copies by node like the cluster state: a
+// relocating copy is RELOCATING on its node and INITIALIZING on its
+// target.
+func (f *Fake) routingNodes() map[string]interface{} {
+	nodes := make(map[string][]map[string]interface{})
+	unassigned := []map[string]interface{}{}
+	for _, s := range f.shards {
+		entry := map[string]interface{}{"index": s.Index, "shard": s.Shard, "primary": s.Primary, "state": "STARTED", "node": s.Node, "relocating_node": nil}
+		switch {
+		case s.Node == "":
+			entry["state"], entry["node"] = "UNASSIGNED", nil
+			unassigned = append(unassigned, entry)
+			continue
+		case s.Target != "":
+			entry["state"], entry["relocating_node"] = "RELOCATING", s.Target
+			nodes[s.Target] = append(nodes[s.Target], map[string]interface{}{
+				"index": s.Index, "shard": s.Shard, "primary": s.Primary, "state": "INITIALIZING", "node": s.Target, "relocating_node": s.Node,
+			})
+		}
+		nodes[s.Node] = append(nodes[s.Node], entry)
+	}
+	return map[string]interface{}{"routing_nodes": map[string]interface{}{"nodes": nodes, "unassigned": unassigned}}
+}
+
+func (f *Fake) nodesInfo() map[string]interface{} {
+	nodes := make(map[string]interface{})
+	for i, n := range f.nodes {
+		ip := fmt.Sprintf("10.0.0.%d", i+1)
+		nodes[n.ID] = map[string]interface{}{"name": n.Name, "host": ip, "ip": ip, "roles": n.Roles, "attributes": n.Attributes}
+	}
+	return map[string]interface{}{"nodes": nodes}
+}
+
+// nodesStats has the sections of every node stats request of the balancer:
+// fs, os, jvm and indices. The load is constant and light.
+func (f *Fake) nodesStats() map[string]interface{} {
+	nodes := make(map[string]interface{})
+	for _, n := range f.nodes {
+		fs := map[string]interface{}{"io_stats": map[string]interface{}{"total": map[string]interface{}{"io_time_in_millis": 0}}}
+		if n.DiskBytes > 0 {
+			fs["total"] = map[string]interface{}{"total_in_bytes": n.DiskBytes, "available_in_bytes": n.DiskBytes - f.usedBytes(n.ID)}
+		}
+		nodes[n.ID] = map[string]interface{}{
+			"name": n.Name,
+			"fs":   fs,
+			"os":   map[string]interface{}{"cpu": map[string]interface{}{"percent": 10}},
+			"jvm":  map[string]interface{}{"mem": map[string]interface{}{"heap_used_percent": 40}},
+			"indices": map[string]interface{}{
+				"search":   map[string]interface{}{"query_total": 0, "query_time_in_millis": 0},
+				"indexing": map[string]interface{}{"index_total": 0, "index_time_in_millis": 0},
+			},
+		}
+	}
+	return map[string]interface{}{"nodes": nodes}
+}
+
+// catShards lists the copies of the indices, of all with "" or "_all". A
+// relocating copy is listed once, on its node.
+func (f *Fake) catShards(indices string) []map[string]string {
+	rows := []map[string]string{}
+	for _, s := range f.shards {
+		if !matchesIndex(indices, s.Index) {
+			continue
+		}
+		row := map[string]string{"index": s.Index, "shard": strconv.Itoa(s.Shard), "prirep": "r", "state": "STARTED", "docs": strconv.FormatInt(s.Docs, 10), "store": strconv.FormatInt(s.Bytes, 10)}
+		if s.Primary {
+			row["prirep"] = "p"
+		}
+		switch {
+		case s.Node == "":
+			row["state"], row["docs"], row["store"] = "UNASSIGNED", "", ""
+		case s.Target != "":
+			row["state"] = "RELOCATING"
+			fallthrough
+		default:
+			row["id"] = s.Node
+			if n := f.node(s.Node); n != nil {
+				row["node"] = n.Name
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+func (f *Fake) catIndices(indices string) []map[string]string {
+	rows := []map[string]string{}
+	for _, index := range f.indices() {
+		if !matchesIndex(indices, index) {
+			continue
+		}
+		var primaries, copies int
+		var docs, bytes int64
+		for _, s := range f.shards {
+			if s.Index != index {
+				continue
+			}
+			copies++
+			bytes += s.Bytes
+			if s.Primary {
+				primaries++
+				docs += s.Docs
+			}
+		}
+		replicas := 0
+		if primaries > 0 {
+			replicas = copies/primaries - 1
+		}
+		rows = append(rows, map[string]string{
+			"index": index, "pri": strconv.Itoa(primaries), "rep": strconv.Itoa(replicas),
+			"health": "green", "status": "open", "docs.count": strconv.FormatInt(docs, 10), "store.size": strconv.FormatInt(bytes, 10),
+		})
+	}
+	return rows
+}
+
+// matchesIndex tells whether the index is among the comma-separated names,
+// all of them matching "" and "_all".
+func matchesIndex(names, index string) bool {
+	if names == "" || names == "_all" {
+		return true
+	}
+	for _, name := range strings.Split(names, ",") {
+		if name == index {
+			return true
+		}
+	}
+	return false
+}
+
+// catRecovery lists the running relocations, then with !activeOnly the
+// completed ones.
+func (f *Fake) catRecovery(activeOnly bool) []map[string]string {
+	now := f.now()
+	rows := []map[string]string{}
+	add := func(s FakeShard, from, to, stage string, start, stop int64) {
+		rows = append(rows, map[string]string{
+			"index": s.Index, "shard": strconv.Itoa(s.Shard), "type": "peer", "stage": stage,
+			"source_node": f.nodeName(from), "target_node": f.nodeName(to),
+			"bytes_total": strconv.FormatInt(s.Bytes, 10), "time": strconv.FormatInt(stop-start, 10), "start_time_ms": strconv.FormatInt(start, 10),
+		})
+	}
+	for _, s := range f.shards {
+		if s.Target != "" {
+			add(*s, s.Node, s.Target, "index", s.Started.UnixMilli(), now.UnixMilli())
+		}
+	}
+	if !activeOnly {
+		for _, r := range f.recoveries {
+			add(r.shard, r.from, r.to, "done", r.start.UnixMilli(), r.stopped.UnixMilli())
+		}
+	}
+	return rows
+}
+
+// recovery is the detailed progress of the running relocations of the
+// indices, see matchesIndex, by index. There is no translog to replay.
+func (f *Fake) recovery(indices string) map[string]interface{} {
+	now := f.now()
+	progress := make(map[string]interface{})
+	for _, s := range f.shards {
+		if s.Target == "" || !matchesIndex(indices, s.Index) {
+			continue
+		}
+		elapsed := now.Sub(s.Started)
+		recovered := s.Bytes
+		if f.stalled(s) {
+			recovered = 0
+		} else if total := f.relocationTime(s); total > 0 && elapsed < total {
+			recovered = int64(float64(s.Bytes) * float64(elapsed) / float64(total))
+		}
+		entry, _ := progress[s.Index].(map[string]interface{})
+		if entry == nil {
+			entry = map[string]interface{}{"shards": []interface{}{}}
+			progress[s.Index] = entry
+		}
+		entry["shards"] = append(entry["shards"].([]interface{}), map[string]interface{}{
+			"id": s.Shard, "type": "PEER", "stage": "INDEX",
+			"target":               map[string]interface{}{"id": s.Target},
+			"index":                map[string]interface{}{"size": map[string]interface{}{"total_in_bytes": s.Bytes, "recovered_in_bytes": recovered}},
+			"translog":             map[string]interface{}{"total": 0, "recovered": 0},
+			"total_time_in_millis": elapsed.Milliseconds(),
+		})
+	}
+	return progress
+}
+
+func (f *Fake) nodeName(id string) string {
+	if n := f.node(id); n != nil {
+		return n.Name
+	}
+	return id
+}
+
+// fakeSettingDefaults are the defaults of the cluster settings the
+// balancer reads.
+var fakeSettingDefaults = map[string]interface{}{
+	"cluster.routing.allocation.enable":                            "all",
+	"cluster.routing.rebalance.enable":                             "all",
+	"cluster.routing.allocation.node_concurrent_recoveries":        "2",
+	"cluster.routing.allocation.cluster_concurrent_rebalance":      "2",
+	"cluster.routing.allocation.disk.watermark.low":                "85%",
+	"cluster.routing.allocation.disk.watermark.high":               "90%",
+	"cluster.routing.allocation.disk.watermark.flood_stage":        "95%",
+	"indices.recovery.max_bytes_per_sec":                           "40mb",
+	"cluster.routing.allocation.node_initial_primaries_recoveries": "4",
+}
+
+func (f *Fake) clusterSettings(includeDefaults bool) map[string]interface{} {
+	resp := map[string]interface{}{"persistent": f.settings["persistent"], "transient": f.settings["transient"]}
+	if includeDefaults {
+		resp["defaults"] = fakeSettingDefaults
+	}
+	return resp
+}
+
+// putClusterSettings applies an update of flat settings, null resetting a
+// setting.
+func (f *Fake) putClusterSettings(w http.ResponseWriter, body []byte) {
+	var update map[string]map[string]interface{}
+	if err := json.Unmarshal(body, &update); err != nil {
+		replyError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	for scope, settings := range update {
+		if f.settings[scope] == nil {
+			replyError(w, http.StatusBadRequest, "unknown settings scope ["+scope+"]")
+			return
+		}
+		for name, value := range settings {
+			if value == nil {
+				delete(f.settings[scope], name)
+			} else {
+				f.settings[scope][name] = value
+			}
+		}
+	}
+	reply(w, http.StatusOK, map[string]interface{}{"acknowledged": true, "persistent": update["persistent"], "transient": update["transient"]})
+}
+
+type rerouteRequest struct {
+	Commands []struct {
+		Move *struct {
+			Index    string `json:"index"`
+			Shard    int    `json:"shard"`
+			FromNode string `json:"from_node"`
+			ToNode   string `json:"to_node"`
+		} `json:"move"`
+		Cancel *struct {
+			Index string `json:"index"`
+			Shard int    `json:"shard"`
+			Node  string `json:"node"`
+		} `json:"cancel"`
+	} `json:"commands"`
+}
+
+// reroute runs the move and cancel commands, or with dryRun explains the
+// decisions on them. Other commands are acknowledged and ignored.
+func (f *Fake) reroute(w http.ResponseWriter, body []byte, dryRun bool) {
+	var req rerouteRequest
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &req); err != nil {
+			replyError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	var explanations []interface{}
+	for _, c := range req.Commands {
+		switch {
+		case c.Move != nil:
+			m := c.Move
+			from, to := f.nodeByIDOrName(m.FromNode), f.nodeByIDOrName(m.ToNode)
+			if from == nil || to == nil {
+				replyError(w, http.StatusBadRequest, fmt.Sprintf("failed to resolve [%s] or [%s]", m.FromNode, m.ToNode))
+				return
+			}
+			s := f.copyOn(m.Index, m.Shard, from.ID)
+			if s == nil || s.Node != from.ID || s.Target != "" {
+				replyError(w, http.StatusBadRequest, fmt.Sprintf("[move_allocation] can't move [%s][%d], failed to find it on node {%s}", m.Index, m.Shard, from.Name))
+				return
+			}
+			decider, explanation := f.decide(s, to)
+			decision := map[string]interface{}{"decider": "move_allocation_command", "decision": "YES", "explanation": "moving is allowed"}
+			if decider != "" {
+				decision = map[string]interface{}{"decider": decider, "decision": "NO", "explanation": explanation}
+			}
+			explanations = append(explanations, map[string]interface{}{"command": "move", "parameters": m, "decisions": []interface{}{decision}})
+			if dryRun {
+				continue
+			}
+			if decider != "" {
+				replyError(w, http.StatusBadRequest, fmt.Sprintf("[move_allocation] can't move [%s][%d] from %s to %s: %s", m.Index, m.Shard, from.Name, to.Name, explanation))
+				return
+			}
+			s.Target, s.Started = to.ID, f.now()
+		case c.Cancel != nil && !dryRun:
+			for _, s := range f.shards {
+				if s.Index == c.Cancel.Index && s.Shard == c.Cancel.Shard && s.Target != "" && f.nodeMatches(c.Cancel.Node, s.Node, s.Target) {
+					s.Target, s.Started = "", time.Time{}
+				}
+			}
+		}
+	}
+	reply(w, http.StatusOK, map[string]interface{}{"acknowledged": true, "explanations": explanations})
+}
+
+// nodeMatches tells whether name, an ID or name, is one of the nodes.
+func (f *Fake) nodeMatches(name string, ids ...string) bool {
+	n := f.nodeByIDOrName(name)
+	for _, id := range ids {
+		if n != nil && n.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// indexStats has the indexing and search totals of every index, which stay
+// at 0.
+// allIndexSettings answers GET /_all/_settings, flat, the filter of the
+// settings asked for not applied.
+func (f *Fake) allIndexSettings() map[string]interface{} {
+	indices := make(map[string]interface{}, len(f.indexSettings))
+	for index, settings := range f.indexSettings {
+		indices[index] = map[string]interface{}{"settings": settings}
+	}
+	return indices
+}
+
+func (f *Fake) indexStats() map[string]interface{} {
+	indices := make(map[string]interface{})
+	for _, index := range f.indices() {
+		indices[index] = map[string]interface{}{"total": map[string]interface{}{
+			"indexing": map[string]interface{}{"index_total": 0},
+			"search":   map[string]interface{}{"query_total": 0},
+		}}
+	}
+	return map[string]interface{}{"indices": indices}
+}
+
+func (f *Fake) clusterStats() map[string]interface{} {
+	var primaries, total int
+	var docs, bytes int64
+	for _, s := range f.shards {
+		if s.Node == "" {
+			continue
+		}
+		total++
+		bytes += s.Bytes
+		if s.Primary {
+			primaries++
+			docs += s.Docs
+		}
+	}
+	var disk, available int64
+	data := 0
+	for _, n := range f.nodes {
+		if isDataNode(n) {
+			data++
+		}
+		disk += n.DiskBytes
+		if n.DiskBytes > 0 {
+			available += n.DiskBytes - f.usedBytes(n.ID)
+		}
+	}
+	return map[string]interface{}{
+		"cluster_name": f.Name,
+		"status":       f.health()["status"],
+		"indices": map[string]interface{}{
+			"count":  len(f.indices()),
+			"shards": map[string]interface{}{"total": total, "primaries": primaries},
+			"docs":   map[string]interface{}{"count": docs},
+			"store":  map[string]interface{}{"size_in_bytes": bytes},
+		},
+		"nodes": map[string]interface{}{
+			"count": map[string]interface{}{"total": len(f.nodes), "data": data},
+			"jvm":   map[string]interface{}{"mem": map[string]interface{}{"heap_used_in_bytes": int64(len(f.nodes)) << 30, "heap_max_in_bytes": int64(len(f.nodes)) << 31}},
+			"fs":    map[string]interface{}{"total_in_bytes": disk, "available_in_bytes": available},
+		},
+	}
+}
+
+// serveDoc keeps documents, with the optimistic concurrency of the cluster
+// lock: op_type=create fails if the document exists, if_seq_no if it
+// changed.
+func (f *Fake) serveDoc(w http.ResponseWriter, method, path, opType, ifSeqNo string, body []byte) {
+	doc, found := f.docs[path]
+	conflict := found && opType == "create" || ifSeqNo != "" && (!found || strconv.FormatInt(doc.seqNo, 10) != ifSeqNo)
+	switch method {
+	case "GET":
+		if !found {
+			reply(w, http.StatusNotFound, map[string]interface{}{"found": false})
+			return
+		}
+		reply(w, http.StatusOK, map[string]interface{}{"found": true, "_seq_no": doc.seqNo, "_primary_term": 1, "_source": json.RawMessage(doc.source)})
+	case "PUT", "POST":
+		if conflict {
+			replyError(w, http.StatusConflict, "version conflict")
+			return
+		}
+		f.seqNo++
+		f.docs[path] = fakeDoc{seqNo: f.seqNo, source: body}
+		reply(w, http.StatusCreated, map[string]interface{}{"result": "created", "_seq_no": f.seqNo, "_primary_term": 1})
+	case "DELETE":
+		if !found {
+			reply(w, http.StatusNotFound, map[string]interface{}{"result": "not_found"})
+			return
+		}
+		if conflict {
+			replyError(w, http.StatusConflict, "version conflict")
+			return
+		}
+		delete(f.docs, path)
+		reply(w, http.StatusOK, map[string]interface{}{"result": "deleted"})
+	default:
+		replyError(w, http.StatusMethodNotAllowed, "method ["+method+"] not allowed")
+	}
+}
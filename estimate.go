@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// MoveEstimate is a planned move with its expected duration.
+type MoveEstimate struct {
+	Move       Move
+	Bytes      int64
+	Throughput float64 // bytes per second
+	Duration   time.Duration
+}
+
+type RecoveryHistoryEntry struct {
+	Index      string `json:"index"`
+	Shard      string `json:"shard"`
+	Type       string `json:"type"`
+	Stage      string `json:"stage"`
+	SourceNode string `json:"source_node"`
+	TargetNode string `json:"target_node"`
+	BytesTotal string `json:"bytes_total"`
+	Time       string `json:"time"`
+
+	StartTimeMillis string `json:"start_time_ms"`
+}
+
+// throughputModel holds recovery throughput in bytes per second to estimate
+// how long a move takes: what was learned over time, and what the recoveries
+// Elasticsearch currently reports show per node pair and per target node.
+type throughputModel struct {
+	learned *ThroughputStore
+	names   map[string]string // node ID to name
+	tiers   map[string]string // node ID to data tier
+
+	pairs   map[string]float64
+	targets map[string]float64
+	overall float64
+}
+
+func pairKey(from, to string) string {
+	return from + "|" + to
+}
+
+// observedThroughput derives the recovery throughput from the completed
+// peer recoveries Elasticsearch still reports, and adds the new ones to the
+// learned throughput store.
+func observedThroughput(obs *Observation) throughputModel {
+	model := throughputModel{
+		learned: loadThroughputStore(),
+		names:   map[string]string{},
+		tiers:   map[string]string{},
+		pairs:   map[string]float64{},
+		targets: map[string]float64{},
+	}
+	ids := make(map[string]string, len(obs.Nodes.Nodes))
+	tiersByName := make(map[string]string, len(obs.Nodes.Nodes))
+	for id, node := range obs.Nodes.Nodes {
+		ids[node.Name] = id
+		model.names[id] = node.Name
+		model.tiers[id] = nodeTier(node)
+		tiersByName[node.Name] = nodeTier(node)
+	}
+
+	var history []RecoveryHistoryEntry
+	if err := esGet("/_cat/recovery?format=json&bytes=b&time=ms&h=index,shard,type,stage,source_node,target_node,bytes_total,time,start_time_ms", &history); err != nil {
+		fmt.Println("Error getting recovery history, using the learned or default throughput:", err)
+		return model
+	}
+	model.learned.learn(history, tiersByName)
+	model.learned.save()
+
+	type total struct{ bytes, seconds float64 }
+	pairs, targets := map[string]*total{}, map[string]*total{}
+	var overall total
+	add := func(m map[string]*total, key string, bytes, seconds float64) {
+		if m[key] == nil {
+			m[key] = &total{}
+		}
+		m[key].bytes += bytes
+		m[key].seconds += seconds
+	}
+	for _, r := range history {
+		if r.Type != "peer" || r.Stage != "done" {
+			continue
+		}
+		bytes, _ := strconv.ParseFloat(r.BytesTotal, 64)
+		millis, _ := strconv.ParseFloat(r.Time, 64)
+		if bytes <= 0 || millis <= 0 {
+			continue
+		}
+		from, to := ids[r.SourceNode], ids[r.TargetNode]
+		add(pairs, pairKey(from, to), bytes, millis/1000)
+		add(targets, to, bytes, millis/1000)
+		overall.bytes += bytes
+		overall.seconds += millis / 1000
+	}
+
+	for key, t := range pairs {
+		model.pairs[key] = t.bytes / t.seconds
+	}
+	for key, t := range targets {
+		model.targets[key] = t.bytes / t.seconds
+	}
+	if overall.seconds > 0 {
+		model.overall = overall.bytes / overall.seconds
+	}
+	return model
+}
+
+// rate returns the best known throughput for a move between two nodes,
+// falling back from the node pair to the data tier of the target, the
+// target node, the whole cluster and finally the configured default.
+func (m throughputModel) rate(from, to string) float64 {
+	if s := m.learned.Pairs[pairKey(m.names[from], m.names[to])]; s != nil && s.BytesPerSec > 0 {
+		return s.BytesPerSec
+	}
+	if r := m.pairs[pairKey(from, to)]; r > 0 {
+		return r
+	}
+	if s := m.learned.Tiers[m.tiers[to]]; s != nil && s.BytesPerSec > 0 {
+		return s.BytesPerSec
+	}
+	if r := m.targets[to]; r > 0 {
+		return r
+	}
+	if m.overall > 0 {
+		return m.overall
+	}
+	return float64(cfg.DefaultRecoveryThroughput)
+}
+
+func estimatePlan(obs *Observation, moves []Move) []MoveEstimate {
+	model := observedThroughput(obs)
+	estimates := make([]MoveEstimate, 0, len(moves))
+	for _, move := range moves {
+		e := MoveEstimate{
+			Move:       move,
+			Bytes:      move.Bytes,
+			Throughput: model.rate(move.From, move.To),
+		}
+		if e.Throughput > 0 {
+			e.Duration = time.Duration(float64(e.Bytes) / e.Throughput * float64(time.Second))
+		}
+		estimates = append(estimates, e)
+	}
+	return estimates
+}
+
+// printPlan prints the planned moves with their size and estimated
+// duration. Moves run one after the other, so the total is the sum.
+func printPlan(estimates []MoveEstimate) {
+	var totalBytes int64
+	var totalDuration time.Duration
+	for _, e := range estimates {
+		totalBytes += e.Bytes
+		totalDuration += e.Duration
+	}
+	fmt.Printf("Plan: %d moves, %s to relocate, estimated %s\n", len(estimates), formatBytes(totalBytes), totalDuration.Round(time.Second))
+	for _, e := range estimates {
+		fmt.Printf("  [%s][%d] %s -> %s  %s  ~%s at %s/s\n", e.Move.Shard.Index, e.Move.Shard.Shard, e.Move.From, e.Move.To,
+			formatBytes(e.Bytes), e.Duration.Round(time.Second), formatBytes(int64(e.Throughput)))
+	}
+}
+
+// planCommand prints the moves a cycle would make now, without making them.
+//
+//	plan
+func planCommand(args []string) error {
+	obs, err := observeCluster()
+	if err != nil {
+		return fmt.Errorf("observing cluster: %w", err)
+	}
+	smoothed.observe(obs.Distribution)
+	estimates := estimatePlan(obs, planMoves(obs))
+	if jsonOutput() {
+		emit("plan", planResponse(obs, estimates))
+		return nil
+	}
+	if len(estimates) == 0 {
+		fmt.Println("Cluster is already balanced.")
+		return nil
+	}
+	printPlan(estimates)
+	return nil
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
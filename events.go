@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The topics of the event bus and the type of their events.
+const (
+	topicCycle  = "cycle"  // CycleEvent: cycles starting and ending, allocation alarms
+	topicMove   = "move"   // MoveRecord: moves issued and their outcome
+	topicSafety = "safety" // SafetyEvent: what the operator may need to review
+)
+
+// SafetyEvent is an event worth reviewing later, such as a move whose
+// result does not match expectations or a change made on request.
+type SafetyEvent struct {
+	Time   time.Time
+	Name   string
+	Fields map[string]interface{}
+}
+
+// eventBus delivers events to the subscribers of their topic. Delivery is
+// synchronous and in subscription order, so that an event is handled by
+// every consumer once publish returns; the consumers talking to the network
+// only queue it there, see eventQueue.
+type eventBus struct {
+	mu          sync.RWMutex
+	subscribers map[string][]func(event interface{})
+}
+
+var bus = &eventBus{subscribers: make(map[string][]func(event interface{}))}
+
+func (b *eventBus) subscribe(topic string, fn func(event interface{})) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscribers[topic] = append(b.subscribers[topic], fn)
+}
+
+func (b *eventBus) publish(topic string, event interface{}) {
+	b.mu.RLock()
+	subscribers := b.subscribers[topic]
+	b.mu.RUnlock()
+	for _, fn := range subscribers {
+		fn(event)
+	}
+}
+
+// eventQueueSize is how many events may wait for a queued consumer.
+const eventQueueSize = 256
+
+// queuedEvents counts the events waiting in all the eventQueues.
+var queuedEvents atomic.Int64
+
+// eventQueue runs a consumer sending events over the network on a goroutine
+// of its own, in the order they were published, so that a slow or
+// unreachable endpoint does not hold up the cycle. Events published while
+// the queue is full are dropped.
+type eventQueue struct {
+	name   string
+	events chan func()
+}
+
+func newEventQueue(name string) *eventQueue {
+	q := &eventQueue{name: name, events: make(chan func(), eventQueueSize)}
+	go func() {
+		for deliver := range q.events {
+			deliver()
+			queuedEvents.Add(-1)
+		}
+	}()
+	return q
+}
+
+func (q *eventQueue) push(deliver func()) {
+	queuedEvents.Add(1)
+	select {
+	case q.events <- deliver:
+	default:
+		queuedEvents.Add(-1)
+		fmt.Printf("Too many events waiting for the %s, dropping one.\n", q.name)
+	}
+}
+
+// flushEvents waits up to timeout for the queued events to be delivered,
+// before the process exits.
+func flushEvents(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for queuedEvents.Load() > 0 {
+		if time.Now().After(deadline) {
+			fmt.Printf("%d events still undelivered after %s, exiting anyway.\n", queuedEvents.Load(), timeout)
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// subscribeConsumers wires the consumers of the events: the controller
+// behind the admin API, the trend of its dashboard, the notifiers, the
+// report sinks and email reports, the metrics, the health guard and
+// incidents, the audit log, the traces and the JSON output. New consumers
+// are added here.
+func subscribeConsumers() {
+	bus.subscribe(topicCycle, func(e interface{}) {
+		event := e.(CycleEvent)
+		if event.Event == eventCycleCompleted || event.Event == eventCycleFailed {
+			ctl.cycleEnded(event)
+		}
+	})
+	bus.subscribe(topicMove, func(e interface{}) {
+		if record := e.(MoveRecord); record.Result == moveResultIssued {
+			ctl.moveIssued(record.move())
+		}
+	})
+	if cfg.AdminListen != "" {
+		bus.subscribe(topicCycle, func(e interface{}) {
+			if event := e.(CycleEvent); event.Event == eventCycleCompleted || event.Event == eventCycleFailed {
+				recordTrend(event)
+			}
+		})
+	}
+
+	// Cycles that found nothing to move are not announced, to keep the
+	// channels quiet.
+	notifications := newEventQueue("notifications")
+	bus.subscribe(topicCycle, func(e interface{}) {
+		if event := e.(CycleEvent); event.Event != eventCycleCompleted || len(event.Moves) > 0 {
+			notifications.push(func() { notify(event) })
+		}
+	})
+	reports := newEventQueue("report sinks")
+	bus.subscribe(topicCycle, func(e interface{}) {
+		event := e.(CycleEvent)
+		if event.Event == eventCycleCompleted && len(event.Moves) > 0 || event.Event == eventCycleFailed {
+			reports.push(func() { shipReport(reportCycle, event.Event, event) })
+		}
+	})
+	if cfg.EmailReport != nil {
+		mails := newEventQueue("email reports")
+		bus.subscribe(topicCycle, func(e interface{}) {
+			event := e.(CycleEvent)
+			if event.Event == eventCycleCompleted && len(event.Moves) > 0 || event.Event == eventCycleFailed {
+				mails.push(func() { mailReport(event) })
+			}
+		})
+	}
+
+	bus.subscribe(topicCycle, func(e interface{}) { counters.add("cycles", e.(CycleEvent).Event) })
+	bus.subscribe(topicMove, func(e interface{}) { counters.add("moves", e.(MoveRecord).Result) })
+	if cfg.HealthGuard != nil {
+		bus.subscribe(topicMove, func(e interface{}) { guard.moveEvent(e.(MoveRecord)) })
+	}
+	if cfg.Incidents != nil {
+		pages := newEventQueue("incidents")
+		bus.subscribe(topicCycle, func(e interface{}) { pages.push(func() { incidents.cycleEvent(e.(CycleEvent)) }) })
+		bus.subscribe(topicMove, func(e interface{}) { pages.push(func() { incidents.moveEvent(e.(MoveRecord)) }) })
+	}
+	if cfg.StatsDAddress != "" {
+		bus.subscribe(topicCycle, func(e interface{}) { statsd.cycleEvent(e.(CycleEvent)) })
+		bus.subscribe(topicMove, func(e interface{}) { statsd.moveEvent(e.(MoveRecord)) })
+	}
+
+	bus.subscribe(topicSafety, func(e interface{}) { logAudit(e.(SafetyEvent)) })
+
+	// The spans are timed when the event is published, and only exported
+	// from the queue.
+	if cfg.OTLPEndpoint != "" {
+		exports := newEventQueue("span exports")
+		bus.subscribe(topicCycle, func(e interface{}) {
+			spans := traces.cycleEvent(e.(CycleEvent))
+			exports.push(func() { exportSpans(spans) })
+		})
+		bus.subscribe(topicMove, func(e interface{}) {
+			spans := traces.moveEvent(e.(MoveRecord))
+			exports.push(func() { exportSpans(spans) })
+		})
+	}
+
+	bus.subscribe(topicCycle, func(e interface{}) { emit("cycle", e) })
+	bus.subscribe(topicMove, func(e interface{}) { emit("move", e) })
+}
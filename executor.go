@@ -0,0 +1,421 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/tjandrayana/elasticsearch-rebalance-shard/observer"
+)
+
+// What a cycle does once one of its moves failed, see cfg.OnMoveFailure.
+const (
+	onMoveFailureContinue = "continue" // issue the remaining moves
+	onMoveFailureAbort    = "abort"    // issue no further move
+	onMoveFailureRollback = "rollback" // also move back the executed moves
+)
+
+// executePlan runs the moves in stages of cfg.StageSize moves. Between two
+// stages it waits for the relocations to settle, observes the cluster again
+// and only carries on if the executed moves landed, the imbalance did not
+// grow and the remaining moves are still valid. It returns the moves that
+// were issued, and failed when a failed move aborted the plan, see
+// cfg.OnMoveFailure.
+func executePlan(obs *Observation, moves []Move) (all []Move, failed bool) {
+	if cfg.ReplanEvery > 0 {
+		return executeReplanning(moves)
+	}
+
+	stages := splitStages(moves, cfg.StageSize)
+	imbalance := planImbalance(obs)
+	for i, stage := range stages {
+		fmt.Printf("Executing stage %d/%d (%d moves)...\n", i+1, len(stages), len(stage))
+		executed, stopped, failed := executeMoves(stage)
+		all = append(all, executed...)
+		if stopped || i == len(stages)-1 {
+			return all, failed
+		}
+
+		next, ok := checkpoint(executed, flattenStages(stages[i+1:]), imbalance)
+		if !ok {
+			fmt.Printf("Aborting the remaining %d stages.\n", len(stages)-i-1)
+			return all, false
+		}
+		imbalance = next
+	}
+	return all, false
+}
+
+// executeReplanning issues cfg.ReplanEvery moves at a time and plans the
+// rest again from a fresh cluster state, since allocations done by
+// Elasticsearch itself or deleted indices can make the original plan stale.
+// The cycle never executes more moves than the initial plan had.
+func executeReplanning(moves []Move) (all []Move, failed bool) {
+	budget := len(moves)
+	for len(moves) > 0 && budget > 0 {
+		batch := moves
+		if len(batch) > cfg.ReplanEvery {
+			batch = batch[:cfg.ReplanEvery]
+		}
+		if len(batch) > budget {
+			batch = batch[:budget]
+		}
+		budget -= len(batch)
+
+		executed, stopped, failed := executeMoves(batch)
+		all = append(all, executed...)
+		if stopped || budget == 0 {
+			return all, failed
+		}
+
+		obs, err := observeCluster()
+		if err != nil {
+			fmt.Println("Error observing cluster, stopping:", err)
+			return all, false
+		}
+		moves = planMoves(obs)
+		fmt.Printf("Re-planned: %d moves left.\n", len(moves))
+	}
+	return all, false
+}
+
+// executeMoves issues the moves one after the other, or up to
+// cfg.MaxConcurrentRelocations at a time, see relocationTracker. It reports
+// stopped when the cluster is too busy to take more relocations, and also
+// failed when a move failed and cfg.OnMoveFailure does not continue. It
+// returns once the concurrent moves completed. The retries of stalled moves
+// are issued like the other moves once they are known, and replace the
+// cancelled moves in executed, see stalledMoves.
+func executeMoves(moves []Move) (executed []Move, stopped, failed bool) {
+	var anyFailed atomic.Bool
+	var stalls stalledMoves
+	var tracker *relocationTracker
+	if cfg.MaxConcurrentRelocations > 0 {
+		tracker = newRelocationTracker()
+	}
+	defer func() {
+		if tracker != nil {
+			tracker.wait()
+		}
+		executed = withoutMoves(executed, stalls.cancelledMoves())
+		if anyFailed.Load() && cfg.OnMoveFailure != onMoveFailureContinue {
+			stopped, failed = true, true
+		}
+	}()
+	complete := func(move Move, before ShardStats, start time.Time, track bool) {
+		err := completeMove(move, before, start, track)
+		if errors.Is(err, errStalled) && stalls.add(move) {
+			return
+		}
+		if err != nil {
+			anyFailed.Store(true)
+		}
+	}
+
+	for len(moves) > 0 {
+		for i, move := range moves {
+			if tracker != nil {
+				tracker.acquire(move)
+			}
+			if anyFailed.Load() && cfg.OnMoveFailure != onMoveFailureContinue {
+				if tracker != nil {
+					tracker.release(move)
+				}
+				fmt.Printf("A move failed, not issuing the remaining %d moves (on_move_failure %s).\n", len(moves)-i, cfg.OnMoveFailure)
+				return executed, true, true
+			}
+			before, start, outcome := issueMove(move)
+			if outcome != moveIssued {
+				if tracker != nil {
+					tracker.release(move)
+				}
+				if outcome == stopIssuing {
+					return executed, true, false
+				}
+				if outcome == moveFailed {
+					anyFailed.Store(true)
+				}
+				continue
+			}
+			executed = append(executed, move)
+			if tracker != nil {
+				move := move
+				tracker.track(move, func() { complete(move, before, start, true) })
+			} else {
+				complete(move, before, start, false)
+			}
+		}
+		if tracker != nil {
+			tracker.wait()
+		}
+		moves = stalls.takeRetries()
+	}
+	return executed, false, false
+}
+
+// issueOutcome is what came of issueMove.
+type issueOutcome int
+
+const (
+	moveIssued    issueOutcome = iota
+	moveNotIssued              // skipped or rejected by the checks
+	moveFailed                 // the reroute failed
+	stopIssuing                // no further move should be issued
+)
+
+// issueMove runs the checks of a move and issues it. It returns the stats of
+// the copy before the move when verifying moves.
+func issueMove(move Move) (before ShardStats, start time.Time, outcome issueOutcome) {
+	if ctl.isPaused() {
+		fmt.Println("Balancer paused, not issuing further moves.")
+		return before, start, stopIssuing
+	}
+	if !ctl.isLeader() {
+		fmt.Println("Lost the leadership, not issuing further moves.")
+		return before, start, stopIssuing
+	}
+	if lockLost() {
+		fmt.Println("Lost the cluster lock, not issuing further moves.")
+		return before, start, stopIssuing
+	}
+	if !guard.allows() || !breaker.allowsMove() {
+		return before, start, stopIssuing
+	}
+	if !inMaintenanceWindow(time.Now()) {
+		fmt.Println("Maintenance window closed, not issuing further moves.")
+		return before, start, stopIssuing
+	}
+
+	// Don't pile onto a cluster that is already busy recovering
+	if recoveryStorm() {
+		return before, start, stopIssuing
+	}
+	if !waitForCalm() {
+		return before, start, stopIssuing
+	}
+
+	// The index may have been deleted since planning, which the
+	// reroute would only report as an opaque error.
+	if exists, err := indexExists(move.Shard.Index); err == nil && !exists {
+		fmt.Printf("Index %s was deleted since planning, skipping move of [%s][%d].\n", move.Shard.Index, move.Shard.Index, move.Shard.Shard)
+		record := moveRecord(move, moveResultSkipped)
+		record.Error = "index was deleted"
+		recordMoves(record)
+		return before, start, moveNotIssued
+	}
+
+	// Windows of policies may have opened since planning.
+	if policy := deniedBy(move.Shard.Index); policy != "" {
+		record := moveRecord(move, moveResultRejected)
+		record.Error = "denied by policy " + policy
+		fmt.Printf("Not moving [%s][%d]: %s.\n", move.Shard.Index, move.Shard.Shard, record.Error)
+		recordMoves(record)
+		return before, start, moveNotIssued
+	}
+
+	if node, until, ok := moveCoolingDown(move); ok {
+		record := moveRecord(move, moveResultSkipped)
+		record.Error = fmt.Sprintf("node %s cools down until %s", node, until.Format(time.RFC3339))
+		fmt.Printf("Skipping move of [%s][%d]: %s.\n", move.Shard.Index, move.Shard.Shard, record.Error)
+		recordMoves(record)
+		return before, start, moveNotIssued
+	}
+
+	if cfg.DryRunMoves {
+		if ok, reason := moveAllowed(move, nil); !ok {
+			record := moveRecord(move, moveResultRejected)
+			record.Error = reason
+			recordMoves(record)
+			return before, start, moveNotIssued
+		}
+	}
+
+	if cfg.VerifyMoves {
+		var err error
+		if before, err = getShardCopyStats(move.Shard, move.From); err != nil {
+			fmt.Println("Error getting shard stats, skipping move:", err)
+			record := moveRecord(move, moveResultSkipped)
+			record.Error = err.Error()
+			recordMoves(record)
+			return before, start, moveNotIssued
+		}
+	}
+
+	start = time.Now()
+	if err := moveShard(move.Shard, move.From, move.To); err != nil {
+		record := moveRecord(move, moveResultFailed)
+		record.Error = err.Error()
+		recordMoves(record)
+		return before, start, moveFailed
+	}
+	bus.publish(topicMove, moveRecord(move, moveResultIssued))
+	touches.touch(move.From, move.To)
+	smoothed.moved(move)
+	return before, start, moveIssued
+}
+
+// completeMove records the outcome of an issued move and returns why it
+// failed. Verified moves and, with track or cfg.StallTimeout, all moves are
+// waited for; otherwise the next move follows after a pause.
+func completeMove(move Move, before ShardStats, start time.Time, track bool) error {
+	record := moveRecord(move, moveResultExecuted)
+	waited := cfg.VerifyMoves || track || cfg.StallTimeout.Duration > 0
+	var err error
+	switch {
+	case cfg.VerifyMoves:
+		err = verifyMove(move, before)
+	case waited:
+		if _, err = waitForMove(move); err != nil {
+			fmt.Println("Error waiting for move:", err)
+		}
+	default:
+		time.Sleep(5 * time.Second) // Give some time for the move to complete
+	}
+	if err != nil {
+		record.Result = moveResultFailed
+		record.Error = err.Error()
+	}
+	// Only the moves waited for have a known duration.
+	if waited {
+		record.DurationMillis = time.Since(start).Milliseconds()
+	}
+	recordMoves(record)
+	return err
+}
+
+// rollbackFailedPlan moves back the executed moves of a plan aborted by a
+// failed move, once their relocations settled.
+func rollbackFailedPlan(c *cycle, executed []Move) {
+	if len(executed) == 0 {
+		return
+	}
+	if err := waitForRelocations(); err != nil {
+		fmt.Println("Error waiting for the relocations to settle, not rolling back:", err)
+		return
+	}
+	c.rolledBack = rollbackMoves(executed)
+}
+
+// checkpoint re-observes the cluster after a stage. It returns the new
+// imbalance and whether execution may continue with the remaining moves.
+func checkpoint(executed, remaining []Move, previous int) (int, bool) {
+	if err := waitForRelocations(); err != nil {
+		fmt.Println("Checkpoint failed:", err)
+		return 0, false
+	}
+
+	obs, err := observeCluster()
+	if err != nil {
+		fmt.Println("Checkpoint failed observing cluster:", err)
+		return 0, false
+	}
+
+	for _, move := range executed {
+		if !moveLanded(obs.State, move) {
+			fmt.Printf("Checkpoint: shard [%s][%d] is not on node %s as planned.\n", move.Shard.Index, move.Shard.Shard, move.To)
+			return 0, false
+		}
+	}
+
+	imbalance := planImbalance(obs)
+	if imbalance > previous {
+		fmt.Printf("Checkpoint: imbalance grew from %d to %d.\n", previous, imbalance)
+		return 0, false
+	}
+
+	for _, move := range remaining {
+		if reason := validateMove(obs, move); reason != "" {
+			fmt.Printf("Checkpoint: planned move of [%s][%d] from %s to %s is no longer valid: %s.\n", move.Shard.Index, move.Shard.Shard, move.From, move.To, reason)
+			return 0, false
+		}
+	}
+
+	fmt.Printf("Checkpoint passed: imbalance %d -> %d.\n", previous, imbalance)
+	return imbalance, true
+}
+
+// waitForRelocations blocks until the cluster reports no relocating shards.
+func waitForRelocations() error {
+	deadline := time.Now().Add(cfg.MoveTimeout.Duration)
+	for {
+		if breaker.isOpen() {
+			return errBreakerOpen
+		}
+		health, err := getClusterHealth()
+		if err != nil {
+			return err
+		}
+		if health.RelocatingShards == 0 {
+			return nil
+		}
+		ctl.beat(cfg.MoveTimeout.Duration)
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%d shards still relocating after %s", health.RelocatingShards, cfg.MoveTimeout)
+		}
+		time.Sleep(verifyPollInterval)
+	}
+}
+
+// moveLanded reports whether the shard copy is on the target node, or still
+// on its way there.
+func moveLanded(state *ClusterState, move Move) bool {
+	for _, shard := range state.RoutingNodes.Nodes[move.To] {
+		if observer.ShardKey(shard) == observer.ShardKey(move.Shard) {
+			return true
+		}
+	}
+	for _, shard := range state.RoutingNodes.Nodes[move.From] {
+		if observer.ShardKey(shard) == observer.ShardKey(move.Shard) && shard.RelocatingNode == move.To {
+			return true
+		}
+	}
+	return false
+}
+
+// validateMove checks a planned move against a fresh cluster state. It
+// returns why the move can no longer be executed, or "" if it still can.
+func validateMove(obs *Observation, move Move) string {
+	state := obs.State
+	if _, ok := obs.Distribution[move.To]; !ok {
+		return "target is not a data node anymore"
+	}
+	found := false
+	for _, shard := range state.RoutingNodes.Nodes[move.From] {
+		if observer.ShardKey(shard) == observer.ShardKey(move.Shard) && shard.Primary == move.Shard.Primary {
+			if shard.State != "STARTED" {
+				return "shard is " + shard.State
+			}
+			found = true
+		}
+	}
+	if !found {
+		return "shard is not on the source node anymore"
+	}
+	for _, shard := range state.RoutingNodes.Nodes[move.To] {
+		if observer.ShardKey(shard) == observer.ShardKey(move.Shard) {
+			return "target already holds a copy"
+		}
+	}
+	return ""
+}
+
+func splitStages(moves []Move, size int) [][]Move {
+	if size <= 0 || size >= len(moves) {
+		return [][]Move{moves}
+	}
+	var stages [][]Move
+	for len(moves) > size {
+		stages = append(stages, moves[:size])
+		moves = moves[size:]
+	}
+	return append(stages, moves)
+}
+
+func flattenStages(stages [][]Move) []Move {
+	var moves []Move
+	for _, stage := range stages {
+		moves = append(moves, stage...)
+	}
+	return moves
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tjandrayana/elasticsearch-rebalance-shard/esapi"
+)
+
+// failingAfterMove answers like its fake until a move is issued, and with
+// 503s from then on, like a master falling over.
+type failingAfterMove struct {
+	*esapi.Fake
+	failing bool
+}
+
+func (a *failingAfterMove) Do(method, path string, body []byte) (*http.Response, error) {
+	if a.failing {
+		return &http.Response{
+			StatusCode: http.StatusServiceUnavailable,
+			Status:     "503 Service Unavailable",
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(strings.NewReader(`{"error":{"type":"master_not_discovered_exception"},"status":503}`)),
+		}, nil
+	}
+	resp, err := a.Fake.Do(method, path, body)
+	if err == nil && resp.StatusCode == http.StatusOK && method == "POST" && strings.HasPrefix(path, "/_cluster/reroute") &&
+		!strings.Contains(path, "dry_run") && bytes.Contains(body, []byte(`"move"`)) {
+		a.failing = true
+	}
+	return resp, err
+}
+
+func TestExecuteMoves(t *testing.T) {
+	tests := []struct {
+		name string
+		// moves are "index from to", of shard 0 of the index.
+		moves     []string
+		setup     func(fake *esapi.Fake)
+		api       func(fake *esapi.Fake) esapi.API
+		rollback  bool // roll the executed moves back once done
+		want      []string
+		stopped   bool
+		failed    bool
+		wantNodes map[string]string
+	}{
+		{
+			name:      "executes the moves",
+			moves:     []string{"a-0 a b", "a-1 a c"},
+			want:      []string{"a-0 a b", "a-1 a c"},
+			wantNodes: map[string]string{"a-0": "b", "a-1": "c", "a-2": "a"},
+		},
+		{
+			name:  "rolls back after a failed move",
+			moves: []string{"a-0 a b", "a-1 a master", "a-2 a c"},
+			setup: func(fake *esapi.Fake) {
+				fake.AddNode(esapi.FakeNode{ID: "master", Name: "master", Roles: []string{"master"}})
+				cfg.OnMoveFailure = onMoveFailureRollback
+				cfg.DryRunMoves = false
+			},
+			rollback:  true,
+			want:      []string{"a-0 a b"},
+			stopped:   true,
+			failed:    true,
+			wantNodes: map[string]string{"a-0": "a", "a-1": "a", "a-2": "a"},
+		},
+		{
+			name:  "retries a stalled move",
+			moves: []string{"a-0 a b"},
+			setup: func(fake *esapi.Fake) {
+				fake.AddNode(esapi.FakeNode{ID: "b", Name: "b", Roles: []string{"data"}, Stalled: true})
+				cfg.StallTimeout = Duration{50 * time.Millisecond}
+				cfg.OnStall = onStallRetry
+			},
+			want:      []string{"a-0 a c"},
+			wantNodes: map[string]string{"a-0": "c"},
+		},
+		{
+			name:  "flags a stalled move",
+			moves: []string{"a-0 a b"},
+			setup: func(fake *esapi.Fake) {
+				fake.AddNode(esapi.FakeNode{ID: "b", Name: "b", Roles: []string{"data"}, Stalled: true})
+				cfg.StallTimeout = Duration{50 * time.Millisecond}
+			},
+			wantNodes: map[string]string{"a-0": "a"},
+		},
+		{
+			name:  "stops once the breaker trips",
+			moves: []string{"a-0 a b", "a-1 a c"},
+			setup: func(fake *esapi.Fake) {
+				cfg.BreakerFailures = 1
+			},
+			api: func(fake *esapi.Fake) esapi.API {
+				return &failingAfterMove{Fake: fake}
+			},
+			want:      []string{"a-0 a b"},
+			stopped:   true,
+			wantNodes: map[string]string{"a-0": "b", "a-1": "a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := testCluster(t, "a", "b", "c")
+			addShards(fake, "a", 3)
+			// Every move is waited for, as with a stall timeout.
+			cfg.StallTimeout = Duration{time.Hour}
+			if tt.setup != nil {
+				tt.setup(fake)
+			}
+			moves := testMoves(observeTestCluster(t), tt.moves...)
+			if tt.api != nil {
+				es = tt.api(fake)
+			}
+
+			executed, stopped, failed := executeMoves(moves)
+			var got []string
+			for _, move := range executed {
+				got = append(got, move.Shard.Index+" "+move.From+" "+move.To)
+			}
+			if strings.Join(got, ", ") != strings.Join(tt.want, ", ") {
+				t.Errorf("executed %v, want %v", got, tt.want)
+			}
+			if stopped != tt.stopped || failed != tt.failed {
+				t.Errorf("stopped %v and failed %v, want %v and %v", stopped, failed, tt.stopped, tt.failed)
+			}
+			if tt.rollback {
+				c := &cycle{}
+				rollbackFailedPlan(c, executed)
+				if len(c.rolledBack) != len(executed) {
+					t.Errorf("rolled back %d moves, want %d", len(c.rolledBack), len(executed))
+				}
+			}
+			for index, want := range tt.wantNodes {
+				if node := fakeNodeOf(t, fake, index); node != want {
+					t.Errorf("%s is on %q, want %q", index, node, want)
+				}
+			}
+		})
+	}
+}
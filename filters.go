@@ -0,0 +1,44 @@
+package main
+
+import (
+	"path"
+	"time"
+)
+
+// indexAllowed reports whether shards of the index may be relocated. An
+// index must match one of the include patterns (when any are set) and none
+// of the exclude patterns, and not be undergoing an ILM action that moves
+// its shards. Patterns use shell glob syntax, e.g. ".kibana*", and may use
+// date math like index names, e.g. "<logs-{now/d}>", see matchAny.
+func indexAllowed(index string) bool {
+	if _, busy := ilmAction(index); busy {
+		return false
+	}
+	if len(cfg.IncludeIndices) > 0 && !matchAny(cfg.IncludeIndices, index) {
+		return false
+	}
+	return !matchAny(cfg.ExcludeIndices, index)
+}
+
+// matchAny reports whether the name matches one of the patterns. Date math
+// is resolved at the time of the call, and then also matches the indices
+// rolled over from the resolved name, e.g. <logs-{now/d}> matches
+// logs-2024.03.01-000002.
+func matchAny(patterns []string, name string) bool {
+	now := time.Now()
+	for _, pattern := range patterns {
+		resolved, err := resolveDateMath(pattern, now)
+		if err != nil {
+			continue
+		}
+		if ok, _ := path.Match(resolved, name); ok {
+			return true
+		}
+		if isDateMath(pattern) && rolloverSuffix.MatchString(name) {
+			if ok, _ := path.Match(resolved, rolloverSuffix.ReplaceAllString(name, "")); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -1,3 +1,10 @@
 module github.com/tjandrayana/elasticsearch-rebalance-shard
 
 go 1.19
+
+require (
+	go.etcd.io/bbolt v1.3.9
+	golang.org/x/term v0.4.0
+)
+
+require golang.org/x/sys v0.4.0 // indirect
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const eventHealthRegression = "health_regression"
+
+// HealthGuard stops the moves of a cycle once the cluster health is worse
+// than when the cycle started, such as yellow after green, or once
+// MaxFailedMoves of its moves failed, 0 for no limit. Allocation and the
+// recovery settings are restored right away, without waiting for the
+// relocations in flight, and the Targets are alerted.
+type HealthGuard struct {
+	MaxFailedMoves int                  `json:"max_failed_moves"`
+	Targets        []NotificationTarget `json:"targets"`
+}
+
+// HealthRegression is the payload posted to generic webhooks when the guard
+// stopped a cycle.
+type HealthRegression struct {
+	Event            string       `json:"event"`
+	Cluster          string       `json:"cluster,omitempty"`
+	Reason           string       `json:"reason"`
+	CycleStartedAt   time.Time    `json:"cycle_started_at"`
+	StatusBefore     string       `json:"status_before"`
+	Status           string       `json:"status"`
+	UnassignedShards int          `json:"unassigned_shards"`
+	IssuedMoves      int          `json:"issued_moves"`
+	FailedMoves      []MoveRecord `json:"failed_moves,omitempty"`
+}
+
+func (g *HealthGuard) validate() error {
+	if g.MaxFailedMoves < 0 {
+		return fmt.Errorf("health_guard max_failed_moves cannot be negative")
+	}
+	for _, target := range g.Targets {
+		if err := target.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// healthRank orders the health statuses from the best.
+var healthRank = map[string]int{"green": 0, "yellow": 1, "red": 2}
+
+// healthGuard is the state of cfg.HealthGuard during a cycle: the health it
+// started from and its moves, counted from the event bus.
+type healthGuard struct {
+	mu        sync.Mutex
+	startedAt time.Time
+	before    string // empty when unknown, which disables the health check
+	issued    int
+	failed    []MoveRecord
+	tripped   bool
+}
+
+var guard = &healthGuard{}
+
+// start takes the health of the cluster before the moves of the cycle.
+func (g *healthGuard) start(c *cycle) {
+	var before string
+	if health, err := getClusterHealth(); err != nil {
+		fmt.Println("Error getting cluster health, the health guard only counts failed moves:", err)
+	} else {
+		before = health.Status
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.startedAt, g.before = c.startedAt, before
+	g.issued, g.failed, g.tripped = 0, nil, false
+}
+
+func (g *healthGuard) moveEvent(record MoveRecord) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	switch record.Result {
+	case moveResultIssued:
+		g.issued++
+	case moveResultFailed:
+		g.failed = append(g.failed, record)
+	}
+}
+
+// allows reports whether the cycle may issue another move. The first time
+// it does not, it restores the settings and alerts.
+func (g *healthGuard) allows() bool {
+	if cfg.HealthGuard == nil {
+		return true
+	}
+	g.mu.Lock()
+	tripped, before, failed := g.tripped, g.before, len(g.failed)
+	g.mu.Unlock()
+	if tripped {
+		return false
+	}
+
+	var reason string
+	health, err := getClusterHealth()
+	max := cfg.HealthGuard.MaxFailedMoves
+	switch {
+	case max > 0 && failed >= max:
+		reason = fmt.Sprintf("%d moves of the cycle failed", failed)
+	case err != nil:
+		// An unreachable cluster is left to the other checks.
+		return true
+	case before != "" && healthRank[health.Status] > healthRank[before]:
+		reason = fmt.Sprintf("cluster health went from %s to %s", before, health.Status)
+	default:
+		return true
+	}
+
+	g.mu.Lock()
+	g.tripped = true
+	event := HealthRegression{
+		Event:          eventHealthRegression,
+		Cluster:        cfg.ClusterAlias,
+		Reason:         reason,
+		CycleStartedAt: g.startedAt.UTC(),
+		StatusBefore:   before,
+		IssuedMoves:    g.issued,
+		FailedMoves:    append([]MoveRecord(nil), g.failed...),
+	}
+	g.mu.Unlock()
+	if health != nil {
+		event.Status = health.Status
+		event.UnassignedShards = health.UnassignedShards
+	}
+
+	fmt.Printf("Health guard: %s, not issuing further moves.\n", reason)
+	audit(eventHealthRegression, map[string]interface{}{
+		"reason":       reason,
+		"status":       event.Status,
+		"issued_moves": event.IssuedMoves,
+		"failed_moves": len(event.FailedMoves),
+	})
+	// The cycle restores them again once the moves in flight are done.
+	enableAllocation()
+	cfg.HealthGuard.send(event)
+	return false
+}
+
+func (g *HealthGuard) send(event HealthRegression) {
+	for _, target := range g.Targets {
+		if !target.wants(event.Event) {
+			continue
+		}
+		var payload interface{} = event
+		if chatTarget(target.Type) {
+			payload = chatPayload(target.Type, regressionSlackText(event))
+		}
+		if err := postJSON(target.URL, payload); err != nil {
+			fmt.Printf("Error sending %s alert: %v\n", target.Type, err)
+		}
+	}
+}
+
+func regressionSlackText(event HealthRegression) string {
+	var b strings.Builder
+	if event.Cluster != "" {
+		fmt.Fprintf(&b, "[%s] ", event.Cluster)
+	}
+	fmt.Fprintf(&b, ":rotating_light: Rebalance stopped: %s. %d moves issued since %s",
+		event.Reason, event.IssuedMoves, event.CycleStartedAt.Format(time.RFC3339))
+	if event.Status != "" {
+		fmt.Fprintf(&b, ", health %s with %d unassigned shards", event.Status, event.UnassignedShards)
+	}
+	for _, record := range event.FailedMoves {
+		fmt.Fprintf(&b, "\n• [%s][%d] %s → %s failed: %s", record.Index, record.Shard, record.Source, record.Target, record.Error)
+	}
+	return b.String()
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// readinessTimeout bounds the request /readyz makes to the cluster.
+const readinessTimeout = 5 * time.Second
+
+// HealthResponse is returned by GET /healthz and GET /readyz.
+type HealthResponse struct {
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// handleHealthz is the liveness probe: it fails while the balancing loop is
+// stuck, see controller.alive, for the process to be restarted. A failing
+// cluster does not fail it, restarting would not help.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, ctl.alive())
+}
+
+// handleReadyz is the readiness probe: it fails while the cluster cannot be
+// reached, or refuses the credentials of the balancer. Standby instances
+// are ready too, they only wait for the leadership.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	checked := make(chan error, 1)
+	go func() {
+		_, err := getClusterHealth()
+		checked <- err
+	}()
+	select {
+	case err := <-checked:
+		if err != nil {
+			err = fmt.Errorf("cluster unavailable: %w", err)
+		}
+		writeHealth(w, err)
+	case <-time.After(readinessTimeout):
+		writeHealth(w, fmt.Errorf("cluster did not answer within %s", readinessTimeout))
+	}
+}
+
+func writeHealth(w http.ResponseWriter, err error) {
+	if err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, HealthResponse{Status: "failing", Reason: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, HealthResponse{Status: "ok"})
+}
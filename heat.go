@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// defaultHeatTolerance is used when cfg.HeatTolerance is 0.
+const defaultHeatTolerance = 0.2
+
+// The operation rates are the difference between two samples of the index
+// stats: the previous one if it is recent enough, else one taken
+// heatSampleWindow before. Rates computed less than heatSampleWindow ago are
+// reused.
+const (
+	heatSampleWindow = 10 * time.Second
+	maxHeatSampleAge = 30 * time.Minute
+)
+
+type IndexOperations struct {
+	Indices map[string]struct {
+		Total struct {
+			Indexing struct {
+				IndexTotal int64 `json:"index_total"`
+			} `json:"indexing"`
+			Search struct {
+				QueryTotal int64 `json:"query_total"`
+			} `json:"search"`
+		} `json:"total"`
+	} `json:"indices"`
+}
+
+// heatSample is the cumulative count of the indexing and search operations
+// of every index at one point in time.
+type heatSample struct {
+	at  time.Time
+	ops map[string]int64
+}
+
+var (
+	heatMu    sync.Mutex
+	lastHeat  heatSample
+	lastRates map[string]float64
+)
+
+func sampleOperations() (heatSample, error) {
+	var stats IndexOperations
+	if err := esGet("/_stats/indexing,search?level=indices&filter_path=indices.*.total.indexing.index_total,indices.*.total.search.query_total", &stats); err != nil {
+		return heatSample{}, err
+	}
+	sample := heatSample{at: time.Now(), ops: make(map[string]int64, len(stats.Indices))}
+	for index, s := range stats.Indices {
+		sample.ops[index] = s.Total.Indexing.IndexTotal + s.Total.Search.QueryTotal
+	}
+	return sample, nil
+}
+
+// indexHeat returns the indexing and search operations per second of every
+// index, over all its copies.
+func indexHeat() (map[string]float64, error) {
+	heatMu.Lock()
+	defer heatMu.Unlock()
+	prev := lastHeat
+	if lastRates != nil && time.Since(prev.at) < heatSampleWindow {
+		return lastRates, nil
+	}
+	if prev.ops == nil || time.Since(prev.at) > maxHeatSampleAge {
+		var err error
+		if prev, err = sampleOperations(); err != nil {
+			return nil, err
+		}
+		time.Sleep(heatSampleWindow)
+	}
+	sample, err := sampleOperations()
+	if err != nil {
+		return nil, err
+	}
+	lastHeat = sample
+	elapsed := sample.at.Sub(prev.at).Seconds()
+	heat := make(map[string]float64, len(sample.ops))
+	for index, ops := range sample.ops {
+		// Indices created since the previous sample count from 0.
+		if delta := ops - prev.ops[index]; delta > 0 && elapsed > 0 {
+			heat[index] = float64(delta) / elapsed
+		}
+	}
+	lastRates = heat
+	return heat, nil
+}
+
+// heatModel is the heat of every data node: the sum of the heat of its
+// copies, each copy of an index taking an equal share of the index heat.
+type heatModel struct {
+	copyHeat map[string]float64 // by index
+	nodeHeat map[string]float64
+}
+
+func newHeatModel(obs *Observation, heat map[string]float64) *heatModel {
+	copies := make(map[string]int)
+	for nodeID := range obs.Distribution {
+		for _, shard := range obs.State.RoutingNodes.Nodes[nodeID] {
+			copies[shard.Index]++
+		}
+	}
+	m := &heatModel{copyHeat: make(map[string]float64, len(copies)), nodeHeat: make(map[string]float64, len(obs.Distribution))}
+	for index, n := range copies {
+		m.copyHeat[index] = heat[index] / float64(n)
+	}
+	for nodeID := range obs.Distribution {
+		m.nodeHeat[nodeID] = 0
+		for _, shard := range obs.State.RoutingNodes.Nodes[nodeID] {
+			m.nodeHeat[nodeID] += m.copyHeat[shard.Index]
+		}
+	}
+	return m
+}
+
+// excess is how much hotter than the mean the hottest node is, as a
+// fraction of the mean.
+func (m *heatModel) excess() float64 {
+	var sum, max float64
+	for _, h := range m.nodeHeat {
+		sum += h
+		max = math.Max(max, h)
+	}
+	if sum == 0 {
+		return 0
+	}
+	mean := sum / float64(len(m.nodeHeat))
+	return (max - mean) / mean
+}
+
+func heatTolerance() float64 {
+	if cfg.HeatTolerance > 0 {
+		return cfg.HeatTolerance
+	}
+	return defaultHeatTolerance
+}
+
+// heatImbalance is how much hotter than the mean the hottest node is, in
+// percent.
+func heatImbalance(obs *Observation) int {
+	heat, err := indexHeat()
+	if err != nil {
+		fmt.Println("Error getting index stats:", err)
+		return 0
+	}
+	return int(math.Round(newHeatModel(obs, heat).excess() * 100))
+}
+
+// planHeatMoves spreads the busiest shards: while the hottest node is
+// hotter than the mean by more than the heat tolerance, its hottest movable
+// copy goes to the coolest node that can take it. A move never leaves its
+// target hotter than its source, and never takes the spread of the shard
+// counts above the rebalance threshold, or above where it is already.
+func planHeatMoves(obs *Observation, verdicts *verdictCache) []Move {
+	heat, err := indexHeat()
+	if err != nil {
+		fmt.Println("Error getting index stats, not planning:", err)
+		return nil
+	}
+	m := newHeatModel(obs, heat)
+
+	nodeIDs := make([]string, 0, len(obs.Distribution))
+	load := make(map[string]int, len(obs.Distribution))
+	placement := make(map[string][]ShardRouting, len(obs.Distribution))
+	for nodeID, n := range obs.Distribution {
+		nodeIDs = append(nodeIDs, nodeID)
+		load[nodeID] = n
+		placement[nodeID] = append([]ShardRouting(nil), obs.State.RoutingNodes.Nodes[nodeID]...)
+	}
+	if len(nodeIDs) < 2 {
+		return nil
+	}
+	maxSpread := cfg.RebalanceThreshold
+	if spread := countScore(load).Spread; spread > float64(maxSpread) {
+		maxSpread = int(spread)
+	}
+
+	var moves []Move
+	for m.excess() > heatTolerance() {
+		// Hottest node first, coolest last.
+		sort.Slice(nodeIDs, func(i, j int) bool {
+			if m.nodeHeat[nodeIDs[i]] != m.nodeHeat[nodeIDs[j]] {
+				return m.nodeHeat[nodeIDs[i]] > m.nodeHeat[nodeIDs[j]]
+			}
+			return nodeIDs[i] < nodeIDs[j]
+		})
+		from := nodeIDs[0]
+		candidates := append([]ShardRouting(nil), placement[from]...)
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return m.copyHeat[candidates[i].Index] > m.copyHeat[candidates[j].Index]
+		})
+
+		var best Move
+		found := false
+		for k := len(nodeIDs) - 1; k > 0 && !found; k-- {
+			to := nodeIDs[k]
+			load[from]--
+			load[to]++
+			fits := countScore(load).Spread <= float64(maxSpread)
+			load[from]++
+			load[to]--
+			if !fits {
+				continue
+			}
+			for _, shard := range candidates {
+				h := m.copyHeat[shard.Index]
+				if h == 0 || m.nodeHeat[to]+h > m.nodeHeat[from]-h+1e-9 {
+					continue
+				}
+				if _, ok := movableCopy([]ShardRouting{shard}, placement[to], to, verdicts); ok {
+					best, found = Move{Shard: shard, From: from, To: to}, true
+					break
+				}
+			}
+		}
+		if !found {
+			fmt.Println("No movable shard left to spread the heat.")
+			return moves
+		}
+
+		for i, shard := range placement[from] {
+			if shard == best.Shard {
+				placement[from] = append(placement[from][:i:i], placement[from][i+1:]...)
+				break
+			}
+		}
+		// The copy is initializing on its target, where it may not move
+		// again in this plan.
+		relocated := best.Shard
+		relocated.State = "INITIALIZING"
+		placement[best.To] = append(placement[best.To], relocated)
+		load[best.From]--
+		load[best.To]++
+		h := m.copyHeat[best.Shard.Index]
+		m.nodeHeat[best.From] -= h
+		m.nodeHeat[best.To] += h
+		moves = append(moves, best)
+	}
+	return moves
+}
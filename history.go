@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	moveResultPlanned  = "planned"
+	moveResultExecuted = "executed"
+	moveResultFailed   = "failed"
+	moveResultRejected = "rejected"
+	moveResultSkipped  = "skipped"
+
+	// moveResultIssued is published on the event bus when a move is
+	// issued; the history only records its outcome.
+	moveResultIssued = "issued"
+)
+
+var historyBucket = []byte("moves")
+
+// historyMu serializes the writers of the history, as concurrent moves
+// complete at the same time, see relocationTracker.
+var historyMu sync.Mutex
+
+// MoveRecord is an entry of the move history.
+type MoveRecord struct {
+	Time           time.Time `json:"time"`
+	Index          string    `json:"index"`
+	Shard          int       `json:"shard"`
+	Primary        bool      `json:"primary"`
+	Source         string    `json:"source"`
+	Target         string    `json:"target"`
+	Bytes          int64     `json:"bytes"`
+	DurationMillis int64     `json:"duration_ms"`
+	Result         string    `json:"result"`
+	Error          string    `json:"error,omitempty"`
+}
+
+func historyPath() string {
+	return filepath.Join(cfg.StateDir, "history.db")
+}
+
+// withHistory opens the history database for the duration of fn. The
+// database is not kept open so that the history command can read it while
+// the balancer runs.
+func withHistory(readOnly bool, fn func(db *bolt.DB) error) error {
+	if cfg.StateDir == "" {
+		return errors.New("move history needs -state-dir")
+	}
+	if !readOnly {
+		if err := ensureDir(cfg.StateDir); err != nil {
+			return err
+		}
+	}
+	db, err := bolt.Open(historyPath(), 0o644, &bolt.Options{Timeout: 5 * time.Second, ReadOnly: readOnly})
+	if err != nil {
+		return fmt.Errorf("opening move history: %w", err)
+	}
+	defer db.Close()
+	return fn(db)
+}
+
+// recordMoves publishes the entries on the event bus, appends them to the
+// move history and drops the ones older than the retention period. Failures
+// are only logged: the history must never stop the balancer.
+func recordMoves(records ...MoveRecord) {
+	for _, record := range records {
+		bus.publish(topicMove, record)
+	}
+	if cfg.StateDir == "" || len(records) == 0 {
+		return
+	}
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	err := withHistory(false, func(db *bolt.DB) error {
+		return db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists(historyBucket)
+			if err != nil {
+				return err
+			}
+			for _, record := range records {
+				seq, _ := b.NextSequence()
+				value, err := json.Marshal(record)
+				if err != nil {
+					return err
+				}
+				if err := b.Put(historyKey(record.Time, seq), value); err != nil {
+					return err
+				}
+			}
+			return pruneHistory(b)
+		})
+	})
+	if err != nil {
+		fmt.Println("Error recording move history:", err)
+	}
+}
+
+// historyKey sorts entries by time; the sequence keeps entries recorded in
+// the same nanosecond apart.
+func historyKey(t time.Time, seq uint64) []byte {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	binary.BigEndian.PutUint64(key[8:], seq)
+	return key
+}
+
+func pruneHistory(b *bolt.Bucket) error {
+	if cfg.HistoryRetention.Duration <= 0 {
+		return nil
+	}
+	cutoff := historyKey(time.Now().Add(-cfg.HistoryRetention.Duration), 0)
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil && string(k) < string(cutoff); k, _ = c.Next() {
+		if err := c.Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func moveRecord(move Move, result string) MoveRecord {
+	return MoveRecord{
+		Time:    time.Now().UTC(),
+		Index:   move.Shard.Index,
+		Shard:   move.Shard.Shard,
+		Primary: move.Shard.Primary,
+		Source:  move.From,
+		Target:  move.To,
+		Bytes:   move.Bytes,
+		Result:  result,
+	}
+}
+
+// move is the move the record is about, as far as the record tells.
+func (r MoveRecord) move() Move {
+	return Move{
+		Shard: ShardRouting{Index: r.Index, Shard: r.Shard, Primary: r.Primary, State: "STARTED", Node: r.Source},
+		From:  r.Source,
+		To:    r.Target,
+		Bytes: r.Bytes,
+	}
+}
+
+var historyOptions struct {
+	since  time.Duration
+	index  string
+	result string
+	limit  int
+}
+
+func historyFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&historyOptions.since, "since", 24*time.Hour, "only show moves recorded within this period")
+	fs.StringVar(&historyOptions.index, "index", "", "only show moves of indices matching this glob pattern")
+	fs.StringVar(&historyOptions.result, "result", "", "only show moves with this result (planned, executed, failed, rejected, skipped)")
+	fs.IntVar(&historyOptions.limit, "limit", 100, "maximum number of moves to show, most recent last")
+}
+
+// historyCommand prints the recorded moves.
+//
+//	history [-since 24h] [-index pattern] [-result executed] [-limit 100]
+func historyCommand(args []string) error {
+	records, err := readHistory(historyOptions.since, historyOptions.index, historyOptions.result, historyOptions.limit)
+	if err != nil {
+		return err
+	}
+	if jsonOutput() {
+		for _, r := range records {
+			emit("move", r)
+		}
+		return nil
+	}
+	for _, r := range records {
+		line := fmt.Sprintf("%s  %-9s [%s][%d] %s -> %s  %s  %s", r.Time.Local().Format("2006-01-02 15:04:05"), r.Result,
+			r.Index, r.Shard, r.Source, r.Target, formatBytes(r.Bytes), (time.Duration(r.DurationMillis) * time.Millisecond).Round(time.Millisecond))
+		if r.Error != "" {
+			line += "  " + r.Error
+		}
+		fmt.Println(line)
+	}
+	fmt.Printf("%d moves\n", len(records))
+	return nil
+}
+
+// readHistory returns the moves recorded within since, oldest first, of the
+// indices matching the index pattern and with the result, if not empty, and
+// at most the limit most recent ones if above 0.
+func readHistory(since time.Duration, index, result string, limit int) ([]MoveRecord, error) {
+	var records []MoveRecord
+	err := withHistory(true, func(db *bolt.DB) error {
+		return db.View(func(tx *bolt.Tx) error {
+			b := tx.Bucket(historyBucket)
+			if b == nil {
+				return nil
+			}
+			c := b.Cursor()
+			start := historyKey(time.Now().Add(-since), 0)
+			for k, v := c.Seek(start); k != nil; k, v = c.Next() {
+				var record MoveRecord
+				if err := json.Unmarshal(v, &record); err != nil {
+					return err
+				}
+				if index != "" && !matchAny([]string{index}, record.Index) {
+					continue
+				}
+				if result != "" && record.Result != result {
+					continue
+				}
+				records = append(records, record)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if limit > 0 && len(records) > limit {
+		records = records[len(records)-limit:]
+	}
+	return records, nil
+}
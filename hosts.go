@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tjandrayana/elasticsearch-rebalance-shard/esapi"
+)
+
+// hostPool holds the Elasticsearch endpoints requests can go to: the
+// configured ones and, with sniffing, the HTTP addresses the cluster
+// reports for its nodes. Requests stick to one endpoint until it is
+// unreachable.
+type hostPool struct {
+	mu      sync.Mutex
+	hosts   []string
+	current int
+	sniffed time.Time
+}
+
+var esHosts = &hostPool{}
+
+// esClient sends every request to Elasticsearch, see setupESClient.
+var esClient = http.DefaultClient
+
+// setupESClient tunes esClient to cfg once the config is loaded. Its
+// transport pools the connections to all endpoints, failed over to or
+// sniffed ones included, and authenticates the requests, see authTransport.
+func setupESClient() {
+	esClient = &http.Client{
+		Timeout: cfg.ESTimeout.Duration,
+		Transport: authTransport{base: &http.Transport{
+			Proxy:                 esProxy(),
+			DialContext:           (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+			ForceAttemptHTTP2:     true,
+			DisableKeepAlives:     cfg.ESMaxIdleConns == 0,
+			MaxIdleConnsPerHost:   cfg.ESMaxIdleConns,
+			IdleConnTimeout:       cfg.ESIdleConnTimeout.Duration,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: time.Second,
+		}},
+	}
+}
+
+// esProxy is the proxy of the requests to Elasticsearch, cfg.Proxy if set.
+func esProxy() func(*http.Request) (*url.URL, error) {
+	if cfg.Proxy == "" {
+		return http.ProxyFromEnvironment
+	}
+	u, _ := url.Parse(cfg.Proxy)
+	return http.ProxyURL(u)
+}
+
+// candidates returns the endpoints in the order they should be tried.
+func (p *hostPool) candidates() []string {
+	p.mu.Lock()
+	if p.hosts == nil {
+		p.hosts = configuredHosts()
+	}
+	sniff := cfg.Sniff && time.Since(p.sniffed) >= cfg.SniffInterval.Duration
+	if sniff {
+		p.sniffed = time.Now()
+	}
+	hosts := append(append([]string{}, p.hosts[p.current:]...), p.hosts[:p.current]...)
+	p.mu.Unlock()
+
+	if sniff {
+		p.sniff(hosts)
+		return p.candidates()
+	}
+	return hosts
+}
+
+// failed makes the next endpoint after host the current one.
+func (p *hostPool) failed(host string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.hosts[p.current] == host {
+		p.current = (p.current + 1) % len(p.hosts)
+		fmt.Printf("Elasticsearch at %s is unreachable, failing over to %s.\n", host, p.hosts[p.current])
+	}
+}
+
+func configuredHosts() []string {
+	hosts := []string{strings.TrimRight(cfg.ESHost, "/")}
+	for _, host := range cfg.ESHosts {
+		hosts = appendHost(hosts, strings.TrimRight(host, "/"))
+	}
+	return hosts
+}
+
+func appendHost(hosts []string, host string) []string {
+	for _, h := range hosts {
+		if h == host {
+			return hosts
+		}
+	}
+	return append(hosts, host)
+}
+
+type NodesHTTPInfo struct {
+	Nodes map[string]struct {
+		HTTP struct {
+			PublishAddress string `json:"publish_address"`
+		} `json:"http"`
+	} `json:"nodes"`
+}
+
+// sniff adds the HTTP publish addresses of the nodes, asking the first
+// endpoint that answers. The configured endpoints are always kept.
+func (p *hostPool) sniff(hosts []string) {
+	var info NodesHTTPInfo
+	var err error
+	for _, host := range hosts {
+		if err = getJSON(host, "/_nodes/http?filter_path=nodes.*.http.publish_address", &info); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		fmt.Println("Error sniffing nodes:", err)
+		return
+	}
+	scheme := "http"
+	if u, err := url.Parse(cfg.ESHost); err == nil && u.Scheme != "" {
+		scheme = u.Scheme
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	current := p.hosts[p.current]
+	p.hosts = configuredHosts()
+	for _, node := range info.Nodes {
+		// publish_address is "ip:port" or "hostname/ip:port".
+		address := node.HTTP.PublishAddress
+		if i := strings.Index(address, "/"); i >= 0 {
+			address = address[i+1:]
+		}
+		if address != "" {
+			p.hosts = appendHost(p.hosts, scheme+"://"+address)
+		}
+	}
+	p.current = 0
+	for i, host := range p.hosts {
+		if host == current {
+			p.current = i
+		}
+	}
+}
+
+// es is what the requests to Elasticsearch go through: the endpoints of
+// the cluster, unless replaced, as by a fake.
+var es esapi.API = esHosts
+
+// esRequest sends a request through es. Credentials rejected open an
+// incident, see Incidents, and failures count towards the circuit breaker,
+// which fails the request right away while it is open.
+func esRequest(method, path string, body []byte) (*http.Response, error) {
+	if !breaker.allowsRequest(method, path) {
+		return nil, fmt.Errorf("%s %s: %w", method, path, errBreakerOpen)
+	}
+	resp, err := es.Do(method, path, body)
+	if err == nil {
+		incidents.esResponse(method, path, resp.StatusCode)
+	}
+	breaker.record(err != nil || resp.StatusCode >= 500)
+	return resp, err
+}
+
+// Do sends a request to the current endpoint, failing over to the next
+// ones when it cannot be reached. Responses with an error status are
+// returned as they are: the endpoint worked, the request did not. No
+// Accept-Encoding is set, so that net/http asks for a gzipped response and
+// decompresses it transparently, which mostly matters for the routing
+// table and shard list of large clusters.
+func (p *hostPool) Do(method, path string, body []byte) (*http.Response, error) {
+	var lastErr error
+	for _, host := range p.candidates() {
+		req, err := http.NewRequest(method, host+path, bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("creating request: %w", err)
+		}
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		resp, err := esClient.Do(req)
+		if err == nil {
+			return resp, nil
+		}
+		lastErr = err
+		p.failed(host)
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// endpointIdentity is what an endpoint reports about the cluster it belongs
+// to.
+type endpointIdentity struct {
+	host   string
+	uuid   string
+	master string // ID of the elected master, empty if none
+	err    error
+}
+
+type catMaster struct {
+	ID   string `json:"id"`
+	Node string `json:"node"`
+}
+
+// identifyEndpoints asks every configured endpoint for its cluster UUID and
+// elected master.
+func identifyEndpoints() []endpointIdentity {
+	var ids []endpointIdentity
+	for _, host := range configuredHosts() {
+		id := endpointIdentity{host: host}
+		var root RootInfo
+		if id.err = getJSON(host, "/", &root); id.err == nil {
+			id.uuid = root.ClusterUUID
+			var masters []catMaster
+			if err := getJSON(host, "/_cat/master?format=json&h=id,node", &masters); err == nil && len(masters) > 0 {
+				id.master = masters[0].ID
+			}
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// checkClusterUUIDs fails if the endpoints belong to different clusters,
+// which means the endpoint list is misconfigured. Unreachable endpoints are
+// left out.
+func checkClusterUUIDs(ids []endpointIdentity) error {
+	var first *endpointIdentity
+	for i := range ids {
+		id := &ids[i]
+		if id.err != nil || id.uuid == "" || id.uuid == "_na_" {
+			continue
+		}
+		if first == nil {
+			first = id
+		} else if id.uuid != first.uuid {
+			return fmt.Errorf("endpoints belong to different clusters: %s is cluster %s, %s is cluster %s", first.host, first.uuid, id.host, id.uuid)
+		}
+	}
+	return nil
+}
+
+// checkSingleMaster fails unless the reachable endpoints agree on a single
+// elected master. Disagreeing endpoints are a sign of a split brain.
+func checkSingleMaster(ids []endpointIdentity) error {
+	masters := make(map[string][]string)
+	reachable := 0
+	for _, id := range ids {
+		if id.err != nil {
+			continue
+		}
+		reachable++
+		masters[id.master] = append(masters[id.master], id.host)
+	}
+	if reachable == 0 {
+		return nil
+	}
+	if hosts, ok := masters[""]; ok {
+		return fmt.Errorf("no elected master seen by %s", strings.Join(hosts, ", "))
+	}
+	if len(masters) > 1 {
+		var seen []string
+		for master, hosts := range masters {
+			seen = append(seen, fmt.Sprintf("%s by %s", master, strings.Join(hosts, ", ")))
+		}
+		sort.Strings(seen)
+		return fmt.Errorf("endpoints report different elected masters: %s", strings.Join(seen, "; "))
+	}
+	return nil
+}
+
+// checkClusterIdentity reports whether the cycle may go on: all the
+// endpoints must belong to the same cluster and see the same elected
+// master.
+func checkClusterIdentity() bool {
+	ids := identifyEndpoints()
+	err := checkClusterUUIDs(ids)
+	if err == nil {
+		err = checkSingleMaster(ids)
+	}
+	if err != nil {
+		fmt.Println("Not acting:", err)
+		newCycle().failed(err)
+		return false
+	}
+	return true
+}
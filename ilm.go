@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ilmBusyActions are the ILM actions that relocate or rewrite the shards of
+// an index themselves. Moving shards of an index in the middle of one of
+// them would fight the lifecycle manager.
+var ilmBusyActions = map[string]bool{
+	"allocate":            true,
+	"migrate":             true,
+	"shrink":              true,
+	"forcemerge":          true,
+	"searchable_snapshot": true,
+	"downsample":          true,
+}
+
+type ILMExplain struct {
+	Indices map[string]struct {
+		Action string `json:"action"`
+		Step   string `json:"step"`
+	} `json:"indices"`
+}
+
+// ilmBusy holds the indices in the middle of a busy ILM action, by index
+// name, as of the last refreshILM.
+var (
+	ilmMu   sync.Mutex
+	ilmBusy map[string]string
+)
+
+// refreshILM looks up the indices undergoing ILM actions, before planning.
+// OpenSearch has its own state management instead of ILM and is left out.
+// On errors the previous state is kept.
+func refreshILM() {
+	if !cfg.ILMAware {
+		return
+	}
+	if b, err := getBackend(); err == nil && b.OpenSearch() {
+		return
+	}
+	var explain ILMExplain
+	if err := esGet("/*/_ilm/explain?only_managed=true&expand_wildcards=all&filter_path=indices.*.action,indices.*.step", &explain); err != nil {
+		fmt.Println("Error getting ILM state:", err)
+		return
+	}
+	busy := make(map[string]string)
+	for index, state := range explain.Indices {
+		if ilmBusyActions[state.Action] && state.Step != "complete" {
+			busy[index] = state.Action
+		}
+	}
+	if len(busy) > 0 {
+		var names []string
+		for index, action := range busy {
+			names = append(names, index+" ("+action+")")
+		}
+		sort.Strings(names)
+		fmt.Println("Leaving indices under ILM actions alone:", strings.Join(names, ", "))
+	}
+	ilmMu.Lock()
+	ilmBusy = busy
+	ilmMu.Unlock()
+}
+
+// ilmAction returns the busy ILM action the index is undergoing, if any.
+func ilmAction(index string) (string, bool) {
+	ilmMu.Lock()
+	defer ilmMu.Unlock()
+	action, ok := ilmBusy[index]
+	return action, ok
+}
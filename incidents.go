@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+const (
+	incidentPagerDuty = "pagerduty"
+	incidentOpsgenie  = "opsgenie"
+)
+
+// The incidents raised, by the condition they are about.
+const (
+	incidentAllocation  = "allocation_not_enabled"
+	incidentMoveFailure = "moves_failing"
+	incidentAuth        = "authentication_rejected"
+)
+
+// Incidents are opened for the errors someone has to look into: shard
+// allocation that cannot be enabled again, FailedMoves moves of a cycle
+// failing (3 if 0) and credentials rejected by Elasticsearch. Every
+// condition of a cluster has its own deduplication key, so that it is a
+// single incident however often it recurs, resolved once the condition
+// clears: allocation enabled, a cycle moving without failures or a request
+// authenticated.
+type Incidents struct {
+	FailedMoves int              `json:"failed_moves"`
+	Targets     []IncidentTarget `json:"targets"`
+}
+
+// IncidentTarget is a PagerDuty service, with the RoutingKey of an Events
+// API v2 integration, or Opsgenie, with the APIKey of an API integration.
+// URL overrides the API, such as https://api.eu.opsgenie.com. Severity is
+// the PagerDuty severity, critical if empty, or the Opsgenie priority, P1
+// if empty.
+type IncidentTarget struct {
+	Type       string `json:"type"`
+	RoutingKey string `json:"routing_key"`
+	APIKey     string `json:"api_key"`
+	URL        string `json:"url"`
+	Severity   string `json:"severity"`
+}
+
+func (i *Incidents) validate() error {
+	if i.FailedMoves < 0 {
+		return fmt.Errorf("incidents failed_moves cannot be negative")
+	}
+	if len(i.Targets) == 0 {
+		return fmt.Errorf("incidents has no targets")
+	}
+	for _, t := range i.Targets {
+		switch {
+		case t.Type == incidentPagerDuty && t.RoutingKey == "":
+			return fmt.Errorf("pagerduty incident target has no routing_key")
+		case t.Type == incidentOpsgenie && t.APIKey == "":
+			return fmt.Errorf("opsgenie incident target has no api_key")
+		case t.Type != incidentPagerDuty && t.Type != incidentOpsgenie:
+			return fmt.Errorf("invalid incident target type %q", t.Type)
+		}
+	}
+	return nil
+}
+
+func (i *Incidents) failedMoves() int {
+	if i.FailedMoves == 0 {
+		return 3
+	}
+	return i.FailedMoves
+}
+
+// incidentTracker knows the incidents open, so that they are raised and
+// resolved once, and counts the failed moves of the running cycle.
+type incidentTracker struct {
+	mu     sync.Mutex
+	open   map[string]bool
+	failed int
+}
+
+var incidents = &incidentTracker{open: make(map[string]bool)}
+
+// raise opens the incident of the condition unless it is open already.
+func (t *incidentTracker) raise(condition, summary string, details map[string]interface{}) {
+	if cfg.Incidents == nil {
+		return
+	}
+	t.mu.Lock()
+	open := t.open[condition]
+	t.open[condition] = true
+	t.mu.Unlock()
+	if open {
+		return
+	}
+	fmt.Printf("Raising incident: %s.\n", summary)
+	for _, target := range cfg.Incidents.Targets {
+		if err := target.trigger(condition, summary, details); err != nil {
+			fmt.Printf("Error raising %s incident: %v\n", target.Type, err)
+		}
+	}
+}
+
+// resolve resolves the incident of the condition if it is open.
+func (t *incidentTracker) resolve(condition string) {
+	if cfg.Incidents == nil {
+		return
+	}
+	t.mu.Lock()
+	open := t.open[condition]
+	delete(t.open, condition)
+	t.mu.Unlock()
+	if !open {
+		return
+	}
+	fmt.Printf("Resolving incident %s.\n", condition)
+	for _, target := range cfg.Incidents.Targets {
+		if err := target.resolve(condition); err != nil {
+			fmt.Printf("Error resolving %s incident: %v\n", target.Type, err)
+		}
+	}
+}
+
+// cycleEvent and moveEvent raise and resolve the incident of failing moves.
+func (t *incidentTracker) cycleEvent(event CycleEvent) {
+	switch event.Event {
+	case eventCycleStarted:
+		t.mu.Lock()
+		t.failed = 0
+		t.mu.Unlock()
+	case eventCycleCompleted:
+		t.mu.Lock()
+		failed := t.failed
+		t.mu.Unlock()
+		if len(event.Moves) > 0 && failed == 0 {
+			t.resolve(incidentMoveFailure)
+		}
+	}
+}
+
+func (t *incidentTracker) moveEvent(record MoveRecord) {
+	if record.Result != moveResultFailed {
+		return
+	}
+	t.mu.Lock()
+	t.failed++
+	failed := t.failed
+	t.mu.Unlock()
+	if failed >= cfg.Incidents.failedMoves() {
+		t.raise(incidentMoveFailure, fmt.Sprintf("%d moves of the cycle failed", failed), map[string]interface{}{
+			"last_failed_move": fmt.Sprintf("[%s][%d] %s -> %s", record.Index, record.Shard, record.Source, record.Target),
+			"error":            record.Error,
+		})
+	}
+}
+
+// esResponse raises or resolves the incident of rejected credentials from
+// the status of a response of Elasticsearch.
+func (t *incidentTracker) esResponse(method, path string, status int) {
+	if cfg.Incidents == nil {
+		return
+	}
+	switch {
+	case status == http.StatusUnauthorized:
+		t.raise(incidentAuth, "Elasticsearch rejected the credentials of the balancer", map[string]interface{}{
+			"request": method + " " + path,
+		})
+	case status < 300:
+		t.mu.Lock()
+		open := t.open[incidentAuth]
+		t.mu.Unlock()
+		if open {
+			t.resolve(incidentAuth)
+		}
+	}
+}
+
+// incidentCluster names the cluster in incidents and their deduplication
+// keys.
+func incidentCluster() string {
+	if cfg.ClusterAlias != "" {
+		return cfg.ClusterAlias
+	}
+	return cfg.ESHost
+}
+
+func dedupKey(condition string) string {
+	return "elasticsearch-rebalance-shard/" + incidentCluster() + "/" + condition
+}
+
+func (t IncidentTarget) trigger(condition, summary string, details map[string]interface{}) error {
+	summary = fmt.Sprintf("[%s] %s", incidentCluster(), summary)
+	if t.Type == incidentPagerDuty {
+		severity := t.Severity
+		if severity == "" {
+			severity = "critical"
+		}
+		return t.post("/v2/enqueue", map[string]interface{}{
+			"routing_key":  t.RoutingKey,
+			"event_action": "trigger",
+			"dedup_key":    dedupKey(condition),
+			"payload": map[string]interface{}{
+				"summary":        summary,
+				"source":         cfg.LeaderIdentity,
+				"severity":       severity,
+				"component":      incidentCluster(),
+				"class":          condition,
+				"custom_details": details,
+			},
+		})
+	}
+	priority := t.Severity
+	if priority == "" {
+		priority = "P1"
+	}
+	fields := make(map[string]string, len(details))
+	for k, v := range details {
+		fields[k] = fmt.Sprint(v)
+	}
+	return t.post("/v2/alerts", map[string]interface{}{
+		"message":  summary,
+		"alias":    dedupKey(condition),
+		"priority": priority,
+		"source":   cfg.LeaderIdentity,
+		"tags":     []string{"elasticsearch-rebalance-shard", condition},
+		"details":  fields,
+	})
+}
+
+func (t IncidentTarget) resolve(condition string) error {
+	if t.Type == incidentPagerDuty {
+		return t.post("/v2/enqueue", map[string]interface{}{
+			"routing_key":  t.RoutingKey,
+			"event_action": "resolve",
+			"dedup_key":    dedupKey(condition),
+		})
+	}
+	return t.post("/v2/alerts/"+url.PathEscape(dedupKey(condition))+"/close?identifierType=alias",
+		map[string]interface{}{"source": cfg.LeaderIdentity})
+}
+
+func (t IncidentTarget) post(path string, payload interface{}) error {
+	base := t.URL
+	if base == "" {
+		base = "https://events.pagerduty.com"
+		if t.Type == incidentOpsgenie {
+			base = "https://api.opsgenie.com"
+		}
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", strings.TrimRight(base, "/")+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if t.Type == incidentOpsgenie {
+		req.Header.Set("Authorization", "GenieKey "+t.APIKey)
+	}
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("POST %s: %s", req.URL.Redacted(), resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const allocationSettingPrefix = "index.routing.allocation."
+
+// indexAllocation holds the allocation filters of an index, the patterns of
+// every node attribute, and its limit of copies per node, 0 for none.
+type indexAllocation struct {
+	require, include, exclude map[string][]string
+	totalShardsPerNode        int
+}
+
+// indexAllocations holds the allocation settings of the indices that have
+// some, by index name, and the data nodes they are checked against, as of
+// the last readAllocationSettings.
+var (
+	indexAllocationMu sync.Mutex
+	indexAllocations  map[string]*indexAllocation
+	allocationNodes   map[string]NodeInfo
+)
+
+// readAllocationSettings records the allocation settings of the observed
+// indices before planning, so that the planner leaves out the moves the
+// filter and shards limit deciders of Elasticsearch would reject. The tier
+// preference has its own decider with fallbacks and is not checked.
+func readAllocationSettings(obs *Observation) {
+	allocations := make(map[string]*indexAllocation, len(obs.AllocationSettings))
+	for index, settings := range obs.AllocationSettings {
+		a := &indexAllocation{require: map[string][]string{}, include: map[string][]string{}, exclude: map[string][]string{}}
+		for key, value := range settings {
+			name := strings.TrimPrefix(key, allocationSettingPrefix)
+			if name == "total_shards_per_node" {
+				if n, err := strconv.Atoi(value); err == nil && n > 0 {
+					a.totalShardsPerNode = n
+				}
+				continue
+			}
+			kind, attribute, ok := strings.Cut(name, ".")
+			if !ok || attribute == "_tier_preference" || strings.TrimSpace(value) == "" {
+				continue
+			}
+			var patterns []string
+			for _, pattern := range strings.Split(value, ",") {
+				if pattern = strings.TrimSpace(pattern); pattern != "" {
+					patterns = append(patterns, pattern)
+				}
+			}
+			switch kind {
+			case "require":
+				a.require[attribute] = patterns
+			case "include":
+				a.include[attribute] = patterns
+			case "exclude":
+				a.exclude[attribute] = patterns
+			}
+		}
+		allocations[index] = a
+	}
+	var nodes map[string]NodeInfo
+	if obs.Nodes != nil {
+		nodes = obs.Nodes.Nodes
+	}
+	indexAllocationMu.Lock()
+	indexAllocations, allocationNodes = allocations, nodes
+	indexAllocationMu.Unlock()
+}
+
+// allocationAllowed tells whether the index allocation settings let the copy
+// be allocated on the node, which already holds the copies onNode. Like in
+// Elasticsearch, the node must match every require attribute, at least one
+// include attribute when there are some, and no exclude attribute.
+func allocationAllowed(shard ShardRouting, nodeID string, onNode []ShardRouting) bool {
+	indexAllocationMu.Lock()
+	defer indexAllocationMu.Unlock()
+	a, ok := indexAllocations[shard.Index]
+	if !ok {
+		return true
+	}
+	if a.totalShardsPerNode > 0 {
+		n := 0
+		for _, s := range onNode {
+			if s.Index == shard.Index {
+				n++
+			}
+		}
+		if n >= a.totalShardsPerNode {
+			return false
+		}
+	}
+	node := allocationNodes[nodeID]
+	for attribute, patterns := range a.require {
+		if !nodeAttributeMatches(nodeID, node, attribute, patterns) {
+			return false
+		}
+	}
+	if len(a.include) > 0 {
+		included := false
+		for attribute, patterns := range a.include {
+			if nodeAttributeMatches(nodeID, node, attribute, patterns) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return false
+		}
+	}
+	for attribute, patterns := range a.exclude {
+		if nodeAttributeMatches(nodeID, node, attribute, patterns) {
+			return false
+		}
+	}
+	return true
+}
+
+// nodeAttributeMatches tells whether the attribute of the node matches one
+// of the patterns. Besides the custom node attributes, the built-in _id,
+// _name, _host, _ip (also _host_ip and _publish_ip) and _tier are known.
+func nodeAttributeMatches(nodeID string, node NodeInfo, attribute string, patterns []string) bool {
+	var values []string
+	switch attribute {
+	case "_id":
+		values = []string{nodeID}
+	case "_name":
+		values = []string{node.Name}
+	case "_host":
+		values = []string{node.Host}
+	case "_ip", "_host_ip", "_publish_ip":
+		values = []string{node.IP}
+	case "_tier":
+		values = node.Roles
+	default:
+		if v, ok := node.Attributes[attribute]; ok {
+			values = []string{v}
+		}
+	}
+	for _, value := range values {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, value); ok && value != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// kubeClient calls the Kubernetes API from within a pod, with the token of
+// its service account.
+type kubeClient struct {
+	url       string
+	namespace string // of the pod
+	token     string
+	client    *http.Client
+	// watcher has no timeout, for the long running watch requests.
+	watcher *http.Client
+}
+
+func newKubeClient() (*kubeClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in Kubernetes: KUBERNETES_SERVICE_HOST is not set")
+	}
+	token, err := ioutil.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, err
+	}
+	ca, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificate in %s/ca.crt", serviceAccountDir)
+	}
+	namespace, err := ioutil.ReadFile(serviceAccountDir + "/namespace")
+	if err != nil {
+		return nil, err
+	}
+	transport := &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	return &kubeClient{
+		url:       "https://" + net.JoinHostPort(host, port),
+		namespace: strings.TrimSpace(string(namespace)),
+		token:     strings.TrimSpace(string(token)),
+		client:    &http.Client{Timeout: 10 * time.Second, Transport: transport},
+		watcher:   &http.Client{Transport: transport},
+	}, nil
+}
+
+// do sends a JSON request to the API and decodes the response into v if
+// not nil. It returns the status code along with any error.
+func (k *kubeClient) do(ctx context.Context, method, path string, payload, v interface{}) (int, error) {
+	return k.send(ctx, method, path, "application/json", payload, v)
+}
+
+// send is do with the content type of the payload, such as the one of merge
+// patches.
+func (k *kubeClient) send(ctx context.Context, method, path, contentType string, payload, v interface{}) (int, error) {
+	var body *bytes.Reader
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return 0, err
+		}
+		body = bytes.NewReader(data)
+	} else {
+		body = bytes.NewReader(nil)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, k.url+path, body)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+k.token)
+	req.Header.Set("Content-Type", contentType)
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		data, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, data)
+	}
+	if v != nil {
+		return resp.StatusCode, json.NewDecoder(resp.Body).Decode(v)
+	}
+	return resp.StatusCode, nil
+}
+
+// watch starts a watch request and returns the response, whose body
+// streams the events. The caller closes it.
+func (k *kubeClient) watch(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", k.url+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+k.token)
+	resp, err := k.watcher.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("GET %s: %s: %s", path, resp.Status, data)
+	}
+	return resp, nil
+}
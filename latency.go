@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// defaultLatencyWindow is how long latency is measured for when
+// cfg.LatencyWindow is 0.
+const defaultLatencyWindow = time.Minute
+
+// Latency is the average time of the searches and indexing operations run
+// on the cluster during a measurement window, in milliseconds.
+type Latency struct {
+	SearchMillis   float64 `json:"search_ms"`
+	IndexingMillis float64 `json:"indexing_ms"`
+}
+
+func (l Latency) String() string {
+	return fmt.Sprintf("search %.1fms, indexing %.1fms", l.SearchMillis, l.IndexingMillis)
+}
+
+type OperationStats struct {
+	Nodes map[string]struct {
+		Indices struct {
+			Search struct {
+				QueryTotal        int64 `json:"query_total"`
+				QueryTimeInMillis int64 `json:"query_time_in_millis"`
+			} `json:"search"`
+			Indexing struct {
+				IndexTotal        int64 `json:"index_total"`
+				IndexTimeInMillis int64 `json:"index_time_in_millis"`
+			} `json:"indexing"`
+		} `json:"indices"`
+	} `json:"nodes"`
+}
+
+// operationTotals returns the cumulative counts and times of the searches
+// and indexing operations of all nodes.
+func operationTotals() (searches, searchMillis, indexed, indexMillis int64, err error) {
+	var stats OperationStats
+	if err = esGet("/_nodes/stats/indices/search,indexing?filter_path=nodes.*.indices.search.query_total,nodes.*.indices.search.query_time_in_millis,nodes.*.indices.indexing.index_total,nodes.*.indices.indexing.index_time_in_millis", &stats); err != nil {
+		return
+	}
+	for _, node := range stats.Nodes {
+		searches += node.Indices.Search.QueryTotal
+		searchMillis += node.Indices.Search.QueryTimeInMillis
+		indexed += node.Indices.Indexing.IndexTotal
+		indexMillis += node.Indices.Indexing.IndexTimeInMillis
+	}
+	return
+}
+
+// measureLatency samples the operation totals at both ends of the latency
+// window. An operation kind with no traffic in the window has latency 0.
+func measureLatency() (*Latency, error) {
+	window := cfg.LatencyWindow.Duration
+	if window == 0 {
+		window = defaultLatencyWindow
+	}
+	s0, st0, i0, it0, err := operationTotals()
+	if err != nil {
+		return nil, err
+	}
+	time.Sleep(window)
+	s1, st1, i1, it1, err := operationTotals()
+	if err != nil {
+		return nil, err
+	}
+	var l Latency
+	if s1 > s0 {
+		l.SearchMillis = float64(st1-st0) / float64(s1-s0)
+	}
+	if i1 > i0 {
+		l.IndexingMillis = float64(it1-it0) / float64(i1-i0)
+	}
+	return &l, nil
+}
+
+// latencyRegressions lists the operation kinds that got slower than the
+// baseline by more than cfg.LatencyTolerance.
+func latencyRegressions(before, after Latency) []string {
+	var regressions []string
+	check := func(kind string, b, a float64) {
+		if b > 0 && a > b*(1+cfg.LatencyTolerance) {
+			regressions = append(regressions, fmt.Sprintf("%s %.1fms -> %.1fms", kind, b, a))
+		}
+	}
+	check("search", before.SearchMillis, after.SearchMillis)
+	check("indexing", before.IndexingMillis, after.IndexingMillis)
+	return regressions
+}
+
+// checkLatency compares the latency once the cycle's relocations settled
+// with the baseline taken before executing, and flags the cycle when it
+// regressed. With cfg.LatencyRollback the executed moves are then undone.
+func checkLatency(c *cycle, moves []Move) {
+	if c.latencyBefore == nil || len(moves) == 0 {
+		return
+	}
+	if err := waitForRelocations(); err != nil {
+		fmt.Println("Error waiting for the relocations to settle, not checking latency:", err)
+		return
+	}
+	after, err := measureLatency()
+	if err != nil {
+		fmt.Println("Error measuring latency:", err)
+		return
+	}
+	c.latencyAfter = after
+	regressions := latencyRegressions(*c.latencyBefore, *after)
+	if len(regressions) == 0 {
+		fmt.Printf("Latency after the cycle: %s (was %s).\n", after, c.latencyBefore)
+		return
+	}
+	c.latencyRegressed = true
+	fmt.Printf("Latency regressed beyond %.0f%%: %s.\n", cfg.LatencyTolerance*100, strings.Join(regressions, ", "))
+	if cfg.LatencyRollback {
+		c.rolledBack = rollbackMoves(moves)
+	}
+}
+
+// rollbackMoves moves the copies back where they came from, most recent
+// move first, and returns the moves issued to do so.
+func rollbackMoves(moves []Move) []Move {
+	fmt.Printf("Rolling back %d moves...\n", len(moves))
+	disableAllocation()
+	defer enableAllocation()
+	var rolledBack []Move
+	for i := len(moves) - 1; i >= 0; i-- {
+		back := Move{Shard: moves[i].Shard, From: moves[i].To, To: moves[i].From, Bytes: moves[i].Bytes}
+		record := moveRecord(back, moveResultExecuted)
+		if err := moveShard(back.Shard, back.From, back.To); err != nil {
+			record.Result = moveResultFailed
+			record.Error = err.Error()
+		} else {
+			rolledBack = append(rolledBack, back)
+			bus.publish(topicMove, moveRecord(back, moveResultIssued))
+		}
+		recordMoves(record)
+	}
+	return rolledBack
+}
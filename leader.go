@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const leaderElectionKubernetes = "kubernetes"
+
+// elector is a lock only one instance of the balancer can hold at a time.
+// Releasing a lock that is not held is a no-op.
+type elector interface {
+	// acquire takes the lock, or renews it if already held, and reports
+	// whether this instance holds it.
+	acquire(ctx context.Context) (bool, error)
+	// release gives the lock up so that another instance can take over
+	// without waiting for it to expire.
+	release(ctx context.Context) error
+}
+
+// newElectors returns the locks to hold to be the leader: the Kubernetes
+// Lease if enabled, then the cluster lock document. The lease alone does not
+// keep operators running commands by hand from changing the cluster, so it
+// is combined with the cluster lock unless that is disabled.
+func newElectors() ([]elector, error) {
+	var electors []elector
+	switch cfg.LeaderElection {
+	case "":
+	case leaderElectionKubernetes:
+		lease, err := newLeaseElector()
+		if err != nil {
+			return nil, err
+		}
+		electors = append(electors, lease)
+	default:
+		return nil, fmt.Errorf("unknown leader election %q", cfg.LeaderElection)
+	}
+	if cfg.ClusterLock {
+		electors = append(electors, newESLock())
+	}
+	return electors, nil
+}
+
+// electLeader keeps trying to acquire or renew the locks, every third of
+// the lease duration. Only the leader, holding all of them, runs cycles; the
+// others stand by. Any error drops the leadership, as a lock may have been
+// lost.
+func electLeader(ctx context.Context) error {
+	electors, err := newElectors()
+	if err != nil {
+		return fatal(err)
+	}
+	defer func() {
+		ctl.setLeader(false)
+		release, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		for i := len(electors) - 1; i >= 0; i-- {
+			if err := electors[i].release(release); err != nil {
+				fmt.Println("Error releasing leadership:", err)
+			}
+		}
+	}()
+
+	for {
+		leader := true
+		for _, e := range electors {
+			held, err := e.acquire(ctx)
+			if err != nil {
+				fmt.Println("Error in leader election:", err)
+			}
+			if !held {
+				leader = false
+				break
+			}
+		}
+		if leader != ctl.isLeader() {
+			ctl.setLeader(leader)
+			if leader {
+				fmt.Printf("Became the leader as %s.\n", cfg.LeaderIdentity)
+				ctl.triggerNow("leader election")
+			} else {
+				fmt.Println("Not holding the leadership, standing by.")
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(cfg.LeaseDuration.Duration / 3):
+		}
+	}
+}
+
+// leaseElector uses a Kubernetes Lease as the lock. Updates carry the
+// resourceVersion that was read, so two instances racing for an expired
+// lease cannot both win.
+type leaseElector struct {
+	kube *kubeClient
+	path string
+}
+
+func newLeaseElector() (*leaseElector, error) {
+	kube, err := newKubeClient()
+	if err != nil {
+		return nil, err
+	}
+	namespace := cfg.LeaseNamespace
+	if namespace == "" {
+		namespace = kube.namespace
+	}
+	return &leaseElector{kube: kube, path: "/apis/coordination.k8s.io/v1/namespaces/" + namespace + "/leases"}, nil
+}
+
+type Lease struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name            string `json:"name"`
+		ResourceVersion string `json:"resourceVersion,omitempty"`
+	} `json:"metadata"`
+	Spec LeaseSpec `json:"spec"`
+}
+
+type LeaseSpec struct {
+	HolderIdentity       string `json:"holderIdentity"`
+	LeaseDurationSeconds int    `json:"leaseDurationSeconds"`
+	AcquireTime          string `json:"acquireTime,omitempty"`
+	RenewTime            string `json:"renewTime,omitempty"`
+	LeaseTransitions     int    `json:"leaseTransitions"`
+}
+
+// microTime is the format of Kubernetes MicroTime fields.
+const microTime = "2006-01-02T15:04:05.000000Z07:00"
+
+func (l *leaseElector) acquire(ctx context.Context) (bool, error) {
+	now := time.Now().UTC()
+	var lease Lease
+	code, err := l.do(ctx, "GET", "/"+cfg.LeaseName, nil, &lease)
+	if err != nil && code != http.StatusNotFound {
+		return false, err
+	}
+
+	if code == http.StatusNotFound {
+		lease.APIVersion, lease.Kind = "coordination.k8s.io/v1", "Lease"
+		lease.Metadata.Name = cfg.LeaseName
+		lease.Spec = l.spec(now, now, 0)
+		code, err = l.do(ctx, "POST", "", lease, nil)
+		if code == http.StatusConflict {
+			return false, nil // someone else created it first
+		}
+		return err == nil, err
+	}
+
+	spec := lease.Spec
+	if spec.HolderIdentity != cfg.LeaderIdentity {
+		renewed, _ := time.Parse(microTime, spec.RenewTime)
+		expiry := renewed.Add(time.Duration(spec.LeaseDurationSeconds) * time.Second)
+		if spec.HolderIdentity != "" && now.Before(expiry) {
+			return false, nil
+		}
+		lease.Spec = l.spec(now, now, spec.LeaseTransitions+1)
+	} else {
+		acquired, _ := time.Parse(microTime, spec.AcquireTime)
+		lease.Spec = l.spec(acquired, now, spec.LeaseTransitions)
+	}
+	code, err = l.do(ctx, "PUT", "/"+cfg.LeaseName, lease, nil)
+	if code == http.StatusConflict {
+		return false, nil // updated by someone else since we read it
+	}
+	return err == nil, err
+}
+
+func (l *leaseElector) spec(acquired, renewed time.Time, transitions int) LeaseSpec {
+	return LeaseSpec{
+		HolderIdentity:       cfg.LeaderIdentity,
+		LeaseDurationSeconds: int(cfg.LeaseDuration.Seconds()),
+		AcquireTime:          acquired.Format(microTime),
+		RenewTime:            renewed.Format(microTime),
+		LeaseTransitions:     transitions,
+	}
+}
+
+func (l *leaseElector) release(ctx context.Context) error {
+	var lease Lease
+	if _, err := l.do(ctx, "GET", "/"+cfg.LeaseName, nil, &lease); err != nil {
+		return err
+	}
+	if lease.Spec.HolderIdentity != cfg.LeaderIdentity {
+		return nil
+	}
+	lease.Spec.HolderIdentity = ""
+	_, err := l.do(ctx, "PUT", "/"+cfg.LeaseName, lease, nil)
+	return err
+}
+
+func (l *leaseElector) do(ctx context.Context, method, path string, payload, v interface{}) (int, error) {
+	return l.kube.do(ctx, method, l.path+path, payload, v)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// lockIndex holds the cluster lock document. Whoever holds the lock is the
+// only one changing the cluster: the instance running cycles, or an
+// operator running a command like apply-advice.
+const (
+	lockIndex = ".rebalancer-lock"
+	lockDocID = "lock"
+)
+
+type LockDocument struct {
+	Holder     string    `json:"holder"`
+	AcquiredAt time.Time `json:"acquired_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// esLock is the cluster lock document. Its expiry is pushed forward by
+// every acquire, so that the lock of a holder that died frees up after
+// cfg.LeaseDuration. Writes are conditional on the sequence number that was
+// read, so only one of two instances racing for the lock can win.
+type esLock struct {
+	holder string
+}
+
+func newESLock() *esLock {
+	// Two operators may run the tool from the same host, so the identity
+	// alone is not enough to tell holders apart.
+	return &esLock{holder: fmt.Sprintf("%s/%d", cfg.LeaderIdentity, os.Getpid())}
+}
+
+type lockGetResponse struct {
+	Found       bool         `json:"found"`
+	SeqNo       int64        `json:"_seq_no"`
+	PrimaryTerm int64        `json:"_primary_term"`
+	Source      LockDocument `json:"_source"`
+}
+
+func lockPath() string {
+	return "/" + url.PathEscape(lockIndex) + "/_doc/" + lockDocID
+}
+
+// read returns the lock document, with found false if there is none.
+func (l *esLock) read() (*lockGetResponse, error) {
+	code, body, err := doJSON("GET", lockPath(), nil)
+	if code == http.StatusNotFound {
+		return &lockGetResponse{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var doc lockGetResponse
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, fmt.Errorf("parsing lock document: %w", err)
+	}
+	return &doc, nil
+}
+
+func (l *esLock) acquire(ctx context.Context) (bool, error) {
+	held, _, err := l.tryAcquire()
+	return held, err
+}
+
+// tryAcquire takes or renews the lock. When someone else holds it, it also
+// returns their lock document.
+func (l *esLock) tryAcquire() (bool, *LockDocument, error) {
+	doc, err := l.read()
+	if err != nil {
+		return false, nil, err
+	}
+	now := time.Now().UTC()
+	lock := LockDocument{Holder: l.holder, AcquiredAt: now, ExpiresAt: now.Add(cfg.LeaseDuration.Duration)}
+
+	path := lockPath() + "?op_type=create"
+	if doc.Found {
+		if doc.Source.Holder != l.holder && now.Before(doc.Source.ExpiresAt) {
+			return false, &doc.Source, nil
+		}
+		if doc.Source.Holder == l.holder {
+			lock.AcquiredAt = doc.Source.AcquiredAt
+		}
+		path = fmt.Sprintf("%s?if_seq_no=%d&if_primary_term=%d", lockPath(), doc.SeqNo, doc.PrimaryTerm)
+	}
+	code, _, err := doJSON("PUT", path, lock)
+	if code == http.StatusConflict {
+		// Taken or renewed by someone else since it was read.
+		return false, nil, nil
+	}
+	return err == nil, nil, err
+}
+
+func (l *esLock) release(ctx context.Context) error {
+	doc, err := l.read()
+	if err != nil || !doc.Found || doc.Source.Holder != l.holder {
+		return err
+	}
+	code, _, err := doJSON("DELETE", fmt.Sprintf("%s?if_seq_no=%d&if_primary_term=%d", lockPath(), doc.SeqNo, doc.PrimaryTerm), nil)
+	if code == http.StatusConflict || code == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+// errLockLost is returned by withClusterLock when the lock could not be
+// renewed while fn ran.
+var errLockLost = errors.New("lost the cluster lock")
+
+// heldLock is the context of the cluster lock withClusterLock holds, done
+// once it is lost, for the executor to stop issuing moves. It is never done
+// outside of withClusterLock.
+var (
+	heldLockMu sync.Mutex
+	heldLock   = context.Background()
+)
+
+// lockLost tells whether the cluster lock held while changing the cluster
+// was lost.
+func lockLost() bool {
+	heldLockMu.Lock()
+	defer heldLockMu.Unlock()
+	return heldLock.Err() != nil
+}
+
+// withClusterLock runs fn holding the cluster lock, renewing it while fn
+// runs. It fails right away if someone else holds the lock. The context of
+// fn is done as soon as a renewal fails, the lock then being lost; fn that
+// returns nil after that gets errLockLost.
+func withClusterLock(fn func(ctx context.Context) error) error {
+	if !cfg.ClusterLock {
+		return fn(context.Background())
+	}
+	l := newESLock()
+	held, other, err := l.tryAcquire()
+	if err != nil {
+		return fmt.Errorf("acquiring cluster lock: %w", err)
+	}
+	if !held {
+		if other != nil {
+			return fmt.Errorf("cluster is locked by %s until %s", other.Holder, other.ExpiresAt.Local().Format(time.RFC3339))
+		}
+		return fmt.Errorf("cluster lock was taken by someone else")
+	}
+
+	ctx, lose := context.WithCancel(context.Background())
+	heldLockMu.Lock()
+	heldLock = ctx
+	heldLockMu.Unlock()
+	done, renewed := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(renewed)
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(cfg.LeaseDuration.Duration / 3):
+			}
+			held, err := l.acquire(ctx)
+			if held {
+				continue
+			}
+			if err != nil {
+				fmt.Println("Error renewing cluster lock, stopping:", err)
+			} else {
+				fmt.Println("The cluster lock was taken by someone else, stopping.")
+			}
+			lose()
+			return
+		}
+	}()
+	defer func() {
+		close(done)
+		<-renewed
+		heldLockMu.Lock()
+		heldLock = context.Background()
+		heldLockMu.Unlock()
+		if ctx.Err() != nil {
+			// Whoever holds it now keeps it.
+			return
+		}
+		lose()
+		if err := l.release(context.Background()); err != nil {
+			fmt.Println("Error releasing cluster lock:", err)
+		}
+	}()
+	err = fn(ctx)
+	if err == nil && ctx.Err() != nil {
+		err = errLockLost
+	}
+	return err
+}
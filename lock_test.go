@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tjandrayana/elasticsearch-rebalance-shard/esapi"
+)
+
+// stealingLock answers like its fake, the lock being taken by someone else
+// once the first move is issued. The move returns once the holder noticed.
+type stealingLock struct {
+	*esapi.Fake
+	t      *testing.T
+	stolen bool
+}
+
+func (a *stealingLock) Do(method, path string, body []byte) (*http.Response, error) {
+	resp, err := a.Fake.Do(method, path, body)
+	if method == "POST" && strings.HasPrefix(path, "/_cluster/reroute") && !strings.Contains(path, "dry_run") &&
+		bytes.Contains(body, []byte(`"move"`)) && !a.stolen {
+		a.stolen = true
+		now := time.Now().UTC()
+		lock, _ := json.Marshal(LockDocument{Holder: "someone-else", AcquiredAt: now, ExpiresAt: now.Add(time.Hour)})
+		if _, err := a.Fake.Do("PUT", lockPath(), lock); err != nil {
+			a.t.Fatal(err)
+		}
+		for deadline := time.Now().Add(5 * time.Second); !lockLost(); time.Sleep(5 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				a.t.Fatal("the lock was not renewed")
+			}
+		}
+	}
+	return resp, err
+}
+
+func TestLockLostMidRun(t *testing.T) {
+	fake := testCluster(t, "a", "b")
+	addShards(fake, "a", 3)
+	moves := testMoves(observeTestCluster(t), "a-0 a b", "a-1 a b", "a-2 a b")
+	es = &stealingLock{Fake: fake, t: t}
+	cfg.ClusterLock = true
+	cfg.LeaseDuration.Duration = 30 * time.Millisecond
+	// Every move is waited for, as with a stall timeout.
+	cfg.StallTimeout = Duration{time.Hour}
+
+	var executed []Move
+	var stopped, failed bool
+	err := withClusterLock(func(ctx context.Context) error {
+		executed, stopped, failed = executeMoves(moves)
+		if ctx.Err() == nil {
+			t.Error("the context of the locked function is not done once the lock is lost")
+		}
+		return nil
+	})
+	if !errors.Is(err, errLockLost) {
+		t.Errorf("withClusterLock returned %v, want %v", err, errLockLost)
+	}
+	if len(executed) != 1 || !stopped || failed {
+		t.Errorf("executed %d moves, stopped %v and failed %v, want 1, stopped and not failed", len(executed), stopped, failed)
+	}
+	if lockLost() {
+		t.Error("the lock is still reported lost after withClusterLock returned")
+	}
+	doc, err := newESLock().read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !doc.Found || doc.Source.Holder != "someone-else" {
+		t.Errorf("the lock document is %+v, want it left to someone-else", doc)
+	}
+}
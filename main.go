@@ -1,196 +1,408 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"strings"
 	"time"
-)
 
-const (
-	esHost             = "http://localhost:9200"
-	rebalanceThreshold = 10 // Maximum allowed difference in shard count between nodes
-	sleepInterval      = 60 * time.Second
+	"github.com/tjandrayana/elasticsearch-rebalance-shard/observer"
 )
 
 type ClusterHealth struct {
-	Status string `json:"status"`
+	Status           string `json:"status"`
+	RelocatingShards int    `json:"relocating_shards"`
+	UnassignedShards int    `json:"unassigned_shards"`
 }
 
-type ClusterState struct {
-	RoutingNodes struct {
-		Nodes map[string][]interface{} `json:"nodes"`
-	} `json:"routing_nodes"`
+// The observation types live in the observer package so that they can be
+// used without the rest of the balancer.
+type (
+	NodeInfo     = observer.NodeInfo
+	NodesInfo    = observer.NodesInfo
+	ShardRouting = observer.ShardRouting
+	ClusterState = observer.ClusterState
+	Observation  = observer.Observation
+)
+
+// esGet issues a GET request against the cluster and decodes the JSON
+// response into v.
+func esGet(path string, v interface{}) error {
+	resp, err := esRequest("GET", path, nil)
+	if err != nil {
+		return err
+	}
+	return decodeResponse(resp, path, v)
 }
 
-func getClusterHealth() (*ClusterHealth, error) {
-	resp, err := http.Get(esHost + "/_cluster/health")
+// getJSON is esGet against a given endpoint rather than the current one.
+func getJSON(host, path string, v interface{}) error {
+	resp, err := esClient.Get(host + path)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	return decodeResponse(resp, path, v)
+}
+
+func decodeResponse(resp *http.Response, path string, v interface{}) error {
 	defer resp.Body.Close()
 
-	var health ClusterHealth
-	if err := json.NewDecoder(resp.Body).Decode(&health); err != nil {
-		return nil, err
+	if resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("GET %s: %s: %s", path, resp.Status, body)
 	}
-	return &health, nil
+	return json.NewDecoder(resp.Body).Decode(v)
 }
 
-func getClusterState() (*ClusterState, error) {
-	resp, err := http.Get(esHost + "/_cluster/state/routing_nodes")
+// esGetter lets the observer package read from the cluster through esGet.
+type esGetter struct{}
+
+func (esGetter) GetJSON(path string, v interface{}) error {
+	return esGet(path, v)
+}
+
+// Stream makes esGetter an observer.Streamer, for the large responses.
+func (esGetter) Stream(path string) (io.ReadCloser, error) {
+	resp, err := esRequest("GET", path, nil)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("GET %s: %s: %s", path, resp.Status, body)
+	}
+	return resp.Body, nil
+}
 
-	var state ClusterState
-	if err := json.NewDecoder(resp.Body).Decode(&state); err != nil {
+func getClusterHealth() (*ClusterHealth, error) {
+	var health ClusterHealth
+	if err := esGet("/_cluster/health", &health); err != nil {
 		return nil, err
 	}
-	return &state, nil
+	return &health, nil
 }
 
-func getShardDistribution(state *ClusterState) map[string]int {
-	shardDistribution := make(map[string]int)
-	for nodeID, shards := range state.RoutingNodes.Nodes {
-		shardDistribution[nodeID] = len(shards)
-	}
-	return shardDistribution
+func getClusterState() (*ClusterState, error) {
+	return observer.GetClusterState(esGetter{})
 }
 
-func isBalanced(shardDistribution map[string]int) bool {
-	var maxShards, minShards int
-	for _, shardCount := range shardDistribution {
-		if shardCount > maxShards {
-			maxShards = shardCount
-		}
-		if minShards == 0 || shardCount < minShards {
-			minShards = shardCount
-		}
-	}
-	return (maxShards - minShards) <= rebalanceThreshold
+func getNodesInfo() (*NodesInfo, error) {
+	return observer.GetNodesInfo(esGetter{})
 }
 
 func rebalanceShards() {
-	fmt.Println("Rebalancing shards...")
+	if ctl.isPaused() {
+		fmt.Println("Balancer is paused, skipping cycle.")
+		return
+	}
+	if !inMaintenanceWindow(time.Now()) {
+		fmt.Println("Outside of the maintenance windows, skipping cycle.")
+		return
+	}
+	if ctl.inSafeMode() {
+		observeOnly()
+		return
+	}
+	if until, ok := ctl.coolingDown(); ok {
+		fmt.Printf("Cooling down after the last cycle until %s, skipping cycle.\n", until.Format(time.RFC3339))
+		return
+	}
+	if !snapshotsAllow() {
+		return
+	}
+	if cfg.SampleIndices > 0 && sampledBalanced() {
+		return
+	}
 
-	// Disable shard allocation temporarily
-	disableAllocation()
+	fmt.Println("Rebalancing shards...")
+	cycle := newCycle()
 
 	// Get current cluster state
-	state, err := getClusterState()
+	obs, err := observeCluster()
 	if err != nil {
-		fmt.Println("Error getting cluster state:", err)
-		enableAllocation()
+		fmt.Println("Error observing cluster:", err)
+		cycle.failed(err)
 		return
 	}
 
-	fmt.Printf("[xxx] state : %v\n", state)
-
-	shardDistribution := getShardDistribution(state)
+	printNodeTable(obs, false)
+	smoothed.observe(obs.Distribution)
+	before := countScore(obs.Distribution)
+	cycle.scoreBefore = &before
+	fmt.Println("Imbalance score:", before)
 
-	// Determine if the cluster is already balanced
-	if isBalanced(shardDistribution) {
+	moves := planMoves(obs)
+	if cfg.RequireApproval {
+		var approved bool
+		if moves, approved = approvedMoves(cycle, obs, estimatePlan(obs, moves)); !approved {
+			cycle.idle()
+			return
+		}
+	}
+	ctl.planned(planImbalance(obs), len(moves))
+	ctl.setBalancing(len(moves) > 0)
+	if len(moves) == 0 {
 		fmt.Println("Cluster is already balanced.")
-		enableAllocation()
+		cycle.idle()
 		return
 	}
 
-	// Move shards to balance the cluster
-	for nodeID, shardCount := range shardDistribution {
-		if shardCount > rebalanceThreshold {
-			// Get the node with the fewest shards
-			targetNodeID := minShardNode(shardDistribution)
-
-			// Move a shard from the overloaded node to the target node
-			moveShard(nodeID, targetNodeID)
-			time.Sleep(5 * time.Second) // Give some time for the move to complete
+	// Disable shard allocation temporarily, only once there are moves to
+	// execute.
+	disableAllocation()
+	executeCycle(cycle, obs, moves)
+}
+
+// executeCycle executes the planned moves of a cycle, which disabled
+// allocation, and ends it.
+func executeCycle(cycle *cycle, obs *Observation, moves []Move) {
+	estimates := estimatePlan(obs, moves)
+	printPlan(estimates)
+	adviseOnPlan(obs, moves)
+	cycle.started(moves)
+	shipReport(reportPlan, "", planResponse(obs, estimates))
+
+	planned := make([]MoveRecord, 0, len(moves))
+	for _, move := range moves {
+		planned = append(planned, moveRecord(move, moveResultPlanned))
+	}
+	recordMoves(planned...)
+
+	if cfg.LatencyTolerance > 0 {
+		var err error
+		if cycle.latencyBefore, err = measureLatency(); err != nil {
+			fmt.Println("Error measuring baseline latency:", err)
+		} else {
+			fmt.Println("Baseline latency:", cycle.latencyBefore)
 		}
 	}
 
+	// Move shards to balance the cluster
+	if cfg.HealthGuard != nil {
+		guard.start(cycle)
+	}
+	boostRecoveries()
+	stopProgress := reportProgress()
+	executed, failed := executePlan(obs, moves)
+	stopProgress()
+	distribution := afterMoves(obs.Distribution, executed)
+	after := countScore(distribution)
+	cycle.scoreAfter = &after
+	cycle.distribution = make(map[string]int, len(distribution))
+	for id, n := range distribution {
+		cycle.distribution[nodeName(obs, id)] = n
+	}
+	fmt.Printf("Expected imbalance score once the moves are done: %s (was %s).\n", after, *cycle.scoreBefore)
+
 	enableAllocation()
+	if failed && cfg.OnMoveFailure == onMoveFailureRollback {
+		rollbackFailedPlan(cycle, executed)
+	} else {
+		checkLatency(cycle, executed)
+	}
+	cycle.completed(executed)
 }
 
-func minShardNode(shardDistribution map[string]int) string {
-	var minNode string
-	minShards := -1
-	for nodeID, shardCount := range shardDistribution {
-		if minShards == -1 || shardCount < minShards {
-			minShards = shardCount
-			minNode = nodeID
-		}
+// observeCluster fetches the routing table, node roles and shard sizes.
+// Excluded nodes are left out of the distribution.
+func observeCluster() (*Observation, error) {
+	start := time.Now()
+	obs, err := observer.Observe(esGetter{})
+	if err != nil {
+		return nil, err
 	}
-	return minNode
+	recordObservation(obs, time.Since(start))
+	excludeNodes(obs)
+	setAsideMaintenanceNodes(obs)
+	weighNodes(obs)
+	return obs, nil
 }
 
+// disableAllocation and enableAllocation also keep the execution marker, so
+// that a run ending while allocation is disabled is detected at the next
+// start. Allocation is disabled, or scoped to cfg.AllocationEnable, and
+// the value it had before is restored. In reroute-only mode they only
+// disable and enable the rebalancing of Elasticsearch.
 func disableAllocation() {
-	fmt.Println("Disabling shard allocation...")
-	settings := map[string]interface{}{
-		"transient": map[string]interface{}{
-			"cluster.routing.allocation.enable": "none",
-		},
+	rememberAllocation()
+	markExecution()
+	if cfg.RerouteOnly {
+		fmt.Println("Disabling shard rebalancing...")
+		putClusterSettings(clusterSettings{settingRebalanceEnable: allocationEnableNone})
+		return
+	}
+	if cfg.AllocationEnable == allocationEnableNone {
+		fmt.Println("Disabling shard allocation...")
+	} else {
+		fmt.Printf("Limiting shard allocation to %s...\n", strings.ReplaceAll(cfg.AllocationEnable, "_", " "))
 	}
-	sendClusterSettings(settings)
+	putClusterSettings(clusterSettings{settingAllocationEnable: cfg.AllocationEnable})
+	disabledWindow.start()
 }
 
 func enableAllocation() {
-	fmt.Println("Enabling shard allocation...")
-	settings := map[string]interface{}{
-		"transient": map[string]interface{}{
-			"cluster.routing.allocation.enable": nil,
-		},
-	}
-	sendClusterSettings(settings)
+	allocationPriorMu.Lock()
+	prior := allocationPrior
+	allocationPriorMu.Unlock()
+	enableAllocationAs(cfg.RerouteOnly, settingsScope(), prior)
 }
 
-func moveShard(sourceNode, targetNode string) {
-	fmt.Printf("Moving shard from node %s to node %s...\n", sourceNode, targetNode)
-	settings := map[string]interface{}{
-		"transient": map[string]interface{}{
-			"cluster.routing.allocation.exclude._name": sourceNode,
-			"cluster.routing.allocation.include._name": targetNode,
-		},
+// enableAllocationAs undoes what disableAllocation did in the mode and
+// settings scope it ran with, restoring prior or unsetting the setting when
+// it is empty.
+func enableAllocationAs(rerouteOnly bool, scope, prior string) {
+	var err error
+	if rerouteOnly && prior != "" {
+		fmt.Printf("Restoring shard rebalancing to %s...\n", prior)
+		err = putScopedSettings(scope, clusterSettings{settingRebalanceEnable: prior})
+	} else if rerouteOnly {
+		fmt.Println("Enabling shard rebalancing...")
+		err = putScopedSettings(scope, clusterSettings{settingRebalanceEnable: nil})
+	} else if prior != "" {
+		fmt.Printf("Restoring shard allocation to %s...\n", prior)
+		err = putScopedSettings(scope, clusterSettings{settingAllocationEnable: prior})
+		disabledWindow.end()
+	} else {
+		fmt.Println("Enabling shard allocation...")
+		err = putScopedSettings(scope, clusterSettings{settingAllocationEnable: nil})
+		disabledWindow.end()
+	}
+	if err != nil {
+		incidents.raise(incidentAllocation, "shard allocation could not be enabled again", map[string]interface{}{"error": err.Error()})
+	} else {
+		incidents.resolve(incidentAllocation)
+	}
+	restoreRecoveries()
+	// In safe mode the marker stays until the operator acknowledges it.
+	if !ctl.inSafeMode() {
+		clearExecution()
 	}
-	sendClusterSettings(settings)
 }
 
-func sendClusterSettings(settings map[string]interface{}) {
-	jsonData, err := json.Marshal(settings)
+// moveShard relocates a single shard copy with an explicit reroute command,
+// so that only the chosen shard moves instead of the whole source node being
+// filtered away.
+func moveShard(shard ShardRouting, sourceNode, targetNode string) error {
+	fmt.Printf("Moving shard [%s][%d] from node %s to node %s...\n", shard.Index, shard.Shard, sourceNode, targetNode)
+	body, err := sendJSON("POST", "/_cluster/reroute", moveCommand(shard, sourceNode, targetNode))
 	if err != nil {
-		fmt.Println("Error marshaling JSON:", err)
-		return
+		fmt.Println("Error moving shard:", err)
+		return err
 	}
+	fmt.Println("Response:", string(body))
+	return nil
+}
 
-	req, err := http.NewRequest("PUT", esHost+"/_cluster/settings", bytes.NewBuffer(jsonData))
-	if err != nil {
-		fmt.Println("Error creating request:", err)
-		return
+// sendJSON sends payload as a JSON body and returns the raw response body.
+func sendJSON(method, path string, payload interface{}) ([]byte, error) {
+	_, body, err := doJSON(method, path, payload)
+	return body, err
+}
+
+// doJSON is sendJSON also returning the status code, for callers that need
+// to tell a conflict or a missing document from other errors. A nil payload
+// sends no body.
+func doJSON(method, path string, payload interface{}) (int, []byte, error) {
+	var reqBody []byte
+	if payload != nil {
+		var err error
+		if reqBody, err = json.Marshal(payload); err != nil {
+			return 0, nil, fmt.Errorf("marshaling JSON: %w", err)
+		}
 	}
-	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := esRequest(method, path, reqBody)
 	if err != nil {
-		fmt.Println("Error sending request:", err)
-		return
+		auditRequest(method, path, 0, reqBody, nil, err)
+		return 0, nil, fmt.Errorf("sending request: %w", err)
 	}
 	defer resp.Body.Close()
 
 	body, err := ioutil.ReadAll(resp.Body)
+	auditRequest(method, path, resp.StatusCode, reqBody, body, err)
 	if err != nil {
-		fmt.Println("Error reading response:", err)
-		return
+		return resp.StatusCode, nil, fmt.Errorf("reading response: %w", err)
 	}
-
-	fmt.Println("Response:", string(body))
+	if resp.StatusCode >= 300 {
+		return resp.StatusCode, body, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, body)
+	}
+	return resp.StatusCode, body, nil
 }
 
 func main() {
-	for {
-		rebalanceShards()
-		time.Sleep(sleepInterval)
+	name, args := "run", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	command, ok := commands[name]
+	if !ok {
+		fmt.Println("Unknown command:", name)
+		os.Exit(2)
+	}
+
+	c, rest, err := loadConfig(args, command.flags)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Println("Error loading config:", err)
+		os.Exit(2)
+	}
+	cfg = c
+	commandArgs = args
+	if !cfg.Simulate {
+		if err := resolveCloudEndpoint(); err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(2)
+		}
+	}
+	if name != "run" {
+		setAuditSource(commandSource(name))
+	}
+	setupESClient()
+	if cfg.Simulate {
+		startSimulation()
+	} else if err := setupCredentials(); err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	if cfg.Output == outputJSON {
+		startJSONOutput()
+	}
+	subscribeConsumers()
+	if len(cfg.Clusters) > 0 && name != "run" {
+		fmt.Println("The config file defines several clusters, pick one with -cluster.")
+		os.Exit(2)
+	}
+
+	flush := func() {}
+	if cfg.ClusterAlias != "" {
+		if flush, err = prefixStdout("[" + cfg.ClusterAlias + "] "); err != nil {
+			fmt.Println("Error setting up output:", err)
+			os.Exit(1)
+		}
+	}
+
+	if command.locked {
+		if err = checkBackend(); err == nil {
+			err = withClusterLock(func(context.Context) error { return command.run(rest) })
+		}
+	} else {
+		err = command.run(rest)
+	}
+	if err != nil {
+		fmt.Println("Error:", err)
+	}
+	flushEvents(30 * time.Second)
+	flush()
+	if err != nil {
+		os.Exit(1)
 	}
 }
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tjandrayana/elasticsearch-rebalance-shard/esapi"
+)
+
+// testCluster points the balancer at an empty esapi.Fake with the data nodes
+// of the IDs, named after them, and resets the config and the state other
+// tests may have left behind. Relocations complete by the next request.
+func testCluster(t *testing.T, nodes ...string) *esapi.Fake {
+	t.Helper()
+	fake := esapi.NewFake()
+	fake.BytesPerSec = 1 << 40
+	for _, id := range nodes {
+		fake.AddNode(esapi.FakeNode{ID: id, Name: id, Roles: []string{"data"}})
+	}
+
+	prevCfg, prevES, prevPoll := cfg, es, verifyPollInterval
+	t.Cleanup(func() { cfg, es, verifyPollInterval = prevCfg, prevES, prevPoll })
+	cfg = defaultConfig()
+	es = fake
+	verifyPollInterval = 10 * time.Millisecond
+
+	breaker = &circuitBreaker{}
+	touches = &nodeTouches{last: map[string]time.Time{}}
+	stallRetries.Lock()
+	stallRetries.copies = make(map[string]bool)
+	stallRetries.Unlock()
+	backendMu.Lock()
+	backend = nil
+	backendMu.Unlock()
+	allocationPriorMu.Lock()
+	allocationPrior = ""
+	allocationPriorMu.Unlock()
+	return fake
+}
+
+// addShards adds n single-copy indices of one shard on the node, named
+// after it.
+func addShards(fake *esapi.Fake, node string, n int) {
+	for i := 0; i < n; i++ {
+		fake.AddShard(esapi.FakeShard{Index: fmt.Sprintf("%s-%d", node, i), Primary: true, Node: node, Docs: 10, Bytes: 1 << 10})
+	}
+}
+
+func observeTestCluster(t *testing.T) *Observation {
+	t.Helper()
+	obs, err := observeCluster()
+	if err != nil {
+		t.Fatalf("observing the fake cluster: %v", err)
+	}
+	return obs
+}
+
+// fakeNodeOf returns the node holding the started copy of shard 0 of the
+// index, asking the fake directly, past the circuit breaker.
+func fakeNodeOf(t *testing.T, fake *esapi.Fake, index string) string {
+	t.Helper()
+	resp, err := fake.Do("GET", "/_cat/shards/"+index+"?format=json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	var rows []map[string]string
+	if err := json.Unmarshal(body, &rows); err != nil {
+		t.Fatalf("parsing %s: %v", body, err)
+	}
+	for _, row := range rows {
+		if row["shard"] == "0" && row["state"] == "STARTED" {
+			return row["id"]
+		}
+	}
+	return ""
+}
+
+// testMoves returns the moves, "index from to" of shard 0 of the index, of
+// the copies of the observation.
+func testMoves(obs *Observation, moves ...string) []Move {
+	var planned []Move
+	for _, m := range moves {
+		f := strings.Fields(m)
+		move := Move{From: f[1], To: f[2]}
+		for _, shard := range obs.State.RoutingNodes.Nodes[move.From] {
+			if shard.Index == f[0] {
+				move.Shard = shard
+			}
+		}
+		planned = append(planned, move)
+	}
+	return planned
+}
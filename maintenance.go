@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maintenanceWindow tells whether the balancer may move shards at a given
+// time. It is either a time-of-day range such as "22:00-06:00", which may
+// wrap around midnight, or a five-field cron expression such as
+// "* 22-23,0-5 * * 1-5", matching every minute moves are allowed in.
+type maintenanceWindow interface {
+	contains(t time.Time) bool
+}
+
+func parseMaintenanceWindow(s string) (maintenanceWindow, error) {
+	// Cron expressions never contain a colon.
+	if strings.Contains(s, ":") {
+		return parseTimeRange(s)
+	}
+	return parseCron(s)
+}
+
+// inMaintenanceWindow reports whether moves are allowed at t. Without any
+// window configured they always are.
+func inMaintenanceWindow(t time.Time) bool {
+	if len(cfg.MaintenanceWindows) == 0 {
+		return true
+	}
+	if loc, err := time.LoadLocation(cfg.MaintenanceTimezone); err == nil {
+		t = t.In(loc)
+	}
+	for _, s := range cfg.MaintenanceWindows {
+		w, err := parseMaintenanceWindow(s)
+		if err == nil && w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// timeRange is a time-of-day range in minutes since midnight, from
+// included, to excluded.
+type timeRange struct {
+	from, to int
+}
+
+func parseTimeRange(s string) (timeRange, error) {
+	parts := strings.SplitN(strings.TrimSpace(s), "-", 2)
+	if len(parts) != 2 {
+		return timeRange{}, fmt.Errorf("invalid time range %q", s)
+	}
+	from, err := parseTimeOfDay(parts[0])
+	if err != nil {
+		return timeRange{}, fmt.Errorf("invalid time range %q: %w", s, err)
+	}
+	to, err := parseTimeOfDay(parts[1])
+	if err != nil {
+		return timeRange{}, fmt.Errorf("invalid time range %q: %w", s, err)
+	}
+	if from == to {
+		return timeRange{}, fmt.Errorf("invalid time range %q: empty", s)
+	}
+	return timeRange{from, to}, nil
+}
+
+func parseTimeOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (r timeRange) contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	if r.from < r.to {
+		return m >= r.from && m < r.to
+	}
+	return m >= r.from || m < r.to
+}
+
+// cronExpr is a parsed cron expression: the allowed minutes, hours, days of
+// the month, months and days of the week (0 is Sunday, 7 is accepted too).
+type cronExpr struct {
+	minute, hour, dom, month, dow map[int]bool
+	domAny, dowAny                bool
+}
+
+func parseCron(s string) (cronExpr, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 5 {
+		return cronExpr{}, fmt.Errorf("invalid cron expression %q: want 5 fields", s)
+	}
+	var c cronExpr
+	var err error
+	bounds := []struct {
+		set      *map[int]bool
+		min, max int
+	}{
+		{&c.minute, 0, 59},
+		{&c.hour, 0, 23},
+		{&c.dom, 1, 31},
+		{&c.month, 1, 12},
+		{&c.dow, 0, 7},
+	}
+	for i, b := range bounds {
+		if *b.set, err = parseCronField(fields[i], b.min, b.max); err != nil {
+			return cronExpr{}, fmt.Errorf("invalid cron expression %q: %w", s, err)
+		}
+	}
+	if c.dow[7] {
+		c.dow[0] = true
+	}
+	c.domAny, c.dowAny = fields[2] == "*", fields[4] == "*"
+	return c, nil
+}
+
+// parseCronField parses a comma-separated list of values, ranges ("1-5")
+// and steps ("*/15", "0-30/10").
+func parseCronField(field string, min, max int) (map[int]bool, error) {
+	set := make(map[int]bool)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid step in %q", part)
+			}
+			step, part = n, part[:i]
+		}
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, fmt.Errorf("invalid value %q", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("invalid value %q", part)
+				}
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return nil, fmt.Errorf("value %q out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+func (c cronExpr) contains(t time.Time) bool {
+	return c.minute[t.Minute()] && c.hour[t.Hour()] && c.month[int(t.Month())] && c.dayMatches(t)
+}
+
+// dayMatches follows the usual cron rule: when both the day of the month
+// and the day of the week are restricted, matching either is enough.
+func (c cronExpr) dayMatches(t time.Time) bool {
+	dom, dow := c.dom[t.Day()], c.dow[int(t.Weekday())]
+	switch {
+	case c.domAny && c.dowAny:
+		return true
+	case c.domAny:
+		return dow
+	case c.dowAny:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+// next returns the first minute after t matching the expression, or the
+// zero time if there is none within the next five years, as for
+// "0 0 31 2 *".
+func (c cronExpr) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case !c.month[int(t.Month())]:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case !c.hour[t.Hour()]:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case !c.minute[t.Minute()]:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// windowFlag adds a maintenance window for every occurrence of the flag.
+// Cron expressions contain commas, so unlike stringList the value is not
+// split. Windows already present are not added twice.
+type windowFlag struct {
+	c *Config
+}
+
+func (f windowFlag) String() string {
+	return ""
+}
+
+func (f windowFlag) Set(value string) error {
+	for _, w := range f.c.MaintenanceWindows {
+		if w == value {
+			return nil
+		}
+	}
+	f.c.MaintenanceWindows = append(f.c.MaintenanceWindows, value)
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// eventCounters counts the events of the event bus by kind, e.g. the moves
+// by result.
+type eventCounters struct {
+	mu     sync.Mutex
+	counts map[string]map[string]int64
+}
+
+var counters = &eventCounters{counts: make(map[string]map[string]int64)}
+
+func (c *eventCounters) add(kind, label string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts[kind] == nil {
+		c.counts[kind] = make(map[string]int64)
+	}
+	c.counts[kind][label]++
+}
+
+func (c *eventCounters) get(kind string) map[string]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts := make(map[string]int64, len(c.counts[kind]))
+	for label, n := range c.counts[kind] {
+		counts[label] = n
+	}
+	return counts
+}
+
+// sample is the value of a metric when collected, for the exporters: the
+// Prometheus endpoint and the StatsD emitter. kind is gauge or counter.
+type sample struct {
+	name, kind, help string
+	value            float64
+}
+
+// samples collects the metrics but for the event counters.
+func samples() []sample {
+	window := disabledWindow.stats()
+	s := []sample{
+		{"rebalancer_allocation_disabled_seconds", "gauge",
+			"How long shard allocation has been disabled by the running cycle, 0 if enabled.", float64(window.CurrentMillis) / 1000},
+		{"rebalancer_allocation_disabled_last_seconds", "gauge",
+			"How long the last cycle that disabled shard allocation kept it disabled.", float64(window.LastMillis) / 1000},
+		{"rebalancer_allocation_disabled_seconds_total", "counter",
+			"Total time shard allocation was disabled by cycles.", float64(window.TotalMillis) / 1000},
+		{"rebalancer_allocation_disabled_windows_total", "counter",
+			"Number of times cycles disabled and enabled shard allocation again.", float64(window.Windows)},
+	}
+	if max := cfg.MaxAllocationDisabled.Duration; max > 0 {
+		s = append(s, sample{"rebalancer_allocation_disabled_threshold_seconds", "gauge",
+			"How long shard allocation may stay disabled before an alert.", max.Seconds()})
+	}
+	if cfg.BreakerFailures > 0 {
+		s = append(s, breaker.sample())
+	}
+	if p := inFlightProgress(nil); p != nil {
+		s = append(s,
+			sample{"rebalancer_relocation_bytes_total", "gauge",
+				"Bytes to relocate by the moves of the running cycle.", float64(p.BytesTotal)},
+			sample{"rebalancer_relocation_bytes_remaining", "gauge",
+				"Bytes left to relocate by the moves of the running cycle.", float64(p.BytesRemaining)},
+			sample{"rebalancer_relocation_bytes_per_second", "gauge",
+				"Combined rate of the running relocations of the cycle.", p.BytesPerSecond})
+		if p.ETAMillis > 0 {
+			s = append(s, sample{"rebalancer_relocation_eta_seconds", "gauge",
+				"Time left until the moves of the running cycle complete at the current rate.", float64(p.ETAMillis) / 1000})
+		}
+	}
+	return s
+}
+
+// handleMetrics serves the metrics in the Prometheus text format.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, s := range samples() {
+		writeMetric(w, s.name, s.kind, s.help, s.value)
+	}
+	writeCounters(w, "rebalancer_cycle_events_total", "Cycle events by kind.", "event", counters.get("cycles"))
+	writeCounters(w, "rebalancer_moves_total", "Moves by result, issued counting every reroute sent.", "result", counters.get("moves"))
+}
+
+func writeMetric(w http.ResponseWriter, name, kind, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	if cfg.ClusterAlias != "" {
+		fmt.Fprintf(w, "%s{cluster=%q} %g\n", name, cfg.ClusterAlias, value)
+	} else {
+		fmt.Fprintf(w, "%s %g\n", name, value)
+	}
+}
+
+// writeCounters writes a counter with one series per label value.
+func writeCounters(w http.ResponseWriter, name, help, label string, counts map[string]int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	values := make([]string, 0, len(counts))
+	for v := range counts {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+	for _, v := range values {
+		if cfg.ClusterAlias != "" {
+			fmt.Fprintf(w, "%s{cluster=%q,%s=%q} %d\n", name, cfg.ClusterAlias, label, v, counts[v])
+		} else {
+			fmt.Fprintf(w, "%s{%s=%q} %d\n", name, label, v, counts[v])
+		}
+	}
+}
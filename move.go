@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// manualMoveCommand relocates one shard copy on the operator's request. The move
+// goes through the checks of the planned moves: it must still be valid
+// against the cluster state, the allocation deciders must accept it in a
+// dry run, and the nodes must not be cooling down. It is then executed like
+// a cycle's move, with allocation disabled, recorded in the history and
+// waited for. Nodes are given by name or ID.
+//
+//	move [-yes] <index> <shard> <source> <target>
+func manualMoveCommand(args []string) error {
+	if len(args) != 4 {
+		return errors.New("usage: move [-yes] <index> <shard> <source> <target>")
+	}
+	index, source, target := args[0], args[2], args[3]
+	shardNum, err := strconv.Atoi(args[1])
+	if err != nil {
+		return fmt.Errorf("invalid shard number %q", args[1])
+	}
+
+	obs, err := observeCluster()
+	if err != nil {
+		return fmt.Errorf("observing cluster: %w", err)
+	}
+	from, err := resolveNode(obs, source)
+	if err != nil {
+		return err
+	}
+	to, err := resolveNode(obs, target)
+	if err != nil {
+		return err
+	}
+	var move Move
+	found := false
+	for _, shard := range obs.State.RoutingNodes.Nodes[from] {
+		if shard.Index == index && shard.Shard == shardNum {
+			move, found = Move{Shard: shard, From: from, To: to, Bytes: obs.CopyBytes(shard, from)}, true
+		}
+	}
+	if !found {
+		return fmt.Errorf("node %s holds no copy of [%s][%d]", source, index, shardNum)
+	}
+
+	if reason := validateMove(obs, move); reason != "" {
+		return fmt.Errorf("cannot move [%s][%d]: %s", index, shardNum, reason)
+	}
+	if policy := deniedBy(index); policy != "" {
+		return fmt.Errorf("cannot move [%s][%d]: denied by policy %s", index, shardNum, policy)
+	}
+	if node, until, ok := moveCoolingDown(move); ok {
+		return fmt.Errorf("cannot move [%s][%d]: node %s cools down until %s", index, shardNum, nodeName(obs, node), until.Format(time.RFC3339))
+	}
+	if ok, reason := moveAllowed(move, nil); !ok {
+		return fmt.Errorf("cannot move [%s][%d]: %s", index, shardNum, reason)
+	}
+
+	kind := "replica"
+	if move.Shard.Primary {
+		kind = "primary"
+	}
+	if !confirm(fmt.Sprintf("Move the %s of [%s][%d] (%s) from %s to %s?", kind, index, shardNum, formatBytes(move.Bytes), nodeName(obs, from), nodeName(obs, to))) {
+		return errors.New("aborted")
+	}
+	audit("manual_move", moveFields(move, map[string]interface{}{"bytes": move.Bytes}))
+
+	disableAllocation()
+	defer enableAllocation()
+	executed, _, _ := executeMoves([]Move{move})
+	if len(executed) == 0 {
+		return fmt.Errorf("move of [%s][%d] was not executed", index, shardNum)
+	}
+	// Verified and concurrent moves were already waited for.
+	if !cfg.VerifyMoves && cfg.MaxConcurrentRelocations == 0 {
+		fmt.Println("Waiting for the move to complete...")
+		if _, err := waitForMove(move); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Moved [%s][%d] to %s.\n", index, shardNum, nodeName(obs, to))
+	return nil
+}
+
+// resolveNode returns the ID of the data node with the given name or ID.
+func resolveNode(obs *Observation, node string) (string, error) {
+	if _, ok := obs.Distribution[node]; ok {
+		return node, nil
+	}
+	for id := range obs.Distribution {
+		if nodeName(obs, id) == node {
+			return id, nil
+		}
+	}
+	return "", fmt.Errorf("no data node %s", node)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// nodePatternError tells what is wrong with a node pattern, or returns nil.
+// A node pattern is an exact node name, a shell glob such as "warm-*", or a
+// regular expression between slashes such as "/^hot-[0-9]+$/".
+func nodePatternError(pattern string) error {
+	if re, ok := nodeRegexp(pattern); ok {
+		if _, err := regexp.Compile(re); err != nil {
+			return fmt.Errorf("invalid node pattern %q: %w", pattern, err)
+		}
+		return nil
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid node pattern %q: %w", pattern, err)
+	}
+	return nil
+}
+
+func nodeRegexp(pattern string) (string, bool) {
+	if len(pattern) >= 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		return pattern[1 : len(pattern)-1], true
+	}
+	return "", false
+}
+
+// matchNode reports whether the node name matches one of the patterns, see
+// nodePatternError. Every place matching node names goes through it.
+func matchNode(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if re, ok := nodeRegexp(pattern); ok {
+			if matched, _ := regexp.MatchString(re, name); matched {
+				return true
+			}
+		} else if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// excludeNodes leaves the nodes matching cfg.ExcludeNodes out of the
+// distribution, so that shards are neither moved to nor from them.
+func excludeNodes(obs *Observation) {
+	if len(cfg.ExcludeNodes) == 0 {
+		return
+	}
+	for id := range obs.Distribution {
+		if matchNode(cfg.ExcludeNodes, nodeName(obs, id)) {
+			delete(obs.Distribution, id)
+		}
+	}
+}
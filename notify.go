@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tjandrayana/elasticsearch-rebalance-shard/observer"
+)
+
+const (
+	eventCycleStarted   = "cycle_started"
+	eventCycleCompleted = "cycle_completed"
+	eventCycleFailed    = "cycle_failed"
+
+	eventAllocationDisabledTooLong = "allocation_disabled_too_long"
+)
+
+const (
+	notifierSlack   = "slack"
+	notifierTeams   = "teams"
+	notifierDiscord = "discord"
+	notifierWebhook = "webhook"
+)
+
+// NotificationTarget is a destination for cycle notifications: the
+// incoming webhook of Slack, Microsoft Teams or Discord, which get a
+// message, see chatPayload, or a webhook getting the JSON of the event.
+// Events restricts what is sent to the target; empty means every event.
+type NotificationTarget struct {
+	Type   string   `json:"type"`
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+}
+
+// MoveSummary describes an executed move in notifications.
+type MoveSummary struct {
+	Index   string `json:"index"`
+	Shard   int    `json:"shard"`
+	Primary bool   `json:"primary"`
+	From    string `json:"from"`
+	To      string `json:"to"`
+	Bytes   int64  `json:"bytes"`
+}
+
+// CycleEvent is the payload posted to generic webhooks.
+type CycleEvent struct {
+	Event          string        `json:"event"`
+	Cluster        string        `json:"cluster,omitempty"`
+	StartedAt      time.Time     `json:"started_at"`
+	DurationMillis int64         `json:"duration_ms"`
+	Moves          []MoveSummary `json:"moves"`
+	BytesRelocated int64         `json:"bytes_relocated"`
+	Error          string        `json:"error,omitempty"`
+
+	// ScoreBefore is the imbalance score the cycle started from, and
+	// ScoreAfter the one expected once its moves are done.
+	ScoreBefore *observer.Score `json:"score_before,omitempty"`
+	ScoreAfter  *observer.Score `json:"score_after,omitempty"`
+	// Distribution is the shard count of every node, by name, expected
+	// once the moves are done.
+	Distribution map[string]int `json:"distribution,omitempty"`
+
+	// LatencyBefore and LatencyAfter are the latency before executing and
+	// once the relocations settled, when compared. LatencyRegressed flags a
+	// regression beyond the tolerance; RolledBack are the moves undoing the
+	// cycle then.
+	LatencyBefore    *Latency      `json:"latency_before,omitempty"`
+	LatencyAfter     *Latency      `json:"latency_after,omitempty"`
+	LatencyRegressed bool          `json:"latency_regressed,omitempty"`
+	RolledBack       []MoveSummary `json:"rolled_back,omitempty"`
+
+	// PlanID and ExpiresAt identify the plan of the plan events, see
+	// PendingPlan.
+	PlanID    string     `json:"plan_id,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+var notifyClient = &http.Client{Timeout: 10 * time.Second}
+
+// notify posts the event to every configured target subscribed to it.
+func notify(event CycleEvent) {
+	for _, target := range cfg.Notifications {
+		if !target.wants(event.Event) {
+			continue
+		}
+		var payload interface{} = event
+		if chatTarget(target.Type) {
+			payload = chatPayload(target.Type, slackText(event))
+		}
+		if err := postJSON(target.URL, payload); err != nil {
+			fmt.Printf("Error sending %s notification: %v\n", target.Type, err)
+		}
+	}
+}
+
+func (t NotificationTarget) validate() error {
+	if !chatTarget(t.Type) && t.Type != notifierWebhook {
+		return fmt.Errorf("invalid notification type %q", t.Type)
+	}
+	if t.URL == "" {
+		return fmt.Errorf("notification target of type %q has no URL", t.Type)
+	}
+	return nil
+}
+
+func (t NotificationTarget) wants(event string) bool {
+	if len(t.Events) == 0 {
+		return true
+	}
+	for _, e := range t.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func postJSON(url string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	resp, err := notifyClient.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("POST %s: %s", url, resp.Status)
+	}
+	return nil
+}
+
+func slackText(event CycleEvent) string {
+	var b strings.Builder
+	if event.Cluster != "" {
+		fmt.Fprintf(&b, "[%s] ", event.Cluster)
+	}
+	switch event.Event {
+	case eventCycleStarted:
+		fmt.Fprintf(&b, ":arrows_counterclockwise: Rebalance started: %d moves, %s to relocate", len(event.Moves), formatBytes(event.BytesRelocated))
+	case eventCycleCompleted:
+		fmt.Fprintf(&b, ":white_check_mark: Rebalance completed in %s: %d moves, %s relocated",
+			(time.Duration(event.DurationMillis) * time.Millisecond).Round(time.Second), len(event.Moves), formatBytes(event.BytesRelocated))
+		if event.ScoreBefore != nil && event.ScoreAfter != nil {
+			fmt.Fprintf(&b, ", %s → %s", event.ScoreBefore, event.ScoreAfter)
+		}
+		if event.LatencyRegressed {
+			fmt.Fprintf(&b, "\n:warning: Latency regressed: %s → %s", event.LatencyBefore, event.LatencyAfter)
+			if len(event.RolledBack) > 0 {
+				fmt.Fprintf(&b, ", %d moves rolled back", len(event.RolledBack))
+			}
+		}
+	case eventCycleFailed:
+		fmt.Fprintf(&b, ":x: Rebalance failed after %s: %s",
+			(time.Duration(event.DurationMillis) * time.Millisecond).Round(time.Second), event.Error)
+	case eventPlanPending:
+		fmt.Fprintf(&b, ":raised_hand: Plan %s waits for approval until %s: %d moves, %s to relocate. Approve it with `approve %s`",
+			event.PlanID, event.ExpiresAt.Format(time.RFC3339), len(event.Moves), formatBytes(event.BytesRelocated), event.PlanID)
+	case eventPlanExpired:
+		fmt.Fprintf(&b, ":hourglass: Plan %s expired without approval", event.PlanID)
+	case eventAllocationDisabledTooLong:
+		fmt.Fprintf(&b, ":hourglass: Shard allocation has been disabled for %s, recoveries are waiting",
+			(time.Duration(event.DurationMillis) * time.Millisecond).Round(time.Second))
+	}
+	for _, move := range event.Moves {
+		fmt.Fprintf(&b, "\n• [%s][%d] %s → %s (%s)", move.Index, move.Shard, move.From, move.To, formatBytes(move.Bytes))
+	}
+	return b.String()
+}
@@ -0,0 +1,244 @@
+// Package observer computes the shard distribution of an Elasticsearch
+// cluster and scores its imbalance. It only reads from the cluster and does
+// not depend on the rest of the balancer, so it can be embedded in services
+// that only want to monitor imbalance.
+package observer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type NodeInfo struct {
+	Name       string            `json:"name"`
+	Host       string            `json:"host"`
+	IP         string            `json:"ip"`
+	Roles      []string          `json:"roles"`
+	Attributes map[string]string `json:"attributes"`
+}
+
+type NodesInfo struct {
+	Nodes map[string]NodeInfo `json:"nodes"`
+}
+
+type ShardRouting struct {
+	Index          string `json:"index"`
+	Shard          int    `json:"shard"`
+	Primary        bool   `json:"primary"`
+	State          string `json:"state"`
+	Node           string `json:"node"`
+	RelocatingNode string `json:"relocating_node"`
+}
+
+type ClusterState struct {
+	RoutingNodes struct {
+		Nodes      map[string][]ShardRouting `json:"nodes"`
+		Unassigned []ShardRouting            `json:"unassigned"`
+	} `json:"routing_nodes"`
+}
+
+// ShardStats is a row of _cat/shards for a single shard copy.
+type ShardStats struct {
+	Index  string `json:"index"`
+	Shard  string `json:"shard"`
+	Prirep string `json:"prirep"`
+	State  string `json:"state"`
+	Docs   string `json:"docs"`
+	Store  string `json:"store"`
+	NodeID string `json:"id"`
+	Node   string `json:"node"`
+}
+
+func (s ShardStats) DocCount() int64 {
+	n, _ := strconv.ParseInt(s.Docs, 10, 64)
+	return n
+}
+
+func (s ShardStats) StoreBytes() int64 {
+	n, _ := strconv.ParseInt(s.Store, 10, 64)
+	return n
+}
+
+// Observation is a snapshot of what is known about the cluster at one point
+// in time.
+type Observation struct {
+	State *ClusterState
+	Nodes *NodesInfo
+	// Distribution is the shard count of every data node.
+	Distribution map[string]int
+	// ShardBytes is the store size of every shard copy, see CopyKey.
+	ShardBytes map[string]int64
+	// AllocationSettings are the index.routing.allocation settings of every
+	// index that has some, flat, by index name.
+	AllocationSettings map[string]map[string]string
+}
+
+// CopyBytes returns the store size of the copy of shard on nodeID.
+func (o *Observation) CopyBytes(shard ShardRouting, nodeID string) int64 {
+	return o.ShardBytes[CopyKey(shard, nodeID)]
+}
+
+// Getter fetches a JSON document from the cluster, path being relative to
+// the cluster URL.
+type Getter interface {
+	GetJSON(path string, v interface{}) error
+}
+
+// HTTPGetter is a Getter talking to the cluster at URL.
+type HTTPGetter struct {
+	URL    string
+	Client *http.Client // http.DefaultClient if nil
+}
+
+func (g HTTPGetter) GetJSON(path string, v interface{}) error {
+	body, err := g.Stream(path)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	return json.NewDecoder(body).Decode(v)
+}
+
+// Stream makes HTTPGetter a Streamer. Like every request of http.Client,
+// it asks for a gzipped response and decompresses it as it arrives.
+func (g HTTPGetter) Stream(path string) (io.ReadCloser, error) {
+	client := g.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Get(g.URL + path)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("GET %s: %s: %s", path, resp.Status, body)
+	}
+	return resp.Body, nil
+}
+
+// GetClusterState fetches the routing table, streamed if g is a Streamer.
+func GetClusterState(g Getter) (*ClusterState, error) {
+	body, err := stream(g, routingPath)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	var state ClusterState
+	if err := decodeRoutingNodes(body, &state); err != nil {
+		return nil, fmt.Errorf("decoding routing table: %w", err)
+	}
+	return &state, nil
+}
+
+func GetNodesInfo(g Getter) (*NodesInfo, error) {
+	var nodes NodesInfo
+	if err := g.GetJSON("/_nodes?filter_path=nodes.*.name,nodes.*.host,nodes.*.ip,nodes.*.roles,nodes.*.attributes", &nodes); err != nil {
+		return nil, err
+	}
+	return &nodes, nil
+}
+
+// GetShardStats lists every shard copy in the cluster.
+func GetShardStats(g Getter) ([]ShardStats, error) {
+	var stats []ShardStats
+	if err := EachShardStats(g, func(s ShardStats) { stats = append(stats, s) }); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// GetAllocationSettings returns the index.routing.allocation settings of
+// every index that has some, flat, by index name.
+func GetAllocationSettings(g Getter) (map[string]map[string]string, error) {
+	var indices map[string]struct {
+		Settings map[string]string `json:"settings"`
+	}
+	if err := g.GetJSON("/_all/_settings/index.routing.allocation.*?flat_settings=true&expand_wildcards=all", &indices); err != nil {
+		return nil, err
+	}
+	settings := make(map[string]map[string]string)
+	for index, s := range indices {
+		if len(s.Settings) > 0 {
+			settings[index] = s.Settings
+		}
+	}
+	return settings, nil
+}
+
+// Observe fetches the routing table, node roles, shard sizes and index
+// allocation settings.
+func Observe(g Getter) (*Observation, error) {
+	state, err := GetClusterState(g)
+	if err != nil {
+		return nil, fmt.Errorf("getting cluster state: %w", err)
+	}
+	nodes, err := GetNodesInfo(g)
+	if err != nil {
+		return nil, fmt.Errorf("getting nodes info: %w", err)
+	}
+	// Only the sizes are kept of the shard list, as it is streamed.
+	shardBytes := make(map[string]int64)
+	err = EachShardStats(g, func(s ShardStats) {
+		shardBytes[s.Index+"/"+s.Shard+"@"+s.NodeID] = s.StoreBytes()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("getting shard stats: %w", err)
+	}
+	allocation, err := GetAllocationSettings(g)
+	if err != nil {
+		return nil, fmt.Errorf("getting index allocation settings: %w", err)
+	}
+	return &Observation{
+		State:              state,
+		Nodes:              nodes,
+		Distribution:       Distribution(state, nodes),
+		ShardBytes:         shardBytes,
+		AllocationSettings: allocation,
+	}, nil
+}
+
+// IsDataNode reports whether the node can hold shards. Besides the generic
+// "data" role, data tier roles (data_hot, data_content, ...) also count.
+func IsDataNode(node NodeInfo) bool {
+	for _, role := range node.Roles {
+		if role == "data" || strings.HasPrefix(role, "data_") {
+			return true
+		}
+	}
+	return false
+}
+
+// Distribution counts shards per data node. Non-data nodes are left out
+// entirely, while data nodes without any shard are included with a count
+// of 0.
+func Distribution(state *ClusterState, nodes *NodesInfo) map[string]int {
+	distribution := make(map[string]int)
+	for nodeID, node := range nodes.Nodes {
+		if IsDataNode(node) {
+			distribution[nodeID] = 0
+		}
+	}
+	for nodeID, shards := range state.RoutingNodes.Nodes {
+		if _, ok := distribution[nodeID]; ok {
+			distribution[nodeID] = len(shards)
+		}
+	}
+	return distribution
+}
+
+// ShardKey identifies a shard, regardless of which copy.
+func ShardKey(shard ShardRouting) string {
+	return fmt.Sprintf("%s/%d", shard.Index, shard.Shard)
+}
+
+// CopyKey identifies a shard copy by its shard and the node holding it.
+func CopyKey(shard ShardRouting, nodeID string) string {
+	return ShardKey(shard) + "@" + nodeID
+}
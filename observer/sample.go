@@ -0,0 +1,123 @@
+package observer
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"net/url"
+	"strings"
+)
+
+// maxSamplePath bounds the length of the path of a _cat/shards request,
+// whose index names are fetched in as many requests as needed to stay
+// below the 4kb of http.max_initial_line_length.
+const maxSamplePath = 3500
+
+// Sample is an estimate of the balance made from the shards of a random
+// subset of the indices, for clusters too large to observe every cycle.
+type Sample struct {
+	Indices int // total number of indices
+	Sampled int // number of indices sampled
+	// Distribution is the estimated shard count of every data node: the
+	// count in the sampled indices scaled up to all indices.
+	Distribution map[string]float64
+}
+
+// CountImbalance estimates CountImbalance. Sampling noise adds to the spread,
+// so the estimate tends to be high rather than low.
+func (s *Sample) CountImbalance() int {
+	maxCount, minCount := 0.0, math.Inf(1)
+	for _, n := range s.Distribution {
+		maxCount = math.Max(maxCount, n)
+		minCount = math.Min(minCount, n)
+	}
+	if len(s.Distribution) == 0 {
+		return 0
+	}
+	return int(math.Round(maxCount - minCount))
+}
+
+type catIndex struct {
+	Index string `json:"index"`
+}
+
+type catShard struct {
+	State  string `json:"state"`
+	NodeID string `json:"id"`
+}
+
+// SampleBalance lists the indices and fetches the shards of size of them,
+// picked with rnd. Every index is used when there are no more than size.
+func SampleBalance(g Getter, size int, rnd *rand.Rand) (*Sample, error) {
+	nodes, err := GetNodesInfo(g)
+	if err != nil {
+		return nil, fmt.Errorf("getting nodes info: %w", err)
+	}
+	var indices []catIndex
+	if err := g.GetJSON("/_cat/indices?format=json&h=index&expand_wildcards=all", &indices); err != nil {
+		return nil, fmt.Errorf("listing indices: %w", err)
+	}
+	rnd.Shuffle(len(indices), func(i, j int) { indices[i], indices[j] = indices[j], indices[i] })
+	sampled := indices
+	if len(sampled) > size {
+		sampled = sampled[:size]
+	}
+
+	counts := make(map[string]int)
+	for nodeID, node := range nodes.Nodes {
+		if IsDataNode(node) {
+			counts[nodeID] = 0
+		}
+	}
+	for _, names := range indexBatches(sampled, maxSamplePath) {
+		var shards []catShard
+		if err := g.GetJSON("/_cat/shards/"+strings.Join(names, ",")+"?format=json&h=state,id&expand_wildcards=all", &shards); err != nil {
+			return nil, fmt.Errorf("getting shards: %w", err)
+		}
+		for _, shard := range shards {
+			if _, ok := counts[shard.NodeID]; !ok || shard.State == "UNASSIGNED" {
+				continue
+			}
+			counts[shard.NodeID]++
+		}
+	}
+
+	sample := &Sample{
+		Indices:      len(indices),
+		Sampled:      len(sampled),
+		Distribution: make(map[string]float64, len(counts)),
+	}
+	scale := 1.0
+	if len(sampled) > 0 {
+		scale = float64(len(indices)) / float64(len(sampled))
+	}
+	for nodeID, n := range counts {
+		sample.Distribution[nodeID] = float64(n) * scale
+	}
+	return sample, nil
+}
+
+// indexBatches splits the escaped names of the indices into lists whose
+// comma-separated length stays within limit. A name longer than limit gets a
+// list of its own.
+func indexBatches(indices []catIndex, limit int) [][]string {
+	var batches [][]string
+	var batch []string
+	length := 0
+	for _, index := range indices {
+		name := url.PathEscape(index.Index)
+		if len(batch) > 0 && length+1+len(name) > limit {
+			batches = append(batches, batch)
+			batch, length = nil, 0
+		}
+		if len(batch) > 0 {
+			length++
+		}
+		batch = append(batch, name)
+		length += len(name)
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
@@ -0,0 +1,96 @@
+package observer
+
+import (
+	"fmt"
+	"math"
+)
+
+// Spread is the difference between the highest and the lowest count.
+func Spread(counts map[string]int) int {
+	maxCount, minCount := 0, -1
+	for _, n := range counts {
+		if n > maxCount {
+			maxCount = n
+		}
+		if minCount == -1 || n < minCount {
+			minCount = n
+		}
+	}
+	if minCount == -1 {
+		return 0
+	}
+	return maxCount - minCount
+}
+
+// CountImbalance is the spread of the total shard count over the data
+// nodes.
+func CountImbalance(obs *Observation) int {
+	return Spread(obs.Distribution)
+}
+
+// IndexImbalance is the sum over all indices of the spread of their shard
+// count over the data nodes. It is 0 when every index is spread evenly.
+func IndexImbalance(obs *Observation) int {
+	perIndex := make(map[string]map[string]int)
+	for nodeID := range obs.Distribution {
+		for _, shard := range obs.State.RoutingNodes.Nodes[nodeID] {
+			if perIndex[shard.Index] == nil {
+				perIndex[shard.Index] = make(map[string]int, len(obs.Distribution))
+				for id := range obs.Distribution {
+					perIndex[shard.Index][id] = 0
+				}
+			}
+			perIndex[shard.Index][nodeID]++
+		}
+	}
+	total := 0
+	for _, counts := range perIndex {
+		total += Spread(counts)
+	}
+	return total
+}
+
+// Score measures the imbalance of a distribution continuously: the standard
+// deviation of the per-node load, and its spread between the most and the
+// least loaded node.
+type Score struct {
+	StdDev float64 `json:"stddev"`
+	Spread float64 `json:"spread"`
+}
+
+// ScoreOf scores the shard count of every node.
+func ScoreOf(counts map[string]int) Score {
+	return WeightedScoreOf(counts, func(string) float64 { return 1 })
+}
+
+// WeightedScoreOf scores the shard count of every node divided by its
+// weight, so that a node of weight 2 is expected to hold twice as many
+// shards as a node of weight 1.
+func WeightedScoreOf(counts map[string]int, weight func(nodeID string) float64) Score {
+	if len(counts) == 0 {
+		return Score{}
+	}
+	loads := make([]float64, 0, len(counts))
+	var sum float64
+	for id, n := range counts {
+		load := float64(n) / weight(id)
+		loads = append(loads, load)
+		sum += load
+	}
+	mean := sum / float64(len(loads))
+	var variance float64
+	minLoad, maxLoad := loads[0], loads[0]
+	for _, load := range loads {
+		variance += (load - mean) * (load - mean)
+		minLoad = math.Min(minLoad, load)
+		maxLoad = math.Max(maxLoad, load)
+	}
+	return Score{
+		StdDev: math.Sqrt(variance / float64(len(loads))),
+		Spread: maxLoad - minLoad,
+	}
+}
+
+func (s Score) String() string {
+	return fmt.Sprintf("stddev %.2f, spread %.0f", s.StdDev, s.Spread)
+}
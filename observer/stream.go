@@ -0,0 +1,148 @@
+package observer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Streamer is implemented by the Getters that can hand out the body of a
+// response as it arrives. The routing table and shard list of clusters
+// with tens of thousands of shards run into hundreds of MB; streamed, they
+// are decoded a shard at a time instead of being read whole first. The
+// caller closes the body.
+type Streamer interface {
+	Stream(path string) (io.ReadCloser, error)
+}
+
+// routingPath is the routing table of the cluster state, filtered down to
+// the fields of ShardRouting: the allocation ids, recovery sources and
+// unassigned infos left out make up most of it.
+const routingPath = "/_cluster/state/routing_nodes?filter_path=" +
+	"routing_nodes.nodes.*.index,routing_nodes.nodes.*.shard,routing_nodes.nodes.*.primary," +
+	"routing_nodes.nodes.*.state,routing_nodes.nodes.*.node,routing_nodes.nodes.*.relocating_node," +
+	"routing_nodes.unassigned.index,routing_nodes.unassigned.shard,routing_nodes.unassigned.primary," +
+	"routing_nodes.unassigned.state"
+
+// stream returns the body of the response to path, streamed if g is a
+// Streamer.
+func stream(g Getter, path string) (io.ReadCloser, error) {
+	if s, ok := g.(Streamer); ok {
+		return s.Stream(path)
+	}
+	var body json.RawMessage
+	if err := g.GetJSON(path, &body); err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(body)), nil
+}
+
+// decodeRoutingNodes decodes the response to routingPath into state.
+func decodeRoutingNodes(r io.Reader, state *ClusterState) error {
+	state.RoutingNodes.Nodes = make(map[string][]ShardRouting)
+	dec := json.NewDecoder(r)
+	return eachField(dec, func(key string) error {
+		if key != "routing_nodes" {
+			return skip(dec)
+		}
+		return eachField(dec, func(key string) error {
+			switch key {
+			case "nodes":
+				return eachField(dec, func(nodeID string) error {
+					return eachElement(dec, func() error {
+						var shard ShardRouting
+						if err := dec.Decode(&shard); err != nil {
+							return err
+						}
+						state.RoutingNodes.Nodes[nodeID] = append(state.RoutingNodes.Nodes[nodeID], shard)
+						return nil
+					})
+				})
+			case "unassigned":
+				return eachElement(dec, func() error {
+					var shard ShardRouting
+					if err := dec.Decode(&shard); err != nil {
+						return err
+					}
+					state.RoutingNodes.Unassigned = append(state.RoutingNodes.Unassigned, shard)
+					return nil
+				})
+			default:
+				return skip(dec)
+			}
+		})
+	})
+}
+
+// EachShardStats calls f with every shard copy of the cluster as the list
+// is streamed.
+func EachShardStats(g Getter, f func(ShardStats)) error {
+	body, err := stream(g, "/_cat/shards?format=json&bytes=b&h=index,shard,prirep,state,docs,store,id,node")
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	dec := json.NewDecoder(body)
+	return eachElement(dec, func() error {
+		var s ShardStats
+		if err := dec.Decode(&s); err != nil {
+			return err
+		}
+		f(s)
+		return nil
+	})
+}
+
+// eachField calls f with the key of every field of the object next in dec,
+// f decoding the value.
+func eachField(dec *json.Decoder, f func(key string) error) error {
+	if err := expect(dec, json.Delim('{')); err != nil {
+		return err
+	}
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key, ok := t.(string)
+		if !ok {
+			return fmt.Errorf("unexpected %v, want a key", t)
+		}
+		if err := f(key); err != nil {
+			return err
+		}
+	}
+	return expect(dec, json.Delim('}'))
+}
+
+// eachElement calls f for every element of the array next in dec, f
+// decoding the element.
+func eachElement(dec *json.Decoder, f func() error) error {
+	if err := expect(dec, json.Delim('[')); err != nil {
+		return err
+	}
+	for dec.More() {
+		if err := f(); err != nil {
+			return err
+		}
+	}
+	return expect(dec, json.Delim(']'))
+}
+
+func expect(dec *json.Decoder, delim json.Delim) error {
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if t != delim {
+		return fmt.Errorf("unexpected %v, want %v", t, delim)
+	}
+	return nil
+}
+
+// skip decodes the value next in dec, of any type, and drops it.
+func skip(dec *json.Decoder) error {
+	var v json.RawMessage
+	return dec.Decode(&v)
+}
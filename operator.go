@@ -0,0 +1,491 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	policyAPI      = "/apis/rebalancer.tjandrayana.github.io/v1alpha1"
+	policyResource = "shardrebalancepolicies"
+)
+
+// policyCRD is the definition of the ShardRebalancePolicy resource, and the
+// role the operator needs, printed by operator -print-crd.
+//
+//go:embed shardrebalancepolicy.yaml
+var policyCRD string
+
+// The phases of a resource, in its status.
+const (
+	policyPhaseRunning    = "Running"
+	policyPhaseRestarting = "Restarting"
+	policyPhaseInvalid    = "Invalid"
+)
+
+// The spec settings the operator sets itself.
+var reservedPolicySettings = []string{"name", "clusters", "output"}
+
+var operatorOptions struct {
+	namespace string
+	printCRD  bool
+}
+
+func operatorFlags(fs *flag.FlagSet) {
+	fs.StringVar(&operatorOptions.namespace, "namespace", "", "namespace of the ShardRebalancePolicy resources to run (default the namespace of the operator)")
+	fs.BoolVar(&operatorOptions.printCRD, "print-crd", false, "print the ShardRebalancePolicy resource definition and the role the operator needs")
+}
+
+// ShardRebalancePolicy is the resource the operator runs a balancer for.
+// Spec holds settings of the config file, see policyCRD.
+type ShardRebalancePolicy struct {
+	Metadata struct {
+		Name            string `json:"name"`
+		Namespace       string `json:"namespace"`
+		ResourceVersion string `json:"resourceVersion"`
+		Generation      int64  `json:"generation"`
+	} `json:"metadata"`
+	Spec json.RawMessage `json:"spec"`
+}
+
+type ShardRebalancePolicyList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []ShardRebalancePolicy `json:"items"`
+}
+
+// PolicyStatus is the status the operator reports on a resource. Its
+// fields are named the Kubernetes way, unlike the settings of the spec.
+type PolicyStatus struct {
+	ObservedGeneration int64             `json:"observedGeneration"`
+	Phase              string            `json:"phase"`
+	LastCycle          *PolicyCycle      `json:"lastCycle,omitempty"`
+	Conditions         []PolicyCondition `json:"conditions"`
+}
+
+// PolicyCycle is the last cycle that ended. Spread is the one expected once
+// its moves are done, or the observed one when it had none.
+type PolicyCycle struct {
+	Event          string    `json:"event"`
+	StartedAt      time.Time `json:"startedAt"`
+	Moves          int       `json:"moves"`
+	BytesRelocated int64     `json:"bytesRelocated"`
+	Spread         *float64  `json:"spread,omitempty"`
+	Error          string    `json:"error,omitempty"`
+}
+
+// PolicyCondition is a condition of the status: Ready while the balancer of
+// the resource runs, Degraded while its last cycle failed.
+type PolicyCondition struct {
+	Type               string    `json:"type"`
+	Status             string    `json:"status"`
+	Reason             string    `json:"reason"`
+	Message            string    `json:"message,omitempty"`
+	LastTransitionTime time.Time `json:"lastTransitionTime"`
+}
+
+// operatorCommand runs a balancer for every ShardRebalancePolicy resource
+// of the namespace, in a child process like the clusters of the config
+// file, and reports its state in the status of the resource. Resources are
+// watched: a changed spec restarts the balancer, a deleted resource stops
+// it. The settings of the operator, from its config file and flags, are the
+// defaults of the resources, but for the admin API and leader election
+// which the balancers would compete for. A single replica is meant to run;
+// the cluster lock keeps two from moving the shards of a cluster at once.
+//
+//	operator [-namespace ns] [-print-crd]
+func operatorCommand(args []string) error {
+	if operatorOptions.printCRD {
+		fmt.Print(policyCRD)
+		return nil
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	kube, err := newKubeClient()
+	if err != nil {
+		return err
+	}
+	namespace := operatorOptions.namespace
+	if namespace == "" {
+		namespace = kube.namespace
+	}
+	defaults, err := operatorDefaults()
+	if err != nil {
+		return err
+	}
+	dir, err := ioutil.TempDir("", "rebalancer-operator")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	op := &operator{
+		kube:     kube,
+		path:     policyAPI + "/namespaces/" + namespace + "/" + policyResource,
+		dir:      dir,
+		defaults: defaults,
+		runners:  make(map[string]*policyRunner),
+	}
+	fmt.Printf("Running the ShardRebalancePolicy resources of namespace %s.\n", namespace)
+	err = supervise(ctx, component{name: "operator", run: op.run})
+	op.stopAll()
+	return err
+}
+
+// operatorDefaults returns the settings of the operator as the settings of
+// a config file.
+func operatorDefaults() (map[string]json.RawMessage, error) {
+	c := *cfg
+	c.AdminListen, c.LeaderElection, c.Clusters = "", "", nil
+	data, err := json.Marshal(&c)
+	if err != nil {
+		return nil, err
+	}
+	var defaults map[string]json.RawMessage
+	return defaults, json.Unmarshal(data, &defaults)
+}
+
+type operator struct {
+	kube     *kubeClient
+	path     string // of the resources
+	dir      string // of the config files of the balancers
+	defaults map[string]json.RawMessage
+
+	mu      sync.Mutex
+	runners map[string]*policyRunner // by namespace/name
+}
+
+// run lists the resources, reconciles the balancers with them, and watches
+// them until the watch ends, to list them again.
+func (o *operator) run(ctx context.Context) error {
+	for {
+		var list ShardRebalancePolicyList
+		if _, err := o.kube.do(ctx, "GET", o.path, nil, &list); err != nil {
+			return err
+		}
+		o.reconcile(list.Items)
+		if err := o.watch(ctx, list.Metadata.ResourceVersion); err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+}
+
+// watchEvent is an event of a watch request.
+type watchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// watch applies the changes to the resources from resourceVersion on. It
+// returns nil when the watch ends, expired included, for a new list.
+func (o *operator) watch(ctx context.Context, resourceVersion string) error {
+	resp, err := o.kube.watch(ctx, o.path+"?watch=1&timeoutSeconds=300&resourceVersion="+url.QueryEscape(resourceVersion))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var event watchEvent
+		if err := dec.Decode(&event); err != nil {
+			if err == io.EOF || ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		var policy ShardRebalancePolicy
+		if err := json.Unmarshal(event.Object, &policy); err != nil {
+			return err
+		}
+		switch event.Type {
+		case "ADDED", "MODIFIED":
+			o.apply(policy)
+		case "DELETED":
+			o.stop(policyKey(policy))
+		case "ERROR":
+			// Mostly 410 Gone: the resource version is too old to watch from.
+			return nil
+		}
+	}
+}
+
+func policyKey(p ShardRebalancePolicy) string {
+	return p.Metadata.Namespace + "/" + p.Metadata.Name
+}
+
+// reconcile runs a balancer for every resource, stopping the ones of
+// resources that are gone.
+func (o *operator) reconcile(policies []ShardRebalancePolicy) {
+	keep := make(map[string]bool, len(policies))
+	for _, p := range policies {
+		keep[policyKey(p)] = true
+		o.apply(p)
+	}
+	o.mu.Lock()
+	var gone []string
+	for key := range o.runners {
+		if !keep[key] {
+			gone = append(gone, key)
+		}
+	}
+	o.mu.Unlock()
+	for _, key := range gone {
+		o.stop(key)
+	}
+}
+
+// apply starts the balancer of the resource, or restarts it if the spec
+// changed. Status updates, which do not change the generation, leave it
+// running.
+func (o *operator) apply(p ShardRebalancePolicy) {
+	key := policyKey(p)
+	o.mu.Lock()
+	r := o.runners[key]
+	o.mu.Unlock()
+	if r != nil && r.generation == p.Metadata.Generation {
+		return
+	}
+	if r != nil {
+		fmt.Printf("Spec of %s changed, restarting its balancer.\n", key)
+		o.stop(key)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r = &policyRunner{op: o, key: key, name: p.Metadata.Name, generation: p.Metadata.Generation, cancel: cancel, done: make(chan struct{})}
+	o.mu.Lock()
+	o.runners[key] = r
+	o.mu.Unlock()
+
+	file, err := o.writeConfig(p)
+	if err != nil {
+		cancel()
+		close(r.done)
+		r.update(func(s *PolicyStatus) {
+			s.Phase = policyPhaseInvalid
+			s.setCondition("Ready", false, "InvalidSpec", err.Error())
+		})
+		return
+	}
+	fmt.Printf("Starting the balancer of %s.\n", key)
+	go r.run(ctx, []string{"run", "-config", file, "-cluster", key, "-output", outputJSON})
+}
+
+func (o *operator) stop(key string) {
+	o.mu.Lock()
+	r := o.runners[key]
+	delete(o.runners, key)
+	o.mu.Unlock()
+	if r != nil {
+		fmt.Printf("Stopping the balancer of %s.\n", key)
+		r.cancel()
+		<-r.done
+	}
+}
+
+func (o *operator) stopAll() {
+	o.mu.Lock()
+	keys := make([]string, 0, len(o.runners))
+	for key := range o.runners {
+		keys = append(keys, key)
+	}
+	o.mu.Unlock()
+	for _, key := range keys {
+		o.stop(key)
+	}
+}
+
+// writeConfig writes the config file of the balancer of the resource: the
+// defaults, with the spec as the only entry of the clusters.
+func (o *operator) writeConfig(p ShardRebalancePolicy) (string, error) {
+	var spec map[string]json.RawMessage
+	if err := json.Unmarshal(p.Spec, &spec); err != nil || spec == nil {
+		return "", errors.New("the spec must be an object of settings")
+	}
+	for _, name := range reservedPolicySettings {
+		if _, ok := spec[name]; ok {
+			return "", fmt.Errorf("the spec cannot set %s", name)
+		}
+	}
+	key, _ := json.Marshal(policyKey(p))
+	spec["name"] = key
+	section, err := json.Marshal(spec)
+	if err != nil {
+		return "", err
+	}
+
+	settings := make(map[string]json.RawMessage, len(o.defaults)+1)
+	for name, value := range o.defaults {
+		settings[name] = value
+	}
+	settings["clusters"] = json.RawMessage("[" + string(section) + "]")
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return "", err
+	}
+	file := filepath.Join(o.dir, p.Metadata.Namespace+"_"+p.Metadata.Name+".json")
+	return file, ioutil.WriteFile(file, data, 0o600)
+}
+
+// policyRunner runs the balancer of a resource and keeps its status.
+type policyRunner struct {
+	op         *operator
+	key, name  string
+	generation int64
+	cancel     context.CancelFunc
+	done       chan struct{}
+
+	mu     sync.Mutex
+	status PolicyStatus
+}
+
+// run supervises the balancer process until ctx is done or its settings
+// turn out invalid. The documents it prints update the status, its text
+// goes to the log of the operator.
+func (r *policyRunner) run(ctx context.Context, args []string) {
+	defer close(r.done)
+	c := component{name: "balancer of " + r.key, run: func(ctx context.Context) error {
+		// With -output json the balancer prints its documents to stdout
+		// and its text to stderr.
+		docs, docsW := io.Pipe()
+		text, textW := io.Pipe()
+		defer docs.Close()
+		defer text.Close()
+		go r.readDocuments(docs)
+		lastLine := make(chan string, 1)
+		go func() { lastLine <- r.readText(text) }()
+
+		r.update(func(s *PolicyStatus) {
+			s.Phase = policyPhaseRunning
+			s.setCondition("Ready", true, "Running", "")
+		})
+		err := runChild(ctx, args, docsW, textW)
+		docsW.Close()
+		textW.Close()
+		line := <-lastLine
+		if ctx.Err() != nil {
+			return nil
+		}
+		var fe fatalError
+		r.update(func(s *PolicyStatus) {
+			if errors.As(err, &fe) {
+				s.Phase = policyPhaseInvalid
+				s.setCondition("Ready", false, "InvalidSpec", line)
+			} else {
+				s.Phase = policyPhaseRestarting
+				s.setCondition("Ready", false, "ProcessExited", fmt.Sprintf("%v: %s", err, line))
+			}
+		})
+		return err
+	}}
+	c.supervise(ctx)
+}
+
+// readDocuments updates the status with the cycle documents of the
+// balancer, passing them on with -output json.
+func (r *policyRunner) readDocuments(out io.Reader) {
+	s := bufio.NewScanner(out)
+	s.Buffer(nil, 16<<20)
+	for s.Scan() {
+		if jsonOutput() {
+			documents.Lock()
+			fmt.Fprintln(documents.w, s.Text())
+			documents.Unlock()
+		}
+		var doc struct {
+			Kind string     `json:"kind"`
+			Data CycleEvent `json:"data"`
+		}
+		if err := json.Unmarshal(s.Bytes(), &doc); err != nil || doc.Kind != "cycle" {
+			continue
+		}
+		event := doc.Data
+		if event.Event != eventCycleCompleted && event.Event != eventCycleFailed {
+			continue
+		}
+		cycle := &PolicyCycle{Event: event.Event, StartedAt: event.StartedAt, Moves: len(event.Moves), BytesRelocated: event.BytesRelocated, Error: event.Error}
+		if score := event.ScoreAfter; score != nil && len(event.Moves) > 0 {
+			cycle.Spread = &score.Spread
+		} else if score := event.ScoreBefore; score != nil {
+			cycle.Spread = &score.Spread
+		}
+		r.update(func(s *PolicyStatus) {
+			s.LastCycle = cycle
+			if event.Event == eventCycleFailed {
+				s.setCondition("Degraded", true, "CycleFailed", event.Error)
+			} else {
+				s.setCondition("Degraded", false, "CycleCompleted", "")
+			}
+		})
+	}
+	io.Copy(ioutil.Discard, out)
+}
+
+// readText prints the text of the balancer, which it prefixes with the
+// name of the resource. It returns the last line, which says why a
+// balancer exited.
+func (r *policyRunner) readText(out io.Reader) string {
+	var last string
+	s := bufio.NewScanner(out)
+	for s.Scan() {
+		last = s.Text()
+		fmt.Println(last)
+	}
+	io.Copy(ioutil.Discard, out)
+	return strings.TrimPrefix(last, "["+r.key+"] ")
+}
+
+// update changes the status and writes it to the resource.
+func (r *policyRunner) update(change func(s *PolicyStatus)) {
+	r.mu.Lock()
+	r.status.ObservedGeneration = r.generation
+	change(&r.status)
+	patch := map[string]interface{}{"status": r.status}
+	r.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	code, err := r.op.kube.send(ctx, "PATCH", r.op.path+"/"+r.name+"/status", "application/merge-patch+json", patch, nil)
+	if err != nil && code != http.StatusNotFound {
+		fmt.Printf("Error updating the status of %s: %v\n", r.key, err)
+	}
+}
+
+// setCondition sets the condition of the type, keeping its transition time
+// unless its status changed.
+func (s *PolicyStatus) setCondition(kind string, status bool, reason, message string) {
+	c := PolicyCondition{Type: kind, Status: "False", Reason: reason, Message: message, LastTransitionTime: time.Now().UTC().Truncate(time.Second)}
+	if status {
+		c.Status = "True"
+	}
+	for i, existing := range s.Conditions {
+		if existing.Type == kind {
+			if existing.Status == c.Status {
+				c.LastTransitionTime = existing.LastTransitionTime
+			}
+			s.Conditions[i] = c
+			return
+		}
+	}
+	s.Conditions = append(s.Conditions, c)
+}
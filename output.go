@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// The output formats, see Config.Output.
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+// documentVersion is the version of the JSON documents. Fields may be
+// added to a version, changing or removing one needs a new version.
+const documentVersion = 1
+
+// Document is what the commands print with -output json, one per line.
+// Kind tells the type of Data:
+//
+//	status        StatusReport
+//	plan          PlanResponse
+//	report        ClusterReport
+//	churn         ChurnReport
+//	cycle         CycleEvent, as the cycles of run start and end
+//	move          MoveRecord, as moves are issued and complete, and the
+//	              entries of history
+//	snapshot      SnapshotSaved
+//	replayed      ReplayedSnapshot, for every snapshot replay plans on
+//	replay        ReplaySummary
+//	simulated     SimulatedCycle, for every cycle simulate plans
+//	simulation    SimulationSummary
+//	cancel        CancelResult
+//	advice_change AdviceChange, applied or undone
+//	control       ControlStatus, from pause and resume
+//	approval      PendingPlan, approved
+type Document struct {
+	Version int         `json:"version"`
+	Kind    string      `json:"kind"`
+	Time    time.Time   `json:"time"`
+	Cluster string      `json:"cluster,omitempty"`
+	Data    interface{} `json:"data"`
+}
+
+var documents struct {
+	sync.Mutex
+	w io.Writer // nil with text output
+}
+
+// startJSONOutput keeps stdout for the documents and sends everything else
+// printed to stderr.
+func startJSONOutput() {
+	documents.w = os.Stdout
+	os.Stdout = os.Stderr
+}
+
+func jsonOutput() bool {
+	return documents.w != nil
+}
+
+// emit prints a document of the kind with -output json, and does nothing
+// otherwise.
+func emit(kind string, data interface{}) {
+	if !jsonOutput() {
+		return
+	}
+	documents.Lock()
+	defer documents.Unlock()
+	json.NewEncoder(documents.w).Encode(Document{
+		Version: documentVersion,
+		Kind:    kind,
+		Time:    time.Now().UTC(),
+		Cluster: cfg.ClusterAlias,
+		Data:    data,
+	})
+}
+
+// prefixStdout prefixes every line printed to stdout with prefix, so that
+// the output of balancers for several clusters can be told apart once
+// collected in one place. Output is passed on as it comes rather than line
+// by line, so prompts without a trailing newline still show. The returned
+// function flushes what is left and must be called before exiting.
+func prefixStdout(prefix string) (flush func(), err error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	out := os.Stdout
+	os.Stdout = w
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		copyPrefixed(out, r, []byte(prefix))
+	}()
+	return func() {
+		os.Stdout = out
+		w.Close()
+		<-done
+	}, nil
+}
+
+func copyPrefixed(dst io.Writer, src io.Reader, prefix []byte) {
+	buf := make([]byte, 32*1024)
+	lineStart := true
+	for {
+		n, err := src.Read(buf)
+		var b bytes.Buffer
+		for _, line := range bytes.SplitAfter(buf[:n], []byte("\n")) {
+			if len(line) == 0 {
+				continue
+			}
+			if lineStart {
+				b.Write(prefix)
+			}
+			b.Write(line)
+			lineStart = line[len(line)-1] == '\n'
+		}
+		dst.Write(b.Bytes())
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tjandrayana/elasticsearch-rebalance-shard/observer"
+)
+
+// PlanFile is the schema of the plans import-plan executes. It is the one
+// of PlanResponse, so that GET /api/v1/plan and the plan command with
+// -output json, whose document is accepted as is, produce plans to import.
+// Of the moves only index, shard, primary, from and to are read. Nodes are
+// given by name or ID, and primary may be left out since a node holds a
+// single copy of a shard:
+//
+//	{"moves": [{"index": "logs-a", "shard": 0, "primary": true, "from": "data-1", "to": "data-3"}]}
+type PlanFile struct {
+	Moves []ImportedMove `json:"moves"`
+}
+
+type ImportedMove struct {
+	Index   string `json:"index"`
+	Shard   int    `json:"shard"`
+	Primary *bool  `json:"primary,omitempty"`
+	From    string `json:"from"`
+	To      string `json:"to"`
+}
+
+// importPlanCommand executes a plan produced by another tool, or by hand.
+// Every move goes through the checks of the planned moves first: it must be
+// valid against the cluster state, its index must be balanced, its copy
+// not oversized and no policy may deny it, no other move of the plan may touch the same shard, the
+// nodes must not be cooling down and the allocation deciders must accept
+// it in a dry run. The plan is executed only if all moves pass, as the
+// moves of a cycle: in stages with their checkpoints, recorded in the
+// history, notified and audited. Moves depending on earlier moves of the
+// plan are rejected, since all are checked against the current state.
+//
+//	import-plan [-yes] <file>|-
+func importPlanCommand(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: import-plan [-yes] <file>|-")
+	}
+	plan, err := readPlanFile(args[0])
+	if err != nil {
+		return err
+	}
+	if len(plan.Moves) == 0 {
+		return fmt.Errorf("%s has no moves", args[0])
+	}
+
+	obs, err := observeCluster()
+	if err != nil {
+		return fmt.Errorf("observing cluster: %w", err)
+	}
+	classifyShards(obs)
+	moves, problems := resolveImportedMoves(obs, plan.Moves)
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			fmt.Println("  " + problem)
+		}
+		return fmt.Errorf("%d of the %d moves of %s cannot be executed", len(problems), len(plan.Moves), args[0])
+	}
+
+	// The cycle prints the plan again once confirmed.
+	if !cfg.AssumeYes {
+		printPlan(estimatePlan(obs, moves))
+	}
+	if !confirm(fmt.Sprintf("Execute the %d moves of %s?", len(moves), args[0])) {
+		return errors.New("aborted")
+	}
+	var total int64
+	for _, move := range moves {
+		total += move.Bytes
+	}
+	audit("plan_imported", map[string]interface{}{"file": args[0], "moves": len(moves), "bytes": total})
+
+	cycle := newCycle()
+	smoothed.observe(obs.Distribution)
+	before := countScore(obs.Distribution)
+	cycle.scoreBefore = &before
+	disableAllocation()
+	executeCycle(cycle, obs, moves)
+	return nil
+}
+
+// readPlanFile reads a PlanFile, or the document of the plan command with
+// -output json, from the file or, for "-", stdin.
+func readPlanFile(name string) (*PlanFile, error) {
+	var r io.Reader = os.Stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var doc struct {
+		Kind string          `json:"kind"`
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(data, &doc); err == nil && doc.Kind != "" {
+		if doc.Kind != "plan" {
+			return nil, fmt.Errorf("%s is a %s document, not a plan", name, doc.Kind)
+		}
+		data = doc.Data
+	}
+	var plan PlanFile
+	if err := json.Unmarshal(data, &plan); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", name, err)
+	}
+	return &plan, nil
+}
+
+// resolveImportedMoves turns the imported moves into moves of obs, and
+// returns why those failing a check cannot be executed.
+func resolveImportedMoves(obs *Observation, imported []ImportedMove) ([]Move, []string) {
+	var moves []Move
+	var problems []string
+	shards := make(map[string]int)
+	for i, m := range imported {
+		fail := func(format string, a ...interface{}) {
+			problems = append(problems, fmt.Sprintf("move %d, [%s][%d] from %s to %s: ", i+1, m.Index, m.Shard, m.From, m.To)+fmt.Sprintf(format, a...))
+		}
+		from, err := resolveNode(obs, m.From)
+		if err != nil {
+			fail("%v", err)
+			continue
+		}
+		to, err := resolveNode(obs, m.To)
+		if err != nil {
+			fail("%v", err)
+			continue
+		}
+
+		var move Move
+		found := false
+		for _, shard := range obs.State.RoutingNodes.Nodes[from] {
+			if shard.Index == m.Index && shard.Shard == m.Shard && (m.Primary == nil || shard.Primary == *m.Primary) {
+				move, found = Move{Shard: shard, From: from, To: to, Bytes: obs.CopyBytes(shard, from)}, true
+			}
+		}
+		if !found {
+			fail("the source node holds no such copy")
+			continue
+		}
+
+		key := observer.ShardKey(move.Shard)
+		if j, ok := shards[key]; ok {
+			fail("move %d already moves a copy of the shard", j+1)
+			continue
+		}
+		shards[key] = i
+		if !indexAllowed(move.Shard.Index) {
+			fail("the index is not balanced")
+			continue
+		}
+		if isOversizedShard(move.Shard) {
+			fail("the copy is larger than max_shard_size")
+			continue
+		}
+		if policy := deniedBy(move.Shard.Index); policy != "" {
+			fail("denied by policy %s", policy)
+			continue
+		}
+		if reason := validateMove(obs, move); reason != "" {
+			fail("%s", reason)
+			continue
+		}
+		if node, until, ok := moveCoolingDown(move); ok {
+			fail("node %s cools down until %s", nodeName(obs, node), until.Format(time.RFC3339))
+			continue
+		}
+		if ok, reason := moveAllowed(move, nil); !ok {
+			fail("%s", strings.TrimSuffix(reason, "."))
+			continue
+		}
+		moves = append(moves, move)
+	}
+	return moves, problems
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/tjandrayana/elasticsearch-rebalance-shard/observer"
+)
+
+const (
+	balanceModeCount = "count" // equalize the total shard count per node
+	balanceModeIndex = "index" // spread the shards of every index evenly
+	balanceModeHeat  = "heat"  // spread the busiest shards
+)
+
+// Move is a single planned shard relocation.
+type Move struct {
+	Shard ShardRouting
+	From  string
+	To    string
+	Bytes int64 // store size of the copy being moved
+}
+
+func planMoves(obs *Observation) []Move {
+	// With dry runs, the planner asks the deciders about every move it
+	// considers, once per pass.
+	var verdicts *verdictCache
+	if cfg.DryRunMoves {
+		verdicts = newVerdictCache()
+	}
+	refreshILM()
+	classifyShards(obs)
+	readAllocationSettings(obs)
+	readDiskUsage(obs)
+	moves := planDrainMoves(obs, verdicts)
+	draining := len(moves) > 0
+	switch {
+	case draining:
+		// The balance is planned once the nodes under maintenance are
+		// drained, to account for their shards.
+	case cfg.BalanceMode == balanceModeIndex:
+		moves = planIndexMoves(obs.State, obs.Distribution, verdicts)
+	case cfg.BalanceMode == balanceModeHeat:
+		moves = planHeatMoves(obs, verdicts)
+	case isBalanced(smoothed.distribution(obs.Distribution)) && len(overCap(obs.Distribution)) == 0:
+		// Only the threshold gate uses the smoothed counts, see smoother;
+		// the moves are planned against the observed ones.
+	default:
+		moves = planCountMoves(obs.State, obs.Distribution, verdicts)
+		moves = trimConverged(obs.Distribution, moves)
+	}
+	if cfg.BalancePrimaries && !draining {
+		moves = append(moves, planPrimaryMoves(obs.State, obs.Distribution, moves, verdicts)...)
+	}
+	for i := range moves {
+		moves[i].Bytes = obs.CopyBytes(moves[i].Shard, moves[i].From)
+	}
+	return moves
+}
+
+// planCountMoves plans moves one at a time against a model of the shard
+// count per weight of every node, see NodeWeight, each time picking the move
+// that reduces its variance the most, until the spread is within the
+// threshold or no move helps. A move never leaves its target more loaded
+// than its source, so that it does not create a new imbalance. Nodes above
+// MaxShardsPerNode are relieved first, even when the spread is within the
+// threshold, and no move brings a node above it.
+func planCountMoves(state *ClusterState, shardDistribution map[string]int, verdicts *verdictCache) []Move {
+	if isBalanced(shardDistribution) && len(overCap(shardDistribution)) == 0 {
+		return nil
+	}
+
+	nodeIDs := make([]string, 0, len(shardDistribution))
+	load := make(map[string]int, len(shardDistribution))
+	weight := make(map[string]float64, len(shardDistribution))
+	placement := make(map[string][]ShardRouting, len(shardDistribution))
+	for nodeID, n := range shardDistribution {
+		nodeIDs = append(nodeIDs, nodeID)
+		load[nodeID] = n
+		weight[nodeID] = nodeWeight(nodeID)
+		placement[nodeID] = append([]ShardRouting(nil), state.RoutingNodes.Nodes[nodeID]...)
+	}
+	sort.Strings(nodeIDs)
+	perWeight := func(nodeID string, delta int) float64 {
+		return float64(load[nodeID]+delta) / weight[nodeID]
+	}
+	count := float64(len(nodeIDs))
+
+	var moves []Move
+	for {
+		balanced, capped := isBalanced(load), overCap(load)
+		if balanced && len(capped) == 0 {
+			return moves
+		}
+		var sum, sumSquares float64
+		for _, nodeID := range nodeIDs {
+			sum += perWeight(nodeID, 0)
+			sumSquares += perWeight(nodeID, 0) * perWeight(nodeID, 0)
+		}
+		variance := sumSquares/count - (sum/count)*(sum/count)
+
+		best, bestGain, bestIndex, bestRelief := Move{}, 0.0, -1, false
+		for _, from := range nodeIDs {
+			relief := capped[from]
+			if (balanced || bestRelief) && !relief {
+				continue
+			}
+			for _, to := range nodeIDs {
+				if to == from || cfg.MaxShardsPerNode > 0 && load[to] >= cfg.MaxShardsPerNode {
+					continue
+				}
+				// Relieving a node above the cap takes the best move
+				// available, even one that does not improve the balance.
+				if !relief && perWeight(to, 1) > perWeight(from, -1) {
+					continue
+				}
+				afterSum := sum - perWeight(from, 0) + perWeight(from, -1) - perWeight(to, 0) + perWeight(to, 1)
+				afterSquares := sumSquares - perWeight(from, 0)*perWeight(from, 0) + perWeight(from, -1)*perWeight(from, -1) -
+					perWeight(to, 0)*perWeight(to, 0) + perWeight(to, 1)*perWeight(to, 1)
+				gain := variance - (afterSquares/count - (afterSum/count)*(afterSum/count))
+				if !relief && gain <= 1e-9 {
+					continue
+				}
+				if bestIndex >= 0 && relief == bestRelief && gain <= bestGain {
+					continue
+				}
+				if i, ok := movableCopy(placement[from], placement[to], to, verdicts); ok {
+					best, bestGain, bestIndex, bestRelief = Move{Shard: placement[from][i], From: from, To: to}, gain, i, relief
+				}
+			}
+		}
+		if bestIndex < 0 {
+			if len(capped) > 0 {
+				fmt.Printf("No movable shard left to bring %d nodes within %d shards.\n", len(capped), cfg.MaxShardsPerNode)
+			} else {
+				fmt.Println("No movable shard left to improve the balance.")
+			}
+			return moves
+		}
+
+		// The copy is initializing on its target, where it may not move
+		// again in this plan.
+		relocated := best.Shard
+		relocated.State = "INITIALIZING"
+		placement[best.From] = append(placement[best.From][:bestIndex:bestIndex], placement[best.From][bestIndex+1:]...)
+		placement[best.To] = append(placement[best.To], relocated)
+		load[best.From]--
+		load[best.To]++
+		moves = append(moves, best)
+	}
+}
+
+// overCap returns the nodes holding more than cfg.MaxShardsPerNode shards.
+func overCap(shardDistribution map[string]int) map[string]bool {
+	capped := make(map[string]bool)
+	if cfg.MaxShardsPerNode <= 0 {
+		return capped
+	}
+	for nodeID, n := range shardDistribution {
+		if n > cfg.MaxShardsPerNode {
+			capped[nodeID] = true
+		}
+	}
+	return capped
+}
+
+// planIndexMoves balances every index on its own: the shards of an index are
+// moved from the data node holding the most of them to the one holding the
+// fewest until no two nodes differ by more than one shard of that index.
+// This keeps hot indices from concentrating on a few nodes even when the
+// total shard count is even.
+func planIndexMoves(state *ClusterState, shardDistribution map[string]int, verdicts *verdictCache) []Move {
+	nodeIDs := make([]string, 0, len(shardDistribution))
+	for nodeID := range shardDistribution {
+		nodeIDs = append(nodeIDs, nodeID)
+	}
+	sort.Strings(nodeIDs)
+	if len(nodeIDs) < 2 {
+		return nil
+	}
+
+	// placement[index][nodeID] holds the copies of the index on the node.
+	placement := make(map[string]map[string][]ShardRouting)
+	for _, nodeID := range nodeIDs {
+		for _, shard := range state.RoutingNodes.Nodes[nodeID] {
+			if placement[shard.Index] == nil {
+				placement[shard.Index] = make(map[string][]ShardRouting)
+			}
+			placement[shard.Index][nodeID] = append(placement[shard.Index][nodeID], shard)
+		}
+	}
+
+	indices := make([]string, 0, len(placement))
+	for index := range placement {
+		if indexAllowed(index) {
+			indices = append(indices, index)
+		}
+	}
+	sort.Strings(indices)
+
+	var moves []Move
+	for _, index := range indices {
+		moves = append(moves, spreadIndex(placement[index], nodeIDs, verdicts)...)
+	}
+	return moves
+}
+
+func spreadIndex(onNode map[string][]ShardRouting, nodeIDs []string, verdicts *verdictCache) []Move {
+	var moves []Move
+	for {
+		source, target := nodeIDs[0], nodeIDs[0]
+		for _, nodeID := range nodeIDs {
+			if len(onNode[nodeID]) > len(onNode[source]) {
+				source = nodeID
+			}
+			if len(onNode[nodeID]) < len(onNode[target]) {
+				target = nodeID
+			}
+		}
+		if len(onNode[source])-len(onNode[target]) <= 1 {
+			return moves
+		}
+
+		i, ok := movableCopy(onNode[source], onNode[target], target, verdicts)
+		if !ok {
+			return moves
+		}
+		shard := onNode[source][i]
+		onNode[source] = append(onNode[source][:i:i], onNode[source][i+1:]...)
+		onNode[target] = append(onNode[target], shard)
+		moves = append(moves, Move{Shard: shard, From: source, To: target})
+	}
+}
+
+// movableCopy returns the position of a started copy in from whose shard
+// has no copy in to, the copies of the target node, whose index passes the
+// index filters and whose allocation settings accept the target, that
+// leaves the target below the high disk watermark, and, unless verdicts is
+// nil, that the allocation deciders accept moving to the target, see
+// verdictCache. Replicas are preferred
+// over primaries since relocating a primary also moves indexing load
+// around, and copies of at least MinShardSize over smaller ones, which are
+// only moved when nothing else can be.
+func movableCopy(from, to []ShardRouting, target string, verdicts *verdictCache) (int, bool) {
+	for _, small := range []bool{false, true} {
+		if i, ok := movableCopyOfKind(from, to, target, false, small, verdicts); ok {
+			return i, true
+		}
+		if i, ok := movableCopyOfKind(from, to, target, true, small, verdicts); ok {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func movablePrimary(from, to []ShardRouting, target string, verdicts *verdictCache) (int, bool) {
+	if i, ok := movableCopyOfKind(from, to, target, true, false, verdicts); ok {
+		return i, true
+	}
+	return movableCopyOfKind(from, to, target, true, true, verdicts)
+}
+
+func movableReplica(from, to []ShardRouting, target string, verdicts *verdictCache) (int, bool) {
+	if i, ok := movableCopyOfKind(from, to, target, false, false, verdicts); ok {
+		return i, true
+	}
+	return movableCopyOfKind(from, to, target, false, true, verdicts)
+}
+
+// movableCopyOfKind looks for a movable primary or replica, leaving out the
+// copies smaller than MinShardSize unless small is set. Copies larger than
+// MaxShardSize, and of indices a policy denies moving, are never moved. The
+// deciders are only asked about the copies that pass every other check.
+func movableCopyOfKind(from, to []ShardRouting, target string, primary, small bool, verdicts *verdictCache) (int, bool) {
+	onTarget := make(map[string]bool)
+	for _, shard := range to {
+		onTarget[observer.ShardKey(shard)] = true
+	}
+	for i, shard := range from {
+		if shard.Primary == primary && shard.State == "STARTED" && !onTarget[observer.ShardKey(shard)] && indexAllowed(shard.Index) && deniedBy(shard.Index) == "" &&
+			(small || !isSmallShard(shard)) && !isOversizedShard(shard) &&
+			allocationAllowed(shard, target, to) && belowHighWatermark(shard, target, to) {
+			if verdicts != nil {
+				if ok, _ := moveAllowed(Move{Shard: shard, From: shard.Node, To: target}, verdicts); !ok {
+					continue
+				}
+			}
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// planImbalance measures what the current balance mode tries to reduce: the
+// spread of the shard count per weight in count mode, the sum of the
+// per-index spreads in index mode, and how much hotter than the mean the
+// hottest node is, in percent, in heat mode.
+func planImbalance(obs *Observation) int {
+	switch cfg.BalanceMode {
+	case balanceModeIndex:
+		return observer.IndexImbalance(obs)
+	case balanceModeHeat:
+		return heatImbalance(obs)
+	}
+	return int(math.Round(countScore(obs.Distribution).Spread))
+}
+
+func isBalanced(shardDistribution map[string]int) bool {
+	return countScore(shardDistribution).Spread <= float64(balanceThreshold())
+}
+
+// afterMoves returns the distribution once the moves are done.
+func afterMoves(shardDistribution map[string]int, moves []Move) map[string]int {
+	after := make(map[string]int, len(shardDistribution))
+	for id, n := range shardDistribution {
+		after[id] = n
+	}
+	for _, move := range moves {
+		after[move.From]--
+		after[move.To]++
+	}
+	return after
+}
+
+// trimConverged cuts the plan at the first move improving the standard
+// deviation of the shard counts by less than cfg.MinMoveImprovement, as the
+// moves after it are not worth their cost.
+func trimConverged(shardDistribution map[string]int, moves []Move) []Move {
+	if cfg.MinMoveImprovement <= 0 {
+		return moves
+	}
+	prev := countScore(shardDistribution).StdDev
+	for i := range moves {
+		score := countScore(afterMoves(shardDistribution, moves[:i+1])).StdDev
+		if prev-score < cfg.MinMoveImprovement {
+			fmt.Printf("Plan converged after %d moves: the next one improves the stddev by only %.3f.\n", i, prev-score)
+			return moves[:i]
+		}
+		prev = score
+	}
+	return moves
+}
+
+// balanceThreshold is the spread above which count mode moves shards:
+// cfg.RebalanceThreshold, or cfg.RebalanceStopThreshold while the previous
+// cycles are still bringing the spread down to it.
+func balanceThreshold() int {
+	if cfg.RebalanceStopThreshold > 0 && ctl.isBalancing() {
+		return cfg.RebalanceStopThreshold
+	}
+	return cfg.RebalanceThreshold
+}
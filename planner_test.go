@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tjandrayana/elasticsearch-rebalance-shard/esapi"
+	"github.com/tjandrayana/elasticsearch-rebalance-shard/observer"
+)
+
+func TestPlanCountMoves(t *testing.T) {
+	tests := []struct {
+		name string
+		// shards is the number of single-copy shards on every node.
+		shards    map[string]int
+		replicas  bool // every shard of node a has a replica on node b
+		threshold int
+		maxShards int
+		weights   []NodeWeight
+		want      map[string]int
+		wantMoves int
+	}{
+		{
+			name:      "balanced",
+			shards:    map[string]int{"a": 2, "b": 2, "c": 1},
+			threshold: 1,
+			want:      map[string]int{"a": 2, "b": 2, "c": 1},
+		},
+		{
+			name:      "spreads a crowded node",
+			shards:    map[string]int{"a": 6, "b": 0, "c": 0},
+			threshold: 1,
+			want:      map[string]int{"a": 2, "b": 2, "c": 2},
+			wantMoves: 4,
+		},
+		{
+			name:      "keeps copies of a shard apart",
+			shards:    map[string]int{"a": 3, "b": 0, "c": 0},
+			replicas:  true,
+			threshold: 1,
+			want:      map[string]int{"a": 2, "b": 2, "c": 2},
+			wantMoves: 2,
+		},
+		{
+			name:      "relieves nodes above max_shards_per_node",
+			shards:    map[string]int{"a": 5, "b": 2, "c": 2},
+			threshold: 10,
+			maxShards: 3,
+			want:      map[string]int{"a": 3, "b": 3, "c": 3},
+			wantMoves: 2,
+		},
+		{
+			name:      "weighs nodes",
+			shards:    map[string]int{"a": 0, "b": 4, "c": 4},
+			threshold: 1,
+			weights:   []NodeWeight{{Nodes: []string{"a"}, Weight: 2}},
+			want:      map[string]int{"a": 4, "b": 2, "c": 2},
+			wantMoves: 4,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := testCluster(t, "a", "b", "c")
+			for node, n := range tt.shards {
+				addShards(fake, node, n)
+			}
+			if tt.replicas {
+				for i := 0; i < tt.shards["a"]; i++ {
+					fake.AddShard(esapi.FakeShard{Index: fmt.Sprintf("a-%d", i), Node: "b", Docs: 10, Bytes: 1 << 10})
+				}
+			}
+			cfg.RebalanceThreshold = tt.threshold
+			cfg.MaxShardsPerNode = tt.maxShards
+			cfg.NodeWeights = tt.weights
+			obs := observeTestCluster(t)
+
+			moves := planCountMoves(obs.State, obs.Distribution, nil)
+			if len(moves) != tt.wantMoves {
+				t.Errorf("planned %d moves, want %d: %v", len(moves), tt.wantMoves, moves)
+			}
+			if got := afterMoves(obs.Distribution, moves); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("distribution after the moves is %v, want %v", got, tt.want)
+			}
+			// No move may take a copy to a node holding one of the shard.
+			holds := make(map[string]bool)
+			for node, shards := range obs.State.RoutingNodes.Nodes {
+				for _, shard := range shards {
+					holds[node+"/"+observer.ShardKey(shard)] = true
+				}
+			}
+			for _, move := range moves {
+				key := move.To + "/" + observer.ShardKey(move.Shard)
+				if holds[key] {
+					t.Errorf("move of [%s][%d] from %s to %s joins a copy of the shard", move.Shard.Index, move.Shard.Shard, move.From, move.To)
+				}
+				holds[key] = true
+			}
+		})
+	}
+}
+
+// countingDryRuns answers like its fake, counting the reroute dry runs by
+// index and target node.
+type countingDryRuns struct {
+	*esapi.Fake
+	dryRuns map[string]int
+}
+
+func (a *countingDryRuns) Do(method, path string, body []byte) (*http.Response, error) {
+	if method == "POST" && strings.HasPrefix(path, "/_cluster/reroute") && strings.Contains(path, "dry_run=true") {
+		var req struct {
+			Commands []struct {
+				Move struct {
+					Index  string `json:"index"`
+					ToNode string `json:"to_node"`
+				} `json:"move"`
+			} `json:"commands"`
+		}
+		if err := json.Unmarshal(body, &req); err == nil {
+			for _, command := range req.Commands {
+				a.dryRuns[command.Move.Index+" "+command.Move.ToNode]++
+			}
+		}
+	}
+	return a.Fake.Do(method, path, body)
+}
+
+func TestPlanMovesAsksDecidersOncePerPass(t *testing.T) {
+	fake := testCluster(t, "a", "b")
+	// The deciders reject every copy on c, whose disk is full.
+	fake.AddNode(esapi.FakeNode{ID: "c", Name: "c", Roles: []string{"data"}, DiskBytes: 1})
+	addShards(fake, "a", 6)
+	api := &countingDryRuns{Fake: fake, dryRuns: make(map[string]int)}
+	es = api
+	cfg.RebalanceThreshold = 1
+	cfg.DryRunMoves = true
+	// Left to the deciders.
+	cfg.DiskWatermarkAware = false
+
+	for pass := 1; pass <= 2; pass++ {
+		moves := planMoves(observeTestCluster(t))
+		if len(moves) == 0 {
+			t.Fatalf("pass %d planned no move", pass)
+		}
+		for _, move := range moves {
+			if move.To == "c" {
+				t.Errorf("pass %d moves [%s][%d] to c, whose deciders reject it", pass, move.Shard.Index, move.Shard.Shard)
+			}
+		}
+		rejected := 0
+		for key, got := range api.dryRuns {
+			if !strings.HasSuffix(key, " c") {
+				continue
+			}
+			rejected++
+			if got != pass {
+				t.Errorf("after pass %d, moving %s was dry run %d times, want %d", pass, strings.Replace(key, " ", " to ", 1), got, pass)
+			}
+		}
+		if rejected == 0 {
+			t.Errorf("pass %d asked the deciders about no move to c", pass)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"time"
+)
+
+// Policy is a rule the moves must follow on top of the balancer's own
+// checks, such as never moving the shards of billing indices during
+// business hours. It covers the moves of the indices matching Indices, glob
+// patterns like IncludeIndices, while the time is within one of During,
+// windows in the syntax of MaintenanceWindows and in MaintenanceTimezone.
+// Either left empty covers everything. Deny forbids the moves it covers.
+// MaxPerSource and MaxPerTarget hold a move back while that many
+// relocations run off its source node, or onto its target node, which
+// needs MaxConcurrentRelocations.
+//
+//	{"name": "billing-hours", "indices": ["prod-billing-*"], "during": ["* 9-16 * * 1-5"], "deny": true}
+//	{"name": "gentle-sources", "max_concurrent_per_source": 2}
+type Policy struct {
+	Name         string   `json:"name"`
+	Indices      []string `json:"indices"`
+	During       []string `json:"during"`
+	Deny         bool     `json:"deny"`
+	MaxPerSource int      `json:"max_concurrent_per_source"`
+	MaxPerTarget int      `json:"max_concurrent_per_target"`
+}
+
+func (p Policy) validate() error {
+	if p.Name == "" {
+		return fmt.Errorf("policy has no name")
+	}
+	if !p.Deny && p.MaxPerSource <= 0 && p.MaxPerTarget <= 0 {
+		return fmt.Errorf("policy %s neither denies moves nor limits them", p.Name)
+	}
+	if p.MaxPerSource < 0 || p.MaxPerTarget < 0 {
+		return fmt.Errorf("policy %s: the concurrency limits cannot be negative", p.Name)
+	}
+	for _, pattern := range p.Indices {
+		resolved, err := resolveDateMath(pattern, time.Now())
+		if err != nil {
+			return fmt.Errorf("policy %s: %w", p.Name, err)
+		}
+		if _, err := path.Match(resolved, ""); err != nil {
+			return fmt.Errorf("policy %s: invalid index pattern %q: %w", p.Name, pattern, err)
+		}
+	}
+	for _, w := range p.During {
+		if _, err := parseMaintenanceWindow(w); err != nil {
+			return fmt.Errorf("policy %s: invalid window: %w", p.Name, err)
+		}
+	}
+	return nil
+}
+
+// covers tells whether the policy applies to the moves of the index at t.
+func (p Policy) covers(index string, t time.Time) bool {
+	if len(p.Indices) > 0 && !matchAny(p.Indices, index) {
+		return false
+	}
+	if len(p.During) == 0 {
+		return true
+	}
+	if loc, err := time.LoadLocation(cfg.MaintenanceTimezone); err == nil {
+		t = t.In(loc)
+	}
+	for _, s := range p.During {
+		w, err := parseMaintenanceWindow(s)
+		if err == nil && w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// deniedBy returns the name of the first policy forbidding to move the
+// copies of the index now, or "" if none does.
+func deniedBy(index string) string {
+	now := time.Now()
+	for _, p := range cfg.Policies {
+		if p.Deny && p.covers(index, now) {
+			return p.Name
+		}
+	}
+	return ""
+}
+
+// policyLimits returns the lowest limits of the policies covering the move
+// now on the relocations off its source and onto its target, 0 for none.
+func policyLimits(move Move) (source, target int) {
+	now := time.Now()
+	lower := func(limit, policy int) int {
+		if policy > 0 && (limit == 0 || policy < limit) {
+			return policy
+		}
+		return limit
+	}
+	for _, p := range cfg.Policies {
+		if p.covers(move.Shard.Index, now) {
+			source, target = lower(source, p.MaxPerSource), lower(target, p.MaxPerTarget)
+		}
+	}
+	return source, target
+}
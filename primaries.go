@@ -0,0 +1,85 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/tjandrayana/elasticsearch-rebalance-shard/observer"
+)
+
+// planPrimaryMoves evens out the number of primaries per data node, since
+// primaries carry the indexing load. It starts from the placement the
+// planned moves lead to. Every primary moved to a node is paired, where
+// possible, with a replica moved the other way so the total shard count of
+// both nodes stays the same.
+func planPrimaryMoves(state *ClusterState, shardDistribution map[string]int, planned []Move, verdicts *verdictCache) []Move {
+	placement := simulatePlacement(state, shardDistribution, planned)
+	nodeIDs := make([]string, 0, len(placement))
+	for nodeID := range placement {
+		nodeIDs = append(nodeIDs, nodeID)
+	}
+	sort.Strings(nodeIDs)
+	if len(nodeIDs) < 2 {
+		return nil
+	}
+
+	var moves []Move
+	for {
+		source, target := nodeIDs[0], nodeIDs[0]
+		for _, nodeID := range nodeIDs {
+			if countPrimaries(placement[nodeID]) > countPrimaries(placement[source]) {
+				source = nodeID
+			}
+			if countPrimaries(placement[nodeID]) < countPrimaries(placement[target]) {
+				target = nodeID
+			}
+		}
+		if countPrimaries(placement[source])-countPrimaries(placement[target]) <= cfg.PrimaryThreshold {
+			return moves
+		}
+
+		i, ok := movablePrimary(placement[source], placement[target], target, verdicts)
+		if !ok {
+			return moves
+		}
+		primary := placement[source][i]
+		placement[source] = append(placement[source][:i:i], placement[source][i+1:]...)
+		placement[target] = append(placement[target], primary)
+		moves = append(moves, Move{Shard: primary, From: source, To: target})
+
+		if j, ok := movableReplica(placement[target], placement[source], source, verdicts); ok {
+			replica := placement[target][j]
+			placement[target] = append(placement[target][:j:j], placement[target][j+1:]...)
+			placement[source] = append(placement[source], replica)
+			moves = append(moves, Move{Shard: replica, From: target, To: source})
+		}
+	}
+}
+
+// simulatePlacement returns the shard copies of every data node once the
+// moves have been applied.
+func simulatePlacement(state *ClusterState, shardDistribution map[string]int, moves []Move) map[string][]ShardRouting {
+	placement := make(map[string][]ShardRouting)
+	for nodeID := range shardDistribution {
+		placement[nodeID] = append([]ShardRouting(nil), state.RoutingNodes.Nodes[nodeID]...)
+	}
+	for _, move := range moves {
+		for i, shard := range placement[move.From] {
+			if observer.ShardKey(shard) == observer.ShardKey(move.Shard) && shard.Primary == move.Shard.Primary {
+				placement[move.From] = append(placement[move.From][:i:i], placement[move.From][i+1:]...)
+				placement[move.To] = append(placement[move.To], shard)
+				break
+			}
+		}
+	}
+	return placement
+}
+
+func countPrimaries(shards []ShardRouting) int {
+	n := 0
+	for _, shard := range shards {
+		if shard.Primary {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/tjandrayana/elasticsearch-rebalance-shard/observer"
+)
+
+type RecoveryState struct {
+	Shards []struct {
+		ID     int    `json:"id"`
+		Type   string `json:"type"`
+		Stage  string `json:"stage"`
+		Target struct {
+			ID string `json:"id"`
+		} `json:"target"`
+		Index struct {
+			Size struct {
+				TotalInBytes     int64 `json:"total_in_bytes"`
+				RecoveredInBytes int64 `json:"recovered_in_bytes"`
+			} `json:"size"`
+		} `json:"index"`
+		Translog struct {
+			Recovered int64 `json:"recovered"`
+		} `json:"translog"`
+		TotalTimeInMillis int64 `json:"total_time_in_millis"`
+	} `json:"shards"`
+}
+
+// The stages of a move in MoveProgress besides the recovery stages of
+// Elasticsearch (INIT, INDEX, TRANSLOG, ...).
+const (
+	moveStageQueued    = "QUEUED"
+	moveStageCompleted = "COMPLETED"
+)
+
+// RelocationProgress is how far the moves issued by the running cycle are,
+// over all of them. The rate is the sum of the average rates of the
+// running recoveries, and the ETA assumes it holds for the remaining bytes.
+type RelocationProgress struct {
+	Moves          int     `json:"moves"`
+	Completed      int     `json:"completed"`
+	BytesTotal     int64   `json:"bytes_total"`
+	BytesRemaining int64   `json:"bytes_remaining"`
+	BytesPerSecond float64 `json:"bytes_per_second"`
+	ETAMillis      int64   `json:"eta_ms,omitempty"`
+
+	Relocations []MoveProgress `json:"relocations"`
+}
+
+// MoveProgress is how far one move is. A move is QUEUED until Elasticsearch
+// starts its recovery.
+type MoveProgress struct {
+	MoveSummary
+	Stage          string  `json:"stage"`
+	BytesRecovered int64   `json:"bytes_recovered"`
+	Percent        float64 `json:"percent"`
+	BytesPerSecond float64 `json:"bytes_per_second"`
+	ETAMillis      int64   `json:"eta_ms,omitempty"`
+}
+
+// relocationProgress looks up the recoveries of the moves in the _recovery
+// API. A move without a recovery is completed when its copy is started on
+// the target, and not started yet otherwise.
+func relocationProgress(state *ClusterState, moves []Move) (*RelocationProgress, error) {
+	var recoveries map[string]RecoveryState
+	if err := esGet("/_recovery?active_only=true&filter_path=*.shards.id,*.shards.type,*.shards.stage,*.shards.target.id,*.shards.index.size,*.shards.total_time_in_millis", &recoveries); err != nil {
+		return nil, err
+	}
+	p := &RelocationProgress{Moves: len(moves), Relocations: []MoveProgress{}}
+	for _, move := range moves {
+		m := MoveProgress{MoveSummary: summarizeMove(move), Stage: moveStageQueued}
+		for _, r := range recoveries[move.Shard.Index].Shards {
+			if r.ID != move.Shard.Shard || r.Target.ID != move.To {
+				continue
+			}
+			m.Stage = r.Stage
+			if r.Index.Size.TotalInBytes > 0 {
+				m.Bytes = r.Index.Size.TotalInBytes
+			}
+			m.BytesRecovered = r.Index.Size.RecoveredInBytes
+			if r.TotalTimeInMillis > 0 {
+				m.BytesPerSecond = float64(m.BytesRecovered) / (float64(r.TotalTimeInMillis) / 1000)
+			}
+		}
+		if m.Stage == moveStageQueued && copyStarted(state, move) {
+			m.Stage = moveStageCompleted
+			m.BytesRecovered = m.Bytes
+			p.Completed++
+		}
+		if m.Bytes > 0 {
+			m.Percent = float64(m.BytesRecovered) * 100 / float64(m.Bytes)
+		}
+		m.ETAMillis = etaMillis(m.Bytes-m.BytesRecovered, m.BytesPerSecond)
+		p.BytesTotal += m.Bytes
+		p.BytesRemaining += m.Bytes - m.BytesRecovered
+		p.BytesPerSecond += m.BytesPerSecond
+		p.Relocations = append(p.Relocations, m)
+	}
+	p.ETAMillis = etaMillis(p.BytesRemaining, p.BytesPerSecond)
+	return p, nil
+}
+
+func etaMillis(remaining int64, bytesPerSecond float64) int64 {
+	if bytesPerSecond <= 0 {
+		return 0
+	}
+	return int64(float64(remaining) / bytesPerSecond * 1000)
+}
+
+// copyStarted tells whether the moved copy is started on its target.
+func copyStarted(state *ClusterState, move Move) bool {
+	for _, shard := range state.RoutingNodes.Nodes[move.To] {
+		if observer.ShardKey(shard) == observer.ShardKey(move.Shard) {
+			return shard.State == "STARTED"
+		}
+	}
+	return false
+}
+
+// inFlightProgress is the progress of the moves of the running cycle, nil
+// when it issued none. Errors are only logged.
+func inFlightProgress(state *ClusterState) *RelocationProgress {
+	moves := ctl.inFlightMoves()
+	if len(moves) == 0 {
+		return nil
+	}
+	if state == nil {
+		var err error
+		if state, err = observer.GetClusterState(esGetter{}); err != nil {
+			fmt.Println("Error getting cluster state:", err)
+			return nil
+		}
+	}
+	p, err := relocationProgress(state, moves)
+	if err != nil {
+		fmt.Println("Error getting recovery progress:", err)
+		return nil
+	}
+	return p
+}
+
+// reportProgress prints the progress of the moves of the running cycle every
+// cfg.ProgressInterval until the returned function is called.
+func reportProgress() (stop func()) {
+	if cfg.ProgressInterval.Duration <= 0 {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(cfg.ProgressInterval.Duration)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if p := inFlightProgress(nil); p != nil {
+					printProgress(p)
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+func printProgress(p *RelocationProgress) {
+	line := fmt.Sprintf("Progress: %d/%d moves completed, %s of %s left at %s/s", p.Completed, p.Moves,
+		formatBytes(p.BytesRemaining), formatBytes(p.BytesTotal), formatBytes(int64(p.BytesPerSecond)))
+	if p.ETAMillis > 0 {
+		line += fmt.Sprintf(", ETA %s", time.Duration(p.ETAMillis*int64(time.Millisecond)).Round(time.Second))
+	}
+	fmt.Println(line)
+	for _, m := range p.Relocations {
+		if m.Stage == moveStageQueued || m.Stage == moveStageCompleted {
+			continue
+		}
+		line := fmt.Sprintf("  [%s][%d] %s -> %s  %s  %.0f%% of %s at %s/s", m.Index, m.Shard, m.From, m.To, m.Stage,
+			m.Percent, formatBytes(m.Bytes), formatBytes(int64(m.BytesPerSecond)))
+		if m.ETAMillis > 0 {
+			line += fmt.Sprintf(", ETA %s", time.Duration(m.ETAMillis*int64(time.Millisecond)).Round(time.Second))
+		}
+		fmt.Println(line)
+	}
+}
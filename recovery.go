@@ -0,0 +1,38 @@
+package main
+
+import "fmt"
+
+type RecoveryEntry struct {
+	Index string `json:"index"`
+	Shard string `json:"shard"`
+	Stage string `json:"stage"`
+	Type  string `json:"type"`
+}
+
+// getActiveRecoveries lists the recoveries currently running in the cluster,
+// whoever started them (relocations, replica recoveries, snapshot restores).
+func getActiveRecoveries() ([]RecoveryEntry, error) {
+	var recoveries []RecoveryEntry
+	if err := esGet("/_cat/recovery?active_only=true&format=json&h=index,shard,stage,type", &recoveries); err != nil {
+		return nil, err
+	}
+	return recoveries, nil
+}
+
+// recoveryStorm reports whether the cluster is already busy with too many
+// recoveries to accept another relocation.
+func recoveryStorm() bool {
+	if cfg.MaxClusterRecoveries <= 0 {
+		return false
+	}
+	recoveries, err := getActiveRecoveries()
+	if err != nil {
+		fmt.Println("Error getting active recoveries:", err)
+		return true
+	}
+	if len(recoveries) >= cfg.MaxClusterRecoveries {
+		fmt.Printf("Cluster has %d active recoveries (limit %d), not starting new relocations.\n", len(recoveries), cfg.MaxClusterRecoveries)
+		return true
+	}
+	return false
+}
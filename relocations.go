@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// relocationTracker runs the moves of executeMoves concurrently: it holds
+// off issuing a move while cfg.MaxConcurrentRelocations of them are running,
+// or while its source or target already takes part in as many relocations as
+// the node_concurrent_recoveries of the cluster allows, and tracks every
+// issued move until it completes.
+type relocationTracker struct {
+	mu       sync.Mutex
+	released *sync.Cond
+	perNode  int
+	running  int
+	incoming map[string]int
+	outgoing map[string]int
+	wg       sync.WaitGroup
+}
+
+func newRelocationTracker() *relocationTracker {
+	perNode := defaultNodeConcurrentRecoveries
+	if settings, err := getClusterSettings(); err != nil {
+		fmt.Println("Error getting cluster settings, assuming the default node_concurrent_recoveries:", err)
+	} else if n, err := strconv.Atoi(settings.effective(settingNodeConcurrentRecoveries)); err == nil && n > 0 {
+		perNode = n
+	}
+	t := &relocationTracker{perNode: perNode, incoming: make(map[string]int), outgoing: make(map[string]int)}
+	t.released = sync.NewCond(&t.mu)
+	return t
+}
+
+// acquire blocks until the move can be issued within the limits, the ones
+// of the policies covering it included.
+func (t *relocationTracker) acquire(move Move) {
+	outgoing, incoming := t.perNode, t.perNode
+	source, target := policyLimits(move)
+	if source > 0 && source < outgoing {
+		outgoing = source
+	}
+	if target > 0 && target < incoming {
+		incoming = target
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for t.running >= cfg.MaxConcurrentRelocations || t.outgoing[move.From] >= outgoing || t.incoming[move.To] >= incoming {
+		t.released.Wait()
+	}
+	t.running++
+	t.outgoing[move.From]++
+	t.incoming[move.To]++
+}
+
+// release frees the room of a move that completed or was not issued.
+func (t *relocationTracker) release(move Move) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.running--
+	t.outgoing[move.From]--
+	t.incoming[move.To]--
+	t.released.Broadcast()
+}
+
+// track runs complete, which waits for the issued move to complete, in the
+// background, and then releases the room of the move.
+func (t *relocationTracker) track(move Move, complete func()) {
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		defer t.release(move)
+		complete()
+	}()
+}
+
+// wait blocks until all the tracked moves completed.
+func (t *relocationTracker) wait() {
+	t.wg.Wait()
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tjandrayana/elasticsearch-rebalance-shard/observer"
+)
+
+// StateSnapshot is an observation of the cluster saved by the snapshot
+// command, for replay. Exclusions and weights are not applied yet, so that
+// a replay can try other ones.
+type StateSnapshot struct {
+	Time        time.Time    `json:"time"`
+	Cluster     string       `json:"cluster,omitempty"`
+	Observation *Observation `json:"observation"`
+}
+
+// SnapshotSaved is the document of the snapshot command.
+type SnapshotSaved struct {
+	Path string    `json:"path"`
+	Time time.Time `json:"time"`
+}
+
+// ReplayedSnapshot is the document of replay for every snapshot, and
+// ReplaySummary the one summing them up.
+type ReplayedSnapshot struct {
+	Time      time.Time `json:"time"`
+	Imbalance int       `json:"imbalance"`
+	Moves     int       `json:"moves"`
+	Bytes     int64     `json:"bytes"`
+}
+
+type ReplaySummary struct {
+	Snapshots int   `json:"snapshots"`
+	Acted     int   `json:"acted"`
+	Moves     int   `json:"moves"`
+	Bytes     int64 `json:"bytes"`
+	MaxMoves  int   `json:"max_moves"`
+}
+
+var snapshotOptions struct {
+	dir string
+}
+
+func snapshotFlags(fs *flag.FlagSet) {
+	fs.StringVar(&snapshotOptions.dir, "snapshot-dir", "", "directory of the state snapshots (default snapshots in -state-dir)")
+}
+
+func snapshotDir() (string, error) {
+	switch {
+	case snapshotOptions.dir != "":
+		return snapshotOptions.dir, nil
+	case cfg.StateDir != "":
+		return filepath.Join(cfg.StateDir, "snapshots"), nil
+	}
+	return "", errors.New("no snapshot directory, set -snapshot-dir or -state-dir")
+}
+
+// snapshotCommand saves the current state of the cluster for later replays,
+// for instance from cron every hour.
+//
+//	snapshot [-snapshot-dir path]
+func snapshotCommand(args []string) error {
+	dir, err := snapshotDir()
+	if err != nil {
+		return err
+	}
+	obs, err := observer.Observe(esGetter{})
+	if err != nil {
+		return fmt.Errorf("observing cluster: %w", err)
+	}
+	snapshot := StateSnapshot{Time: time.Now().UTC(), Cluster: cfg.ClusterAlias, Observation: obs}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	name := filepath.Join(dir, snapshot.Time.Format("20060102T150405Z")+".json")
+	if err := writeFileAtomic(name, data); err != nil {
+		return err
+	}
+	emit("snapshot", SnapshotSaved{Path: name, Time: snapshot.Time})
+	fmt.Println("Saved", name)
+	return nil
+}
+
+// replayCommand plans a cycle on every saved snapshot, oldest first, with
+// the policy given by the config and flags, and reports how often and how
+// much it would have moved. The snapshots are replayed as they were
+// observed: the moves planned on one are not applied to the next. The
+// hysteresis of the stop threshold and the smoothing carry over from one
+// snapshot to the next like between cycles.
+//
+//	replay [-snapshot-dir path]
+func replayCommand(args []string) error {
+	if cfg.BalanceMode == balanceModeHeat {
+		return errors.New("heat mode cannot be replayed, snapshots have no operation rates")
+	}
+	dir, err := snapshotDir()
+	if err != nil {
+		return err
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("no snapshots in %s", dir)
+	}
+	sort.Strings(names)
+
+	// The ILM state and the disk usage are not part of the snapshots, and
+	// must not be read from the live cluster.
+	cfg.ILMAware = false
+	cfg.DiskWatermarkAware = false
+	var replayed, acted, totalMoves, maxMoves int
+	var totalBytes int64
+	for _, name := range names {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		var snapshot StateSnapshot
+		if err := json.Unmarshal(data, &snapshot); err != nil || snapshot.Observation == nil {
+			fmt.Printf("Skipping %s: not a state snapshot.\n", filepath.Base(name))
+			continue
+		}
+		replayed++
+		obs := snapshot.Observation
+		excludeNodes(obs)
+		setAsideMaintenanceNodes(obs)
+		weighNodes(obs)
+		smoothed.observe(obs.Distribution)
+
+		moves := planMoves(obs)
+		ctl.setBalancing(len(moves) > 0)
+		var bytes int64
+		for _, move := range moves {
+			bytes += move.Bytes
+		}
+		emit("replayed", ReplayedSnapshot{Time: snapshot.Time, Imbalance: planImbalance(obs), Moves: len(moves), Bytes: bytes})
+		line := fmt.Sprintf("%s  imbalance %-4d", snapshot.Time.Local().Format("2006-01-02 15:04"), planImbalance(obs))
+		if len(moves) > 0 {
+			acted++
+			totalMoves += len(moves)
+			totalBytes += bytes
+			if len(moves) > maxMoves {
+				maxMoves = len(moves)
+			}
+			line += fmt.Sprintf("  %d moves, %s", len(moves), formatBytes(bytes))
+		}
+		if !jsonOutput() {
+			fmt.Println(strings.TrimRight(line, " "))
+		}
+	}
+
+	if replayed == 0 {
+		return fmt.Errorf("no state snapshots in %s", dir)
+	}
+	if jsonOutput() {
+		emit("replay", ReplaySummary{Snapshots: replayed, Acted: acted, Moves: totalMoves, Bytes: totalBytes, MaxMoves: maxMoves})
+		return nil
+	}
+	fmt.Printf("\n%d snapshots, the policy would have acted on %d (%d%%)\n", replayed, acted, acted*100/replayed)
+	if acted > 0 {
+		fmt.Printf("%d moves, %s to relocate, %.1f moves per cycle acting, at most %d\n",
+			totalMoves, formatBytes(totalBytes), float64(totalMoves)/float64(acted), maxMoves)
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+type ClusterStats struct {
+	ClusterName string `json:"cluster_name"`
+	Status      string `json:"status"`
+	Indices     struct {
+		Count  int `json:"count"`
+		Shards struct {
+			Total     int `json:"total"`
+			Primaries int `json:"primaries"`
+		} `json:"shards"`
+		Docs struct {
+			Count int64 `json:"count"`
+		} `json:"docs"`
+		Store struct {
+			SizeInBytes int64 `json:"size_in_bytes"`
+		} `json:"store"`
+	} `json:"indices"`
+	Nodes struct {
+		Count struct {
+			Total int `json:"total"`
+			Data  int `json:"data"`
+		} `json:"count"`
+		JVM struct {
+			Mem struct {
+				HeapUsedInBytes int64 `json:"heap_used_in_bytes"`
+				HeapMaxInBytes  int64 `json:"heap_max_in_bytes"`
+			} `json:"mem"`
+		} `json:"jvm"`
+		FS struct {
+			TotalInBytes     int64 `json:"total_in_bytes"`
+			AvailableInBytes int64 `json:"available_in_bytes"`
+		} `json:"fs"`
+	} `json:"nodes"`
+}
+
+// ClusterReport is the document of the report command.
+type ClusterReport struct {
+	Imbalance    int              `json:"imbalance"`
+	Threshold    int              `json:"threshold"`
+	BalanceMode  string           `json:"balance_mode"`
+	Distribution map[string]int   `json:"distribution"`
+	Oversized    []OversizedShard `json:"oversized"`
+	Stats        *ClusterStats    `json:"stats"`
+}
+
+func getClusterStats() (*ClusterStats, error) {
+	var stats ClusterStats
+	if err := esGet("/_cluster/stats", &stats); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// reportCommand prints the balance of the cluster, the shards too large for
+// the balancer to move and, around it, its capacity: shards, indices, store
+// size, disk and heap.
+//
+//	report
+func reportCommand(args []string) error {
+	obs, err := observeCluster()
+	if err != nil {
+		return fmt.Errorf("observing cluster: %w", err)
+	}
+	stats, err := getClusterStats()
+	if err != nil {
+		return fmt.Errorf("getting cluster stats: %w", err)
+	}
+	if jsonOutput() {
+		emit("report", ClusterReport{
+			Imbalance:    planImbalance(obs),
+			Threshold:    cfg.RebalanceThreshold,
+			BalanceMode:  cfg.BalanceMode,
+			Distribution: obs.Distribution,
+			Oversized:    append([]OversizedShard{}, findOversizedShards(obs)...),
+			Stats:        stats,
+		})
+		return nil
+	}
+
+	fmt.Printf("Cluster %s (%s)\n\n", stats.ClusterName, stats.Status)
+	fmt.Println("Balance")
+	fmt.Printf("  imbalance         %d (threshold %d, %s mode)\n", planImbalance(obs), cfg.RebalanceThreshold, cfg.BalanceMode)
+	ids := make([]string, 0, len(obs.Distribution))
+	for id := range obs.Distribution {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return nodeName(obs, ids[i]) < nodeName(obs, ids[j]) })
+	for _, id := range ids {
+		fmt.Printf("  %-17s %d shards\n", nodeName(obs, id), obs.Distribution[id])
+	}
+
+	if oversized := findOversizedShards(obs); len(oversized) > 0 {
+		max, _ := parseByteSize(cfg.MaxShardSize)
+		fmt.Printf("\nShards larger than %s, for manual handling\n", formatBytes(max))
+		for _, s := range oversized {
+			kind := "r"
+			if s.Primary {
+				kind = "p"
+			}
+			fmt.Printf("  [%s][%d] %s  on %s  %s\n", s.Index, s.Shard, kind, nodeName(obs, s.Node), formatBytes(s.Bytes))
+		}
+	}
+
+	c := stats.Indices
+	n := stats.Nodes
+	fmt.Println("\nCapacity")
+	fmt.Printf("  nodes             %d (%d data)\n", n.Count.Total, n.Count.Data)
+	fmt.Printf("  indices           %d\n", c.Count)
+	fmt.Printf("  shards            %d (%d primaries)\n", c.Shards.Total, c.Shards.Primaries)
+	if len(obs.Distribution) > 0 {
+		fmt.Printf("  shards per node   %.1f\n", float64(c.Shards.Total)/float64(len(obs.Distribution)))
+	}
+	fmt.Printf("  documents         %d\n", c.Docs.Count)
+	fmt.Printf("  store             %s", formatBytes(c.Store.SizeInBytes))
+	if c.Shards.Total > 0 {
+		fmt.Printf(" (%s per shard)", formatBytes(c.Store.SizeInBytes/int64(c.Shards.Total)))
+	}
+	fmt.Println()
+	fmt.Printf("  disk              %s used of %s%s\n", formatBytes(n.FS.TotalInBytes-n.FS.AvailableInBytes), formatBytes(n.FS.TotalInBytes), percentOf(n.FS.TotalInBytes-n.FS.AvailableInBytes, n.FS.TotalInBytes))
+	fmt.Printf("  heap              %s used of %s%s\n", formatBytes(n.JVM.Mem.HeapUsedInBytes), formatBytes(n.JVM.Mem.HeapMaxInBytes), percentOf(n.JVM.Mem.HeapUsedInBytes, n.JVM.Mem.HeapMaxInBytes))
+	return nil
+}
+
+func nodeName(obs *Observation, id string) string {
+	if node, ok := obs.Nodes.Nodes[id]; ok && node.Name != "" {
+		return node.Name
+	}
+	return id
+}
+
+func percentOf(n, total int64) string {
+	if total <= 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (%d%%)", n*100/total)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/tjandrayana/elasticsearch-rebalance-shard/observer"
+)
+
+type RerouteDecision struct {
+	Decider     string `json:"decider"`
+	Decision    string `json:"decision"`
+	Explanation string `json:"explanation"`
+}
+
+type RerouteExplanation struct {
+	Command   string            `json:"command"`
+	Decisions []RerouteDecision `json:"decisions"`
+}
+
+type RerouteResponse struct {
+	Acknowledged bool                 `json:"acknowledged"`
+	Explanations []RerouteExplanation `json:"explanations"`
+}
+
+func moveCommand(shard ShardRouting, sourceNode, targetNode string) map[string]interface{} {
+	return map[string]interface{}{
+		"commands": []interface{}{
+			map[string]interface{}{
+				"move": map[string]interface{}{
+					"index":     shard.Index,
+					"shard":     shard.Shard,
+					"from_node": sourceNode,
+					"to_node":   targetNode,
+				},
+			},
+		},
+	}
+}
+
+func cancelCommand(shard ShardRouting, nodeID string, allowPrimary bool) map[string]interface{} {
+	return map[string]interface{}{
+		"commands": []interface{}{
+			map[string]interface{}{
+				"cancel": map[string]interface{}{
+					"index":         shard.Index,
+					"shard":         shard.Shard,
+					"node":          nodeID,
+					"allow_primary": allowPrimary,
+				},
+			},
+		},
+	}
+}
+
+// dryRunMove asks the allocation deciders whether the move would be
+// accepted, without changing the cluster. It returns the explanation of
+// every decider that rejected it; an empty result means the move is allowed.
+func dryRunMove(move Move) ([]RerouteDecision, error) {
+	body, err := sendJSON("POST", "/_cluster/reroute?dry_run=true&explain=true&metric=none", moveCommand(move.Shard, move.From, move.To))
+	if err != nil {
+		return nil, err
+	}
+	var resp RerouteResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, fmt.Errorf("parsing reroute response: %w", err)
+	}
+	var rejected []RerouteDecision
+	for _, explanation := range resp.Explanations {
+		for _, decision := range explanation.Decisions {
+			if decision.Decision == "NO" {
+				rejected = append(rejected, decision)
+			}
+		}
+	}
+	return rejected, nil
+}
+
+// verdictCache memoizes the verdicts of the allocation deciders on moves,
+// by shard copy, source and target. planMoves makes one for every planning
+// pass, so that the planner dry runs a candidate move only once and leaves
+// out the moves the deciders rejected; the verdicts are not kept across
+// passes, since they may not hold anymore once the moves planned before
+// changed the cluster. Failed dry runs are not memoized.
+type verdictCache struct {
+	mu      sync.Mutex
+	reasons map[string]string // empty when the move is allowed
+}
+
+func newVerdictCache() *verdictCache {
+	return &verdictCache{reasons: make(map[string]string)}
+}
+
+func verdictKey(shard ShardRouting, from, to string) string {
+	return fmt.Sprintf("%s/%v/%s/%s", observer.ShardKey(shard), shard.Primary, from, to)
+}
+
+// moveAllowed validates the move with a reroute dry run, unless verdicts
+// holds its verdict already; a nil cache dry runs every move. When the
+// deciders would refuse it, it logs and returns the reasons.
+func moveAllowed(move Move, verdicts *verdictCache) (bool, string) {
+	key := verdictKey(move.Shard, move.From, move.To)
+	if verdicts != nil {
+		verdicts.mu.Lock()
+		reason, ok := verdicts.reasons[key]
+		verdicts.mu.Unlock()
+		if ok {
+			return reason == "", reason
+		}
+	}
+	rejected, err := dryRunMove(move)
+	if err != nil {
+		fmt.Printf("Skipping move of [%s][%d] from %s to %s, dry run failed: %v\n", move.Shard.Index, move.Shard.Shard, move.From, move.To, err)
+		return false, "dry run failed: " + err.Error()
+	}
+	reasons := make([]string, 0, len(rejected))
+	for _, decision := range rejected {
+		reasons = append(reasons, decision.Decider+": "+decision.Explanation)
+	}
+	if verdicts != nil {
+		verdicts.mu.Lock()
+		verdicts.reasons[key] = strings.Join(reasons, "; ")
+		verdicts.mu.Unlock()
+	}
+	if len(rejected) == 0 {
+		return true, ""
+	}
+	fmt.Printf("Skipping move of [%s][%d] from %s to %s, rejected by allocation deciders:\n  %s\n", move.Shard.Index, move.Shard.Shard, move.From, move.To, strings.Join(reasons, "\n  "))
+	return false, strings.Join(reasons, "; ")
+}
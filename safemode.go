@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ExecutionMarker is kept in the state directory while a cycle has
+// allocation disabled. Finding it at startup means the previous run ended
+// in the middle of a cycle.
+type ExecutionMarker struct {
+	StartedAt time.Time `json:"started_at"`
+	PID       int       `json:"pid"`
+	// RestoreSettings are the settings to put back for the recovery boost.
+	RestoreSettings *boostPrior `json:"restore_settings,omitempty"`
+	// RerouteOnly and Scope are the mode and the settings scope the cycle
+	// disabled allocation, or rebalancing, with.
+	RerouteOnly bool   `json:"reroute_only,omitempty"`
+	Scope       string `json:"scope,omitempty"`
+	// RestoreAllocation is the value of the setting the cycle changed, see
+	// allocationSetting, to put back, empty to unset it.
+	RestoreAllocation string `json:"restore_allocation,omitempty"`
+}
+
+func executionMarkerPath() string {
+	return filepath.Join(cfg.StateDir, "execution.json")
+}
+
+func markExecution() {
+	if cfg.StateDir == "" {
+		return
+	}
+	allocationPriorMu.Lock()
+	prior := allocationPrior
+	allocationPriorMu.Unlock()
+	data, err := json.Marshal(ExecutionMarker{
+		StartedAt:         time.Now().UTC(),
+		PID:               os.Getpid(),
+		RestoreSettings:   boostedSettings(),
+		RerouteOnly:       cfg.RerouteOnly,
+		Scope:             settingsScope(),
+		RestoreAllocation: prior,
+	})
+	if err == nil {
+		err = writeFileAtomic(executionMarkerPath(), data)
+	}
+	if err != nil {
+		fmt.Println("Error writing execution marker:", err)
+	}
+}
+
+func clearExecution() {
+	if cfg.StateDir == "" {
+		return
+	}
+	if err := os.Remove(executionMarkerPath()); err != nil && !os.IsNotExist(err) {
+		fmt.Println("Error removing execution marker:", err)
+	}
+}
+
+func loadExecutionMarker() (*ExecutionMarker, error) {
+	if cfg.StateDir == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(executionMarkerPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var marker ExecutionMarker
+	if err := json.Unmarshal(data, &marker); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", executionMarkerPath(), err)
+	}
+	return &marker, nil
+}
+
+// checkUncleanShutdown enters safe mode if the previous run ended in the
+// middle of a cycle, unless the operator already acknowledged it with
+// -acknowledge-crash. Allocation is enabled again, or restored, and boosted
+// recovery settings restored in any case since the cycle that changed them
+// never did, in the mode and scope recorded by the marker rather than the
+// current config's.
+func checkUncleanShutdown() error {
+	marker, err := loadExecutionMarker()
+	if err != nil || marker == nil {
+		return err
+	}
+	fmt.Printf("The previous run (pid %d) ended in the middle of a cycle started at %s.\n", marker.PID, marker.StartedAt.Local().Format(time.RFC3339))
+	if cfg.AcknowledgeCrash {
+		fmt.Println("Crash acknowledged, resuming normal operation.")
+	} else {
+		ctl.enterSafeMode(fmt.Sprintf("previous run ended uncleanly during the cycle started at %s", marker.StartedAt.Format(time.RFC3339)))
+	}
+	boostMu.Lock()
+	boosted = marker.RestoreSettings
+	boostMu.Unlock()
+	scope := marker.Scope
+	if scope == "" {
+		// Written by a version that did not record it.
+		scope = settingsScope()
+	}
+	enableAllocationAs(marker.RerouteOnly, scope, marker.RestoreAllocation)
+	return nil
+}
+
+// observeOnly is a cycle in safe mode: the plan is computed and shown, but
+// nothing is changed on the cluster.
+func observeOnly() {
+	fmt.Println("Safe mode: observing only until acknowledged.")
+	obs, err := observeCluster()
+	if err != nil {
+		fmt.Println("Error observing cluster:", err)
+		return
+	}
+	smoothed.observe(obs.Distribution)
+	moves := planMoves(obs)
+	ctl.planned(planImbalance(obs), len(moves))
+	if len(moves) == 0 {
+		fmt.Println("Cluster is already balanced.")
+		return
+	}
+	printPlan(estimatePlan(obs, moves))
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/tjandrayana/elasticsearch-rebalance-shard/observer"
+)
+
+var sampleRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// sampledBalanced estimates the imbalance from cfg.SampleIndices random
+// indices and reports whether the cluster is probably balanced, in which
+// case the cycle is skipped without observing the whole cluster. Sampling
+// errors fall back to the full observation. The estimate only covers the
+// spread of the plain shard counts, so the cycle is never skipped with
+// MaxShardsPerNode, NodeWeights, BalancePrimaries or nodes to drain, nor
+// in other balance modes.
+func sampledBalanced() bool {
+	if cfg.BalanceMode != balanceModeCount || cfg.MaxShardsPerNode > 0 || len(cfg.NodeWeights) > 0 || cfg.BalancePrimaries ||
+		cfg.DrainMaintenanceNodes && cfg.MaintenanceAttribute != "" {
+		return false
+	}
+	sample, err := observer.SampleBalance(esGetter{}, cfg.SampleIndices, sampleRand)
+	if err != nil {
+		fmt.Println("Error sampling cluster:", err)
+		return false
+	}
+	imbalance := sample.CountImbalance()
+	if imbalance > cfg.RebalanceThreshold {
+		fmt.Printf("Estimated imbalance %d from %d of %d indices, observing the whole cluster.\n", imbalance, sample.Sampled, sample.Indices)
+		return false
+	}
+	fmt.Printf("Estimated imbalance %d from %d of %d indices is within %d, skipping cycle.\n", imbalance, sample.Sampled, sample.Indices, cfg.RebalanceThreshold)
+	ctl.planned(imbalance, 0)
+	return true
+}
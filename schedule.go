@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// scheduler decides when the next cycle starts: at the next match of
+// cfg.Schedule, after cfg.SleepInterval, or after an interval adapted to the
+// last observed imbalance.
+type scheduler struct {
+	interval time.Duration
+}
+
+// run signals due when a cycle should start: right away, then as scheduled
+// after the previous cycle ended, or when triggered through the admin API.
+// The balancer closes the channel sent on due when the cycle ends.
+func (s *scheduler) run(ctx context.Context, due chan<- chan struct{}) error {
+	for {
+		done := make(chan struct{})
+		select {
+		case due <- done:
+		case <-ctx.Done():
+			return nil
+		}
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil
+		}
+		wait := s.next(time.Now())
+		fmt.Printf("Next cycle in %s.\n", wait.Round(time.Second))
+		if !ctl.wait(ctx, wait) {
+			return nil
+		}
+	}
+}
+
+func (s *scheduler) next(now time.Time) time.Duration {
+	if cfg.Schedule != "" {
+		expr, _ := parseCron(cfg.Schedule)
+		if loc, err := time.LoadLocation(cfg.MaintenanceTimezone); err == nil {
+			now = now.In(loc)
+		}
+		return expr.next(now).Sub(now)
+	}
+	if !cfg.AdaptiveInterval {
+		return cfg.SleepInterval.Duration
+	}
+	return s.adapt()
+}
+
+// adapt doubles the interval, up to cfg.MaxInterval, for every cycle in a
+// row that found nothing to move. When the last cycle had moves to make, the
+// interval is cfg.SleepInterval shortened by how far the imbalance exceeds
+// the threshold, down to cfg.MinInterval.
+func (s *scheduler) adapt() time.Duration {
+	imbalance, moves, ok := ctl.lastPlan()
+	base := cfg.SleepInterval.Duration
+	switch {
+	case !ok:
+		s.interval = base
+	case moves == 0:
+		if s.interval < base {
+			s.interval = base
+		}
+		s.interval *= 2
+	default:
+		s.interval = base
+		if threshold := cfg.RebalanceThreshold; imbalance > threshold && threshold > 0 {
+			s.interval = base * time.Duration(threshold) / time.Duration(imbalance)
+		}
+	}
+	if s.interval > cfg.MaxInterval.Duration {
+		s.interval = cfg.MaxInterval.Duration
+	}
+	if s.interval < cfg.MinInterval.Duration {
+		s.interval = cfg.MinInterval.Duration
+	}
+	return s.interval
+}
@@ -0,0 +1,42 @@
+package main
+
+import "fmt"
+
+const (
+	scopeTransient  = "transient"
+	scopePersistent = "persistent"
+)
+
+// clusterSettings is an update of cluster settings. A nil value resets the
+// setting to its default.
+type clusterSettings map[string]interface{}
+
+// settingsScope returns the scope the balancer writes cluster settings in:
+// cfg.SettingsScope if set, otherwise the default of the detected backend,
+// transient if it could not be detected.
+func settingsScope() string {
+	if cfg.SettingsScope != "" {
+		return cfg.SettingsScope
+	}
+	if b, err := getBackend(); err == nil {
+		return b.defaultSettingsScope()
+	}
+	return scopeTransient
+}
+
+// putClusterSettings writes the settings in the scope of settingsScope. All
+// the cluster settings the balancer changes go through it, or through
+// putScopedSettings when restoring them in the scope they were changed in.
+func putClusterSettings(settings clusterSettings) error {
+	return putScopedSettings(settingsScope(), settings)
+}
+
+func putScopedSettings(scope string, settings clusterSettings) error {
+	body, err := sendJSON("PUT", "/_cluster/settings", map[string]clusterSettings{scope: settings})
+	if err != nil {
+		fmt.Println("Error updating cluster settings:", err)
+		return err
+	}
+	fmt.Println("Response:", string(body))
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/tjandrayana/elasticsearch-rebalance-shard/observer"
+)
+
+type ShardStats = observer.ShardStats
+
+// getIndexShardStats lists the shard copies of a single index with their
+// doc count and store size in bytes.
+func getIndexShardStats(index string) ([]ShardStats, error) {
+	var stats []ShardStats
+	path := "/_cat/shards/" + url.PathEscape(index) + "?format=json&bytes=b&h=index,shard,prirep,state,docs,store,id,node"
+	if err := esGet(path, &stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// getShardCopyStats returns the stats of the copy of the shard held by
+// nodeID.
+func getShardCopyStats(shard ShardRouting, nodeID string) (ShardStats, error) {
+	stats, err := getIndexShardStats(shard.Index)
+	if err != nil {
+		return ShardStats{}, err
+	}
+	for _, s := range stats {
+		if s.Shard == strconv.Itoa(shard.Shard) && s.NodeID == nodeID {
+			return s, nil
+		}
+	}
+	return ShardStats{}, fmt.Errorf("no copy of [%s][%d] on node %s", shard.Index, shard.Shard, nodeID)
+}
+
+// indexExists tells whether the index is still there.
+func indexExists(index string) (bool, error) {
+	code, _, err := doJSON("HEAD", "/"+url.PathEscape(index), nil)
+	if code == http.StatusNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/tjandrayana/elasticsearch-rebalance-shard/observer"
+)
+
+// OversizedShard is a copy larger than MaxShardSize, whose relocation would
+// take too long to be left to the balancer.
+type OversizedShard struct {
+	Index   string `json:"index"`
+	Shard   int    `json:"shard"`
+	Primary bool   `json:"primary"`
+	Node    string `json:"node"`
+	Bytes   int64  `json:"bytes"`
+}
+
+// smallShards and oversizedShards hold the copies smaller than MinShardSize
+// and larger than MaxShardSize, by copy key, as of the last classifyShards.
+var (
+	shardSizeMu     sync.Mutex
+	smallShards     map[string]bool
+	oversizedShards map[string]bool
+)
+
+// classifyShards records the copies of the observation outside of
+// MinShardSize and MaxShardSize before planning.
+func classifyShards(obs *Observation) {
+	min, _ := parseByteSize(cfg.MinShardSize)
+	small := make(map[string]bool)
+	oversized := make(map[string]bool)
+	for key, bytes := range obs.ShardBytes {
+		if min > 0 && bytes < min {
+			small[key] = true
+		}
+	}
+	for _, shard := range findOversizedShards(obs) {
+		oversized[observer.CopyKey(ShardRouting{Index: shard.Index, Shard: shard.Shard}, shard.Node)] = true
+	}
+	if len(oversized) > 0 {
+		max, _ := parseByteSize(cfg.MaxShardSize)
+		fmt.Printf("Leaving %d shard copies larger than %s for manual handling, see the report command.\n", len(oversized), formatBytes(max))
+	}
+	shardSizeMu.Lock()
+	smallShards, oversizedShards = small, oversized
+	shardSizeMu.Unlock()
+}
+
+// isSmallShard tells whether the copy is smaller than MinShardSize. Copies
+// are looked up on the node they were observed on, since simulated moves
+// keep it.
+func isSmallShard(shard ShardRouting) bool {
+	shardSizeMu.Lock()
+	defer shardSizeMu.Unlock()
+	return smallShards[observer.CopyKey(shard, shard.Node)]
+}
+
+// isOversizedShard tells whether the copy is larger than MaxShardSize.
+func isOversizedShard(shard ShardRouting) bool {
+	shardSizeMu.Lock()
+	defer shardSizeMu.Unlock()
+	return oversizedShards[observer.CopyKey(shard, shard.Node)]
+}
+
+// findOversizedShards lists the started copies larger than MaxShardSize,
+// largest first.
+func findOversizedShards(obs *Observation) []OversizedShard {
+	max, _ := parseByteSize(cfg.MaxShardSize)
+	if max <= 0 {
+		return nil
+	}
+	var shards []OversizedShard
+	for nodeID, copies := range obs.State.RoutingNodes.Nodes {
+		for _, shard := range copies {
+			if bytes := obs.CopyBytes(shard, nodeID); shard.State == "STARTED" && bytes > max {
+				shards = append(shards, OversizedShard{Index: shard.Index, Shard: shard.Shard, Primary: shard.Primary, Node: nodeID, Bytes: bytes})
+			}
+		}
+	}
+	sort.Slice(shards, func(i, j int) bool { return shards[i].Bytes > shards[j].Bytes })
+	return shards
+}
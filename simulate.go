@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tjandrayana/elasticsearch-rebalance-shard/esapi"
+	"github.com/tjandrayana/elasticsearch-rebalance-shard/observer"
+)
+
+// The cluster of cfg.Simulate.
+const (
+	simulateNodes    = 6
+	simulateIndices  = 30
+	simulateShards   = 3
+	simulateReplicas = 1
+	simulateMaxBytes = 2 << 30
+)
+
+// startSimulation points the requests to Elasticsearch at a generated
+// esapi.Fake, the endpoints probed directly included.
+func startSimulation() {
+	fake := esapi.GenerateFake(simulateNodes, simulateIndices, simulateShards, simulateReplicas, simulateMaxBytes, rand.New(rand.NewSource(time.Now().UnixNano())))
+	esClient.Transport = esapi.Transport{API: fake}
+	if cfg.StateDir != "" {
+		cfg.StateDir = filepath.Join(cfg.StateDir, "simulate")
+	}
+	fmt.Printf("Simulating a cluster of %d nodes and %d shard copies, relocating %s per second; nothing is sent to Elasticsearch.\n",
+		simulateNodes, simulateIndices*simulateShards*(simulateReplicas+1), formatBytes(fake.BytesPerSec))
+}
+
+// SimulatedCycle is the document of the simulate command for every cycle
+// planned, and SimulationSummary the one summing them up.
+type SimulatedCycle struct {
+	Cycle           int   `json:"cycle"`
+	Imbalance       int   `json:"imbalance"`
+	Moves           int   `json:"moves"`
+	Rejected        int   `json:"rejected,omitempty"`
+	Bytes           int64 `json:"bytes"`
+	EstimatedMillis int64 `json:"estimated_ms"`
+}
+
+type SimulationSummary struct {
+	Cycles          int   `json:"cycles"`
+	Converged       bool  `json:"converged"`
+	Moves           int   `json:"moves"`
+	Rejected        int   `json:"rejected,omitempty"`
+	Bytes           int64 `json:"bytes"`
+	EstimatedMillis int64 `json:"estimated_ms"`
+	ImbalanceBefore int   `json:"imbalance_before"`
+	ImbalanceAfter  int   `json:"imbalance_after"`
+}
+
+var simulateOptions struct {
+	stateFile string
+	maxCycles int
+}
+
+func simulateFlags(fs *flag.FlagSet) {
+	fs.StringVar(&simulateOptions.stateFile, "state-file", "", "saved cluster state to simulate: a state snapshot, a _cluster/state or a _cat/shards?format=json dump")
+	fs.IntVar(&simulateOptions.maxCycles, "max-cycles", 100, "cycles to plan at most before giving up on convergence")
+}
+
+// simulateCommand plans cycle after cycle on a saved cluster state, the
+// moves of every cycle applied to an esapi.Fake of the cluster at once, until
+// a cycle plans none, and reports how many moves and how long the relocations
+// would take to get there. Every request goes to the fake, nothing to
+// Elasticsearch. The duration is estimated like for plan, the moves of a
+// cycle one after the other, the waits between cycles left out.
+//
+//	simulate -state-file state.json [-max-cycles 100]
+func simulateCommand(args []string) error {
+	if simulateOptions.stateFile == "" {
+		return errors.New("no cluster state to simulate, set -state-file")
+	}
+	if simulateOptions.maxCycles <= 0 {
+		return errors.New("-max-cycles must be positive")
+	}
+	if cfg.BalanceMode == balanceModeHeat {
+		return errors.New("heat mode cannot be simulated, saved states have no operation rates")
+	}
+	data, err := ioutil.ReadFile(simulateOptions.stateFile)
+	if err != nil {
+		return err
+	}
+	fake, err := loadFake(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", simulateOptions.stateFile, err)
+	}
+	esClient.Transport = esapi.Transport{API: fake}
+	// Neither the ILM state nor the disk usage are part of the saved states.
+	cfg.ILMAware = false
+	cfg.DiskWatermarkAware = false
+
+	var summary SimulationSummary
+	for summary.Cycles < simulateOptions.maxCycles {
+		obs, err := observer.Observe(esGetter{})
+		if err != nil {
+			return fmt.Errorf("observing the simulated cluster: %w", err)
+		}
+		excludeNodes(obs)
+		setAsideMaintenanceNodes(obs)
+		weighNodes(obs)
+		smoothed.observe(obs.Distribution)
+		imbalance := planImbalance(obs)
+		if summary.Cycles == 0 {
+			summary.ImbalanceBefore = imbalance
+		}
+		summary.ImbalanceAfter = imbalance
+
+		moves := planMoves(obs)
+		ctl.setBalancing(len(moves) > 0)
+		if len(moves) == 0 {
+			summary.Converged = true
+			break
+		}
+		summary.Cycles++
+		cycle := SimulatedCycle{Cycle: summary.Cycles, Imbalance: imbalance}
+		var took time.Duration
+		for _, e := range estimatePlan(obs, moves) {
+			if err := fake.Relocate(e.Move.Shard.Index, e.Move.Shard.Shard, e.Move.From, e.Move.To); err != nil {
+				cycle.Rejected++
+				continue
+			}
+			cycle.Moves++
+			cycle.Bytes += e.Bytes
+			took += e.Duration
+		}
+		cycle.EstimatedMillis = took.Milliseconds()
+		summary.Moves += cycle.Moves
+		summary.Rejected += cycle.Rejected
+		summary.Bytes += cycle.Bytes
+		summary.EstimatedMillis += cycle.EstimatedMillis
+		emit("simulated", cycle)
+		if !jsonOutput() {
+			line := fmt.Sprintf("cycle %-3d  imbalance %-4d  %d moves, %s, ~%s", cycle.Cycle, cycle.Imbalance,
+				cycle.Moves, formatBytes(cycle.Bytes), took.Round(time.Second))
+			if cycle.Rejected > 0 {
+				line += fmt.Sprintf(", %d rejected", cycle.Rejected)
+			}
+			fmt.Println(line)
+		}
+		if cycle.Moves == 0 {
+			// The planner would keep planning the same rejected moves.
+			break
+		}
+	}
+
+	if jsonOutput() {
+		emit("simulation", summary)
+		return nil
+	}
+	took := time.Duration(summary.EstimatedMillis) * time.Millisecond
+	switch {
+	case summary.Converged && summary.Cycles == 0:
+		fmt.Printf("Balanced already, imbalance %d: no moves.\n", summary.ImbalanceAfter)
+	case summary.Converged:
+		fmt.Printf("\nConverged in %d cycles: %d moves, %s to relocate, estimated %s; imbalance %d -> %d\n",
+			summary.Cycles, summary.Moves, formatBytes(summary.Bytes), took.Round(time.Second), summary.ImbalanceBefore, summary.ImbalanceAfter)
+	default:
+		fmt.Printf("\nNot converged after %d cycles: %d moves, %s to relocate, estimated %s; imbalance %d -> %d\n",
+			summary.Cycles, summary.Moves, formatBytes(summary.Bytes), took.Round(time.Second), summary.ImbalanceBefore, summary.ImbalanceAfter)
+	}
+	return nil
+}
+
+// loadFake builds an esapi.Fake of a saved cluster state: a StateSnapshot,
+// the _cluster/state of the cluster or its _cat/shards in JSON. The
+// cluster state has no shard sizes, the copies counting as empty, and the
+// shard list no node roles or IDs, the nodes being data nodes known by
+// name. Relocations in flight are taken as done.
+func loadFake(data []byte) (*esapi.Fake, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		var rows []observer.ShardStats
+		if err := json.Unmarshal(data, &rows); err != nil {
+			return nil, err
+		}
+		return fakeFromCatShards(rows)
+	}
+	var saved struct {
+		StateSnapshot
+		Nodes map[string]observer.NodeInfo `json:"nodes"`
+		observer.ClusterState
+	}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, err
+	}
+	switch {
+	case saved.Observation != nil:
+		return fakeFromObservation(saved.Observation), nil
+	case saved.RoutingNodes.Nodes != nil:
+		return fakeFromObservation(&Observation{
+			State: &saved.ClusterState,
+			Nodes: &observer.NodesInfo{Nodes: saved.Nodes},
+		}), nil
+	}
+	return nil, errors.New("not a state snapshot, _cluster/state or _cat/shards dump")
+}
+
+func fakeFromObservation(obs *Observation) *esapi.Fake {
+	fake := esapi.NewFake()
+	if obs.Nodes == nil {
+		obs.Nodes = &observer.NodesInfo{}
+	}
+	for id, node := range obs.Nodes.Nodes {
+		roles := node.Roles
+		if len(roles) == 0 {
+			roles = []string{"data"}
+		}
+		fake.AddNode(esapi.FakeNode{ID: id, Name: node.Name, Roles: roles, Attributes: node.Attributes})
+	}
+	if obs.State == nil {
+		return fake
+	}
+	for nodeID, shards := range obs.State.RoutingNodes.Nodes {
+		if _, ok := obs.Nodes.Nodes[nodeID]; !ok {
+			fake.AddNode(esapi.FakeNode{ID: nodeID, Name: nodeID, Roles: []string{"data"}})
+		}
+		for _, shard := range shards {
+			node := nodeID
+			switch {
+			case shard.State == "INITIALIZING" && shard.RelocatingNode != "":
+				continue // the target of a relocation, added with its source
+			case shard.State == "RELOCATING" && shard.RelocatingNode != "":
+				node = shard.RelocatingNode
+			}
+			fake.AddShard(esapi.FakeShard{Index: shard.Index, Shard: shard.Shard, Primary: shard.Primary, Node: node, Bytes: obs.CopyBytes(shard, nodeID)})
+		}
+	}
+	for _, shard := range obs.State.RoutingNodes.Unassigned {
+		fake.AddShard(esapi.FakeShard{Index: shard.Index, Shard: shard.Shard, Primary: shard.Primary})
+	}
+	for index, settings := range obs.AllocationSettings {
+		fake.SetIndexSettings(index, settings)
+	}
+	return fake
+}
+
+func fakeFromCatShards(rows []observer.ShardStats) (*esapi.Fake, error) {
+	fake := esapi.NewFake()
+	nodes := make(map[string]bool)
+	for _, row := range rows {
+		shard, err := strconv.Atoi(row.Shard)
+		if err != nil {
+			return nil, fmt.Errorf("shard %q of %s: %w", row.Shard, row.Index, err)
+		}
+		var size int64
+		if row.Store != "" {
+			if size, err = parseByteSize(row.Store); err != nil {
+				return nil, fmt.Errorf("store of [%s][%d]: %w", row.Index, shard, err)
+			}
+		}
+		// The node of a relocating copy reads "source -> ip id target".
+		name := row.Node
+		if i := strings.Index(name, " -> "); i >= 0 {
+			fields := strings.Fields(name[i+len(" -> "):])
+			name = fields[len(fields)-1]
+		}
+		if name != "" && !nodes[name] {
+			nodes[name] = true
+			fake.AddNode(esapi.FakeNode{ID: name, Name: name, Roles: []string{"data"}})
+		}
+		fake.AddShard(esapi.FakeShard{Index: row.Index, Shard: shard, Primary: row.Prirep == "p", Node: name, Docs: row.DocCount(), Bytes: size})
+	}
+	return fake, nil
+}
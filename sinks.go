@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	sinkFile = "file"
+	sinkHTTP = "http"
+	sinkS3   = "s3"
+	sinkGCS  = "gcs"
+)
+
+// The reports shipped to sinks: the plan of a cycle with moves when it
+// starts, and the cycle event when it completes or fails.
+const (
+	reportPlan  = "plan"
+	reportCycle = "cycle"
+)
+
+const defaultReportKey = "{{.Cluster}}/{{.Date}}/{{.Time}}-{{.Report}}.json"
+
+// ReportSink is a destination reports are archived to, each under the key
+// rendered from the Key template:
+//
+//	file  written under the directory Path
+//	http  PUT to URL followed by the key
+//	s3    put in Bucket of Region, or of the S3-compatible API at Endpoint
+//	gcs   put in Bucket through the S3-compatible API of Cloud Storage,
+//	      with HMAC keys
+//
+// S3 credentials default to the ones of the default chain, see awsChain.
+// Reports restricts which reports are shipped; empty means all.
+type ReportSink struct {
+	Type    string   `json:"type"`
+	Key     string   `json:"key"`
+	Reports []string `json:"reports"`
+
+	Path string `json:"path"`
+	URL  string `json:"url"`
+
+	Bucket          string `json:"bucket"`
+	Region          string `json:"region"`
+	Endpoint        string `json:"endpoint"`
+	AccessKeyID     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+}
+
+// ReportKey holds the fields available in key templates.
+type ReportKey struct {
+	Cluster string // cluster alias, "default" if none
+	Host    string // leader identity of the instance
+	Report  string // plan or cycle
+	Event   string // cycle event, empty for plans
+	Date    string // 2006-01-02, UTC
+	Time    string // 20060102T150405Z
+}
+
+func (s ReportSink) validate() error {
+	switch s.Type {
+	case sinkFile:
+		if s.Path == "" {
+			return fmt.Errorf("report sink of type file has no path")
+		}
+	case sinkHTTP:
+		if s.URL == "" {
+			return fmt.Errorf("report sink of type http has no URL")
+		}
+	case sinkS3:
+		if s.Bucket == "" || s.Region == "" {
+			return fmt.Errorf("report sink of type s3 needs a bucket and a region")
+		}
+	case sinkGCS:
+		if s.Bucket == "" || s.AccessKeyID == "" || s.SecretAccessKey == "" {
+			return fmt.Errorf("report sink of type gcs needs a bucket and HMAC keys")
+		}
+	default:
+		return fmt.Errorf("invalid report sink type %q", s.Type)
+	}
+	for _, report := range s.Reports {
+		if report != reportPlan && report != reportCycle {
+			return fmt.Errorf("invalid report %q, want plan or cycle", report)
+		}
+	}
+	_, err := s.keyTemplate()
+	return err
+}
+
+func (s ReportSink) keyTemplate() (*template.Template, error) {
+	key := s.Key
+	if key == "" {
+		key = defaultReportKey
+	}
+	t, err := template.New("key").Option("missingkey=error").Parse(key)
+	if err != nil {
+		return nil, fmt.Errorf("parsing report sink key: %w", err)
+	}
+	return t, nil
+}
+
+func (s ReportSink) wants(report string) bool {
+	if len(s.Reports) == 0 {
+		return true
+	}
+	for _, r := range s.Reports {
+		if r == report {
+			return true
+		}
+	}
+	return false
+}
+
+// shipReport archives the report to every sink that wants it. Failures are
+// reported and otherwise ignored.
+func shipReport(report, event string, v interface{}) {
+	if len(cfg.ReportSinks) == 0 {
+		return
+	}
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		fmt.Println("Error marshaling report:", err)
+		return
+	}
+	now := time.Now().UTC()
+	key := ReportKey{
+		Cluster: cfg.ClusterAlias,
+		Host:    cfg.LeaderIdentity,
+		Report:  report,
+		Event:   event,
+		Date:    now.Format("2006-01-02"),
+		Time:    now.Format("20060102T150405Z"),
+	}
+	if key.Cluster == "" {
+		key.Cluster = "default"
+	}
+	for _, sink := range cfg.ReportSinks {
+		if !sink.wants(report) {
+			continue
+		}
+		if err := sink.put(key, data); err != nil {
+			fmt.Printf("Error shipping %s report to %s sink: %v\n", report, sink.Type, err)
+		}
+	}
+}
+
+func (s ReportSink) put(key ReportKey, data []byte) error {
+	t, err := s.keyTemplate()
+	if err != nil {
+		return err
+	}
+	var name strings.Builder
+	if err := t.Execute(&name, key); err != nil {
+		return err
+	}
+	object := strings.TrimLeft(name.String(), "/")
+
+	switch s.Type {
+	case sinkFile:
+		path := filepath.Join(s.Path, filepath.FromSlash(object))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return err
+		}
+		return writeFileAtomic(path, data)
+	case sinkHTTP:
+		return putObject(strings.TrimRight(s.URL, "/")+"/"+escapeKey(object), data, nil)
+	default:
+		endpoint, region, creds := s.Endpoint, s.Region, awsCredentials{
+			AccessKeyID:     s.AccessKeyID,
+			SecretAccessKey: s.SecretAccessKey,
+		}
+		if s.Type == sinkGCS {
+			if endpoint == "" {
+				endpoint = "https://storage.googleapis.com"
+			}
+			region = "auto"
+		} else {
+			if endpoint == "" {
+				endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", region)
+			}
+			if creds.AccessKeyID == "" {
+				var err error
+				if creds, err = awsDefaultCredentials.get(); err != nil {
+					return err
+				}
+			}
+		}
+		// Path-style URLs work with S3, Cloud Storage and most
+		// S3-compatible stores alike.
+		u := strings.TrimRight(endpoint, "/") + "/" + url.PathEscape(s.Bucket) + "/" + escapeKey(object)
+		return putObject(u, data, func(req *http.Request) {
+			signV4(req, data, creds, region, "s3", time.Now())
+		})
+	}
+}
+
+// escapeKey escapes every segment of an object key, keeping the slashes.
+func escapeKey(key string) string {
+	segments := strings.Split(key, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+func putObject(u string, data []byte, sign func(*http.Request)) error {
+	req, err := http.NewRequest("PUT", u, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if sign != nil {
+		sign(req)
+	}
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("PUT %s: %s", req.URL.Redacted(), resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"math"
+	"sync"
+)
+
+// smoother keeps an exponentially weighted moving average of the shard
+// count of every node over the cycles, so that the shards of short-lived
+// indices coming and going between two cycles do not trigger moves.
+// cfg.SmoothingAlpha is the weight of the latest observation.
+type smoother struct {
+	mu     sync.Mutex
+	counts map[string]float64
+}
+
+var smoothed = &smoother{counts: map[string]float64{}}
+
+// observe adds the shard counts of a new observation. Nodes seen for the
+// first time start at their current count.
+func (s *smoother) observe(distribution map[string]int) {
+	if cfg.SmoothingAlpha <= 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for nodeID := range s.counts {
+		if _, ok := distribution[nodeID]; !ok {
+			delete(s.counts, nodeID)
+		}
+	}
+	for nodeID, n := range distribution {
+		previous, ok := s.counts[nodeID]
+		if !ok {
+			previous = float64(n)
+		}
+		s.counts[nodeID] = cfg.SmoothingAlpha*float64(n) + (1-cfg.SmoothingAlpha)*previous
+	}
+}
+
+// moved accounts for a move issued by the balancer right away: its effect
+// on the counts is known, and lagging behind it would make re-planning move
+// more shards than needed.
+func (s *smoother) moved(move Move) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.counts[move.From]; ok {
+		s.counts[move.From]--
+	}
+	if _, ok := s.counts[move.To]; ok {
+		s.counts[move.To]++
+	}
+}
+
+// distribution returns the smoothed shard counts of the data nodes of
+// distribution, rounded, or distribution itself with smoothing disabled.
+func (s *smoother) distribution(distribution map[string]int) map[string]int {
+	if cfg.SmoothingAlpha <= 0 {
+		return distribution
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := make(map[string]int, len(distribution))
+	for nodeID, n := range distribution {
+		if v, ok := s.counts[nodeID]; ok {
+			n = int(math.Round(v))
+		}
+		result[nodeID] = n
+	}
+	return result
+}
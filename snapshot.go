@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// What to do when a cycle is due while a snapshot is running: relocating
+// shards mid-snapshot slows both down.
+const (
+	snapshotsSkip   = "skip"   // skip the cycle
+	snapshotsWait   = "wait"   // wait for the snapshots to finish, up to MoveTimeout
+	snapshotsIgnore = "ignore" // rebalance anyway
+)
+
+// snapshotPoll is how often running snapshots are checked again while
+// waiting for them.
+const snapshotPoll = 30 * time.Second
+
+type SnapshotStatus struct {
+	Snapshots []struct {
+		Snapshot   string `json:"snapshot"`
+		Repository string `json:"repository"`
+		State      string `json:"state"`
+	} `json:"snapshots"`
+}
+
+// runningSnapshots lists the snapshots in progress, as repository:snapshot.
+func runningSnapshots() ([]string, error) {
+	var status SnapshotStatus
+	if err := esGet("/_snapshot/_status", &status); err != nil {
+		return nil, err
+	}
+	var running []string
+	for _, s := range status.Snapshots {
+		running = append(running, s.Repository+":"+s.Snapshot)
+	}
+	return running, nil
+}
+
+// snapshotsAllow reports whether the cycle may start given the running
+// snapshots and cfg.DuringSnapshots. Errors listing the snapshots do not
+// hold the cycle.
+func snapshotsAllow() bool {
+	if cfg.DuringSnapshots == snapshotsIgnore {
+		return true
+	}
+	deadline := time.Now().Add(cfg.MoveTimeout.Duration)
+	for {
+		running, err := runningSnapshots()
+		if err != nil {
+			fmt.Println("Error getting running snapshots:", err)
+			return true
+		}
+		if len(running) == 0 {
+			return true
+		}
+		list := strings.Join(running, ", ")
+		if cfg.DuringSnapshots == snapshotsSkip {
+			fmt.Printf("Snapshots in progress (%s), skipping cycle.\n", list)
+			return false
+		}
+		if time.Now().After(deadline) {
+			fmt.Printf("Snapshots still in progress after %s (%s), skipping cycle.\n", cfg.MoveTimeout.Duration, list)
+			return false
+		}
+		fmt.Printf("Snapshots in progress (%s), waiting for them to finish...\n", list)
+		ctl.beat(cfg.MoveTimeout.Duration)
+		time.Sleep(snapshotPoll)
+		if ctl.isPaused() || !ctl.isLeader() {
+			return false
+		}
+	}
+}
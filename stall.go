@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tjandrayana/elasticsearch-rebalance-shard/observer"
+)
+
+const (
+	onStallRetry = "retry"
+	onStallFlag  = "flag"
+)
+
+// errStalled is wrapped by the errors of the moves cancelled for making no
+// progress.
+var errStalled = errors.New("relocation stalled")
+
+// stallWatch follows the progress of the recovery of a move on its target,
+// the bytes of files and the translog operations recovered, in the
+// _recovery API.
+type stallWatch struct {
+	progress int64
+	since    time.Time
+}
+
+// stalled reports whether the recovery of the move made no progress for
+// cfg.StallTimeout. A relocation without an active recovery, still queued
+// behind others, is not stalled; nor is one whose recovery cannot be
+// looked up.
+func (w *stallWatch) stalled(move Move) bool {
+	if cfg.StallTimeout.Duration <= 0 {
+		return false
+	}
+	progress, active, err := recoveryProgress(move)
+	if err != nil {
+		fmt.Println("Error getting recovery progress:", err)
+		return false
+	}
+	if !active || w.since.IsZero() || progress != w.progress {
+		w.progress, w.since = progress, time.Now()
+		return false
+	}
+	return time.Since(w.since) >= cfg.StallTimeout.Duration
+}
+
+func recoveryProgress(move Move) (progress int64, active bool, err error) {
+	var recoveries map[string]RecoveryState
+	path := "/" + url.PathEscape(move.Shard.Index) + "/_recovery?active_only=true&filter_path=*.shards.id,*.shards.target.id,*.shards.index.size.recovered_in_bytes,*.shards.translog.recovered"
+	if err := esGet(path, &recoveries); err != nil {
+		return 0, false, err
+	}
+	for _, r := range recoveries[move.Shard.Index].Shards {
+		if r.ID == move.Shard.Shard && r.Target.ID == move.To {
+			return r.Index.Size.RecoveredInBytes + r.Translog.Recovered, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// cancelStalled cancels the relocation of the stalled move, which leaves
+// the copy on its source, and flags it in the audit log.
+func cancelStalled(move Move, since time.Time) error {
+	stalledFor := time.Since(since).Round(time.Second)
+	fmt.Printf("Relocation of [%s][%d] from %s to %s made no progress for %s, cancelling it.\n", move.Shard.Index, move.Shard.Shard, move.From, move.To, stalledFor)
+	fields := moveFields(move, map[string]interface{}{
+		"stalled_for": stalledFor.String(),
+		"on_stall":    cfg.OnStall,
+	})
+	if _, err := sendJSON("POST", "/_cluster/reroute?metric=none", cancelCommand(move.Shard, move.To, false)); err != nil {
+		fields["error"] = err.Error()
+		audit("relocation_stalled", fields)
+		return fmt.Errorf("move of [%s][%d] to %s made no progress for %s and could not be cancelled: %v: %w", move.Shard.Index, move.Shard.Shard, move.To, stalledFor, err, errStalled)
+	}
+	audit("relocation_stalled", fields)
+	return fmt.Errorf("move of [%s][%d] to %s made no progress for %s and was cancelled: %w", move.Shard.Index, move.Shard.Shard, move.To, stalledFor, errStalled)
+}
+
+// stallRetries are the shard copies already retried after a stall, which
+// are flagged instead if they stall again.
+var stallRetries = struct {
+	sync.Mutex
+	copies map[string]bool
+}{copies: make(map[string]bool)}
+
+// retryTarget picks another target for the stalled move: the data node with
+// the fewest shards per weight that the planner could move the copy to,
+// within MaxShardsPerNode, the index allocation settings and the high disk
+// watermark, that is not cooling down and whose move the allocation
+// deciders allow. It picks none if the copy was retried before.
+func retryTarget(move Move) (Move, bool) {
+	key := observer.CopyKey(move.Shard, move.From)
+	stallRetries.Lock()
+	retried := stallRetries.copies[key]
+	stallRetries.copies[key] = true
+	stallRetries.Unlock()
+	if retried {
+		fmt.Printf("[%s][%d] stalled before, leaving it to the operator.\n", move.Shard.Index, move.Shard.Shard)
+		return Move{}, false
+	}
+
+	obs, err := observeCluster()
+	if err != nil {
+		fmt.Println("Error observing cluster, not retrying the stalled move:", err)
+		return Move{}, false
+	}
+	readAllocationSettings(obs)
+	readDiskUsage(obs)
+	var candidates []string
+	for node, n := range obs.Distribution {
+		onNode := obs.State.RoutingNodes.Nodes[node]
+		if node == move.From || node == move.To || holdsCopy(obs.State, node, move.Shard) ||
+			cfg.MaxShardsPerNode > 0 && n >= cfg.MaxShardsPerNode ||
+			!allocationAllowed(move.Shard, node, onNode) || !belowHighWatermark(move.Shard, node, onNode) {
+			continue
+		}
+		if _, cooling := touches.coolingDown(node); cooling {
+			continue
+		}
+		candidates = append(candidates, node)
+	}
+	perWeight := func(node string) float64 {
+		return float64(obs.Distribution[node]) / nodeWeight(node)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if perWeight(candidates[i]) != perWeight(candidates[j]) {
+			return perWeight(candidates[i]) < perWeight(candidates[j])
+		}
+		return candidates[i] < candidates[j]
+	})
+	for _, node := range candidates {
+		retry := move
+		retry.To = node
+		if ok, _ := moveAllowed(retry, nil); ok {
+			fmt.Printf("Retrying the move of [%s][%d] to %s.\n", move.Shard.Index, move.Shard.Shard, nodeName(obs, node))
+			return retry, true
+		}
+	}
+	fmt.Printf("No other node can take [%s][%d], leaving it to the operator.\n", move.Shard.Index, move.Shard.Shard)
+	return Move{}, false
+}
+
+func holdsCopy(state *ClusterState, node string, shard ShardRouting) bool {
+	for _, s := range state.RoutingNodes.Nodes[node] {
+		if observer.ShardKey(s) == observer.ShardKey(shard) {
+			return true
+		}
+	}
+	return false
+}
+
+// stalledMoves collects the moves of executeMoves that were cancelled for
+// stalling, and the retries to issue for them with cfg.OnStall retry.
+type stalledMoves struct {
+	mu        sync.Mutex
+	cancelled []Move
+	retries   []Move
+}
+
+// add records the cancelled move and reports whether a retry of it was
+// queued, in which case the move does not count as failed.
+func (s *stalledMoves) add(move Move) bool {
+	var retry Move
+	ok := false
+	if cfg.OnStall == onStallRetry {
+		retry, ok = retryTarget(move)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cancelled = append(s.cancelled, move)
+	if ok {
+		s.retries = append(s.retries, retry)
+	}
+	return ok
+}
+
+func (s *stalledMoves) cancelledMoves() []Move {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cancelled
+}
+
+func (s *stalledMoves) takeRetries() []Move {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	retries := s.retries
+	s.retries = nil
+	return retries
+}
+
+// withoutMoves returns the moves except the ones in drop.
+func withoutMoves(moves, drop []Move) []Move {
+	if len(drop) == 0 {
+		return moves
+	}
+	dropped := make(map[string]bool, len(drop))
+	for _, move := range drop {
+		dropped[observer.CopyKey(move.Shard, move.From)+">"+move.To] = true
+	}
+	var kept []Move
+	for _, move := range moves {
+		if !dropped[observer.CopyKey(move.Shard, move.From)+">"+move.To] {
+			kept = append(kept, move)
+		}
+	}
+	return kept
+}
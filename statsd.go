@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	statsdFormatDogStatsD = "dogstatsd"
+	statsdFormatStatsD    = "statsd"
+)
+
+// statsdClient sends the metrics to cfg.StatsDAddress over UDP, the same
+// ones as handleMetrics with the rebalancer_ prefix written rebalancer. and
+// the labels as tags. The event counters are sent as the events happen,
+// the moves also tagged with their source and target node; the other
+// metrics every cfg.StatsDInterval, see emitStatsD. Sending is best effort:
+// errors are only logged once until sending works again.
+type statsdClient struct {
+	mu     sync.Mutex
+	conn   net.Conn
+	failed bool
+}
+
+var statsd = &statsdClient{}
+
+// tag is a tag of a StatsD metric, name and value.
+type tag [2]string
+
+func statsdTags(tags ...tag) []tag {
+	if cfg.ClusterAlias != "" {
+		tags = append([]tag{{"cluster", cfg.ClusterAlias}}, tags...)
+	}
+	return tags
+}
+
+// statsdLine formats a metric of type kind, c or g. Plain StatsD has no
+// tags: their values are appended to the name instead.
+func statsdLine(name, kind string, value float64, tags []tag) string {
+	name = strings.Replace(name, "rebalancer_", "rebalancer.", 1)
+	if cfg.StatsDFormat == statsdFormatStatsD {
+		for _, t := range tags {
+			if t[1] != "" {
+				name += "." + statsdSafe(t[1])
+			}
+		}
+		tags = nil
+	}
+	line := name + ":" + strconv.FormatFloat(value, 'f', -1, 64) + "|" + kind
+	for i, t := range tags {
+		if i == 0 {
+			line += "|#"
+		} else {
+			line += ","
+		}
+		line += statsdSafe(t[0]) + ":" + statsdSafe(t[1])
+	}
+	return line
+}
+
+// statsdSafe replaces the characters separating the fields of a line.
+func statsdSafe(s string) string {
+	return strings.NewReplacer(":", "_", "|", "_", ",", "_", "#", "_", "@", "_", " ", "_", "\n", "_").Replace(s)
+}
+
+// send writes the lines in as few datagrams as fit the usual 1432 bytes of
+// a UDP payload.
+func (c *statsdClient) send(lines ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		conn, err := net.Dial("udp", cfg.StatsDAddress)
+		if err != nil {
+			c.logError(err)
+			return
+		}
+		c.conn = conn
+	}
+	var packet []byte
+	flush := func() {
+		if len(packet) == 0 {
+			return
+		}
+		if _, err := c.conn.Write(packet); err != nil {
+			c.logError(err)
+		} else {
+			c.failed = false
+		}
+		packet = packet[:0]
+	}
+	for _, line := range lines {
+		if len(packet) > 0 && len(packet)+1+len(line) > 1432 {
+			flush()
+		}
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+	}
+	flush()
+}
+
+func (c *statsdClient) logError(err error) {
+	if !c.failed {
+		fmt.Println("Error sending metrics to StatsD:", err)
+		c.failed = true
+	}
+}
+
+func (c *statsdClient) cycleEvent(event CycleEvent) {
+	c.send(statsdLine("rebalancer_cycle_events_total", "c", 1, statsdTags(tag{"event", event.Event})))
+}
+
+func (c *statsdClient) moveEvent(record MoveRecord) {
+	c.send(statsdLine("rebalancer_moves_total", "c", 1,
+		statsdTags(tag{"result", record.Result}, tag{"source_node", record.Source}, tag{"target_node", record.Target})))
+}
+
+// emitStatsD sends the metrics but for the event counters every
+// cfg.StatsDInterval, once right away.
+func emitStatsD(ctx context.Context) error {
+	ticker := time.NewTicker(cfg.StatsDInterval.Duration)
+	defer ticker.Stop()
+	for {
+		var lines []string
+		for _, s := range samples() {
+			lines = append(lines, statsdLine(s.name, "g", s.value, statsdTags()))
+		}
+		statsd.send(lines...)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+const (
+	colorAuto   = "auto"
+	colorAlways = "always"
+	colorNever  = "never"
+
+	statusBarWidth       = 30
+	defaultZoneAttribute = "zone"
+)
+
+var statusOptions struct {
+	color         string
+	zoneAttribute string
+}
+
+func statusFlags(fs *flag.FlagSet) {
+	fs.StringVar(&statusOptions.color, "color", colorAuto, "color the load bars: auto (when printing to a terminal), always or never")
+	fs.StringVar(&statusOptions.zoneAttribute, "zone-attribute", defaultZoneAttribute, "node attribute shown as the zone of the nodes")
+}
+
+// StatusReport is the document of the status command.
+type StatusReport struct {
+	Imbalance   int          `json:"imbalance"`
+	Threshold   int          `json:"threshold"`
+	BalanceMode string       `json:"balance_mode"`
+	Nodes       []NodeStatus `json:"nodes"`
+}
+
+// NodeStatus is a row of the status table.
+type NodeStatus struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Zone      string `json:"zone,omitempty"`
+	Shards    int    `json:"shards"`
+	Primaries int    `json:"primaries"`
+	Bytes     int64  `json:"bytes"`
+	// DiskPercent is nil when the disk usage of the node is unknown.
+	DiskPercent *int `json:"disk_percent,omitempty"`
+}
+
+// statusCommand prints a table of the data nodes, sorted by name, with their
+// shard and primary counts, store size, disk usage, zone and a bar of their
+// shard count relative to the most loaded node. The bars are green within
+// half the rebalance threshold of the mean, yellow within the threshold and
+// red beyond.
+//
+//	status [-color auto|always|never] [-zone-attribute name]
+func statusCommand(args []string) error {
+	switch statusOptions.color {
+	case colorAuto, colorAlways, colorNever:
+	default:
+		return fmt.Errorf("invalid -color %q, want auto, always or never", statusOptions.color)
+	}
+	obs, err := observeCluster()
+	if err != nil {
+		return fmt.Errorf("observing cluster: %w", err)
+	}
+	if jsonOutput() {
+		emit("status", StatusReport{
+			Imbalance:   planImbalance(obs),
+			Threshold:   cfg.RebalanceThreshold,
+			BalanceMode: cfg.BalanceMode,
+			Nodes:       nodeStatuses(obs),
+		})
+		return nil
+	}
+	fmt.Printf("Imbalance %d (threshold %d, %s mode)\n\n", planImbalance(obs), cfg.RebalanceThreshold, cfg.BalanceMode)
+	printNodeTable(obs, useColor(statusOptions.color))
+	return nil
+}
+
+// useColor tells whether to color the output. Auto colors a terminal unless
+// NO_COLOR is set.
+func useColor(mode string) bool {
+	switch mode {
+	case colorAlways:
+		return true
+	case colorNever:
+		return false
+	}
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	info, err := os.Stdout.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func nodeStatuses(obs *Observation) []NodeStatus {
+	zoneAttribute := statusOptions.zoneAttribute
+	if zoneAttribute == "" {
+		zoneAttribute = defaultZoneAttribute
+	}
+	var fs NodesFS
+	if err := esGet("/_nodes/stats/fs?filter_path=nodes.*.fs.total.total_in_bytes,nodes.*.fs.total.available_in_bytes", &fs); err != nil {
+		fmt.Println("Error getting disk usage:", err)
+	}
+	rows := make([]NodeStatus, 0, len(obs.Distribution))
+	for id, n := range obs.Distribution {
+		row := NodeStatus{ID: id, Name: nodeName(obs, id), Shards: n}
+		if node, ok := obs.Nodes.Nodes[id]; ok {
+			row.Zone = node.Attributes[zoneAttribute]
+		}
+		for _, shard := range obs.State.RoutingNodes.Nodes[id] {
+			if shard.Primary {
+				row.Primaries++
+			}
+			row.Bytes += obs.CopyBytes(shard, id)
+		}
+		if disk, ok := fs.Nodes[id]; ok && disk.FS.Total.TotalInBytes > 0 {
+			total := disk.FS.Total.TotalInBytes
+			percent := int((total - disk.FS.Total.AvailableInBytes) * 100 / total)
+			row.DiskPercent = &percent
+		}
+		rows = append(rows, row)
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Name < rows[j].Name })
+	return rows
+}
+
+func printNodeTable(obs *Observation, color bool) {
+	writeNodeTable(os.Stdout, nodeStatuses(obs), color)
+}
+
+func writeNodeTable(out io.Writer, rows []NodeStatus, color bool) {
+	max, sum := 0, 0
+	for _, row := range rows {
+		sum += row.Shards
+		if row.Shards > max {
+			max = row.Shards
+		}
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NODE\tZONE\tSHARDS\tPRIMARIES\tSIZE\tDISK\tLOAD")
+	for _, row := range rows {
+		zone, disk := row.Zone, "-"
+		if zone == "" {
+			zone = "-"
+		}
+		if row.DiskPercent != nil {
+			disk = fmt.Sprintf("%d%%", *row.DiskPercent)
+		}
+		width := 0
+		if max > 0 {
+			width = row.Shards * statusBarWidth / max
+		}
+		bar := strings.Repeat("#", width)
+		if color && len(rows) > 0 {
+			bar = loadColor(float64(row.Shards)-float64(sum)/float64(len(rows))) + bar + "\033[0m"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\t%s\t%s\n", row.Name, zone, row.Shards, row.Primaries, formatBytes(row.Bytes), disk, bar)
+	}
+	w.Flush()
+}
+
+// loadColor is the ANSI color of a node whose shard count is off the mean by
+// deviation.
+func loadColor(deviation float64) string {
+	if deviation < 0 {
+		deviation = -deviation
+	}
+	switch threshold := float64(cfg.RebalanceThreshold); {
+	case deviation <= threshold/2:
+		return "\033[32m"
+	case deviation <= threshold:
+		return "\033[33m"
+	}
+	return "\033[31m"
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// component is a long running part of the balancer, such as the scheduler
+// or the admin API. run returns when ctx is done; an error makes the
+// supervisor restart the component, unless it is fatal.
+type component struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+// fatalError stops the whole supervisor instead of restarting the component
+// that returned it.
+type fatalError struct {
+	err error
+}
+
+func (e fatalError) Error() string { return e.err.Error() }
+func (e fatalError) Unwrap() error { return e.err }
+
+func fatal(err error) error {
+	return fatalError{err}
+}
+
+const (
+	restartBackoffMin = time.Second
+	restartBackoffMax = time.Minute
+)
+
+// supervise runs the components until ctx is done or one of them fails
+// fatally, in which case the others are stopped and the fatal error is
+// returned. Components that fail or panic are restarted with an exponential
+// backoff, which is reset once a component ran for restartBackoffMax.
+func supervise(ctx context.Context, components ...component) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var result error
+	for _, c := range components {
+		wg.Add(1)
+		go func(c component) {
+			defer wg.Done()
+			if err := c.supervise(ctx); err != nil {
+				once.Do(func() {
+					result = fmt.Errorf("%s: %w", c.name, err)
+					cancel()
+				})
+			}
+		}(c)
+	}
+	wg.Wait()
+	return result
+}
+
+func (c component) supervise(ctx context.Context) error {
+	backoff := restartBackoffMin
+	for {
+		started := time.Now()
+		err := c.runSafely(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err == nil {
+			fmt.Printf("Component %s finished.\n", c.name)
+			return nil
+		}
+		var fe fatalError
+		if errors.As(err, &fe) {
+			fmt.Printf("Component %s failed: %v\n", c.name, err)
+			return err
+		}
+
+		if time.Since(started) >= restartBackoffMax {
+			backoff = restartBackoffMin
+		}
+		fmt.Printf("Component %s failed, restarting in %s: %v\n", c.name, backoff, err)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > restartBackoffMax {
+			backoff = restartBackoffMax
+		}
+	}
+}
+
+// runSafely turns a panic of the component into an error so that it can be
+// restarted like any other failure.
+func (c component) runSafely(ctx context.Context) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v\n%s", r, debug.Stack())
+		}
+	}()
+	return c.run(ctx)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	settingMaxBytesPerSec           = "indices.recovery.max_bytes_per_sec"
+	settingNodeConcurrentRecoveries = "cluster.routing.allocation.node_concurrent_recoveries"
+)
+
+// Caps on the recovery boost, so that a typo cannot saturate the network of
+// every node or flood them with recoveries.
+const (
+	maxBoostBytesPerSec          = 2 << 30
+	maxBoostConcurrentRecoveries = 10
+)
+
+// defaultNodeConcurrentRecoveries is the Elasticsearch default of
+// settingNodeConcurrentRecoveries.
+const defaultNodeConcurrentRecoveries = 2
+
+// boosted holds the values the recovery boost replaced, until they are
+// restored. They are kept in the execution marker so that a crashed run
+// restores them at the next start.
+var (
+	boostMu sync.Mutex
+	boosted *boostPrior
+)
+
+// boostPrior holds the values of the boosted settings in the persistent and
+// the transient scope, nil for those not set there, each restored to its
+// own scope.
+type boostPrior struct {
+	Persistent clusterSettings `json:"persistent"`
+	Transient  clusterSettings `json:"transient"`
+}
+
+type clusterSettingsResponse struct {
+	Persistent map[string]interface{} `json:"persistent"`
+	Transient  map[string]interface{} `json:"transient"`
+	Defaults   map[string]interface{} `json:"defaults"`
+}
+
+// effective returns the value in effect for key: transient over persistent
+// over the default.
+func (r *clusterSettingsResponse) effective(key string) string {
+	for _, scope := range []map[string]interface{}{r.Transient, r.Persistent, r.Defaults} {
+		if v, ok := scope[key].(string); ok {
+			return v
+		}
+	}
+	return ""
+}
+
+func (r *clusterSettingsResponse) scope(name string) map[string]interface{} {
+	if name == scopePersistent {
+		return r.Persistent
+	}
+	return r.Transient
+}
+
+func getClusterSettings() (*clusterSettingsResponse, error) {
+	var settings clusterSettingsResponse
+	if err := esGet("/_cluster/settings?include_defaults=true&flat_settings=true", &settings); err != nil {
+		return nil, err
+	}
+	return &settings, nil
+}
+
+// boostRecoveries raises the recovery throttles to cfg.BoostMaxBytesPerSec
+// and cfg.BoostNodeConcurrentRecoveries for the moves of a cycle. Settings
+// already at or above the boost are left alone. Boosting in the persistent
+// scope unsets the transient values, which would take precedence.
+func boostRecoveries() {
+	if cfg.BoostMaxBytesPerSec == "" && cfg.BoostNodeConcurrentRecoveries == 0 {
+		return
+	}
+	current, err := getClusterSettings()
+	if err != nil {
+		fmt.Println("Error getting cluster settings, not boosting recoveries:", err)
+		return
+	}
+
+	boost := clusterSettings{}
+	if cfg.BoostMaxBytesPerSec != "" {
+		want, _ := parseByteSize(cfg.BoostMaxBytesPerSec)
+		if have, err := parseByteSize(current.effective(settingMaxBytesPerSec)); err != nil || have < want {
+			boost[settingMaxBytesPerSec] = cfg.BoostMaxBytesPerSec
+		}
+	}
+	if cfg.BoostNodeConcurrentRecoveries > 0 {
+		have, err := strconv.Atoi(current.effective(settingNodeConcurrentRecoveries))
+		if err != nil {
+			have = defaultNodeConcurrentRecoveries
+		}
+		if have < cfg.BoostNodeConcurrentRecoveries {
+			boost[settingNodeConcurrentRecoveries] = strconv.Itoa(cfg.BoostNodeConcurrentRecoveries)
+		}
+	}
+	if len(boost) == 0 {
+		return
+	}
+
+	prior := &boostPrior{Persistent: clusterSettings{}, Transient: clusterSettings{}}
+	shadowing := clusterSettings{}
+	for key := range boost {
+		prior.Persistent[key] = current.Persistent[key]
+		prior.Transient[key] = current.Transient[key]
+		if current.Transient[key] != nil {
+			shadowing[key] = nil
+		}
+	}
+	boostMu.Lock()
+	boosted = prior
+	boostMu.Unlock()
+	markExecution()
+
+	fmt.Println("Boosting recoveries...")
+	putClusterSettings(boost)
+	if settingsScope() == scopePersistent && len(shadowing) > 0 {
+		putScopedSettings(scopeTransient, shadowing)
+	}
+}
+
+// restoreRecoveries puts back the settings replaced by boostRecoveries.
+func restoreRecoveries() {
+	boostMu.Lock()
+	prior := boosted
+	boosted = nil
+	boostMu.Unlock()
+	if prior == nil {
+		return
+	}
+	fmt.Println("Restoring recovery settings...")
+	if len(prior.Persistent) > 0 {
+		putScopedSettings(scopePersistent, prior.Persistent)
+	}
+	if len(prior.Transient) > 0 {
+		putScopedSettings(scopeTransient, prior.Transient)
+	}
+}
+
+func boostedSettings() *boostPrior {
+	boostMu.Lock()
+	defer boostMu.Unlock()
+	return boosted
+}
+
+// parseByteSize parses an Elasticsearch byte size such as "40mb". A plain
+// number is a count of bytes.
+func parseByteSize(s string) (int64, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil && n >= 0 {
+		return n, nil
+	}
+	units := []struct {
+		suffix string
+		size   int64
+	}{{"tb", 1 << 40}, {"gb", 1 << 30}, {"mb", 1 << 20}, {"kb", 1 << 10}, {"b", 1}}
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			n, err := strconv.ParseFloat(strings.TrimSuffix(s, u.suffix), 64)
+			if err != nil || n < 0 {
+				return 0, fmt.Errorf("invalid byte size %q", s)
+			}
+			return int64(n * float64(u.size)), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid byte size %q", s)
+}
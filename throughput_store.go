@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// throughputSmoothing is the weight of a new sample in the learned
+// throughput averages.
+const throughputSmoothing = 0.3
+
+// ThroughputStat is a smoothed throughput learned over many relocations.
+type ThroughputStat struct {
+	BytesPerSec float64   `json:"bytes_per_sec"`
+	Samples     int       `json:"samples"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+func (t *ThroughputStat) add(bytesPerSec float64, now time.Time) {
+	if t.Samples == 0 {
+		t.BytesPerSec = bytesPerSec
+	} else {
+		t.BytesPerSec += throughputSmoothing * (bytesPerSec - t.BytesPerSec)
+	}
+	t.Samples++
+	t.UpdatedAt = now
+}
+
+// ThroughputStore persists the relocation throughput observed per node pair
+// (keyed by node names, which survive node restarts) and per data tier of
+// the target node, so estimates improve across runs.
+type ThroughputStore struct {
+	Pairs map[string]*ThroughputStat `json:"pairs"`
+	Tiers map[string]*ThroughputStat `json:"tiers"`
+	// Seen holds the recoveries already accounted for, since Elasticsearch
+	// keeps reporting a completed recovery until the shard recovers again.
+	Seen map[string]bool `json:"seen"`
+}
+
+func throughputStorePath() string {
+	return filepath.Join(cfg.StateDir, "throughput.json")
+}
+
+// loadThroughputStore reads the store from the state directory. It returns
+// an empty store when the state directory is not configured or the file
+// does not exist yet.
+func loadThroughputStore() *ThroughputStore {
+	store := &ThroughputStore{Pairs: map[string]*ThroughputStat{}, Tiers: map[string]*ThroughputStat{}, Seen: map[string]bool{}}
+	if cfg.StateDir == "" {
+		return store
+	}
+	data, err := ioutil.ReadFile(throughputStorePath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Println("Error reading throughput store:", err)
+		}
+		return store
+	}
+	if err := json.Unmarshal(data, store); err != nil {
+		fmt.Println("Error parsing throughput store:", err)
+	}
+	return store
+}
+
+func (s *ThroughputStore) save() {
+	if cfg.StateDir == "" {
+		return
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		fmt.Println("Error marshaling throughput store:", err)
+		return
+	}
+	if err := writeFileAtomic(throughputStorePath(), data); err != nil {
+		fmt.Println("Error writing throughput store:", err)
+	}
+}
+
+// learn records the completed peer recoveries that were not seen before.
+func (s *ThroughputStore) learn(history []RecoveryHistoryEntry, tiers map[string]string) {
+	now := time.Now().UTC()
+	seen := make(map[string]bool, len(history))
+	for _, r := range history {
+		if r.Type != "peer" || r.Stage != "done" {
+			continue
+		}
+		key := r.Index + "/" + r.Shard + "@" + r.TargetNode + "@" + r.StartTimeMillis
+		seen[key] = true
+		if s.Seen[key] {
+			continue
+		}
+		bytes, _ := strconv.ParseFloat(r.BytesTotal, 64)
+		millis, _ := strconv.ParseFloat(r.Time, 64)
+		if bytes <= 0 || millis <= 0 {
+			continue
+		}
+		rate := bytes / (millis / 1000)
+		s.stat(s.Pairs, pairKey(r.SourceNode, r.TargetNode)).add(rate, now)
+		if tier := tiers[r.TargetNode]; tier != "" {
+			s.stat(s.Tiers, tier).add(rate, now)
+		}
+	}
+	// Forget the recoveries Elasticsearch no longer reports to keep the
+	// store small.
+	s.Seen = seen
+}
+
+func (s *ThroughputStore) stat(m map[string]*ThroughputStat, key string) *ThroughputStat {
+	if m[key] == nil {
+		m[key] = &ThroughputStat{}
+	}
+	return m[key]
+}
+
+// nodeTier returns the data tier of a node ("hot", "warm", ...), or "data"
+// for nodes with the generic data role. Tiers only exist since Elasticsearch
+// 7.10.
+func nodeTier(node NodeInfo) string {
+	if b, err := getBackend(); err == nil && !b.supportsDataTiers() {
+		return "data"
+	}
+	for _, role := range node.Roles {
+		if strings.HasPrefix(role, "data_") {
+			return strings.TrimPrefix(role, "data_")
+		}
+	}
+	return "data"
+}
+
+// writeFileAtomic writes the file through a temporary file and a rename so a
+// crash never leaves a truncated file behind.
+func writeFileAtomic(name string, data []byte) error {
+	if err := ensureDir(filepath.Dir(name)); err != nil {
+		return err
+	}
+	tmp := name + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+func ensureDir(dir string) error {
+	return os.MkdirAll(dir, 0o755)
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The balancer traces its cycles as OpenTelemetry spans exported to
+// cfg.OTLPEndpoint in the JSON encoding of OTLP/HTTP: a cycle span, with a
+// plan span for the observing and planning and a relocation span for every
+// move issued, from the reroute until the move completed. The spans are
+// made from the events of the bus and a cycle is exported once it ended.
+// Moves outside of cycles, such as with the move command, are traces of
+// their own.
+
+const tracerName = "elasticsearch-rebalance-shard"
+
+// The status codes and span kind of OTLP.
+const (
+	spanStatusOK     = 1
+	spanStatusError  = 2
+	spanKindInternal = 1
+)
+
+type span struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	Start        string          `json:"startTimeUnixNano"`
+	End          string          `json:"endTimeUnixNano"`
+	Attributes   []spanAttribute `json:"attributes,omitempty"`
+	Status       *spanStatus     `json:"status,omitempty"`
+}
+
+type spanAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type spanStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+func newSpan(traceID, parentID, name string, start time.Time) *span {
+	return &span{
+		TraceID:      traceID,
+		SpanID:       randomID(8),
+		ParentSpanID: parentID,
+		Name:         name,
+		Kind:         spanKindInternal,
+		Start:        unixNano(start),
+	}
+}
+
+func (s *span) end(t time.Time) {
+	s.End = unixNano(t)
+}
+
+// set adds an attribute of type string, int, int64, float64 or bool.
+func (s *span) set(key string, value interface{}) {
+	var v map[string]interface{}
+	switch value := value.(type) {
+	case string:
+		v = map[string]interface{}{"stringValue": value}
+	case int:
+		v = map[string]interface{}{"intValue": strconv.Itoa(value)}
+	case int64:
+		v = map[string]interface{}{"intValue": strconv.FormatInt(value, 10)}
+	case float64:
+		v = map[string]interface{}{"doubleValue": value}
+	case bool:
+		v = map[string]interface{}{"boolValue": value}
+	default:
+		v = map[string]interface{}{"stringValue": fmt.Sprint(value)}
+	}
+	s.Attributes = append(s.Attributes, spanAttribute{Key: key, Value: v})
+}
+
+func (s *span) fail(message string) {
+	s.Status = &spanStatus{Code: spanStatusError, Message: message}
+}
+
+func randomID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// tracer turns the events of the bus into spans. cycle is nil between
+// cycles; relocations are the spans of the moves issued and not done yet,
+// by moveKey.
+type tracer struct {
+	mu          sync.Mutex
+	cycle       *span
+	spans       []*span // ended, of the running cycle
+	relocations map[string]*span
+}
+
+var traces = &tracer{relocations: make(map[string]*span)}
+
+func moveKey(r MoveRecord) string {
+	return fmt.Sprintf("%s/%d@%s>%s", r.Index, r.Shard, r.Source, r.Target)
+}
+
+// cycleEvent and moveEvent return the spans ended, to export, if any.
+func (t *tracer) cycleEvent(event CycleEvent) []*span {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	if t.cycle == nil {
+		if event.Event != eventCycleStarted && event.Event != eventCycleCompleted && event.Event != eventCycleFailed {
+			return nil
+		}
+		t.cycle = newSpan(randomID(16), "", "rebalance cycle", event.StartedAt)
+		if cfg.ClusterAlias != "" {
+			t.cycle.set("rebalance.cluster", cfg.ClusterAlias)
+		}
+		// The plan of a cycle ends when it starts moving, or with the
+		// cycle if it had nothing to move.
+		plan := newSpan(t.cycle.TraceID, t.cycle.SpanID, "plan", event.StartedAt)
+		plan.end(now)
+		plan.set("rebalance.moves", len(event.Moves))
+		if event.ScoreBefore != nil {
+			plan.set("rebalance.imbalance", event.ScoreBefore.Spread)
+		}
+		if event.Event == eventCycleFailed {
+			plan.fail(event.Error)
+		}
+		t.spans = append(t.spans, plan)
+	}
+	switch event.Event {
+	case eventCycleCompleted, eventCycleFailed:
+	default:
+		return nil
+	}
+
+	c := t.cycle
+	c.end(now)
+	c.set("rebalance.moves", len(event.Moves))
+	c.set("rebalance.bytes_relocated", event.BytesRelocated)
+	if event.ScoreBefore != nil {
+		c.set("rebalance.imbalance_before", event.ScoreBefore.Spread)
+	}
+	if event.ScoreAfter != nil {
+		c.set("rebalance.imbalance_after", event.ScoreAfter.Spread)
+	}
+	if event.Event == eventCycleFailed {
+		c.fail(event.Error)
+	} else {
+		c.Status = &spanStatus{Code: spanStatusOK}
+	}
+	// Moves still relocating are waited for by the following cycles, their
+	// spans end here.
+	for key, s := range t.relocations {
+		s.end(now)
+		s.set("rebalance.result", "pending")
+		t.spans = append(t.spans, s)
+		delete(t.relocations, key)
+	}
+	spans := append(t.spans, c)
+	t.cycle, t.spans = nil, nil
+	return spans
+}
+
+func (t *tracer) moveEvent(record MoveRecord) []*span {
+	if record.Result == moveResultPlanned {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := moveKey(record)
+	if record.Result == moveResultIssued {
+		var traceID, parentID string
+		if t.cycle != nil {
+			traceID, parentID = t.cycle.TraceID, t.cycle.SpanID
+		} else {
+			traceID = randomID(16)
+		}
+		s := newSpan(traceID, parentID, "relocation", record.Time)
+		s.set("es.index", record.Index)
+		s.set("es.shard", record.Shard)
+		s.set("es.primary", record.Primary)
+		s.set("es.source_node", record.Source)
+		s.set("es.target_node", record.Target)
+		s.set("rebalance.bytes", record.Bytes)
+		t.relocations[key] = s
+		return nil
+	}
+
+	// Moves not issued, rejected or skipped, have no relocation span.
+	s, ok := t.relocations[key]
+	if !ok {
+		return nil
+	}
+	delete(t.relocations, key)
+	// The time of the record is when the wait for the move started.
+	s.end(time.Now())
+	s.set("rebalance.result", record.Result)
+	if record.Result == moveResultFailed {
+		s.fail(record.Error)
+	} else {
+		s.Status = &spanStatus{Code: spanStatusOK}
+	}
+	if t.cycle != nil && s.TraceID == t.cycle.TraceID {
+		t.spans = append(t.spans, s)
+		return nil
+	}
+	return []*span{s}
+}
+
+// exportSpans posts the spans to the collector. Failures are only logged,
+// the spans are dropped.
+func exportSpans(spans []*span) {
+	if len(spans) == 0 {
+		return
+	}
+	resource := []spanAttribute{
+		{Key: "service.name", Value: map[string]interface{}{"stringValue": tracerName}},
+		{Key: "service.instance.id", Value: map[string]interface{}{"stringValue": cfg.LeaderIdentity}},
+	}
+	payload := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{"attributes": resource},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": tracerName},
+				"spans": spans,
+			}},
+		}},
+	}
+	if err := postOTLP(payload); err != nil {
+		fmt.Println("Error exporting traces:", err)
+	}
+}
+
+func postOTLP(payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	u := strings.TrimRight(cfg.OTLPEndpoint, "/") + "/v1/traces"
+	req, err := http.NewRequest("POST", u, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range cfg.OTLPHeaders {
+		req.Header.Set(name, value)
+	}
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("POST %s: %s", req.URL.Redacted(), resp.Status)
+	}
+	return nil
+}
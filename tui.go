@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/term"
+)
+
+const (
+	tuiLogLines     = 8
+	tuiPlanLines    = 10
+	tuiProgressBars = 20
+)
+
+var tuiOptions struct {
+	refresh time.Duration
+}
+
+func tuiFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&tuiOptions.refresh, "refresh", 2*time.Second, "how often to refresh the dashboard")
+}
+
+// tui is the state of the dashboard. Only the loop of tuiCommand uses it,
+// but for the log, which collects what is printed meanwhile.
+type tui struct {
+	screen      io.Writer
+	obs         *Observation
+	imbalance   int
+	rows        []NodeStatus
+	relocations *RelocationProgress
+
+	// The plan waiting for approval, and the observation it was planned on.
+	plan      []MoveEstimate
+	planObs   *Observation
+	executing bool
+	quitting  bool
+
+	mu  sync.Mutex
+	log []string
+}
+
+// tuiCommand shows a dashboard of the cluster, refreshed every -refresh:
+// the shards, bytes and disk usage of every node, the relocations running
+// with their progress, and the last lines printed. Keys plan a cycle,
+// approve the plan, which executes it holding the cluster lock, and pause
+// or resume the moves, of the dashboard and, with -admin-listen, of the
+// balancer running there.
+//
+//	tui [-refresh 2s]
+func tuiCommand(args []string) error {
+	in, out := int(os.Stdin.Fd()), int(os.Stdout.Fd())
+	if !term.IsTerminal(in) || !term.IsTerminal(out) {
+		return errors.New("tui needs a terminal")
+	}
+	if tuiOptions.refresh <= 0 {
+		return errors.New("-refresh must be positive")
+	}
+	state, err := term.MakeRaw(in)
+	if err != nil {
+		return err
+	}
+	defer term.Restore(in, state)
+
+	// What is printed while the dashboard is shown goes to its log.
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	t := &tui{screen: os.Stdout}
+	os.Stdout = w
+	defer func() {
+		os.Stdout = t.screen.(*os.File)
+		w.Close()
+	}()
+	changed := make(chan struct{}, 1)
+	go t.collectLog(r, changed)
+
+	keys := make(chan byte)
+	go func() {
+		buf := make([]byte, 1)
+		for {
+			if _, err := os.Stdin.Read(buf); err != nil {
+				close(keys)
+				return
+			}
+			keys <- buf[0]
+		}
+	}()
+
+	// The alternate screen leaves the terminal as it was on exit.
+	fmt.Fprint(t.screen, "\033[?1049h\033[?25l")
+	defer fmt.Fprint(t.screen, "\033[?25h\033[?1049l")
+
+	ticker := time.NewTicker(tuiOptions.refresh)
+	defer ticker.Stop()
+	done := make(chan error, 1)
+	t.refresh()
+	for {
+		t.draw()
+		select {
+		case key, ok := <-keys:
+			if !ok {
+				return nil
+			}
+			switch key {
+			case 'q', 3: // Ctrl-C does not interrupt in raw mode.
+				if !t.executing {
+					return nil
+				}
+				t.quitting = true
+				ctl.setPaused(true)
+				fmt.Println("Pausing, quitting once the issued moves completed...")
+			case 'r':
+				t.refresh()
+			case 'p':
+				t.planCycle()
+			case 'a':
+				t.approve(done)
+			case ' ':
+				t.togglePause()
+			case 't':
+				t.trigger()
+			}
+		case err := <-done:
+			t.executing = false
+			if err != nil {
+				fmt.Println("Error:", err)
+			}
+			if t.quitting {
+				return nil
+			}
+			t.refresh()
+		case <-changed:
+		case <-ticker.C:
+			t.refresh()
+		}
+	}
+}
+
+func (t *tui) collectLog(r io.Reader, changed chan<- struct{}) {
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		t.mu.Lock()
+		t.log = append(t.log, s.Text())
+		if len(t.log) > tuiLogLines {
+			t.log = t.log[len(t.log)-tuiLogLines:]
+		}
+		t.mu.Unlock()
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// refresh observes the cluster and the progress of its relocations, whoever
+// started them.
+func (t *tui) refresh() {
+	obs, err := observeCluster()
+	if err != nil {
+		fmt.Println("Error observing cluster:", err)
+		return
+	}
+	t.obs, t.imbalance, t.rows = obs, planImbalance(obs), nodeStatuses(obs)
+
+	var moves []Move
+	for _, shards := range obs.State.RoutingNodes.Nodes {
+		for _, shard := range shards {
+			if shard.State == "RELOCATING" {
+				moves = append(moves, Move{Shard: shard, From: shard.Node, To: shard.RelocatingNode, Bytes: obs.CopyBytes(shard, shard.Node)})
+			}
+		}
+	}
+	sort.Slice(moves, func(i, j int) bool {
+		a, b := moves[i].Shard, moves[j].Shard
+		return a.Index < b.Index || a.Index == b.Index && a.Shard < b.Shard
+	})
+	t.relocations = nil
+	if len(moves) > 0 {
+		if t.relocations, err = relocationProgress(obs.State, moves); err != nil {
+			fmt.Println("Error getting recovery progress:", err)
+		}
+	}
+}
+
+func (t *tui) planCycle() {
+	if t.executing {
+		fmt.Println("Moves are running, plan again once they completed.")
+		return
+	}
+	t.refresh()
+	if t.obs == nil {
+		return
+	}
+	smoothed.observe(t.obs.Distribution)
+	t.plan, t.planObs = estimatePlan(t.obs, planMoves(t.obs)), t.obs
+	if len(t.plan) == 0 {
+		fmt.Println("Cluster is already balanced.")
+	}
+}
+
+// approve executes the plan in the background, like a cycle would, and
+// reports on done.
+func (t *tui) approve(done chan<- error) {
+	switch {
+	case t.executing:
+		fmt.Println("Moves are running already.")
+		return
+	case len(t.plan) == 0:
+		fmt.Println("No plan to approve, press p to plan.")
+		return
+	case ctl.isPaused():
+		fmt.Println("Paused, press space to resume first.")
+		return
+	}
+	moves := make([]Move, 0, len(t.plan))
+	var total int64
+	for _, e := range t.plan {
+		moves = append(moves, e.Move)
+		total += e.Bytes
+	}
+	obs := t.planObs
+	t.plan, t.planObs, t.executing = nil, nil, true
+	go func() {
+		done <- withClusterLock(func(context.Context) error {
+			audit("plan_approved", map[string]interface{}{"moves": len(moves), "bytes": total})
+			disableAllocation()
+			defer enableAllocation()
+			executed, failed := executePlan(obs, moves)
+			if failed {
+				fmt.Printf("Executed %d of %d moves, some failed, see the history.\n", len(executed), len(moves))
+			} else {
+				fmt.Printf("Executed %d of %d moves.\n", len(executed), len(moves))
+			}
+			return nil
+		})
+	}()
+}
+
+func (t *tui) togglePause() {
+	paused := !ctl.isPaused()
+	ctl.setPaused(paused)
+	path, what := "/resume", "Resumed"
+	if paused {
+		path, what = "/pause", "Paused"
+	}
+	if cfg.AdminListen == "" {
+		fmt.Println(what + ".")
+		return
+	}
+	if _, err := callAdmin(apiPrefix + path); err != nil {
+		fmt.Println(what+", but not the balancer at "+cfg.AdminListen+":", err)
+		return
+	}
+	fmt.Println(what + ", and the balancer at " + cfg.AdminListen + ".")
+}
+
+// trigger starts a cycle of the balancer at cfg.AdminListen.
+func (t *tui) trigger() {
+	if cfg.AdminListen == "" {
+		fmt.Println("Triggering a cycle needs the balancer's -admin-listen.")
+		return
+	}
+	if _, err := callAdmin(apiPrefix + "/rebalance"); err != nil {
+		fmt.Println("Error triggering a cycle:", err)
+		return
+	}
+	fmt.Println("Triggered a cycle of the balancer at " + cfg.AdminListen + ".")
+}
+
+func (t *tui) draw() {
+	var b bytes.Buffer
+	title := "Shard rebalancer"
+	if cfg.ClusterAlias != "" {
+		title += " - " + cfg.ClusterAlias
+	}
+	fmt.Fprintf(&b, "%s   imbalance %d (threshold %d, %s mode)", title, t.imbalance, cfg.RebalanceThreshold, cfg.BalanceMode)
+	switch {
+	case t.executing:
+		b.WriteString("   EXECUTING")
+	case ctl.isPaused():
+		b.WriteString("   PAUSED")
+	}
+	b.WriteString("\n\n")
+	writeNodeTable(&b, t.rows, true)
+
+	b.WriteString("\nRelocations\n")
+	if t.relocations == nil || len(t.relocations.Relocations) == 0 {
+		b.WriteString("  none\n")
+	} else {
+		for _, m := range t.relocations.Relocations {
+			fmt.Fprintf(&b, "  [%s][%d] %s -> %s  %s %5.1f%%  %s of %s", m.Index, m.Shard, nodeName(t.obs, m.From), nodeName(t.obs, m.To),
+				progressBar(m.Percent), m.Percent, formatBytes(m.BytesRecovered), formatBytes(m.Bytes))
+			if m.ETAMillis > 0 {
+				fmt.Fprintf(&b, ", ETA %s", time.Duration(m.ETAMillis*int64(time.Millisecond)).Round(time.Second))
+			}
+			b.WriteString("\n")
+		}
+	}
+
+	if len(t.plan) > 0 {
+		var total int64
+		for _, e := range t.plan {
+			total += e.Bytes
+		}
+		fmt.Fprintf(&b, "\nPlan: %d moves, %s to relocate, press a to approve\n", len(t.plan), formatBytes(total))
+		for i, e := range t.plan {
+			if i == tuiPlanLines {
+				fmt.Fprintf(&b, "  ... and %d more\n", len(t.plan)-i)
+				break
+			}
+			fmt.Fprintf(&b, "  [%s][%d] %s -> %s  %s\n", e.Move.Shard.Index, e.Move.Shard.Shard, nodeName(t.planObs, e.Move.From), nodeName(t.planObs, e.Move.To), formatBytes(e.Bytes))
+		}
+	}
+
+	b.WriteString("\nLog\n")
+	t.mu.Lock()
+	for _, line := range t.log {
+		b.WriteString("  " + line + "\n")
+	}
+	t.mu.Unlock()
+
+	b.WriteString("\np plan  a approve  space pause/resume  r refresh  q quit")
+	if cfg.AdminListen != "" {
+		b.WriteString("  t trigger a cycle")
+	}
+	// Raw mode needs carriage returns. Lines are cleared as they are
+	// written over, which does not flicker like clearing the screen.
+	screen := "\033[H" + strings.ReplaceAll(b.String(), "\n", "\033[K\r\n") + "\033[K\033[J"
+	io.WriteString(t.screen, screen)
+}
+
+func progressBar(percent float64) string {
+	done := int(percent / 100 * tuiProgressBars)
+	if done > tuiProgressBars {
+		done = tuiProgressBars
+	}
+	return "[" + strings.Repeat("#", done) + strings.Repeat("-", tuiProgressBars-done) + "]"
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/tjandrayana/elasticsearch-rebalance-shard/observer"
+)
+
+type UnassignedInfo struct {
+	Reason                   string `json:"reason"`
+	Details                  string `json:"details"`
+	FailedAllocationAttempts int    `json:"failed_allocation_attempts"`
+	LastAllocationStatus     string `json:"last_allocation_status"`
+}
+
+type DeciderResult struct {
+	Decider     string `json:"decider"`
+	Decision    string `json:"decision"`
+	Explanation string `json:"explanation"`
+}
+
+type NodeAllocationDecision struct {
+	NodeID       string          `json:"node_id"`
+	NodeName     string          `json:"node_name"`
+	NodeDecision string          `json:"node_decision"`
+	Deciders     []DeciderResult `json:"deciders"`
+}
+
+type AllocationExplanation struct {
+	Index                   string                   `json:"index"`
+	Shard                   int                      `json:"shard"`
+	Primary                 bool                     `json:"primary"`
+	CurrentState            string                   `json:"current_state"`
+	UnassignedInfo          UnassignedInfo           `json:"unassigned_info"`
+	CanAllocate             string                   `json:"can_allocate"`
+	AllocateExplanation     string                   `json:"allocate_explanation"`
+	NodeAllocationDecisions []NodeAllocationDecision `json:"node_allocation_decisions"`
+}
+
+func explainAllocation(shard ShardRouting) (*AllocationExplanation, error) {
+	body, err := sendJSON("POST", "/_cluster/allocation/explain", map[string]interface{}{
+		"index":   shard.Index,
+		"shard":   shard.Shard,
+		"primary": shard.Primary,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var explanation AllocationExplanation
+	if err := json.Unmarshal(body, &explanation); err != nil {
+		return nil, fmt.Errorf("parsing allocation explanation: %w", err)
+	}
+	return &explanation, nil
+}
+
+// remediateUnassigned looks for unassigned shards and asks Elasticsearch
+// why they are not allocated. Shards whose allocation failed too many times
+// are retried, and replicas that are only held back by the allocation enable
+// setting are allocated explicitly. Other causes are logged for the
+// operator. Nothing is changed unless cfg.RemediateUnassigned is set.
+func remediateUnassigned() {
+	state, err := getClusterState()
+	if err != nil {
+		fmt.Println("Error getting cluster state:", err)
+		return
+	}
+	if len(state.RoutingNodes.Unassigned) == 0 {
+		return
+	}
+	fmt.Printf("Found %d unassigned shards.\n", len(state.RoutingNodes.Unassigned))
+
+	retry := false
+	seen := make(map[string]bool)
+	for _, shard := range state.RoutingNodes.Unassigned {
+		// Replicas of the same shard share the same explanation.
+		key := fmt.Sprintf("%s/%v", observer.ShardKey(shard), shard.Primary)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		explanation, err := explainAllocation(shard)
+		if err != nil {
+			fmt.Printf("Error explaining allocation of [%s][%d]: %v\n", shard.Index, shard.Shard, err)
+			continue
+		}
+
+		switch {
+		case explanation.CanAllocate == "throttled", explanation.CanAllocate == "awaiting_info", explanation.CanAllocate == "allocation_delayed":
+			fmt.Printf("Shard [%s][%d] is waiting to be allocated (%s).\n", shard.Index, shard.Shard, explanation.CanAllocate)
+
+		case explanation.UnassignedInfo.Reason == "ALLOCATION_FAILED":
+			fmt.Printf("Shard [%s][%d] failed allocation %d times: %s\n", shard.Index, shard.Shard, explanation.UnassignedInfo.FailedAllocationAttempts, explanation.UnassignedInfo.Details)
+			retry = true
+
+		case !shard.Primary && replicaTarget(explanation) != "":
+			node := replicaTarget(explanation)
+			fmt.Printf("Replica [%s][%d] is held back by the allocation enable setting, can go to node %s.\n", shard.Index, shard.Shard, node)
+			if cfg.RemediateUnassigned {
+				allocateReplica(shard, node)
+			}
+
+		default:
+			fmt.Printf("Shard [%s][%d] cannot be allocated (%s): %s\n", shard.Index, shard.Shard, explanation.CanAllocate, explanation.AllocateExplanation)
+			for _, node := range explanation.NodeAllocationDecisions {
+				for _, decider := range node.Deciders {
+					if decider.Decision == "NO" {
+						fmt.Printf("  %s: %s: %s\n", node.NodeName, decider.Decider, decider.Explanation)
+					}
+				}
+			}
+		}
+	}
+
+	if retry && cfg.RemediateUnassigned {
+		fmt.Println("Retrying failed allocations...")
+		body, err := sendJSON("POST", "/_cluster/reroute?retry_failed=true&metric=none", map[string]interface{}{})
+		if err != nil {
+			fmt.Println("Error retrying failed allocations:", err)
+			return
+		}
+		fmt.Println("Response:", string(body))
+	}
+}
+
+// replicaTarget returns a node the replica could be allocated to with an
+// explicit command, i.e. one where the only rejecting decider is the
+// allocation enable setting (which explicit reroute commands bypass).
+func replicaTarget(explanation *AllocationExplanation) string {
+	for _, node := range explanation.NodeAllocationDecisions {
+		if node.NodeDecision == "yes" {
+			return node.NodeID
+		}
+		blocked := false
+		for _, decider := range node.Deciders {
+			if decider.Decision == "NO" && decider.Decider != "enable" {
+				blocked = true
+				break
+			}
+		}
+		if !blocked && len(node.Deciders) > 0 {
+			return node.NodeID
+		}
+	}
+	return ""
+}
+
+func allocateReplica(shard ShardRouting, nodeID string) {
+	fmt.Printf("Allocating replica [%s][%d] to node %s...\n", shard.Index, shard.Shard, nodeID)
+	body, err := sendJSON("POST", "/_cluster/reroute?metric=none", map[string]interface{}{
+		"commands": []interface{}{
+			map[string]interface{}{
+				"allocate_replica": map[string]interface{}{
+					"index": shard.Index,
+					"shard": shard.Shard,
+					"node":  nodeID,
+				},
+			},
+		},
+	})
+	if err != nil {
+		fmt.Println("Error allocating replica:", err)
+		return
+	}
+	fmt.Println("Response:", string(body))
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// verifyPollInterval is how often the waits for relocations poll the
+// cluster, shortened by the tests.
+var verifyPollInterval = 5 * time.Second
+
+// waitForMove polls the shard copies of the moved shard until the copy on
+// the target node is started or cfg.MoveTimeout elapses. A relocation
+// stalled for cfg.StallTimeout is cancelled.
+func waitForMove(move Move) (ShardStats, error) {
+	deadline := time.Now().Add(cfg.MoveTimeout.Duration)
+	var watch stallWatch
+	for {
+		if breaker.isOpen() {
+			return ShardStats{}, fmt.Errorf("move of [%s][%d] to %s: %w", move.Shard.Index, move.Shard.Shard, move.To, errBreakerOpen)
+		}
+		after, err := getShardCopyStats(move.Shard, move.To)
+		if err == nil && after.State == "STARTED" {
+			return after, nil
+		}
+		if watch.stalled(move) {
+			return ShardStats{}, cancelStalled(move, watch.since)
+		}
+		if time.Now().After(deadline) {
+			if err == nil {
+				err = fmt.Errorf("copy on target is %s", after.State)
+			}
+			return ShardStats{}, fmt.Errorf("move of [%s][%d] to %s did not complete within %s: %w", move.Shard.Index, move.Shard.Shard, move.To, cfg.MoveTimeout, err)
+		}
+		ctl.beat(cfg.MoveTimeout.Duration)
+		time.Sleep(verifyPollInterval)
+	}
+}
+
+// verifyMove waits for the move to complete and compares the relocated copy
+// with the stats captured before the move. Discrepancies are flagged in the
+// audit log; they do not stop the cycle. It returns an error if the move
+// did not complete.
+func verifyMove(move Move, before ShardStats) error {
+	after, err := waitForMove(move)
+	if err != nil {
+		fmt.Println("Error verifying move:", err)
+		audit("move_verification_failed", moveFields(move, map[string]interface{}{
+			"error": err.Error(),
+		}))
+		return err
+	}
+
+	var problems []string
+	if after.DocCount() != before.DocCount() {
+		problems = append(problems, fmt.Sprintf("doc count %d, expected %d", after.DocCount(), before.DocCount()))
+	}
+	if !withinTolerance(after.StoreBytes(), before.StoreBytes(), cfg.VerifyStoreTolerance) {
+		problems = append(problems, fmt.Sprintf("store size %d bytes, expected %d (±%.0f%%)", after.StoreBytes(), before.StoreBytes(), cfg.VerifyStoreTolerance*100))
+	}
+	if len(problems) == 0 {
+		fmt.Printf("Verified shard [%s][%d] on node %s.\n", move.Shard.Index, move.Shard.Shard, move.To)
+		return nil
+	}
+
+	fmt.Printf("Shard [%s][%d] on node %s differs from the source copy: %v\n", move.Shard.Index, move.Shard.Shard, move.To, problems)
+	audit("move_verification_mismatch", moveFields(move, map[string]interface{}{
+		"docs_before":  before.DocCount(),
+		"docs_after":   after.DocCount(),
+		"store_before": before.StoreBytes(),
+		"store_after":  after.StoreBytes(),
+		"problems":     problems,
+	}))
+	return nil
+}
+
+func withinTolerance(actual, expected int64, tolerance float64) bool {
+	diff := float64(actual - expected)
+	if diff < 0 {
+		diff = -diff
+	}
+	return diff <= float64(expected)*tolerance
+}
+
+func moveFields(move Move, extra map[string]interface{}) map[string]interface{} {
+	fields := map[string]interface{}{
+		"index":   move.Shard.Index,
+		"shard":   move.Shard.Shard,
+		"primary": move.Shard.Primary,
+		"from":    move.From,
+		"to":      move.To,
+	}
+	for k, v := range extra {
+		fields[k] = v
+	}
+	return fields
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/tjandrayana/elasticsearch-rebalance-shard/observer"
+)
+
+// NodeWeight gives the nodes matching one of the Nodes patterns (see
+// nodePatternError), or having the node attribute Attribute ("name:value"),
+// a weight relative to the default of 1. A node of weight 2 is balanced to
+// hold twice as many shards as a node of weight 1. The first matching entry
+// applies.
+type NodeWeight struct {
+	Nodes     []string `json:"nodes"`
+	Attribute string   `json:"attribute"`
+	Weight    float64  `json:"weight"`
+}
+
+func (w NodeWeight) validate() error {
+	if w.Weight <= 0 {
+		return fmt.Errorf("node weight must be positive")
+	}
+	if len(w.Nodes) == 0 && w.Attribute == "" {
+		return fmt.Errorf("node weight %g matches no node, it needs nodes or an attribute", w.Weight)
+	}
+	if w.Attribute != "" && !strings.Contains(w.Attribute, ":") {
+		return fmt.Errorf("invalid node weight attribute %q, want name:value", w.Attribute)
+	}
+	for _, pattern := range w.Nodes {
+		if err := nodePatternError(pattern); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w NodeWeight) matches(node NodeInfo) bool {
+	if matchNode(w.Nodes, node.Name) {
+		return true
+	}
+	if w.Attribute == "" {
+		return false
+	}
+	name, value, _ := strings.Cut(w.Attribute, ":")
+	v, ok := node.Attributes[name]
+	return ok && v == value
+}
+
+// nodeWeights holds the weight of every data node, by node ID, as of the
+// last observation. They are scaled so that their mean is 1, which keeps the
+// threshold in shards of an average node.
+var (
+	nodeWeightsMu sync.Mutex
+	nodeWeights   map[string]float64
+)
+
+// weighNodes records the weight of the data nodes of the observation.
+func weighNodes(obs *Observation) {
+	weights := make(map[string]float64, len(obs.Distribution))
+	if len(cfg.NodeWeights) > 0 && len(obs.Distribution) > 0 {
+		var sum float64
+		for id := range obs.Distribution {
+			weights[id] = 1
+			for _, w := range cfg.NodeWeights {
+				if w.matches(obs.Nodes.Nodes[id]) {
+					weights[id] = w.Weight
+					break
+				}
+			}
+			sum += weights[id]
+		}
+		mean := sum / float64(len(weights))
+		for id := range weights {
+			weights[id] /= mean
+		}
+	}
+	nodeWeightsMu.Lock()
+	nodeWeights = weights
+	nodeWeightsMu.Unlock()
+}
+
+// nodeWeight returns the weight of the node, 1 when none is configured.
+func nodeWeight(nodeID string) float64 {
+	nodeWeightsMu.Lock()
+	defer nodeWeightsMu.Unlock()
+	if w, ok := nodeWeights[nodeID]; ok {
+		return w
+	}
+	return 1
+}
+
+// countScore scores the shard counts per weight of the nodes.
+func countScore(shardDistribution map[string]int) observer.Score {
+	return observer.WeightedScoreOf(shardDistribution, nodeWeight)
+}